@@ -0,0 +1,51 @@
+//go:build !unit && !observer
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"outline-cli-ws/pkg/outlinews"
+	"syscall"
+)
+
+// daemonLogs implements "outline-cli-ws daemon-logs": it prints the recent
+// log lines kept by the daemon whose admin server the config names (or
+// -addr), and with -follow keeps printing new ones until interrupted.
+func daemonLogs(args []string) int {
+	fs := flag.NewFlagSet("daemon-logs", flag.ExitOnError)
+	cfgPath := fs.String("c", "config.yaml", "config path")
+	addr := fs.String("addr", "", "admin address of the daemon (default: listen.admin from config)")
+	tail := fs.Int("n", 100, "print the last N lines (0 = all kept lines)")
+	follow := fs.Bool("follow", false, "keep streaming new lines")
+	_ = fs.Parse(args)
+
+	cfg, err := outlinews.LoadConfig(*cfgPath)
+	if err != nil {
+		log.Printf("config: %v", err)
+		return 1
+	}
+	target := *addr
+	if target == "" {
+		target = cfg.Listen.Admin
+	}
+	if target == "" {
+		log.Printf("daemon-logs: no listen.admin in config; pass -addr")
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err = outlinews.FetchLogs(ctx, target, cfg.Metrics.Token, *tail, *follow, func(rec outlinews.LogRecord) {
+		fmt.Println(rec.Line)
+	})
+	if err != nil {
+		log.Printf("daemon-logs: %v", err)
+		return 1
+	}
+	return 0
+}
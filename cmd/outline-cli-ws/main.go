@@ -1,45 +1,68 @@
-//go:build !unit
+//go:build !unit && !observer
 
 package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"log"
 	"net"
 	"os"
 	"os/signal"
 	"outline-cli-ws/pkg/outlinews"
+	"strings"
 	"syscall"
 	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "reset-stats" {
+		os.Exit(resetStats(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "daemon-logs" {
+		os.Exit(daemonLogs(os.Args[2:]))
+	}
+
 	var cfgPath string
 	var metricsAddr string
 	var noProbes bool
+	var insecurePlainCipher bool
 	flag.StringVar(&cfgPath, "c", "config.yaml", "config path")
 	flag.StringVar(&metricsAddr, "metrics", "", "prometheus metrics listen address, e.g. :9100")
 	flag.BoolVar(&noProbes, "no-probes", false, "disable background health checks/probes/warm-standby for clean per-request logs")
+	flag.BoolVar(&insecurePlainCipher, "insecure-plain-cipher", false, "allow cipher: none/plain (no encryption; WS-layer debugging only)")
 	flag.Parse()
 
+	if insecurePlainCipher {
+		log.Printf("WARNING: -insecure-plain-cipher set; upstreams with cipher none/plain send traffic unencrypted")
+	}
+	outlinews.SetAllowPlainCipher(insecurePlainCipher)
+
 	cfg, err := outlinews.LoadConfig(cfgPath)
 	if err != nil {
 		log.Fatalf("config: %v", err)
 	}
 
+	if err := outlinews.SetLogFormat(cfg.Log.Format); err != nil {
+		log.Fatalf("config: %v", err)
+	}
 	outlinews.SetWebSocketDebug(cfg.WebSocket.Debug)
+	outlinews.SetRelayBufferSize(cfg.CopyBufferSize)
+	outlinews.SetPooledFrameReads(cfg.WebSocket.PooledReads)
+	if err := outlinews.LoadTLSMaterial(cfg.TLS); err != nil {
+		log.Fatalf("config: %v", err)
+	}
 	if cfg.WebSocket.Debug {
 		log.Printf("WebSocket debug logging is enabled")
 	}
 
-	lb := outlinews.NewLoadBalancer(cfg.Upstreams, cfg.Healthcheck, cfg.Selection, cfg.Probe, cfg.Fwmark)
-
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	if metricsAddr != "" {
 		outlinews.EnablePrometheusMetrics()
+		outlinews.SetMetricsToken(cfg.Metrics.Token)
 		go func() {
 			if err := outlinews.StartMetricsServer(ctx, metricsAddr); err != nil {
 				log.Printf("metrics server stopped: %v", err)
@@ -48,6 +71,42 @@ func main() {
 		log.Printf("Prometheus metrics listening on %s", metricsAddr)
 	}
 
+	adminAddr := cfg.Listen.Admin
+	if adminAddr != "" && metricsAddr == "" {
+		outlinews.EnablePrometheusMetrics()
+		outlinews.SetMetricsToken(cfg.Metrics.Token)
+	}
+
+	if cfg.Metrics.OTLPEndpoint != "" {
+		outlinews.EnablePrometheusMetrics()
+		go outlinews.RunOTLPExporter(ctx, cfg.Metrics.OTLPEndpoint, cfg.Metrics.OTLPInterval)
+		log.Printf("pushing OTLP metrics to %s", cfg.Metrics.OTLPEndpoint)
+	}
+
+	// Created after metrics are enabled so config-time gauges (drain) are exported.
+	lb := outlinews.NewLoadBalancer(cfg.Upstreams, cfg.Healthcheck, cfg.Selection, cfg.Probe, cfg.Fwmark)
+	lb.SetMaxConnections(cfg.Listen.MaxConnections)
+	lb.SetUDPDisabled(cfg.Listen.DisableUDP)
+	go reloadOnHUP(ctx, cfgPath, lb)
+
+	if adminAddr != "" {
+		go func() {
+			if err := outlinews.StartAdminServer(ctx, adminAddr, lb); err != nil {
+				log.Printf("admin server stopped: %v", err)
+			}
+		}()
+		log.Printf("admin server listening on %s (/metrics, /status, /healthz, /readyz, /debug/pprof)", adminAddr)
+	}
+
+	if eventsAddr := cfg.Listen.Events; eventsAddr != "" {
+		go func() {
+			if err := outlinews.ServeEvents(ctx, eventsAddr); err != nil {
+				log.Printf("event stream stopped: %v", err)
+			}
+		}()
+		log.Printf("event stream listening on %s", eventsAddr)
+	}
+
 	disableProbes := cfg.DisableProbes || noProbes
 	if disableProbes {
 		lb.DisableBackgroundProbes()
@@ -56,16 +115,17 @@ func main() {
 		// Health-check loop
 		go lb.RunHealthChecks(ctx)
 		go lb.RunWarmStandby(ctx)
+		go lb.RunDNSRefresh(ctx)
 	}
 
 	socksAddr := cfg.Listen.SOCKS5
 	socksEnabled := socksAddr != ""
-	tunEnabled := cfg.Tun.Device != ""
+	tunEnabled := cfg.Tun.Device != "" || cfg.Tun.FD > 0
 
 	if !socksEnabled && !tunEnabled {
-		log.Fatal("nothing to run: neither listen.socks5 nor tun.device is configured")
+		log.Fatal("nothing to run: neither listen.socks5 nor tun.device/tun.fd is configured")
 	}
-	if tunEnabled && !socksEnabled && cfg.Tun.NetNS == "" {
+	if tunEnabled && !socksEnabled && cfg.Tun.Device != "" && cfg.Tun.NetNS == "" {
 		if _, err := net.InterfaceByName(cfg.Tun.Device); err != nil {
 			log.Fatalf("tun-only mode requires existing interface %q: %v", cfg.Tun.Device, err)
 		}
@@ -74,37 +134,69 @@ func main() {
 	var ln net.Listener
 	var srv *outlinews.Socks5Server
 	if socksEnabled {
-		ln, err = net.Listen("tcp", socksAddr)
+		ln, err = outlinews.ListenSocks5(socksAddr, cfg.Listen.TLSCert, cfg.Listen.TLSKey)
 		if err != nil {
 			log.Fatalf("listen socks5 %s: %v", socksAddr, err)
 		}
-		log.Printf("SOCKS5 listening on %s", socksAddr)
-		srv = &outlinews.Socks5Server{LB: lb}
+		if cfg.Listen.TLSCert != "" {
+			log.Printf("SOCKS5 listening on %s (TLS)", socksAddr)
+		} else {
+			log.Printf("SOCKS5 listening on %s", socksAddr)
+		}
+		srv = &outlinews.Socks5Server{LB: lb, Routing: cfg.Routing, UDPIdleTimeout: cfg.Listen.UDPIdleTimeout, UpstreamSelect: cfg.Listen.DebugUpstreamSelect}
 	} else {
 		log.Printf("SOCKS5 disabled: listen.socks5 is empty")
 	}
 
+	// Closed once RunTunNative has drained its flows and released the
+	// interface; main waits for it so shutdown does not cut the grace short.
+	tunDone := make(chan struct{})
+	// Closed once the TUN device carries traffic (at once without TUN).
+	tunUp := make(chan struct{})
 	if tunEnabled {
-		log.Printf("TUN mode enabled (native), expecting existing interface %q", cfg.Tun.Device)
-
+		cfg.Tun.Ready = func() { close(tunUp) }
 		go func() {
+			defer close(tunDone)
 			if err := outlinews.RunTunNative(ctx, cfg.Tun, lb); err != nil {
 				log.Printf("tun native stopped: %v", err)
 				cancel()
 			}
 		}()
+	} else {
+		close(tunDone)
+		close(tunUp)
 	}
 
+	hookEnv := lifecycleHookEnv(cfg)
+	defer func() {
+		// ctx is already cancelled here; give on_disconnect its own deadline.
+		_ = outlinews.RunLifecycleHook(context.Background(), cfg.Hooks, "disconnect", hookEnv)
+	}()
+	defer func() { <-tunDone }()
+
 	// Graceful shutdown
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-sigc
 		log.Printf("shutting down...")
-		cancel()
+		// Stop accepting SOCKS5 clients before anything is torn down.
 		if ln != nil {
 			_ = ln.Close()
 		}
+		cancel()
+	}()
+
+	// on_connect runs once startup has finished: the SOCKS5 listener is
+	// bound, the TUN device is up and shutdown signals are handled, so the
+	// hook can route traffic into the tunnel and a slow hook can still be
+	// interrupted. It runs beside the accept loop rather than delaying it.
+	go func() {
+		select {
+		case <-tunUp:
+			_ = outlinews.RunLifecycleHook(ctx, cfg.Hooks, "connect", hookEnv)
+		case <-ctx.Done():
+		}
 	}()
 
 	if !socksEnabled {
@@ -115,6 +207,11 @@ func main() {
 	for {
 		c, err := ln.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				// Closed by the shutdown handler, which cancels ctx next.
+				<-ctx.Done()
+				return
+			}
 			select {
 			case <-ctx.Done():
 				return
@@ -129,3 +226,17 @@ func main() {
 		}()
 	}
 }
+
+// lifecycleHookEnv describes the running daemon to on_connect/on_disconnect hooks.
+func lifecycleHookEnv(cfg *outlinews.Config) map[string]string {
+	names := make([]string, 0, len(cfg.Upstreams))
+	for _, u := range cfg.Upstreams {
+		names = append(names, u.Name)
+	}
+	return map[string]string{
+		"OUTLINEWS_SOCKS5":     cfg.Listen.SOCKS5,
+		"OUTLINEWS_TUN_DEVICE": cfg.Tun.Device,
+		"OUTLINEWS_TUN_NETNS":  cfg.Tun.NetNS,
+		"OUTLINEWS_UPSTREAMS":  strings.Join(names, ","),
+	}
+}
@@ -0,0 +1,101 @@
+//go:build observer && !unit
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"outline-cli-ws/pkg/outlinews"
+	"syscall"
+)
+
+// The observer build probes upstreams and exports their health over the
+// admin/metrics endpoints without serving SOCKS5 or TUN traffic, e.g. as a
+// monitoring sidecar. Build with -tags observer.
+func main() {
+	var cfgPath string
+	var metricsAddr string
+	var insecurePlainCipher bool
+	flag.StringVar(&cfgPath, "c", "config.yaml", "config path")
+	flag.StringVar(&metricsAddr, "metrics", "", "prometheus metrics listen address, e.g. :9100")
+	flag.BoolVar(&insecurePlainCipher, "insecure-plain-cipher", false, "allow cipher: none/plain (no encryption; WS-layer debugging only)")
+	flag.Parse()
+
+	outlinews.SetAllowPlainCipher(insecurePlainCipher)
+
+	cfg, err := outlinews.LoadConfig(cfgPath)
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+
+	if err := outlinews.SetLogFormat(cfg.Log.Format); err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	outlinews.SetWebSocketDebug(cfg.WebSocket.Debug)
+	if err := outlinews.LoadTLSMaterial(cfg.TLS); err != nil {
+		log.Fatalf("config: %v", err)
+	}
+
+	adminAddr := cfg.Listen.Admin
+	if adminAddr == "" && metricsAddr == "" {
+		log.Fatal("nothing to report: the observer build needs listen.admin or -metrics")
+	}
+	if cfg.Listen.SOCKS5 != "" || cfg.Tun.Device != "" || cfg.Tun.FD > 0 {
+		log.Printf("observer build: ignoring listen.socks5 and tun settings, no traffic is served")
+	}
+	if cfg.DisableProbes {
+		log.Printf("observer build: ignoring disable_probes, health checks are all it does")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	outlinews.EnablePrometheusMetrics()
+	outlinews.SetMetricsToken(cfg.Metrics.Token)
+	if metricsAddr != "" {
+		go func() {
+			if err := outlinews.StartMetricsServer(ctx, metricsAddr); err != nil {
+				log.Printf("metrics server stopped: %v", err)
+			}
+		}()
+		log.Printf("Prometheus metrics listening on %s", metricsAddr)
+	}
+	if cfg.Metrics.OTLPEndpoint != "" {
+		go outlinews.RunOTLPExporter(ctx, cfg.Metrics.OTLPEndpoint, cfg.Metrics.OTLPInterval)
+		log.Printf("pushing OTLP metrics to %s", cfg.Metrics.OTLPEndpoint)
+	}
+
+	lb := outlinews.NewLoadBalancer(cfg.Upstreams, cfg.Healthcheck, cfg.Selection, cfg.Probe, cfg.Fwmark)
+	lb.SetUDPDisabled(cfg.Listen.DisableUDP)
+	go reloadOnHUP(ctx, cfgPath, lb)
+
+	if adminAddr != "" {
+		go func() {
+			if err := outlinews.StartAdminServer(ctx, adminAddr, lb); err != nil {
+				log.Printf("admin server stopped: %v", err)
+			}
+		}()
+		log.Printf("admin server listening on %s (/metrics, /status, /healthz, /readyz, /debug/pprof)", adminAddr)
+	}
+
+	if eventsAddr := cfg.Listen.Events; eventsAddr != "" {
+		go func() {
+			if err := outlinews.ServeEvents(ctx, eventsAddr); err != nil {
+				log.Printf("event stream stopped: %v", err)
+			}
+		}()
+		log.Printf("event stream listening on %s", eventsAddr)
+	}
+
+	go lb.RunHealthChecks(ctx)
+	go lb.RunDNSRefresh(ctx)
+	log.Printf("observer: health-checking %d upstream(s)", len(cfg.Upstreams))
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	<-sigc
+	log.Printf("shutting down...")
+}
@@ -0,0 +1,42 @@
+//go:build !unit
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"outline-cli-ws/pkg/outlinews"
+	"syscall"
+)
+
+// reloadOnHUP re-reads the config file on every SIGHUP until ctx is done and
+// applies the parts that can change at run time: the tls.* files, so a
+// rotated CA bundle or client certificate applies to the next dials, and the
+// upstream list (see LoadBalancer.Reload). Other sections keep their startup
+// values. A config that fails to load, or whose TLS files fail to load,
+// changes nothing.
+func reloadOnHUP(ctx context.Context, cfgPath string, lb *outlinews.LoadBalancer) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			cfg, err := outlinews.LoadConfig(cfgPath)
+			if err != nil {
+				log.Printf("SIGHUP: reload failed, keeping current config: %v", err)
+				continue
+			}
+			if err := outlinews.LoadTLSMaterial(cfg.TLS); err != nil {
+				log.Printf("SIGHUP: TLS reload failed, keeping current config: %v", err)
+				continue
+			}
+			lb.Reload(cfg.Upstreams)
+			log.Printf("SIGHUP: TLS material and %d upstreams reloaded from %s", len(cfg.Upstreams), cfgPath)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+//go:build !unit && !observer
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"outline-cli-ws/pkg/outlinews"
+	"time"
+)
+
+// resetStats implements "outline-cli-ws reset-stats": it zeroes the metric
+// counters of the daemon whose admin server the config names (or -addr).
+func resetStats(args []string) int {
+	fs := flag.NewFlagSet("reset-stats", flag.ExitOnError)
+	cfgPath := fs.String("c", "config.yaml", "config path")
+	addr := fs.String("addr", "", "admin or -metrics address of the daemon (default: listen.admin from config)")
+	_ = fs.Parse(args)
+
+	cfg, err := outlinews.LoadConfig(*cfgPath)
+	if err != nil {
+		log.Printf("config: %v", err)
+		return 1
+	}
+	target := *addr
+	if target == "" {
+		target = cfg.Listen.Admin
+	}
+	if target == "" {
+		log.Printf("reset-stats: no listen.admin in config; pass -addr")
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := outlinews.ResetStats(ctx, target, cfg.Metrics.Token); err != nil {
+		log.Printf("reset-stats: %v", err)
+		return 1
+	}
+	log.Printf("metric counters reset on %s", target)
+	return 0
+}
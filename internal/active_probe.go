@@ -6,29 +6,42 @@ import (
 	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"strings"
 	"time"
 
-	"github.com/shadowsocks/go-shadowsocks2/core"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
 )
 
 // ProbeTCPQuality ---- TCP Quality Probe: HTTP HEAD ----
 func ProbeTCPQuality(ctx context.Context, up UpstreamConfig, target string, fwmark uint32) (time.Duration, error) {
 	start := time.Now()
-
-	ciph, err := core.PickCipher(up.Cipher, nil, up.Secret)
+	if _, err := pickCipher(up.Cipher, up.Secret); err != nil {
+		return 0, err
+	}
+	wsc, err := DialWSStream(withUpstreamAuth(ctx, up), up.TCPWSS, fwmark)
 	if err != nil {
 		return 0, err
 	}
+	if _, err := probeTCPQualityOn(ctx, up, wsc, target); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
 
-	wsc, err := DialWSStream(ctx, up.TCPWSS, fwmark)
+// probeTCPQualityOn runs the TCP quality probe over wsc, an already dialed
+// tcp_wss connection that it closes, and returns the probe's own round trip.
+func probeTCPQualityOn(ctx context.Context, up UpstreamConfig, wsc WSConn, target string) (time.Duration, error) {
+	start := time.Now()
+	wsc = dedicatedMuxChannel(up, wsc, wsMuxStream)
+	defer wsc.Close(WSStatusNormalClosure, "tcp-probe")
+
+	ciph, err := pickCipher(up.Cipher, up.Secret)
 	if err != nil {
 		return 0, err
 	}
-	defer wsc.Close(WSStatusNormalClosure, "tcp-probe")
 
 	wsconn := NewWSStreamConn(ctx, wsc, up.Name, "tcp")
 	ssconn := ciph.StreamConn(wsconn)
@@ -65,20 +78,36 @@ func ProbeTCPQuality(ctx context.Context, up UpstreamConfig, target string, fwma
 }
 
 // ProbeUDPQuality ---- UDP Quality Probe: DNS query ----
+//
+// With strict set, only a NOERROR reply carrying an answer of the queried type
+// counts as success; otherwise any reply to our query does.
 func ProbeUDPQuality(ctx context.Context, up UpstreamConfig, dnsServer string,
-	name string, dnstype string, fwmark uint32) (time.Duration, error) {
+	name string, dnstype string, strict bool, fwmark uint32) (time.Duration, error) {
 	start := time.Now()
-
-	ciph, err := core.PickCipher(up.Cipher, nil, up.Secret)
+	if _, err := pickCipher(up.Cipher, up.Secret); err != nil {
+		return 0, err
+	}
+	wsc, err := DialWSStream(withUpstreamAuth(ctx, up), up.UDPWSS, fwmark)
 	if err != nil {
 		return 0, err
 	}
+	if _, err := probeUDPQualityOn(ctx, up, wsc, dnsServer, name, dnstype, strict); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// probeUDPQualityOn is probeTCPQualityOn for the UDP (DNS) quality probe.
+func probeUDPQualityOn(ctx context.Context, up UpstreamConfig, wsc WSConn, dnsServer string,
+	name string, dnstype string, strict bool) (time.Duration, error) {
+	start := time.Now()
+	wsc = dedicatedMuxChannel(up, wsc, wsMuxDatagram)
+	defer wsc.Close(WSStatusNormalClosure, "udp-probe")
 
-	wsc, err := DialWSStream(ctx, up.UDPWSS, fwmark)
+	ciph, err := pickCipher(up.Cipher, up.Secret)
 	if err != nil {
 		return 0, err
 	}
-	defer wsc.Close(WSStatusNormalClosure, "udp-probe")
 
 	// Underlying WS packet transport
 	wsPC := NewWSPacketConn(ctx, wsc, up.Name, "udp")
@@ -86,8 +115,8 @@ func ProbeUDPQuality(ctx context.Context, up UpstreamConfig, dnsServer string,
 	defer encPC.Close()
 
 	// Build DNS query (A)
-	txid := uint16(time.Now().UnixNano()) // not crypto, fine for probe
-	var qtype uint16 = 1                  // A
+	txid := dnsTxID()
+	var qtype uint16 = 1 // A
 	if strings.ToUpper(dnstype) == "AAAA" {
 		qtype = 28
 	}
@@ -118,17 +147,100 @@ func ProbeUDPQuality(ctx context.Context, up UpstreamConfig, dnsServer string,
 		if err != nil || off >= len(p) {
 			continue
 		}
-		dns := p[off:]
-		if len(dns) < 12 {
+		ours, err := dnsProbeReply(p[off:], txid, qtype, strict)
+		if !ours {
+			// иначе это не наш ответ — продолжим (маловероятно)
 			continue
 		}
-		rxid := binary.BigEndian.Uint16(dns[0:2])
-		flags := binary.BigEndian.Uint16(dns[2:4])
-		qr := (flags >> 15) & 1
-		if rxid == txid && qr == 1 {
-			return time.Since(start), nil
+		if err != nil {
+			return 0, fmt.Errorf("udp probe: %s %s: %w", name, dnstype, err)
+		}
+		return time.Since(start), nil
+	}
+}
+
+// dnsProbeReply reports whether dns is the response to query txid and, if so,
+// whether it counts as a healthy answer.
+func dnsProbeReply(dns []byte, txid, qtype uint16, strict bool) (ours bool, err error) {
+	if len(dns) < 12 {
+		return false, nil
+	}
+	rxid := binary.BigEndian.Uint16(dns[0:2])
+	flags := binary.BigEndian.Uint16(dns[2:4])
+	if rxid != txid || flags>>15 != 1 {
+		return false, nil
+	}
+	if !strict {
+		return true, nil
+	}
+	return true, checkDNSAnswer(dns, qtype)
+}
+
+// checkDNSAnswer verifies that a DNS response carries NOERROR and at least
+// one answer record of qtype. A resolver that replies but returns NXDOMAIN,
+// SERVFAIL or an empty answer is not a working path.
+func checkDNSAnswer(msg []byte, qtype uint16) error {
+	if len(msg) < 12 {
+		return errors.New("dns response too short")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	if rcode := flags & 0x000f; rcode != 0 {
+		return fmt.Errorf("dns rcode %d", rcode)
+	}
+	qd := int(binary.BigEndian.Uint16(msg[4:6]))
+	an := int(binary.BigEndian.Uint16(msg[6:8]))
+	if an == 0 {
+		return errors.New("dns response has no answers")
+	}
+
+	off := 12
+	for i := 0; i < qd; i++ {
+		next, err := skipDNSName(msg, off)
+		if err != nil {
+			return err
+		}
+		off = next + 4 // QTYPE, QCLASS
+	}
+	for i := 0; i < an; i++ {
+		next, err := skipDNSName(msg, off)
+		if err != nil {
+			return err
+		}
+		if next+10 > len(msg) {
+			return errors.New("dns answer truncated")
+		}
+		typ := binary.BigEndian.Uint16(msg[next : next+2])
+		rdlen := int(binary.BigEndian.Uint16(msg[next+8 : next+10]))
+		off = next + 10 + rdlen
+		if off > len(msg) {
+			return errors.New("dns answer truncated")
+		}
+		if typ == qtype {
+			return nil
+		}
+	}
+	return fmt.Errorf("dns response has no type %d record", qtype)
+}
+
+// skipDNSName returns the offset just past the (possibly compressed) name
+// starting at off.
+func skipDNSName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errors.New("dns name truncated")
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0:
+			if off+2 > len(msg) {
+				return 0, errors.New("dns name truncated")
+			}
+			return off + 2, nil
+		default:
+			off += 1 + l
 		}
-		// иначе это не наш ответ — продолжим (маловероятно)
 	}
 }
 
@@ -0,0 +1,80 @@
+//go:build !unit
+
+package internal
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// dnsResponse builds a reply to buildDNSQuery's question with the given
+// rcode and answers of type qtype (each answer uses a compressed name).
+func dnsResponse(txid uint16, name string, qtype uint16, rcode uint16, answers int) []byte {
+	msg := buildDNSQuery(txid, name, qtype)
+	binary.BigEndian.PutUint16(msg[2:4], 0x8180|rcode) // QR, RD, RA
+	binary.BigEndian.PutUint16(msg[6:8], uint16(answers))
+	for i := 0; i < answers; i++ {
+		msg = append(msg, 0xc0, 0x0c) // pointer to the question name
+		msg = binary.BigEndian.AppendUint16(msg, qtype)
+		msg = binary.BigEndian.AppendUint16(msg, 1)  // IN
+		msg = binary.BigEndian.AppendUint32(msg, 60) // TTL
+		msg = binary.BigEndian.AppendUint16(msg, 4)  // RDLENGTH
+		msg = append(msg, 93, 184, 216, byte(34+i))  // RDATA
+	}
+	return msg
+}
+
+func TestCheckDNSAnswer(t *testing.T) {
+	const typeA, typeAAAA = 1, 28
+	tests := []struct {
+		name    string
+		msg     []byte
+		qtype   uint16
+		wantErr bool
+	}{
+		{"valid answer", dnsResponse(7, "example.com", typeA, 0, 1), typeA, false},
+		{"nxdomain", dnsResponse(7, "nope.example.com", typeA, 3, 0), typeA, true},
+		{"servfail", dnsResponse(7, "example.com", typeA, 2, 0), typeA, true},
+		{"noerror but empty", dnsResponse(7, "example.com", typeA, 0, 0), typeA, true},
+		{"wrong record type", dnsResponse(7, "example.com", typeA, 0, 1), typeAAAA, true},
+		{"truncated answer", dnsResponse(7, "example.com", typeA, 0, 1)[:40], typeA, true},
+		{"short header", []byte{0, 7, 0x81}, typeA, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkDNSAnswer(tt.msg, tt.qtype)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkDNSAnswer err=%v, wantErr=%v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDNSProbeReply_Strictness(t *testing.T) {
+	const typeA = 1
+	tests := []struct {
+		name       string
+		msg        []byte
+		strict     bool
+		wantOurs   bool
+		wantHealth bool
+	}{
+		{"noerror with answers", dnsResponse(9, "example.com", typeA, 0, 2), true, true, true},
+		{"nxdomain strict", dnsResponse(9, "example.com", typeA, 3, 0), true, true, false},
+		{"servfail strict", dnsResponse(9, "example.com", typeA, 2, 0), true, true, false},
+		{"nxdomain lenient", dnsResponse(9, "example.com", typeA, 3, 0), false, true, true},
+		{"other txid", dnsResponse(10, "example.com", typeA, 0, 1), true, false, false},
+		{"query not response", buildDNSQuery(9, "example.com", typeA), true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ours, err := dnsProbeReply(tt.msg, 9, typeA, tt.strict)
+			if ours != tt.wantOurs {
+				t.Fatalf("ours=%v, want %v", ours, tt.wantOurs)
+			}
+			if ours && (err == nil) != tt.wantHealth {
+				t.Fatalf("err=%v, want healthy=%v", err, tt.wantHealth)
+			}
+		})
+	}
+}
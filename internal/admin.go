@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StartAdminServer serves the admin endpoints on addr until ctx is cancelled:
+//
+//	/metrics       Prometheus metrics
+//	/reset         POST: zero the cumulative metric counters
+//	/status        JSON snapshot of every upstream
+//	/logs          recent log lines as JSON lines (?follow=1 streams)
+//	/upstreams/{name}/check  POST: health-check now ("all" = every upstream)
+//	/healthz       liveness: 200 whenever the process is serving
+//	/readyz        readiness: 200 once at least one TCP upstream is healthy
+//	/debug/pprof/  Go profiling
+//
+// With a nil lb only /metrics and /reset are served. The metrics bearer token (see
+// SetMetricsToken) guards every route except /healthz and /readyz.
+func StartAdminServer(ctx context.Context, addr string, lb *LoadBalancer) error {
+	if strings.TrimSpace(addr) == "" {
+		return errors.New("empty admin address")
+	}
+	srv := &http.Server{Addr: addr, Handler: newAdminMux(lb)}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	err := srv.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("admin server: %w", err)
+	}
+	return nil
+}
+
+func newAdminMux(lb *LoadBalancer) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.Handle("/reset", requireMetricsToken(http.HandlerFunc(resetHandler)))
+	if lb == nil {
+		return mux
+	}
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		readyzHandler(w, lb)
+	})
+	mux.Handle("/status", requireMetricsToken(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			Upstreams []UpstreamStatus `json:"upstreams"`
+		}{lb.Snapshot()})
+	})))
+	mux.Handle("/logs", requireMetricsToken(http.HandlerFunc(logsHandler)))
+	mux.Handle("/upstreams/{name}/check", requireMetricsToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checkNowHandler(w, r, lb)
+	})))
+	mux.Handle("/debug/pprof/", requireMetricsToken(http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", requireMetricsToken(http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", requireMetricsToken(http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", requireMetricsToken(http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", requireMetricsToken(http.HandlerFunc(pprof.Trace)))
+	return mux
+}
+
+func readyzHandler(w http.ResponseWriter, lb *LoadBalancer) {
+	if n := lb.HealthyCount(); n > 0 {
+		_, _ = fmt.Fprintf(w, "ok: %d healthy upstream(s)\n", n)
+		return
+	}
+	http.Error(w, "no healthy upstreams", http.StatusServiceUnavailable)
+}
+
+func resetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ResetMetrics()
+	log.Printf("admin: metric counters reset by %s", r.RemoteAddr)
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func checkNowHandler(w http.ResponseWriter, r *http.Request, lb *LoadBalancer) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if lb.probesOff.Load() {
+		http.Error(w, "background probes are disabled", http.StatusConflict)
+		return
+	}
+	name := r.PathValue("name")
+	if !lb.CheckNow(name) {
+		http.Error(w, fmt.Sprintf("no upstream %q", name), http.StatusNotFound)
+		return
+	}
+	log.Printf("admin: health check of %s requested by %s", name, r.RemoteAddr)
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// ResetStats asks the admin server at addr (host:port or http(s) URL) to
+// zero its metric counters, authenticating with token when non-empty.
+func ResetStats(ctx context.Context, addr, token string) error {
+	base := addr
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(base, "/")+"/reset", nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("reset: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// FetchLogs reads the recent log lines of the daemon whose admin server is
+// at addr and calls fn for each, oldest first: the last tail lines (all kept
+// ones when tail <= 0), then, with follow, every new line until ctx is done.
+func FetchLogs(ctx context.Context, addr, token string, tail int, follow bool, fn func(LogRecord)) error {
+	base := addr
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	q := url.Values{}
+	if tail > 0 {
+		q.Set("n", strconv.Itoa(tail))
+	}
+	if follow {
+		q.Set("follow", "1")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(base, "/")+"/logs?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("logs: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var rec LogRecord
+		if err := dec.Decode(&rec); err != nil {
+			if errors.Is(err, io.EOF) || ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("logs: %w", err)
+		}
+		fn(rec)
+	}
+}
+
+// requireMetricsToken rejects requests lacking the configured bearer token.
+func requireMetricsToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !metricsAuthorized(r) {
+			writeUnauthorized(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
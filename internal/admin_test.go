@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminGet(t *testing.T, h http.Handler, path, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAdminMux_Routes(t *testing.T) {
+	metricsMu.Lock()
+	metrics = telemetry{}
+	metricsMu.Unlock()
+	EnablePrometheusMetrics()
+
+	lb := NewLoadBalancer([]UpstreamConfig{
+		{Name: "a", Weight: 1, TCPWSS: "wss://a/tcp"},
+		{Name: "b", Backup: true, TCPWSS: "wss://b/tcp"},
+	}, HealthcheckConfig{}, SelectionConfig{}, ProbeConfig{}, 0)
+	mux := newAdminMux(lb)
+
+	if rr := adminGet(t, mux, "/healthz", ""); rr.Code != http.StatusOK {
+		t.Fatalf("/healthz is liveness and must be 200: status=%d", rr.Code)
+	}
+	if rr := adminGet(t, mux, "/readyz", ""); rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz with no healthy upstream: status=%d want 503", rr.Code)
+	}
+	markHealthy(lb.pool[0], true, 30*time.Millisecond)
+	if rr := adminGet(t, mux, "/readyz", ""); rr.Code != http.StatusOK {
+		t.Fatalf("/readyz with a healthy upstream: status=%d want 200", rr.Code)
+	}
+
+	rr := adminGet(t, mux, "/status", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("/status: status=%d", rr.Code)
+	}
+	var status struct {
+		Upstreams []UpstreamStatus `json:"upstreams"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+		t.Fatalf("/status json: %v\n%s", err, rr.Body.String())
+	}
+	if len(status.Upstreams) != 2 || status.Upstreams[0].Name != "a" || !status.Upstreams[0].TCP.Healthy || status.Upstreams[0].TCP.RTTMillis != 30 {
+		t.Fatalf("unexpected status: %+v", status.Upstreams)
+	}
+	if !status.Upstreams[1].Backup || status.Upstreams[1].TCP.Healthy {
+		t.Fatalf("unexpected backup status: %+v", status.Upstreams[1])
+	}
+
+	if rr := adminGet(t, mux, "/metrics", ""); rr.Code != http.StatusOK {
+		t.Fatalf("/metrics: status=%d", rr.Code)
+	}
+	if rr := adminGet(t, mux, "/debug/pprof/", ""); rr.Code != http.StatusOK {
+		t.Fatalf("/debug/pprof/: status=%d", rr.Code)
+	}
+
+	// With a token, everything but /healthz requires it.
+	SetMetricsToken("tok")
+	defer SetMetricsToken("")
+	for _, path := range []string{"/metrics", "/status", "/debug/pprof/"} {
+		if rr := adminGet(t, mux, path, ""); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("%s without token: status=%d want 401", path, rr.Code)
+		}
+		if rr := adminGet(t, mux, path, "tok"); rr.Code != http.StatusOK {
+			t.Fatalf("%s with token: status=%d want 200", path, rr.Code)
+		}
+	}
+	for _, path := range []string{"/healthz", "/readyz"} {
+		if rr := adminGet(t, mux, path, ""); rr.Code != http.StatusOK {
+			t.Fatalf("%s must stay unauthenticated: status=%d", path, rr.Code)
+		}
+	}
+}
+
+func TestReadyz_FlipsWithUpstreamHealth(t *testing.T) {
+	lb := NewLoadBalancer([]UpstreamConfig{{Name: "a", TCPWSS: "wss://a/tcp"}, {Name: "b", TCPWSS: "wss://b/tcp"}}, HealthcheckConfig{}, SelectionConfig{}, ProbeConfig{}, 0)
+	mux := newAdminMux(lb)
+
+	// UDP health alone does not make the proxy ready.
+	markHealthy(lb.pool[0], false, 10*time.Millisecond)
+	if n := lb.HealthyCount(); n != 0 {
+		t.Fatalf("HealthyCount=%d with only UDP healthy, want 0", n)
+	}
+	if rr := adminGet(t, mux, "/readyz", ""); rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz: status=%d want 503", rr.Code)
+	}
+
+	markHealthy(lb.pool[0], true, 10*time.Millisecond)
+	markHealthy(lb.pool[1], true, 10*time.Millisecond)
+	if n := lb.HealthyCount(); n != 2 {
+		t.Fatalf("HealthyCount=%d want 2", n)
+	}
+	if rr := adminGet(t, mux, "/readyz", ""); rr.Code != http.StatusOK {
+		t.Fatalf("/readyz: status=%d want 200", rr.Code)
+	}
+
+	for _, up := range lb.pool {
+		lb.ReportTCPFailure(up, errors.New("down"))
+	}
+	if rr := adminGet(t, mux, "/readyz", ""); rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz after failures: status=%d want 503", rr.Code)
+	}
+	if rr := adminGet(t, mux, "/healthz", ""); rr.Code != http.StatusOK {
+		t.Fatalf("/healthz must not depend on upstreams: status=%d", rr.Code)
+	}
+}
+
+func TestAdminMux_MetricsOnlyWithoutLB(t *testing.T) {
+	mux := newAdminMux(nil)
+	for _, path := range []string{"/status", "/healthz", "/readyz"} {
+		if rr := adminGet(t, mux, path, ""); rr.Code != http.StatusNotFound {
+			t.Fatalf("%s on metrics-only server: status=%d want 404", path, rr.Code)
+		}
+	}
+}
+
+func TestAdminReset_ZeroesCountersBehindToken(t *testing.T) {
+	metricsMu.Lock()
+	metrics = telemetry{}
+	metricsMu.Unlock()
+	EnablePrometheusMetrics()
+	SetMetricsToken("s3cret")
+	defer SetMetricsToken("")
+
+	observeSelection("a", "tcp")
+	observeUpstreamTraffic("a", "tcp", "up", 1500)
+	observeTunDrop("max_connections")
+	observeConnectionRejected()
+	setConnectionsActive(3)
+
+	srv := httptest.NewServer(newAdminMux(nil))
+	defer srv.Close()
+
+	if rr := adminGet(t, srv.Config.Handler, "/reset", "s3cret"); rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET /reset: status=%d want 405", rr.Code)
+	}
+	if err := ResetStats(context.Background(), srv.URL, ""); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("reset without token: err=%v want 401", err)
+	}
+	if body := adminGet(t, srv.Config.Handler, "/metrics", "s3cret").Body.String(); !strings.Contains(body, "outlinews_connections_rejected_total 1") {
+		t.Fatalf("counters reset without auth:\n%s", body)
+	}
+
+	if err := ResetStats(context.Background(), strings.TrimPrefix(srv.URL, "http://"), "s3cret"); err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	body := adminGet(t, srv.Config.Handler, "/metrics", "s3cret").Body.String()
+	for _, gone := range []string{"outlinews_upstream_selected_total{", "outlinews_upstream_bytes_total{", "outlinews_tun_drops_total{"} {
+		if strings.Contains(body, gone) {
+			t.Fatalf("%s survived reset:\n%s", gone, body)
+		}
+	}
+	if !strings.Contains(body, "outlinews_connections_rejected_total 0") {
+		t.Fatalf("rejected counter not zeroed:\n%s", body)
+	}
+	if !strings.Contains(body, "outlinews_connections_active 3") {
+		t.Fatalf("gauge must survive reset:\n%s", body)
+	}
+}
+
+func TestAdminCheckNow_SchedulesNamedUpstream(t *testing.T) {
+	SetMetricsToken("")
+	lb := NewLoadBalancer([]UpstreamConfig{{Name: "a", Weight: 1, TCPWSS: "wss://a/tcp"}}, HealthcheckConfig{}, SelectionConfig{}, ProbeConfig{}, 0)
+	later := time.Now().Add(time.Hour)
+	lb.pool[0].tcp.nextHC = later
+	mux := newAdminMux(lb)
+
+	post := func(path string) int {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, path, nil))
+		return rr.Code
+	}
+	if rr := adminGet(t, mux, "/upstreams/a/check", ""); rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET check: status=%d, want 405", rr.Code)
+	}
+	if code := post("/upstreams/nope/check"); code != http.StatusNotFound {
+		t.Fatalf("unknown upstream: status=%d, want 404", code)
+	}
+	if code := post("/upstreams/a/check"); code != http.StatusOK {
+		t.Fatalf("check a: status=%d, want 200", code)
+	}
+	if !lb.pool[0].tcp.nextHC.Before(later) {
+		t.Fatal("check of a not moved forward")
+	}
+
+	lb.DisableBackgroundProbes()
+	if code := post("/upstreams/all/check"); code != http.StatusConflict {
+		t.Fatalf("check with probes disabled: status=%d, want 409", code)
+	}
+}
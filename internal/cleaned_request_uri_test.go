@@ -17,3 +17,24 @@ func TestCleanedRequestURI_StripsHealthcheckControlParams(t *testing.T) {
 		t.Fatalf("cleanedRequestURI=%q", got)
 	}
 }
+
+func TestCleanedRequestURI_StripsDialTimeoutHint(t *testing.T) {
+	u, _ := url.Parse("wss://h/tcp?dial_timeout=3s&x=1")
+	if got := cleanedRequestURI(u); got != "/tcp?x=1" {
+		t.Fatalf("dial_timeout hint leaked into :path: %q", got)
+	}
+}
+
+func TestCleanedRequestURI_StripsProxyProtocolHints(t *testing.T) {
+	u, _ := url.Parse("wss://h/tcp?proxy_protocol=v2&proxy_source=192.0.2.1%3A80&x=1")
+	if got := cleanedRequestURI(u); got != "/tcp?x=1" {
+		t.Fatalf("proxy protocol hints leaked into :path: %q", got)
+	}
+}
+
+func TestCleanedRequestURI_StripsAddressFamilyHint(t *testing.T) {
+	u, _ := url.Parse("wss://h/tcp?address_family=ipv4&x=1")
+	if got := cleanedRequestURI(u); got != "/tcp?x=1" {
+		t.Fatalf("address_family hint leaked into :path: %q", got)
+	}
+}
@@ -3,8 +3,13 @@
 package internal
 
 import (
+	"fmt"
+	"log"
 	"net"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -14,19 +19,94 @@ import (
 type Config struct {
 	Listen struct {
 		SOCKS5 string `yaml:"socks5"`
+		Events string `yaml:"events"` // optional JSON event stream: "unix:/path.sock" (mode 0600)
+		Admin  string `yaml:"admin"`  // optional admin HTTP server: /metrics, /status, /healthz, /readyz, /debug/pprof
+		// MaxConnections caps concurrent SOCKS5 sessions plus TUN flows; 0 = unlimited.
+		MaxConnections int `yaml:"max_connections"`
+		// DisableUDP refuses UDP ASSOCIATE and TUN UDP flows and skips UDP
+		// health checks and standbys.
+		DisableUDP bool `yaml:"disable_udp"`
+		// UDPIdleTimeout closes a SOCKS5 UDP association (and its control
+		// connection) after this long without datagrams; 0 = never.
+		UDPIdleTimeout time.Duration `yaml:"udp_idle_timeout"`
+		// TLSCert/TLSKey (PEM) put the SOCKS5 listener behind TLS; empty = plaintext.
+		TLSCert string `yaml:"tls_cert"`
+		TLSKey  string `yaml:"tls_key"`
+		// DebugUpstreamSelect lets a CONNECT to "<host>.<upstream>.select.outline"
+		// pin that connection to the named upstream. Testing aid; off by default.
+		DebugUpstreamSelect bool `yaml:"debug_upstream_select"`
 	} `yaml:"listen"`
 	Tun           TunConfig         `yaml:"tun"`
 	WebSocket     WebSocketConfig   `yaml:"websocket"`
 	Healthcheck   HealthcheckConfig `yaml:"healthcheck"`
 	Selection     SelectionConfig   `yaml:"selection"`
 	Upstreams     []UpstreamConfig  `yaml:"upstreams"`
+	UpstreamsDir  string            `yaml:"upstreams_dir"` // optional directory of *.yaml upstream files merged into upstreams
 	Probe         ProbeConfig       `yaml:"probe"`
 	DisableProbes bool              `yaml:"disable_probes"`
 	Fwmark        uint32            `yaml:"fwmark"` // 0 = disabled
+	Hooks         HooksConfig       `yaml:"hooks"`
+	Metrics       MetricsConfig     `yaml:"metrics"`
+	Routing       RoutingConfig     `yaml:"routing"`
+	TLS           TLSConfig         `yaml:"tls"`
+	Log           LogConfig         `yaml:"log"`
+
+	// CopyBufferSize is the per-direction buffer of SOCKS5 and TUN relays,
+	// in bytes; 0 = 32 KiB.
+	CopyBufferSize int `yaml:"copy_buffer_size"`
+}
+
+// RoutingConfig holds destination rules for the SOCKS5 frontend (and for
+// TUN TCP flows by TLS server name, with tun.sniff_sni).
+type RoutingConfig struct {
+	// Direct lists destinations dialed without the tunnel: IPs, CIDRs,
+	// exact domains or "*.suffix" domains.
+	Direct []string `yaml:"direct"`
+}
+
+// TLSConfig overrides the trust material of upstream TLS handshakes. The
+// files are read at startup and again on SIGHUP.
+type TLSConfig struct {
+	CAFile   string `yaml:"ca_file"`   // PEM bundle trusted instead of the system roots
+	CertFile string `yaml:"cert_file"` // client certificate (PEM), with key_file
+	KeyFile  string `yaml:"key_file"`
+}
+
+// QUICConfig mirrors the tunable fields of x/net/quic's Config. Zero keeps the
+// library default; a negative idle timeout never closes idle connections.
+type QUICConfig struct {
+	MaxIdleTimeout    time.Duration `yaml:"max_idle_timeout"`    // default 30s (the smaller of both ends' values applies)
+	KeepAlivePeriod   time.Duration `yaml:"keepalive_period"`    // default off; capped at half the idle timeout
+	MaxBidiStreams    int64         `yaml:"max_bidi_streams"`    // streams the server may open; default 100
+	MaxUniStreams     int64         `yaml:"max_uni_streams"`     // default 100
+	StreamReadBuffer  int64         `yaml:"stream_read_buffer"`  // bytes per stream; default 1 MiB
+	StreamWriteBuffer int64         `yaml:"stream_write_buffer"` // bytes per stream; default 1 MiB
+	ConnReadBuffer    int64         `yaml:"conn_read_buffer"`    // bytes across streams; default 1 MiB
+}
+
+// LogConfig selects the log output format.
+type LogConfig struct {
+	Format string `yaml:"format"` // "text" (default) or "json": one JSON object per line
+}
+
+// MetricsConfig configures the Prometheus endpoint (address via -metrics).
+type MetricsConfig struct {
+	Token string `yaml:"token"` // optional bearer token required to scrape /metrics
+
+	OTLPEndpoint string        `yaml:"otlp_endpoint"` // optional OTLP/HTTP collector to push metrics to
+	OTLPInterval time.Duration `yaml:"otlp_interval"` // push period, default 15s
+}
+
+// HooksConfig holds optional lifecycle commands (run via /bin/sh -c).
+type HooksConfig struct {
+	OnConnect    string        `yaml:"on_connect"`    // after SOCKS5/TUN data plane is started
+	OnDisconnect string        `yaml:"on_disconnect"` // on shutdown, before exit
+	Timeout      time.Duration `yaml:"timeout"`       // per-hook limit, default 10s
 }
 
 type TunConfig struct {
 	Device string `yaml:"device"`
+	FD     int    `yaml:"fd"` // already-open TUN fd inherited from a privileged helper (instead of device)
 	MTU    int    `yaml:"mtu"`
 	NetNS  string `yaml:"netns"` // optional path to target network namespace (Linux), e.g. /var/run/netns/vpn
 	Debug  bool   `yaml:"debug"` // extra TUN diagnostics (flow-level logs, useful for netns/routing troubleshooting)
@@ -36,10 +116,36 @@ type TunConfig struct {
 	UDPGCInterval      time.Duration `yaml:"udp_gc_interval"`       // e.g. 10s
 	UDPFlowIdleTimeout time.Duration `yaml:"udp_flow_idle_timeout"` // idle dst-subscription внутри port-session
 	UDPMaxDstPerPort   int           `yaml:"udp_max_dst_per_port"`
+	UDPSessionMode     string        `yaml:"udp_session_mode"` // "port" (default) or "flow": one upstream session per 5-tuple
+
+	// MSSClamp caps the MSS option of TCP SYNs crossing the TUN in both
+	// directions: 0 = auto (MTU minus headers and tunnel framing), <0 = off.
+	MSSClamp int `yaml:"mss_clamp"`
+
+	// ShutdownGrace is how long live TCP flows may finish after shutdown
+	// starts before they are closed: 0 = 5s, <0 = close at once.
+	ShutdownGrace time.Duration `yaml:"shutdown_grace"`
+
+	// SniffSNI reads the TLS ClientHello of each TCP flow and routes by its
+	// server name: names matching Direct skip the tunnel, and
+	// consistent_hash hashes the name instead of the IP.
+	SniffSNI bool `yaml:"sniff_sni"`
+	// Direct is routing.direct, copied in by LoadConfig.
+	Direct []string `yaml:"-"`
+
+	// FailOpen sends flows direct (with fwmark, unencrypted) while no
+	// upstream is healthy, instead of dropping them. Off by default: a
+	// dead tunnel should not quietly expose traffic.
+	FailOpen bool `yaml:"fail_open"`
+
+	// Ready, when set, is called once RunTunNative has the interface open
+	// and packets flowing through the netstack.
+	Ready func() `yaml:"-"`
 }
 
 type WebSocketConfig struct {
-	Debug bool `yaml:"debug"` // verbose WebSocket transport diagnostics (h1/h2/h3/quic handshake path)
+	Debug       bool `yaml:"debug"`        // verbose WebSocket transport diagnostics (h1/h2/h3/quic handshake path)
+	PooledReads bool `yaml:"pooled_reads"` // h2/h3 tunnels read data frames into pooled buffers
 }
 
 type HealthcheckConfig struct {
@@ -53,6 +159,7 @@ type HealthcheckConfig struct {
 	Jitter        time.Duration `yaml:"jitter"`         // +- случайный сдвиг
 	BackoffFactor float64       `yaml:"backoff_factor"` // рост интервала на фейлах (например 1.6)
 	RTTScale      float64       `yaml:"rtt_scale"`      // добавка от RTT (например 0.25)
+	OutagePoll    time.Duration `yaml:"outage_poll"`    // пауза проверок/дозвонов, когда все апстримы DOWN
 }
 
 type SelectionConfig struct {
@@ -65,17 +172,123 @@ type SelectionConfig struct {
 	StandbyKeepalive             bool          `yaml:"standby_keepalive"`               // ping/pong keepalive for idle standby ws
 	StandbyKeepaliveInterval     time.Duration `yaml:"standby_keepalive_interval"`      // cadence of keepalive checks
 	StandbyKeepaliveProbeTimeout time.Duration `yaml:"standby_keepalive_probe_timeout"` // timeout per keepalive probe
+	StandbyMaxIdle               time.Duration `yaml:"standby_max_idle"`                // recycle idle standby ws older than this (0 = off)
+	RaceN                        int           `yaml:"race_n"`                          // SOCKS5 CONNECT dials the top N upstreams at once, first reply wins (0/1 = off)
+	Strategy                     string        `yaml:"strategy"`                        // "fastest" (default, RTT score), "least_conn" (fewest live tunnels per weight) or "consistent_hash" (by destination host)
+	CooldownMaxFactor            int           `yaml:"cooldown_max_factor"`             // cooldown × consecutive failures, capped at this factor (0/1 = flat cooldown)
+	DNSRefreshInterval           time.Duration `yaml:"dns_refresh_interval"`            // re-resolve upstream hosts this often; new dials use the fresh answer (0 = off)
+	MaxEligibleRTT               time.Duration `yaml:"max_eligible_rtt"`                // skip upstreams whose RTT EWMA is above this while a faster one is usable (0 = no cap)
+	SlowStart                    time.Duration `yaml:"slow_start"`                      // a recovered upstream's share of new connections ramps from 10% to all over this window (0 = off)
+	DialAttempts                 int           `yaml:"dial_attempts"`                   // tunnel/standby dials tried this many times, with jittered backoff (0/1 = once)
+	UDPSticky                    bool          `yaml:"udp_sticky"`                      // UDP keeps its upstream for sticky_ttl like TCP (QUIC/WebRTC); default: always the best
 }
 
 type UpstreamConfig struct {
 	Name   string  `yaml:"name"`
-	Weight float64 `yaml:"weight"`
+	Weight float64 `yaml:"weight"` // default 1 (also when 0 in code); "weight: 0" in YAML means backup
+	Backup bool    `yaml:"backup"` // used only when no primary upstream is healthy
+	Drain  bool    `yaml:"drain"`  // no new tunnels; live ones keep running (decommissioning)
+	// AuthToken (or the contents of AuthTokenFile, re-read on every dial so
+	// it can be rotated) is sent in each WebSocket handshake for servers that
+	// gate the endpoint: as header AuthHeader, or, if that is empty, as query
+	// parameter AuthQuery. It never appears in logs.
+	AuthHeader    string `yaml:"auth_header"`
+	AuthQuery     string `yaml:"auth_query"`
+	AuthToken     string `yaml:"auth_token"`
+	AuthTokenFile string `yaml:"auth_token_file"`
+
+	// MaintenanceWindows drain the upstream while a window is open, e.g.
+	// "Sun 02:00-04:00 UTC" or "01:00-01:30" (daily, local time); see
+	// maintenance.go. MaintenanceSkipProbes also pauses its health checks.
+	MaintenanceWindows    []string `yaml:"maintenance_windows"`
+	MaintenanceSkipProbes bool     `yaml:"maintenance_skip_probes"`
+
+	// ProbeOnly health-checks the upstream and exports its metrics, but it is
+	// never picked for tunnels or warm standbys (monitoring, pre-provisioning).
+	ProbeOnly bool `yaml:"probe_only"`
 
 	TCPWSS string `yaml:"tcp_wss"`
 	UDPWSS string `yaml:"udp_wss"`
 
 	Cipher string `yaml:"cipher"`
 	Secret string `yaml:"secret"`
+
+	// Subprotocol is sent as Sec-WebSocket-Protocol on every handshake
+	// (h1/h2/h3); the dial fails unless the server echoes it back.
+	Subprotocol string `yaml:"subprotocol"`
+
+	// TransportOrder is the preferred handshake ladder, e.g. [h2, h1, h3].
+	// Mode hints in the URL query (h2=, h3=, connect=) take precedence.
+	TransportOrder []string `yaml:"transport_order"`
+
+	// H2WindowSize is the receive window (stream and connection) advertised
+	// on raw RFC 8441 connections; 0 = 1 MiB.
+	H2WindowSize uint32 `yaml:"h2_window_size"`
+
+	// Multiplex carries TCP and UDP over one WebSocket to tcp_wss, tagging
+	// each message with its channel (see ws_mux.go); udp_wss must be empty
+	// or the same URL. Requires a server speaking that framing.
+	Multiplex bool `yaml:"multiplex"`
+
+	// DialTimeout bounds the TCP connect and TLS/QUIC handshake of every
+	// tunnel dial to this upstream; 0 = 10s. Health checks are additionally
+	// capped by healthcheck.timeout.
+	DialTimeout time.Duration `yaml:"dial_timeout"`
+
+	// MaxMessageSize is the largest WebSocket message accepted from the
+	// server, in bytes; larger ones close the tunnel with 1009. 0 = 1 MiB.
+	MaxMessageSize int64 `yaml:"max_message_size"`
+
+	// AddressFamily restricts tunnel dials to "ipv4" or "ipv6" addresses of
+	// the upstream host, for networks where the other family is broken;
+	// "" or "auto" uses both.
+	AddressFamily string `yaml:"address_family"`
+
+	// AcceptStatus lists the HTTP/2 Extended CONNECT response codes taken as
+	// a successful WebSocket handshake; empty = 200 only. Some fronting
+	// proxies answer 2xx codes other than 200.
+	AcceptStatus []int `yaml:"accept_status"`
+
+	// RequireAccept fails an HTTP/2 or HTTP/3 handshake whose response has
+	// no Sec-WebSocket-Accept. RFC 8441 dropped the key exchange, so by
+	// default a missing header is accepted (a wrong one never is).
+	RequireAccept bool `yaml:"require_accept"`
+
+	// QUIC tunes the QUIC connection of h3 dials (tunnels and h3 health
+	// checks); zero fields keep the library defaults.
+	QUIC QUICConfig `yaml:"quic"`
+
+	// SendProxyProtocol ("v1" or "v2") writes a HAProxy PROXY header on each
+	// h1/h2 tunnel connection before TLS, declaring the SOCKS5/TUN client as
+	// the source, or ProxyProtocolSource ("ip:port") when set. Warm standbys
+	// are not kept without a fixed source: they have no client to declare.
+	// An upstream that may dial h3 is rejected: QUIC has no place for it.
+	SendProxyProtocol   string `yaml:"send_proxy_protocol"`
+	ProxyProtocolSource string `yaml:"proxy_protocol_source"`
+
+	// Optional per-upstream quality probe targets; empty = probe.tcp_target/udp_target.
+	ProbeTCPTarget string `yaml:"probe_tcp_target"`
+	ProbeUDPTarget string `yaml:"probe_udp_target"`
+
+	// Optional application-level heartbeat: a text message sent on every
+	// tunnel's WebSocket so CDN/middlebox idle timers don't close it.
+	HeartbeatText     string        `yaml:"heartbeat_text"`
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"` // default 30s when heartbeat_text is set
+}
+
+// UnmarshalYAML defaults an omitted weight to 1 and reads an explicit
+// "weight: 0" as backup: true.
+func (u *UpstreamConfig) UnmarshalYAML(n *yaml.Node) error {
+	type plain UpstreamConfig
+	p := plain{Weight: 1}
+	if err := n.Decode(&p); err != nil {
+		return err
+	}
+	if p.Weight == 0 {
+		p.Weight, p.Backup = 1, true
+	}
+	*u = UpstreamConfig(p)
+	return nil
 }
 
 type ProbeConfig struct {
@@ -88,6 +301,17 @@ type ProbeConfig struct {
 	UDPTarget string `yaml:"udp_target"` // e.g. "1.1.1.1:53"
 	DNSName   string `yaml:"dns_name"`   // e.g. "example.com"
 	DNSType   string `yaml:"dns_type"`   // "A" или "AAAA"
+
+	DNSNames        []string `yaml:"dns_names"`         // rotated per probe; overrides dns_name when set
+	DNSRandomPrefix bool     `yaml:"dns_random_prefix"` // query <random>.<name> to defeat resolver caches (needs a wildcard zone)
+	// By default a probe needs RCODE=NOERROR with an answer of dns_type;
+	// dns_accept_any_reply restores the old "any reply to our txid" check.
+	DNSAcceptAnyReply bool `yaml:"dns_accept_any_reply"`
+
+	// QualityFailure is what a failed quality probe does when the WebSocket
+	// handshake worked: "ignore" (default, log only), "degrade" (stay UP
+	// with a score penalty) or "fail" (the health check fails).
+	QualityFailure string `yaml:"quality_failure"`
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -95,10 +319,57 @@ func LoadConfig(path string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	var c Config
-	if err := yaml.Unmarshal(b, &c); err != nil {
+	var node yaml.Node
+	if err := yaml.Unmarshal(b, &node); err != nil {
+		return nil, err
+	}
+	if err := expandConfigEnv(&node); err != nil {
 		return nil, err
 	}
+	var c Config
+	if len(node.Content) > 0 {
+		if err := node.Decode(&c); err != nil {
+			return nil, err
+		}
+	}
+	if c.UpstreamsDir != "" {
+		dir := c.UpstreamsDir
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(filepath.Dir(path), dir)
+		}
+		extra, err := loadUpstreamsDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		c.Upstreams = append(c.Upstreams, extra...)
+	}
+	if n := c.CopyBufferSize; n != 0 && (n < 4096 || n > 16<<20) {
+		return nil, fmt.Errorf("copy_buffer_size must be within 4096..%d, got %d", 16<<20, n)
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return nil, fmt.Errorf("tls.cert_file and tls.key_file must be set together")
+	}
+	if (c.Listen.TLSCert == "") != (c.Listen.TLSKey == "") {
+		return nil, fmt.Errorf("listen.tls_cert and listen.tls_key must be set together")
+	}
+	if c.Listen.Events != "" && !strings.HasPrefix(c.Listen.Events, "unix:") {
+		return nil, fmt.Errorf("listen.events must be a unix:/path socket (the stream is unauthenticated), got %q", c.Listen.Events)
+	}
+	if c.Listen.UDPIdleTimeout < 0 {
+		return nil, fmt.Errorf("listen.udp_idle_timeout must be >= 0, got %s", c.Listen.UDPIdleTimeout)
+	}
+	if c.Listen.MaxConnections < 0 {
+		return nil, fmt.Errorf("listen.max_connections must be >= 0, got %d", c.Listen.MaxConnections)
+	}
+	if c.Tun.Device != "" && c.Tun.FD != 0 {
+		return nil, fmt.Errorf("tun: set either device or fd, not both")
+	}
+	if c.Tun.FD < 0 {
+		return nil, fmt.Errorf("tun.fd must be > 0, got %d", c.Tun.FD)
+	}
+	if c.Tun.FD != 0 && c.Tun.NetNS != "" {
+		return nil, fmt.Errorf("tun.netns has no effect with tun.fd (the fd is already bound to its namespace)")
+	}
 	if c.Tun.MTU == 0 {
 		c.Tun.MTU = 1500
 	}
@@ -117,6 +388,26 @@ func LoadConfig(path string) (*Config, error) {
 	if c.Tun.UDPMaxDstPerPort == 0 {
 		c.Tun.UDPMaxDstPerPort = 512
 	}
+	if c.Tun.MSSClamp > 0 && (c.Tun.MSSClamp < 536 || c.Tun.MSSClamp > 65495) {
+		return nil, fmt.Errorf("tun.mss_clamp must be within 536..65495 (0 = auto, -1 = off), got %d", c.Tun.MSSClamp)
+	}
+	switch c.Tun.UDPSessionMode {
+	case "":
+		c.Tun.UDPSessionMode = udpSessionModePort
+	case udpSessionModePort, udpSessionModeFlow:
+	default:
+		return nil, fmt.Errorf("tun.udp_session_mode must be %q or %q, got %q", udpSessionModePort, udpSessionModeFlow, c.Tun.UDPSessionMode)
+	}
+	switch c.Log.Format {
+	case "":
+		c.Log.Format = logFormatText
+	case logFormatText, logFormatJSON:
+	default:
+		return nil, fmt.Errorf("log.format must be %q or %q, got %q", logFormatText, logFormatJSON, c.Log.Format)
+	}
+	if c.Hooks.Timeout == 0 {
+		c.Hooks.Timeout = defaultHookTimeout
+	}
 	if c.Healthcheck.Interval == 0 {
 		c.Healthcheck.Interval = 5 * time.Second
 	}
@@ -165,6 +456,40 @@ func LoadConfig(path string) (*Config, error) {
 	if c.Selection.StandbyKeepaliveProbeTimeout == 0 {
 		c.Selection.StandbyKeepaliveProbeTimeout = 1200 * time.Millisecond
 	}
+	switch c.Selection.Strategy {
+	case "", selectionFastest, selectionLeastConn, selectionConsistentHash:
+	default:
+		return nil, fmt.Errorf("selection.strategy must be %q, %q or %q, got %q", selectionFastest, selectionLeastConn, selectionConsistentHash, c.Selection.Strategy)
+	}
+	if c.Selection.MaxEligibleRTT < 0 {
+		return nil, fmt.Errorf("selection.max_eligible_rtt must be >= 0, got %s", c.Selection.MaxEligibleRTT)
+	}
+	if c.Selection.DialAttempts < 0 || c.Selection.DialAttempts > 10 {
+		return nil, fmt.Errorf("selection.dial_attempts must be within 0..10, got %d", c.Selection.DialAttempts)
+	}
+	if c.Metrics.OTLPEndpoint != "" {
+		if _, err := otlpMetricsURL(c.Metrics.OTLPEndpoint); err != nil {
+			return nil, fmt.Errorf("metrics.otlp_endpoint: %w", err)
+		}
+	}
+	if c.Metrics.OTLPInterval < 0 {
+		return nil, fmt.Errorf("metrics.otlp_interval must be >= 0, got %s", c.Metrics.OTLPInterval)
+	}
+	if c.Healthcheck.OutagePoll < 0 {
+		return nil, fmt.Errorf("healthcheck.outage_poll must be >= 0, got %s", c.Healthcheck.OutagePoll)
+	}
+	if c.Selection.SlowStart < 0 {
+		return nil, fmt.Errorf("selection.slow_start must be >= 0, got %s", c.Selection.SlowStart)
+	}
+	if c.Selection.DNSRefreshInterval < 0 {
+		return nil, fmt.Errorf("selection.dns_refresh_interval must be >= 0, got %s", c.Selection.DNSRefreshInterval)
+	}
+	if c.Selection.CooldownMaxFactor < 0 {
+		return nil, fmt.Errorf("selection.cooldown_max_factor must be >= 0, got %d", c.Selection.CooldownMaxFactor)
+	}
+	if c.Selection.RaceN < 0 {
+		return nil, fmt.Errorf("selection.race_n must be >= 0, got %d", c.Selection.RaceN)
+	}
 	if c.Probe.Timeout == 0 {
 		c.Probe.Timeout = 2 * time.Second
 	}
@@ -183,6 +508,31 @@ func LoadConfig(path string) (*Config, error) {
 	if c.Probe.DNSType == "" {
 		c.Probe.DNSType = "A"
 	}
+	switch c.Probe.QualityFailure {
+	case "", qualityFailureIgnore, qualityFailureDegrade, qualityFailureFail:
+	default:
+		return nil, fmt.Errorf("probe.quality_failure must be %q, %q or %q, got %q",
+			qualityFailureIgnore, qualityFailureDegrade, qualityFailureFail, c.Probe.QualityFailure)
+	}
+	if _, err := newRouteRules(c.Routing.Direct); err != nil {
+		return nil, fmt.Errorf("routing.direct: %w", err)
+	}
+	c.Tun.Direct = c.Routing.Direct
+	// Direct TUN flows are dialed with fwmark so policy routing sends them
+	// past the TUN; without a mark they would route straight back into it.
+	if c.Fwmark == 0 {
+		if c.Tun.FailOpen {
+			return nil, fmt.Errorf("tun.fail_open needs fwmark set: unmarked direct flows loop back into the TUN")
+		}
+		if c.Tun.SniffSNI && len(c.Routing.Direct) > 0 {
+			return nil, fmt.Errorf("tun.sniff_sni with routing.direct needs fwmark set: unmarked direct flows loop back into the TUN")
+		}
+	}
+	for _, n := range c.Probe.DNSNames {
+		if strings.TrimSpace(n) == "" {
+			return nil, fmt.Errorf("probe.dns_names: empty name")
+		}
+	}
 	// по умолчанию включим UDP (самый полезный) и TCP
 	// если не хочешь — поставь false в yaml
 	if !c.Probe.EnableTCP && !c.Probe.EnableUDP {
@@ -190,13 +540,148 @@ func LoadConfig(path string) (*Config, error) {
 		c.Probe.EnableUDP = true
 	}
 	for i := range c.Upstreams {
-		if c.Upstreams[i].Weight <= 0 {
-			c.Upstreams[i].Weight = 1
+		if c.Upstreams[i].Weight < 0 {
+			return nil, fmt.Errorf("upstream %q: weight must be >= 0 (0 = backup), got %v", c.Upstreams[i].Name, c.Upstreams[i].Weight)
+		}
+		if isPlainCipher(c.Upstreams[i].Cipher) && !allowPlainCipher.Load() {
+			return nil, fmt.Errorf("upstream %q: cipher %q disables encryption; only allowed with -insecure-plain-cipher", c.Upstreams[i].Name, c.Upstreams[i].Cipher)
+		}
+		if isLegacyPlainCipher(c.Upstreams[i].Cipher) && !allowPlainCipher.Load() {
+			log.Printf("config: upstream %q: cipher %q is deprecated and sends traffic unencrypted; use cipher \"none\" with -insecure-plain-cipher", c.Upstreams[i].Name, c.Upstreams[i].Cipher)
+		}
+		if w := c.Upstreams[i].H2WindowSize; w != 0 && (w < 65535 || w > http2MaxWindow) {
+			return nil, fmt.Errorf("upstream %q: h2_window_size must be within 65535..%d, got %d", c.Upstreams[i].Name, http2MaxWindow, w)
+		}
+		if c.Upstreams[i].Multiplex {
+			switch c.Upstreams[i].UDPWSS {
+			case "":
+				c.Upstreams[i].UDPWSS = c.Upstreams[i].TCPWSS
+			case c.Upstreams[i].TCPWSS:
+			default:
+				return nil, fmt.Errorf("upstream %q: multiplex uses tcp_wss for both protocols; drop udp_wss", c.Upstreams[i].Name)
+			}
+		}
+		if _, err := parseMaintenanceWindows(c.Upstreams[i].MaintenanceWindows); err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", c.Upstreams[i].Name, err)
+		}
+		if up := c.Upstreams[i]; up.AuthToken != "" && up.AuthTokenFile != "" {
+			return nil, fmt.Errorf("upstream %q: auth_token and auth_token_file are mutually exclusive", up.Name)
+		} else if (up.AuthHeader != "" || up.AuthQuery != "") != (up.AuthToken != "" || up.AuthTokenFile != "") {
+			return nil, fmt.Errorf("upstream %q: auth_header/auth_query and auth_token/auth_token_file must be set together", up.Name)
+		}
+		if c.Upstreams[i].DialTimeout < 0 {
+			return nil, fmt.Errorf("upstream %q: dial_timeout must be >= 0, got %s", c.Upstreams[i].Name, c.Upstreams[i].DialTimeout)
+		}
+		if n := c.Upstreams[i].MaxMessageSize; n != 0 && (n < 64<<10 || n > wsFrameSafetyCap) {
+			return nil, fmt.Errorf("upstream %q: max_message_size must be within %d..%d, got %d", c.Upstreams[i].Name, 64<<10, wsFrameSafetyCap, n)
+		}
+		switch c.Upstreams[i].AddressFamily {
+		case "", "auto", "ipv4", "ipv6":
+		default:
+			return nil, fmt.Errorf("upstream %q: address_family must be auto, ipv4 or ipv6, got %q", c.Upstreams[i].Name, c.Upstreams[i].AddressFamily)
+		}
+		if err := c.Upstreams[i].QUIC.validate(); err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", c.Upstreams[i].Name, err)
+		}
+		for _, code := range c.Upstreams[i].AcceptStatus {
+			if code < 200 || code > 299 {
+				return nil, fmt.Errorf("upstream %q: accept_status must list 2xx codes, got %d", c.Upstreams[i].Name, code)
+			}
+		}
+		switch c.Upstreams[i].SendProxyProtocol {
+		case "", "v1", "v2":
+		default:
+			return nil, fmt.Errorf("upstream %q: send_proxy_protocol must be \"v1\" or \"v2\", got %q", c.Upstreams[i].Name, c.Upstreams[i].SendProxyProtocol)
+		}
+		if src := c.Upstreams[i].ProxyProtocolSource; src != "" {
+			if _, err := netip.ParseAddrPort(src); err != nil {
+				return nil, fmt.Errorf("upstream %q: proxy_protocol_source must be ip:port: %w", c.Upstreams[i].Name, err)
+			}
+		} else if c.Upstreams[i].SendProxyProtocol != "" && c.Upstreams[i].Multiplex {
+			return nil, fmt.Errorf("upstream %q: multiplex shares one connection between clients; send_proxy_protocol needs proxy_protocol_source", c.Upstreams[i].Name)
+		}
+		c.Upstreams[i].ProbeUDPTarget = normalizeHostPort(c.Upstreams[i].ProbeUDPTarget)
+		if c.Upstreams[i].HeartbeatText != "" && c.Upstreams[i].HeartbeatInterval <= 0 {
+			c.Upstreams[i].HeartbeatInterval = defaultHeartbeatInterval
+		}
+		if order := c.Upstreams[i].TransportOrder; len(order) > 0 {
+			ladder, err := parseTransportOrder(strings.Join(order, ","))
+			if err != nil {
+				return nil, fmt.Errorf("upstream %q: transport_order: %w", c.Upstreams[i].Name, err)
+			}
+			c.Upstreams[i].TransportOrder = ladder
+		}
+		if c.Upstreams[i].SendProxyProtocol != "" && c.Upstreams[i].mayDialH3() {
+			return nil, fmt.Errorf("upstream %q: send_proxy_protocol cannot be sent on h3 (QUIC) dials; drop h3 from the URL hints and transport_order", c.Upstreams[i].Name)
 		}
 	}
 	return &c, nil
 }
 
+// loadUpstreamsDir reads every *.yaml / *.yml file in dir (sorted by name).
+// A file may hold a single upstream mapping or a list of upstreams; an upstream
+// without a name inherits the file name (without extension, suffixed with the
+// list index for multi-upstream files).
+func loadUpstreamsDir(dir string) ([]UpstreamConfig, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("upstreams_dir: %w", err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(e.Name())) {
+		case ".yaml", ".yml":
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var out []UpstreamConfig
+	for _, name := range names {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("upstreams_dir: %w", err)
+		}
+		var node yaml.Node
+		if err := yaml.Unmarshal(b, &node); err != nil {
+			return nil, fmt.Errorf("upstreams_dir: %s: %w", name, err)
+		}
+		if err := expandConfigEnv(&node); err != nil {
+			return nil, fmt.Errorf("upstreams_dir: %s: %w", name, err)
+		}
+		if len(node.Content) == 0 {
+			continue // empty file
+		}
+		var ups []UpstreamConfig
+		if node.Content[0].Kind == yaml.SequenceNode {
+			if err := node.Content[0].Decode(&ups); err != nil {
+				return nil, fmt.Errorf("upstreams_dir: %s: %w", name, err)
+			}
+		} else {
+			var u UpstreamConfig
+			if err := node.Content[0].Decode(&u); err != nil {
+				return nil, fmt.Errorf("upstreams_dir: %s: %w", name, err)
+			}
+			ups = append(ups, u)
+		}
+		base := strings.TrimSuffix(name, filepath.Ext(name))
+		for i := range ups {
+			if ups[i].Name != "" {
+				continue
+			}
+			ups[i].Name = base
+			if len(ups) > 1 {
+				ups[i].Name = fmt.Sprintf("%s-%d", base, i+1)
+			}
+		}
+		out = append(out, ups...)
+	}
+	return out, nil
+}
+
 // normalizeHostPort tries to ensure the value is a valid host:port string.
 // In particular, it adds brackets around IPv6 literals if they are missing.
 func normalizeHostPort(s string) string {
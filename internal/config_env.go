@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configEnvRef matches ${VAR} and ${VAR:-default} references in config
+// values, and the $${ escape for a literal "${".
+var configEnvRef = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-[^}]*)?\}`)
+
+// expandConfigEnv substitutes environment references in the scalar values
+// of a parsed config, so secrets can live outside the file. Keys and
+// comments are left alone, and a substituted value cannot change the YAML
+// structure around it. As in the shell, ${VAR:-default} falls back to
+// default when VAR is unset or empty; a bare ${VAR} must be set (it may be
+// empty). $${ stands for a literal "${".
+func expandConfigEnv(n *yaml.Node) error {
+	var missing []string
+	expandConfigEnvNode(n, &missing)
+	if len(missing) > 0 {
+		return fmt.Errorf("config references unset environment variable(s): %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func expandConfigEnvNode(n *yaml.Node, missing *[]string) {
+	switch n.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, c := range n.Content {
+			expandConfigEnvNode(c, missing)
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(n.Content); i += 2 {
+			expandConfigEnvNode(n.Content[i], missing)
+		}
+	case yaml.ScalarNode:
+		if !strings.Contains(n.Value, "${") {
+			return
+		}
+		n.Value = configEnvRef.ReplaceAllStringFunc(n.Value, func(ref string) string {
+			if ref == "$${" {
+				return "${"
+			}
+			m := configEnvRef.FindStringSubmatch(ref)
+			name, def := m[1], m[2]
+			v, ok := os.LookupEnv(name)
+			if def != "" {
+				if v == "" {
+					return def[2:]
+				}
+				return v
+			}
+			if !ok {
+				*missing = append(*missing, name)
+			}
+			return v
+		})
+		if n.Style&yaml.TaggedStyle == 0 && n.Style&(yaml.SingleQuotedStyle|yaml.DoubleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+			// A plain scalar is typed by what it reads as after
+			// substitution, so port: ${PORT} still decodes as a number.
+			n.Tag = ""
+		}
+	}
+	// Aliases share their anchor's node, which is expanded where it is
+	// defined.
+}
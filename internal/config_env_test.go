@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func expandConfigEnvString(t *testing.T, in string) (map[string]any, error) {
+	t.Helper()
+	var node yaml.Node
+	if err := yaml.Unmarshal([]byte(in), &node); err != nil {
+		t.Fatalf("%q: %v", in, err)
+	}
+	if err := expandConfigEnv(&node); err != nil {
+		return nil, err
+	}
+	var out map[string]any
+	if err := node.Decode(&out); err != nil {
+		t.Fatalf("%q: decode: %v", in, err)
+	}
+	return out, nil
+}
+
+func TestExpandConfigEnv(t *testing.T) {
+	t.Setenv("OUTLINE_TEST_SECRET", "s3cr3t")
+	t.Setenv("OUTLINE_TEST_EMPTY", "")
+	t.Setenv("OUTLINE_TEST_PORT", "8080")
+	t.Setenv("OUTLINE_TEST_YAML", "x\nother: y")
+
+	for in, want := range map[string]any{
+		"v: ${OUTLINE_TEST_SECRET}":              "s3cr3t",
+		"v: ${OUTLINE_TEST_SECRET:-fallback}":    "s3cr3t",
+		"v: ${OUTLINE_TEST_UNSET:-fallback}":     "fallback",
+		"v: ${OUTLINE_TEST_EMPTY:-fallback}":     "fallback",
+		"v: '${OUTLINE_TEST_EMPTY}'":             "",
+		"v: wss://${OUTLINE_TEST_SECRET}.test/x": "wss://s3cr3t.test/x",
+		"v: $OUTLINE_TEST_SECRET":                "$OUTLINE_TEST_SECRET",
+		"v: ${OUTLINE_TEST_PORT}":                8080,
+		"v: '${OUTLINE_TEST_PORT}'":              "8080",
+		"v: ${OUTLINE_TEST_YAML}":                "x\nother: y",
+		"v: pa$${ss}":                            "pa${ss}",
+		"v: $${OUTLINE_TEST_UNSET}":              "${OUTLINE_TEST_UNSET}",
+		"v: [a, '${OUTLINE_TEST_SECRET}']":       []any{"a", "s3cr3t"},
+		"# ${OUTLINE_TEST_UNSET}\nv: plain":      "plain",
+	} {
+		got, err := expandConfigEnvString(t, in)
+		if err != nil {
+			t.Fatalf("%q: %v", in, err)
+		}
+		if g, w := strings.TrimSpace(yamlString(t, got["v"])), strings.TrimSpace(yamlString(t, want)); g != w {
+			t.Errorf("%q: got %s want %s", in, g, w)
+		}
+		if len(got) != 1 {
+			t.Errorf("%q: value changed the document structure: %v", in, got)
+		}
+	}
+}
+
+func yamlString(t *testing.T, v any) string {
+	t.Helper()
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestExpandConfigEnv_MissingVar(t *testing.T) {
+	_, err := expandConfigEnvString(t, "a: ${OUTLINE_TEST_UNSET_A}\nb: ${OUTLINE_TEST_UNSET_B}\n")
+	if err == nil {
+		t.Fatal("expected error for unset variables")
+	}
+	for _, name := range []string{"OUTLINE_TEST_UNSET_A", "OUTLINE_TEST_UNSET_B"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error %q does not name %s", err, name)
+		}
+	}
+}
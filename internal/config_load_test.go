@@ -40,3 +40,235 @@ upstreams:
 		t.Fatalf("expected tun.debug=true")
 	}
 }
+
+func TestLoadConfig_MergesUpstreamsDir(t *testing.T) {
+	tmpDir := t.TempDir()
+	upDir := filepath.Join(tmpDir, "upstreams.d")
+	if err := os.Mkdir(upDir, 0o700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	files := map[string]string{
+		"10-edge-2.yaml": `tcp_wss: wss://edge-2.example.com/tcp
+udp_wss: wss://edge-2.example.com/udp
+cipher: chacha20-ietf-poly1305
+secret: s2
+`,
+		"20-pair.yaml": `- name: edge-3
+  tcp_wss: wss://edge-3.example.com/tcp
+  weight: 2
+- name: edge-4
+  tcp_wss: wss://edge-4.example.com/tcp
+`,
+		"README.txt": "ignored",
+	}
+	for name, body := range files {
+		if err := os.WriteFile(filepath.Join(upDir, name), []byte(body), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	configYAML := `upstreams_dir: upstreams.d
+upstreams:
+  - name: edge-1
+    tcp_wss: wss://edge-1.example.com/tcp
+`
+	if err := os.WriteFile(configPath, []byte(configYAML), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	var names []string
+	for _, u := range cfg.Upstreams {
+		names = append(names, u.Name)
+	}
+	want := []string{"edge-1", "10-edge-2", "edge-3", "edge-4"}
+	if len(names) != len(want) {
+		t.Fatalf("upstreams=%v want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("upstreams=%v want %v", names, want)
+		}
+	}
+	if cfg.Upstreams[1].Secret != "s2" || cfg.Upstreams[1].UDPWSS != "wss://edge-2.example.com/udp" {
+		t.Fatalf("file upstream not decoded: %+v", cfg.Upstreams[1])
+	}
+	if cfg.Upstreams[2].Weight != 2 || cfg.Upstreams[3].Weight != 1 {
+		t.Fatalf("weights not applied: %v / %v", cfg.Upstreams[2].Weight, cfg.Upstreams[3].Weight)
+	}
+}
+
+func TestLoadConfig_MissingUpstreamsDir(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte("upstreams_dir: nope\n"), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if _, err := LoadConfig(configPath); err == nil {
+		t.Fatalf("expected error for missing upstreams_dir")
+	}
+}
+
+func TestLoadConfig_RejectsUnknownTransportOrder(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	configYAML := `upstreams:
+  - name: edge-1
+    tcp_wss: wss://example.com/tcp
+    udp_wss: wss://example.com/udp
+    cipher: chacha20-ietf-poly1305
+    secret: test-secret
+    transport_order: [h2, quic]
+`
+	if err := os.WriteFile(configPath, []byte(configYAML), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if _, err := LoadConfig(configPath); err == nil {
+		t.Fatalf("expected error for unknown transport in transport_order")
+	}
+}
+
+func TestLoadConfig_ProxyProtocolRejectsH3(t *testing.T) {
+	for name, tc := range map[string]struct {
+		extra string
+		url   string // query on tcp_wss, which udp_wss inherits unless set
+		ok    bool
+	}{
+		"h1/h2 only":              {extra: "    transport_order: [h2, h1]\n", ok: true},
+		"h3 rung":                 {extra: "    transport_order: [h2, h1, h3]\n"},
+		"h3 url hint":             {extra: "    udp_wss: wss://example.com/udp?h3=1\n"},
+		"h2 hint overrides order": {extra: "    transport_order: [h3, h2]\n", url: "?h2=1", ok: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), "config.yaml")
+			configYAML := `upstreams:
+  - name: edge-1
+    tcp_wss: wss://example.com/tcp` + tc.url + `
+    cipher: chacha20-ietf-poly1305
+    secret: test-secret
+    send_proxy_protocol: v2
+` + tc.extra
+			if err := os.WriteFile(configPath, []byte(configYAML), 0o600); err != nil {
+				t.Fatalf("write config: %v", err)
+			}
+			_, err := LoadConfig(configPath)
+			if tc.ok && err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Fatalf("expected send_proxy_protocol with h3 to be rejected")
+			}
+		})
+	}
+}
+
+func TestLoadConfig_WeightZeroIsBackup(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	configYAML := `upstreams:
+  - name: primary
+    tcp_wss: wss://a.example.com/tcp
+    udp_wss: wss://a.example.com/udp
+    cipher: chacha20-ietf-poly1305
+    secret: s
+  - name: backup
+    weight: 0
+    tcp_wss: wss://b.example.com/tcp
+    udp_wss: wss://b.example.com/udp
+    cipher: chacha20-ietf-poly1305
+    secret: s
+`
+	if err := os.WriteFile(configPath, []byte(configYAML), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.Upstreams[0].Weight != 1 {
+		t.Fatalf("omitted weight should default to 1, got %v", cfg.Upstreams[0].Weight)
+	}
+	if cfg.Upstreams[0].Backup {
+		t.Fatalf("omitted weight must not make a backup")
+	}
+	if !cfg.Upstreams[1].Backup {
+		t.Fatalf("explicit weight 0 must mark a backup")
+	}
+}
+
+func TestLoadConfig_RejectsTunDeviceAndFD(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	configYAML := `tun:
+  device: tun0
+  fd: 3
+upstreams: []
+`
+	if err := os.WriteFile(configPath, []byte(configYAML), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if _, err := LoadConfig(configPath); err == nil {
+		t.Fatalf("expected error when both tun.device and tun.fd are set")
+	}
+}
+
+func TestLoadConfig_DirectTunRoutesNeedFwmark(t *testing.T) {
+	for name, tc := range map[string]struct {
+		yaml string
+		ok   bool
+	}{
+		"fail_open":                   {yaml: "tun:\n  fail_open: true\n"},
+		"sniff_sni direct":            {yaml: "tun:\n  sniff_sni: true\nrouting:\n  direct: [example.com]\n"},
+		"sniff_sni without direct":    {yaml: "tun:\n  sniff_sni: true\n", ok: true},
+		"fail_open with fwmark":       {yaml: "fwmark: 1\ntun:\n  fail_open: true\n", ok: true},
+		"sniff_sni direct and fwmark": {yaml: "fwmark: 1\ntun:\n  sniff_sni: true\nrouting:\n  direct: [example.com]\n", ok: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configPath, []byte(tc.yaml+"upstreams: []\n"), 0o600); err != nil {
+				t.Fatalf("write config: %v", err)
+			}
+			if _, err := LoadConfig(configPath); (err == nil) != tc.ok {
+				t.Fatalf("LoadConfig err=%v, want ok=%v", err, tc.ok)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_ExpandsEnvironment(t *testing.T) {
+	t.Setenv("OUTLINE_TEST_SECRET", "from-env")
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	configYAML := `upstreams:
+  - name: edge-1
+    tcp_wss: wss://${OUTLINE_TEST_HOST:-example.com}/tcp
+    udp_wss: wss://example.com/udp
+    cipher: chacha20-ietf-poly1305
+    secret: ${OUTLINE_TEST_SECRET}
+`
+	if err := os.WriteFile(configPath, []byte(configYAML), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if got := cfg.Upstreams[0].Secret; got != "from-env" {
+		t.Fatalf("secret=%q", got)
+	}
+	if got := cfg.Upstreams[0].TCPWSS; got != "wss://example.com/tcp" {
+		t.Fatalf("tcp_wss=%q", got)
+	}
+
+	if err := os.WriteFile(configPath, []byte("upstreams:\n  - secret: ${OUTLINE_TEST_UNSET}\n"), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if _, err := LoadConfig(configPath); err == nil {
+		t.Fatal("expected error for unset variable")
+	}
+}
@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// connCapLogInterval throttles the "connection cap reached" log line; the
+// rejection counter keeps the exact number.
+const connCapLogInterval = 10 * time.Second
+
+// SetMaxConnections caps the number of concurrent client connections (SOCKS5
+// sessions and TUN flows together); 0 = unlimited.
+func (lb *LoadBalancer) SetMaxConnections(n int) {
+	lb.maxConns.Store(int64(n))
+}
+
+// acquireConn reserves a connection slot for a new SOCKS5 session or TUN flow.
+// When the cap is reached it returns ok=false and the caller must drop the
+// connection; otherwise release frees the slot and is safe to call twice.
+func (lb *LoadBalancer) acquireConn(kind string) (release func(), ok bool) {
+	n := lb.liveConns.Add(1)
+	if max := lb.maxConns.Load(); max > 0 && n > max {
+		lb.liveConns.Add(-1)
+		observeConnectionRejected()
+		rejected := lb.connRejects.Add(1)
+		now := time.Now().UnixNano()
+		if last := lb.connCapLogAt.Load(); now-last >= int64(connCapLogInterval) && lb.connCapLogAt.CompareAndSwap(last, now) {
+			log.Printf("[limit] max_connections=%d reached, rejecting new %s connections (%d rejected so far)", max, kind, rejected)
+		}
+		return nil, false
+	}
+	setConnectionsActive(n)
+	var once sync.Once
+	return func() {
+		once.Do(func() { setConnectionsActive(lb.liveConns.Add(-1)) })
+	}, true
+}
@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Phases of a tunnel dial, as the phase label of
+// outlinews_ws_dial_phase_seconds. Slow connect points at the network, slow
+// tls at the server or a middlebox, slow handshake at the WebSocket endpoint.
+const (
+	dialPhaseConnect   = "connect"   // TCP connect
+	dialPhaseTLS       = "tls"       // TLS handshake
+	dialPhaseHandshake = "handshake" // HTTP upgrade or Extended CONNECT until the response
+)
+
+// dialPhaseTimer reports the phases of one dial attempt over transport.
+type dialPhaseTimer struct {
+	ctx       context.Context
+	upstream  string
+	transport string
+}
+
+func newDialPhaseTimer(ctx context.Context, u *url.URL, transport string) *dialPhaseTimer {
+	upstream, _ := upstreamFromURL(u)
+	return &dialPhaseTimer{ctx: ctx, upstream: upstream, transport: transport}
+}
+
+// done records phase as having run from start until now.
+func (t *dialPhaseTimer) done(phase string, start time.Time) {
+	d := time.Since(start)
+	observeDialPhase(t.upstream, t.transport, phase, d)
+	wsTracef(t.ctx, "%s: %s took %s", t.transport, phase, d)
+}
+
+// trace returns ctx with an httptrace hook timing the phases of dials made
+// through net/http (the h1 upgrade and the stdlib h2 path).
+func (t *dialPhaseTimer) trace(ctx context.Context) context.Context {
+	var (
+		mu                          sync.Mutex
+		connectAt, tlsAt, requestAt time.Time
+	)
+	mark := func(at *time.Time) {
+		mu.Lock()
+		if at.IsZero() {
+			*at = time.Now()
+		}
+		mu.Unlock()
+	}
+	finish := func(phase string, at *time.Time) {
+		mu.Lock()
+		start := *at
+		mu.Unlock()
+		if !start.IsZero() {
+			t.done(phase, start)
+		}
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		// With several addresses only the first attempt's start counts, so
+		// connect includes the time lost on addresses that failed.
+		ConnectStart: func(_, _ string) { mark(&connectAt) },
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				finish(dialPhaseConnect, &connectAt)
+			}
+		},
+		TLSHandshakeStart: func() { mark(&tlsAt) },
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				finish(dialPhaseTLS, &tlsAt)
+			}
+		},
+		GotConn:              func(httptrace.GotConnInfo) { mark(&requestAt) },
+		GotFirstResponseByte: func() { finish(dialPhaseHandshake, &requestAt) },
+	})
+}
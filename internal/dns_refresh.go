@@ -0,0 +1,300 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upstream hostnames are re-resolved every selection.dns_refresh_interval.
+// Tunnel dials prefer the freshest answer, and warm standbys pinned to an
+// address that left the DNS answer are dropped, so the client follows
+// DNS-based failover (rotating or anycast records) on the server side.
+
+// lookupUpstreamIPs resolves an upstream hostname; replaced in tests.
+var lookupUpstreamIPs = net.DefaultResolver.LookupNetIP
+
+// dnsRefreshTimeout bounds one lookup of the refresh loop.
+const dnsRefreshTimeout = 5 * time.Second
+
+type dnsEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// upstreamDNSCache holds the last answer per upstream host. Entries are only
+// written by the refresh loop and expire after two intervals, so a stalled
+// loop falls back to per-dial resolution instead of pinning old records.
+type upstreamDNSCache struct {
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+var upstreamDNS = &upstreamDNSCache{entries: map[string]dnsEntry{}}
+
+func (c *upstreamDNSCache) get(host string, now time.Time) []netip.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[host]
+	if !ok || now.After(e.expires) {
+		return nil
+	}
+	return e.addrs
+}
+
+// refresh resolves host and caches the answer for ttl. changed reports that
+// a previous answer existed and the address set differs from it. A failed
+// lookup keeps the previous answer until it expires.
+func (c *upstreamDNSCache) refresh(ctx context.Context, host string, ttl time.Duration) (addrs []netip.Addr, changed bool, err error) {
+	addrs, err = lookupUpstreamIPs(ctx, "ip", host)
+	if err != nil {
+		return nil, false, err
+	}
+	for i, a := range addrs {
+		addrs[i] = a.Unmap()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if prev, ok := c.entries[host]; ok {
+		changed = !sameAddrSet(prev.addrs, addrs)
+	}
+	c.entries[host] = dnsEntry{addrs: addrs, expires: time.Now().Add(ttl)}
+	return addrs, changed, nil
+}
+
+func sameAddrSet(a, b []netip.Addr) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.SortFunc(a, netip.Addr.Compare)
+	slices.SortFunc(b, netip.Addr.Compare)
+	return slices.Equal(a, b)
+}
+
+// happyEyeballsDelay is how long a connect attempt runs alone before the
+// next address is tried alongside it (net.Dialer's default FallbackDelay).
+const happyEyeballsDelay = 300 * time.Millisecond
+
+// resolvingDial wraps dial so hosts with a cached answer are dialed by
+// address, Happy Eyeballs style (RFC 8305): IPv6 and IPv4 addresses are
+// interleaved and attempts are raced with happyEyeballsDelay between them. A
+// "tcp4"/"tcp6" network keeps only that family. Other hosts (no refresh
+// loop, HTTP proxies) go to dial unchanged.
+func resolvingDial(dial dialContextFunc) dialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return dial(ctx, network, addr)
+		}
+		addrs := cachedDialAddrs(network, host)
+		if len(addrs) == 0 {
+			return dial(ctx, network, addr)
+		}
+		return dialAddrsRaced(ctx, dial, network, port, addrs, happyEyeballsDelay)
+	}
+}
+
+// cachedDialAddrs returns the cached answer for host in Happy Eyeballs order,
+// keeping only the family of a "tcp4"/"udp6"-style network, or nil when there
+// is none.
+func cachedDialAddrs(network, host string) []netip.Addr {
+	addrs := upstreamDNS.get(host, time.Now())
+	if len(addrs) == 0 {
+		return nil
+	}
+	addrs = slices.DeleteFunc(slices.Clone(addrs), func(a netip.Addr) bool {
+		return (strings.HasSuffix(network, "4") && !a.Is4()) || (strings.HasSuffix(network, "6") && !a.Is6())
+	})
+	if len(addrs) == 0 {
+		return nil
+	}
+	return interleaveFamilies(addrs)
+}
+
+// interleaveFamilies alternates the address families of addrs, starting
+// with the family of the first answer and keeping the order within each.
+func interleaveFamilies(addrs []netip.Addr) []netip.Addr {
+	var first, other []netip.Addr
+	for _, a := range addrs {
+		if a.Is4() == addrs[0].Is4() {
+			first = append(first, a)
+		} else {
+			other = append(other, a)
+		}
+	}
+	out := make([]netip.Addr, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(other); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(other) {
+			out = append(out, other[i])
+		}
+	}
+	return out
+}
+
+// dialAddrsRaced dials addrs in order, starting the next attempt when the
+// previous one fails or has run for delay. The first connection wins; the
+// other attempts are cancelled and late connections closed. It returns the
+// first error when every attempt fails.
+func dialAddrsRaced(ctx context.Context, dial dialContextFunc, network, port string, addrs []netip.Addr, delay time.Duration) (net.Conn, error) {
+	return raceDials(ctx, addrs, delay, func(ctx context.Context, a netip.Addr) (net.Conn, error) {
+		return dial(ctx, network, net.JoinHostPort(a.String(), port))
+	})
+}
+
+// raceDials is dialAddrsRaced for any connection type, so QUIC dials race
+// the same way as TCP ones.
+func raceDials[C io.Closer](ctx context.Context, addrs []netip.Addr, delay time.Duration, dial func(context.Context, netip.Addr) (C, error)) (C, error) {
+	if len(addrs) == 1 {
+		return dial(ctx, addrs[0])
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		c   C
+		err error
+	}
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			c, err := dial(ctx, addr)
+			results <- result{c, err}
+		}()
+	}
+	start()
+	fallback := time.NewTimer(delay)
+	defer fallback.Stop()
+
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go func(n int) {
+					for ; n > 0; n-- {
+						if l := <-results; l.err == nil {
+							_ = l.c.Close()
+						}
+					}
+				}(pending)
+				return r.c, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) && ctx.Err() == nil {
+				start()
+				fallback.Reset(delay)
+			}
+		case <-fallback.C:
+			if next < len(addrs) {
+				start()
+				fallback.Reset(delay)
+			}
+		}
+	}
+	var zero C
+	return zero, firstErr
+}
+
+// RunDNSRefresh re-resolves the upstream hosts every
+// selection.dns_refresh_interval until ctx is done; a zero interval disables
+// it and dials resolve through the system resolver each time.
+func (lb *LoadBalancer) RunDNSRefresh(ctx context.Context) {
+	every := lb.sel.DNSRefreshInterval
+	if every <= 0 {
+		return
+	}
+	lb.refreshUpstreamDNS(ctx)
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			lb.refreshUpstreamDNS(ctx)
+		}
+	}
+}
+
+func (lb *LoadBalancer) refreshUpstreamDNS(ctx context.Context) {
+	ttl := 2 * lb.sel.DNSRefreshInterval
+	lb.mu.Lock()
+	pool := append([]*UpstreamState(nil), lb.pool...)
+	lb.mu.Unlock()
+
+	changed := map[string]bool{}
+	seen := map[string]bool{}
+	for _, up := range pool {
+		for _, raw := range []string{up.cfg.TCPWSS, up.cfg.UDPWSS} {
+			host := upstreamHost(raw)
+			if host == "" || seen[host] {
+				continue
+			}
+			seen[host] = true
+			rctx, cancel := context.WithTimeout(ctx, dnsRefreshTimeout)
+			addrs, diff, err := upstreamDNS.refresh(rctx, host, ttl)
+			cancel()
+			if err != nil {
+				wsDebugf("dns refresh host=%q failed: %v", host, err)
+				continue
+			}
+			if diff {
+				changed[host] = true
+				log.Printf("[lb] upstream host %s now resolves to %v", host, addrs)
+			}
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+	lb.notifyUpstreamAddrs()
+	for _, up := range pool {
+		if changed[upstreamHost(up.cfg.TCPWSS)] || changed[upstreamHost(up.cfg.UDPWSS)] {
+			lb.dropStandbys(up, "dns-changed")
+		}
+	}
+}
+
+// upstreamHost returns the hostname of a tunnel URL, or "" for IP literals
+// and unparsable URLs, which have nothing to re-resolve.
+func upstreamHost(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	host := u.Hostname()
+	if _, err := netip.ParseAddr(host); err == nil {
+		return ""
+	}
+	return host
+}
+
+// dropStandbys closes up's warm standbys; the next warm-standby tick dials
+// replacements.
+func (lb *LoadBalancer) dropStandbys(up *UpstreamState, reason string) {
+	up.standbyMu.Lock()
+	defer up.standbyMu.Unlock()
+	if up.standbyTCP != nil {
+		_ = up.standbyTCP.Close(WSStatusNormalClosure, reason)
+		up.standbyTCP = nil
+	}
+	if up.standbyUDP != nil {
+		_ = up.standbyUDP.Close(WSStatusNormalClosure, reason)
+		up.standbyUDP = nil
+	}
+}
@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver serves a mutable answer through lookupUpstreamIPs.
+type fakeResolver struct {
+	mu     sync.Mutex
+	answer map[string][]netip.Addr
+}
+
+func (r *fakeResolver) set(host string, addrs ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var as []netip.Addr
+	for _, a := range addrs {
+		as = append(as, netip.MustParseAddr(a))
+	}
+	r.answer[host] = as
+}
+
+func (r *fakeResolver) lookup(_ context.Context, _, host string) ([]netip.Addr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if as, ok := r.answer[host]; ok {
+		return append([]netip.Addr(nil), as...), nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func useFakeResolver(t *testing.T) *fakeResolver {
+	t.Helper()
+	r := &fakeResolver{answer: map[string][]netip.Addr{}}
+	prev, prevCache := lookupUpstreamIPs, upstreamDNS
+	lookupUpstreamIPs = r.lookup
+	upstreamDNS = &upstreamDNSCache{entries: map[string]dnsEntry{}}
+	t.Cleanup(func() { lookupUpstreamIPs, upstreamDNS = prev, prevCache })
+	return r
+}
+
+func TestResolvingDial_NextDialUsesChangedAnswer(t *testing.T) {
+	r := useFakeResolver(t)
+	const host = "rotating.dns-refresh.test"
+	r.set(host, "192.0.2.1")
+
+	var mu sync.Mutex
+	var dialed []string
+	failing := map[string]bool{}
+	dial := resolvingDial(func(_ context.Context, _, addr string) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		dialed = append(dialed, addr)
+		if failing[addr] {
+			return nil, errors.New("connection refused")
+		}
+		c, _ := net.Pipe()
+		return c, nil
+	})
+	ctx := context.Background()
+
+	if _, _, err := upstreamDNS.refresh(ctx, host, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dial(ctx, "tcp", host+":443"); err != nil {
+		t.Fatal(err)
+	}
+
+	r.set(host, "192.0.2.2", "192.0.2.3")
+	if _, changed, err := upstreamDNS.refresh(ctx, host, time.Minute); err != nil || !changed {
+		t.Fatalf("refresh after new answer: changed=%v err=%v", changed, err)
+	}
+	failing["192.0.2.2:443"] = true
+	if _, err := dial(ctx, "tcp", host+":443"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"192.0.2.1:443", "192.0.2.2:443", "192.0.2.3:443"}
+	if len(dialed) != len(want) {
+		t.Fatalf("dialed %v, want %v", dialed, want)
+	}
+	for i := range want {
+		if dialed[i] != want[i] {
+			t.Fatalf("dialed %v, want %v", dialed, want)
+		}
+	}
+
+	// Hosts the refresh loop does not track still go through the dialer as-is.
+	dialed = nil
+	if _, err := dial(ctx, "tcp", "other.dns-refresh.test:443"); err != nil || dialed[0] != "other.dns-refresh.test:443" {
+		t.Fatalf("untracked host dialed as %v (err=%v)", dialed, err)
+	}
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	var in []netip.Addr
+	for _, a := range []string{"2001:db8::1", "2001:db8::2", "2001:db8::3", "192.0.2.1", "192.0.2.2"} {
+		in = append(in, netip.MustParseAddr(a))
+	}
+	want := "[2001:db8::1 192.0.2.1 2001:db8::2 192.0.2.2 2001:db8::3]"
+	if got := fmt.Sprint(interleaveFamilies(in)); got != want {
+		t.Fatalf("interleaveFamilies = %s, want %s", got, want)
+	}
+}
+
+func TestDialAddrsRaced_StalledAddressLosesAfterDelay(t *testing.T) {
+	addrs := []netip.Addr{netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("192.0.2.1")}
+	stalledGaveUp := make(chan struct{})
+	dial := func(ctx context.Context, _, addr string) (net.Conn, error) {
+		if addr == "[2001:db8::1]:443" {
+			<-ctx.Done() // a black-holed IPv6 path
+			close(stalledGaveUp)
+			return nil, ctx.Err()
+		}
+		c, _ := net.Pipe()
+		return c, nil
+	}
+
+	started := time.Now()
+	c, err := dialAddrsRaced(context.Background(), dial, "tcp", "443", addrs, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("dialAddrsRaced: %v", err)
+	}
+	_ = c.Close()
+	if took := time.Since(started); took < 50*time.Millisecond || took > time.Second {
+		t.Fatalf("took %s, want the IPv4 attempt to start after the 50ms delay", took)
+	}
+	select {
+	case <-stalledGaveUp:
+	case <-time.After(time.Second):
+		t.Fatal("the losing attempt was not cancelled")
+	}
+}
+
+func TestRefreshUpstreamDNS_DropsStandbysWhenAnswerChanges(t *testing.T) {
+	r := useFakeResolver(t)
+	const host = "standby.dns-refresh.test"
+	r.set(host, "198.51.100.1")
+
+	lb := NewLoadBalancer([]UpstreamConfig{
+		{Name: "a", TCPWSS: "wss://" + host + "/tcp"},
+		{Name: "b", TCPWSS: "wss://192.0.2.9/tcp"},
+	}, HealthcheckConfig{Timeout: time.Second}, SelectionConfig{DNSRefreshInterval: time.Minute}, ProbeConfig{}, 0)
+	a, b := lb.pool[0], lb.pool[1]
+	ma, mb := &mockWSConn{}, &mockWSConn{}
+	a.standbyTCP, b.standbyTCP = ma, mb
+
+	lb.refreshUpstreamDNS(context.Background())
+	if a.standbyTCP == nil {
+		t.Fatal("standby dropped on the first resolution")
+	}
+
+	r.set(host, "198.51.100.2")
+	lb.refreshUpstreamDNS(context.Background())
+	if a.standbyTCP != nil || !ma.closed {
+		t.Fatal("standby pinned to the old address was kept")
+	}
+	if b.standbyTCP == nil || mb.closed {
+		t.Fatal("standby of an IP-literal upstream was dropped")
+	}
+}
+
+func TestFamilyDial_PinsNetworkAndFiltersDualStackAnswer(t *testing.T) {
+	r := useFakeResolver(t)
+	const host = "dualstack.dns-refresh.test"
+	r.set(host, "2001:db8::1", "192.0.2.1")
+	if _, _, err := upstreamDNS.refresh(context.Background(), host, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		hint, network, addr string
+	}{
+		{"ipv4", "tcp4", "192.0.2.1:443"},
+		{"ipv6", "tcp6", "[2001:db8::1]:443"},
+		{"", "tcp", "[2001:db8::1]:443"},
+	} {
+		var gotNet, gotAddr string
+		base := func(_ context.Context, network, addr string) (net.Conn, error) {
+			gotNet, gotAddr = network, addr
+			c, _ := net.Pipe()
+			return c, nil
+		}
+		q := url.Values{}
+		if tc.hint != "" {
+			q.Set("address_family", tc.hint)
+		}
+		dial := familyDial(resolvingDial(base), wsAddressFamily(q))
+		if _, err := dial(context.Background(), "tcp", host+":443"); err != nil {
+			t.Fatal(err)
+		}
+		if gotNet != tc.network || gotAddr != tc.addr {
+			t.Fatalf("address_family=%q: dialed %s %s, want %s %s", tc.hint, gotNet, gotAddr, tc.network, tc.addr)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+)
+
+// Dial and selection errors. Callers classify failures with errors.Is; the
+// dial helpers wrap these around the underlying transport error.
+var (
+	// ErrNoHealthyUpstreams is returned by the pickers when no upstream is usable.
+	ErrNoHealthyUpstreams = errors.New("no healthy upstreams")
+	// ErrHandshakeRejected means the server answered but refused the
+	// WebSocket / Extended CONNECT handshake (non-101/200 status, bad accept
+	// key, unconfirmed subprotocol).
+	ErrHandshakeRejected = errors.New("websocket handshake rejected")
+	// ErrTLSFailure wraps TLS handshake and certificate verification errors.
+	ErrTLSFailure = errors.New("tls failure")
+	// ErrH2NotSupported means RFC 8441 is unavailable (toolchain or server);
+	// DialWSStream falls back to HTTP/1.1 when it sees it.
+	ErrH2NotSupported = errors.New("rfc8441 not supported by transport")
+	// ErrH3NotSupported is the RFC 9220 counterpart: the URL or the peer
+	// cannot carry WebSockets over HTTP/3.
+	ErrH3NotSupported = errors.New("rfc9220 not supported by transport")
+	// ErrH3HandshakeTimeout means the QUIC handshake or the RFC 9220 CONNECT
+	// exchange ran out of time. UDP is often dropped where TCP passes, so a
+	// transport ladder moves on to its next rung instead of giving up.
+	ErrH3HandshakeTimeout = errors.New("rfc9220 handshake timeout")
+	// ErrMessageTooLarge means the server sent a WebSocket message over the
+	// upstream's max_message_size; the connection is closed with 1009.
+	ErrMessageTooLarge = errors.New("websocket message too large")
+)
+
+// wrapTLSError tags err with ErrTLSFailure when it originates from TLS.
+func wrapTLSError(err error) error {
+	if err == nil || errors.Is(err, ErrTLSFailure) {
+		return err
+	}
+	var (
+		recErr    tls.RecordHeaderError
+		alertErr  tls.AlertError
+		verifyErr *tls.CertificateVerificationError
+		unkAuth   x509.UnknownAuthorityError
+		hostErr   x509.HostnameError
+		invalid   x509.CertificateInvalidError
+	)
+	if errors.As(err, &recErr) || errors.As(err, &alertErr) || errors.As(err, &verifyErr) ||
+		errors.As(err, &unkAuth) || errors.As(err, &hostErr) || errors.As(err, &invalid) {
+		return fmt.Errorf("%w: %w", ErrTLSFailure, err)
+	}
+	return err
+}
+
+// isTransientDialError reports whether a failed dial may work on a retry:
+// timeouts and connection-level network errors. A server that answered and
+// refused, a TLS or certificate failure, or an unsupported transport would
+// fail the same way again.
+func isTransientDialError(err error) bool {
+	if errors.Is(err, ErrHandshakeRejected) || isTransportUnsupported(err) ||
+		errors.Is(wrapTLSError(err), ErrTLSFailure) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var (
+		dnsErr *net.DNSError
+		netErr net.Error
+	)
+	switch {
+	case errors.As(err, &dnsErr):
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return true
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return true // the connection dropped mid-handshake
+	}
+	for _, errno := range []syscall.Errno{
+		syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.ECONNABORTED, syscall.EPIPE,
+		syscall.ENETUNREACH, syscall.EHOSTUNREACH, syscall.ETIMEDOUT,
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTransportUnsupported reports whether err means the transport itself is
+// unavailable (h2 or h3 not offered by the peer or not possible for the URL),
+// as opposed to the server refusing or the network failing.
+func isTransportUnsupported(err error) bool {
+	return errors.Is(err, ErrH2NotSupported) || errors.Is(err, ErrH3NotSupported)
+}
+
+// typedFailureReason maps typed errors to a metrics reason label; ok is false
+// when err carries none of the known types.
+func typedFailureReason(err error) (reason string, ok bool) {
+	var (
+		dnsErr *net.DNSError
+		netErr net.Error
+	)
+	switch {
+	case errors.Is(err, ErrNoHealthyUpstreams):
+		return "no_upstream", true
+	case errors.Is(err, ErrTLSFailure):
+		return "tls", true
+	case errors.Is(err, ErrHandshakeRejected):
+		return "handshake", true
+	case isTransportUnsupported(err):
+		return "unsupported", true
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout", true
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsTimeout {
+			return "timeout", true
+		}
+		return "dns", true
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused", true
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout", true
+	}
+	return "", false
+}
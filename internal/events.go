@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event types published on the event stream.
+const (
+	EventUpstreamUp   = "upstream_up"
+	EventUpstreamDown = "upstream_down"
+	EventSelected     = "selected"
+	EventFailover     = "failover"
+	EventConnOpen     = "conn_open"
+	EventConnClose    = "conn_close"
+)
+
+// Event is one state change, serialized as a single JSON line on the stream.
+type Event struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Upstream string    `json:"upstream,omitempty"`
+	Proto    string    `json:"proto,omitempty"`
+	Flow     uint64    `json:"flow,omitempty"`
+	Dst      string    `json:"dst,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+const defaultEventSubscriberBuffer = 256
+
+// EventSubscription receives events on C until Close. Events that do not fit
+// in its buffer are dropped (and counted) instead of blocking publishers.
+type EventSubscription struct {
+	C <-chan Event
+
+	ch      chan Event
+	dropped atomic.Uint64
+	once    sync.Once
+}
+
+// Dropped reports how many events were discarded because C was full.
+func (s *EventSubscription) Dropped() uint64 { return s.dropped.Load() }
+
+// Close unsubscribes and closes C.
+func (s *EventSubscription) Close() {
+	s.once.Do(func() {
+		eventSubsMu.Lock()
+		delete(eventSubs, s)
+		eventSubsMu.Unlock()
+		eventSubCount.Add(-1)
+		close(s.ch)
+	})
+}
+
+var (
+	eventSubsMu   sync.RWMutex
+	eventSubs     = map[*EventSubscription]struct{}{}
+	eventSubCount atomic.Int64
+)
+
+// SubscribeEvents registers a new event subscriber with the given buffer
+// size (<= 0 uses a default).
+func SubscribeEvents(buffer int) *EventSubscription {
+	if buffer <= 0 {
+		buffer = defaultEventSubscriberBuffer
+	}
+	ch := make(chan Event, buffer)
+	s := &EventSubscription{C: ch, ch: ch}
+	eventSubsMu.Lock()
+	eventSubs[s] = struct{}{}
+	eventSubsMu.Unlock()
+	eventSubCount.Add(1)
+	return s
+}
+
+// publishEvent fans ev out to all subscribers without blocking. It is cheap
+// when nobody is subscribed, so it can sit on the data path.
+func publishEvent(ev Event) {
+	if eventSubCount.Load() == 0 {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	eventSubsMu.RLock()
+	defer eventSubsMu.RUnlock()
+	for s := range eventSubs {
+		select {
+		case s.ch <- ev:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// ServeEvents streams newline-delimited JSON events to every client that
+// connects to addr until ctx is cancelled. The stream is unauthenticated, so
+// addr must be "unix:/path/to.sock" (there is no TCP listener); the socket is
+// accessible to its owner only (see listenPrivateUnix).
+func ServeEvents(ctx context.Context, addr string) error {
+	address, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return fmt.Errorf("events address %q: only unix:/path sockets are supported", addr)
+	}
+	if address == "" {
+		return errors.New("empty events address")
+	}
+	if err := removeStaleSocket(address); err != nil {
+		return err
+	}
+	ln, err := listenPrivateUnix(address)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+		_ = os.Remove(address)
+	}()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go serveEventConn(ctx, c)
+	}
+}
+
+// listenPrivateUnix listens on a unix socket at path with mode 0600. The
+// socket is bound inside a fresh 0700 directory next to path, restricted
+// there and only then renamed into place, so no other local user can
+// connect in between. The caller removes path after closing the listener.
+func listenPrivateUnix(path string) (*net.UnixListener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".events-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The bound name moves away below; path is removed by the caller.
+	ln.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0o600); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// removeStaleSocket removes the socket a previous run left at path. Anything
+// else there (a regular file the path points at by mistake) is left alone
+// and reported.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil
+	case err != nil:
+		return err
+	case fi.Mode().Type() != os.ModeSocket:
+		return fmt.Errorf("events address %q exists and is not a socket", path)
+	}
+	return os.Remove(path)
+}
+
+func serveEventConn(ctx context.Context, c net.Conn) {
+	sub := SubscribeEvents(0)
+	defer sub.Close()
+	defer c.Close()
+
+	// Detect client hang-up even when no events flow.
+	gone := make(chan struct{})
+	go func() {
+		_, _ = bufio.NewReader(c).Discard(1 << 62)
+		close(gone)
+	}()
+
+	enc := json.NewEncoder(c)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-gone:
+			return
+		case ev := <-sub.C:
+			_ = c.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEvents_UpEventDeliveredToSubscriber(t *testing.T) {
+	sub := SubscribeEvents(4)
+	defer sub.Close()
+
+	lb := NewLoadBalancer([]UpstreamConfig{{Name: "edge-1"}}, HealthcheckConfig{SuccessThreshold: 1, FailThreshold: 1}, SelectionConfig{}, ProbeConfig{}, 0)
+	st := lb.pool[0]
+	st.mu.Lock()
+	lb.applyHCResult(&st.tcp, nil, 20*time.Millisecond, "edge-1", "tcp")
+	st.mu.Unlock()
+
+	select {
+	case ev := <-sub.C:
+		if ev.Type != EventUpstreamUp || ev.Upstream != "edge-1" || ev.Proto != "tcp" {
+			t.Fatalf("unexpected event: %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no UP event delivered")
+	}
+}
+
+func TestEvents_SlowSubscriberDropsInsteadOfBlocking(t *testing.T) {
+	sub := SubscribeEvents(1)
+	defer sub.Close()
+
+	publishEvent(Event{Type: EventSelected})
+	publishEvent(Event{Type: EventSelected})
+	publishEvent(Event{Type: EventSelected})
+	if got := sub.Dropped(); got != 2 {
+		t.Fatalf("dropped=%d want 2", got)
+	}
+}
+
+func TestServeEvents_RefusesTCP(t *testing.T) {
+	if err := ServeEvents(context.Background(), "127.0.0.1:0"); err == nil {
+		t.Fatal("the unauthenticated event stream must not listen on TCP")
+	}
+}
+
+func TestServeEvents_KeepsNonSocketAtPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.sock")
+	if err := os.WriteFile(path, []byte("precious"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ServeEvents(context.Background(), "unix:"+path); err == nil {
+		t.Fatal("ServeEvents replaced a regular file")
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != "precious" {
+		t.Fatalf("regular file at the events path was touched: %q, %v", b, err)
+	}
+}
+
+func TestServeEvents_UnixSocketStreamsJSON(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sock := filepath.Join(t.TempDir(), "events.sock")
+	errc := make(chan error, 1)
+	go func() { errc <- ServeEvents(ctx, "unix:"+sock) }()
+
+	var c net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if c, err = net.Dial("unix", sock); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("dial events socket: %v", err)
+	}
+	defer c.Close()
+	if fi, err := os.Stat(sock); err != nil {
+		t.Fatal(err)
+	} else if perm := fi.Mode().Perm(); perm != 0o600 {
+		t.Fatalf("events socket mode=%v, want 0600", perm)
+	}
+
+	// Publish until the server-side subscription is registered and the event arrives.
+	lines := make(chan []byte, 1)
+	go func() {
+		sc := bufio.NewScanner(c)
+		if sc.Scan() {
+			lines <- append([]byte(nil), sc.Bytes()...)
+		}
+	}()
+	deadline := time.After(2 * time.Second)
+	for {
+		publishEvent(Event{Type: EventUpstreamDown, Upstream: "edge-2", Proto: "udp"})
+		select {
+		case line := <-lines:
+			var ev Event
+			if err := json.Unmarshal(line, &ev); err != nil {
+				t.Fatalf("decode %q: %v", line, err)
+			}
+			if ev.Type != EventUpstreamDown || ev.Upstream != "edge-2" {
+				t.Fatalf("unexpected event: %+v", ev)
+			}
+			cancel()
+			if err := <-errc; err != nil && !errors.Is(err, net.ErrClosed) {
+				t.Fatalf("ServeEvents: %v", err)
+			}
+			waitFor(t, func() bool {
+				_, err := os.Lstat(sock)
+				return errors.Is(err, os.ErrNotExist)
+			}, "events socket removed on shutdown")
+			if left, _ := filepath.Glob(filepath.Join(filepath.Dir(sock), ".events-*")); len(left) > 0 {
+				t.Fatalf("temporary bind directory left behind: %v", left)
+			}
+			return
+		case <-deadline:
+			t.Fatalf("no event received on socket")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
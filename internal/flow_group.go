@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultShutdownGrace is how long live TUN flows may keep running after
+// shutdown starts (tun.shutdown_grace = 0).
+const defaultShutdownGrace = 5 * time.Second
+
+// shutdownGrace resolves a configured grace: 0 = default, <0 = none.
+func shutdownGrace(d time.Duration) time.Duration {
+	switch {
+	case d == 0:
+		return defaultShutdownGrace
+	case d < 0:
+		return 0
+	}
+	return d
+}
+
+// flowGroup counts live flows for an ordered shutdown: drain stops admitting
+// new flows, then waits a bounded time for the running ones to finish before
+// the caller tears them down.
+type flowGroup struct {
+	mu      sync.Mutex
+	closing bool
+	active  int
+	idle    chan struct{} // closed when active reaches 0 during drain
+}
+
+// enter admits a flow; false once drain has started. Every admitted flow
+// must call leave.
+func (g *flowGroup) enter() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closing {
+		return false
+	}
+	g.active++
+	return true
+}
+
+func (g *flowGroup) leave() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.active--
+	if g.active == 0 && g.idle != nil {
+		close(g.idle)
+		g.idle = nil
+	}
+}
+
+// drain refuses new flows and waits up to grace for the admitted ones to
+// leave. It returns how many were still running when the wait ended.
+func (g *flowGroup) drain(grace time.Duration) int {
+	g.mu.Lock()
+	g.closing = true
+	if g.active == 0 {
+		g.mu.Unlock()
+		return 0
+	}
+	if g.idle == nil {
+		g.idle = make(chan struct{})
+	}
+	idle := g.idle
+	g.mu.Unlock()
+
+	t := time.NewTimer(grace)
+	defer t.Stop()
+	select {
+	case <-idle:
+	case <-t.C:
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.active
+}
@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlowGroup_DrainGivesLiveFlowsAGraceWindow(t *testing.T) {
+	var g flowGroup
+	if !g.enter() || !g.enter() {
+		t.Fatal("flows refused before shutdown")
+	}
+
+	// One flow finishes inside the grace window, the other never does.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		g.leave()
+	}()
+	start := time.Now()
+	if left := g.drain(150 * time.Millisecond); left != 1 {
+		t.Fatalf("drain left %d flow(s), want 1", left)
+	}
+	if waited := time.Since(start); waited < 150*time.Millisecond {
+		t.Fatalf("drain returned after %s, before the grace window ended", waited)
+	}
+	if g.enter() {
+		t.Fatal("new flow admitted after drain started")
+	}
+
+	g.leave()
+	if left := g.drain(time.Hour); left != 0 {
+		t.Fatalf("drain of an idle group left %d flow(s)", left)
+	}
+}
+
+func TestFlowGroup_DrainReturnsOnceFlowsFinish(t *testing.T) {
+	var g flowGroup
+	g.enter()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		g.leave()
+	}()
+	start := time.Now()
+	if left := g.drain(time.Minute); left != 0 {
+		t.Fatalf("drain left %d flow(s)", left)
+	}
+	if waited := time.Since(start); waited > 10*time.Second {
+		t.Fatalf("drain waited %s for a finished flow", waited)
+	}
+}
+
+func TestShutdownGrace(t *testing.T) {
+	for in, want := range map[time.Duration]time.Duration{
+		0:                defaultShutdownGrace,
+		-1:               0,
+		30 * time.Second: 30 * time.Second,
+	} {
+		if got := shutdownGrace(in); got != want {
+			t.Fatalf("shutdownGrace(%s) = %s, want %s", in, got, want)
+		}
+	}
+}
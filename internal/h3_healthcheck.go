@@ -33,6 +33,9 @@ func ProbeH3ExtendedConnect(ctx context.Context, rawurl string) (time.Duration,
 	if u.Scheme != "wss" && u.Scheme != "https" {
 		return 0, fmt.Errorf("h3 healthcheck requires wss/https, got %q", u.Scheme)
 	}
+	if ctx, err = withHandshakeAuth(ctx); err != nil {
+		return 0, err
+	}
 
 	hcURL := h3HealthcheckURL(u)
 	host := hcURL.Hostname()
@@ -48,8 +51,8 @@ func ProbeH3ExtendedConnect(ctx context.Context, rawurl string) (time.Duration,
 		authority = host
 	}
 
-	tlsConf := &tls.Config{MinVersion: tls.VersionTLS13, ServerName: host, NextProtos: []string{"h3"}}
-	qcConf := &quic.Config{TLSConfig: tlsConf}
+	tlsConf := withUpstreamTLS(&tls.Config{MinVersion: tls.VersionTLS13, ServerName: host, NextProtos: []string{"h3"}})
+	qcConf := h3QUICConfig(u, tlsConf)
 	ep, err := quic.Listen("udp", ":0", qcConf)
 	if err != nil {
 		return 0, fmt.Errorf("h3 healthcheck: quic endpoint init failed: %w", err)
@@ -57,7 +60,7 @@ func ProbeH3ExtendedConnect(ctx context.Context, rawurl string) (time.Duration,
 	defer ep.Close(context.Background())
 
 	dialAddr := net.JoinHostPort(host, port)
-	qconn, err := ep.Dial(ctx, "udp", dialAddr, qcConf)
+	qconn, err := ep.Dial(ctx, "udp"+wsAddressFamily(u.Query()), dialAddr, qcConf)
 	if err != nil {
 		return 0, fmt.Errorf("h3 healthcheck: quic handshake failed: %w", err)
 	}
@@ -92,7 +95,11 @@ func ProbeH3ExtendedConnect(ctx context.Context, rawurl string) (time.Duration,
 		return 0, fmt.Errorf("h3 healthcheck: open request stream failed: %w", err)
 	}
 
-	headers := h3ConnectHeaders(hcURL, authority)
+	fields := h3ConnectHeaderFields(hcURL, authority)
+	if cred, ok := handshakeCredFrom(ctx); ok {
+		fields = cred.fields(fields)
+	}
+	headers := h3EncodeHeaders(fields)
 	requestFrame := appendVarint(nil, h3FrameHeaders)
 	requestFrame = appendVarint(requestFrame, uint64(len(headers)))
 	requestFrame = append(requestFrame, headers...)
@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// handshakeAuthSource is where an upstream behind a gate (auth_header/
+// auth_query) gets the token it presents in every WebSocket handshake. It
+// travels in the dial context (withUpstreamAuth), never in the dial URL,
+// which ends up in traces and errors and whose query belongs to the server;
+// dialWSStream resolves it into a handshakeCred that each transport adds to
+// the request it sends.
+type handshakeAuthSource struct {
+	name             string
+	header, query    string
+	token, tokenFile string
+}
+
+// handshakeCred is the credential of one dial: the token goes in header,
+// or, when header is empty, in the query parameter query.
+type handshakeCred struct {
+	header, query, value string
+}
+
+type (
+	handshakeAuthKey struct{}
+	handshakeCredKey struct{}
+)
+
+// hasHandshakeAuth reports whether u sends a token in its handshakes.
+func (u UpstreamConfig) hasHandshakeAuth() bool {
+	return (u.AuthHeader != "" || u.AuthQuery != "") && (u.AuthToken != "" || u.AuthTokenFile != "")
+}
+
+// withUpstreamAuth makes the dials run with ctx present u's handshake token;
+// upstreams without one get ctx back unchanged.
+func withUpstreamAuth(ctx context.Context, u UpstreamConfig) context.Context {
+	if !u.hasHandshakeAuth() {
+		return ctx
+	}
+	return context.WithValue(ctx, handshakeAuthKey{}, handshakeAuthSource{
+		name: u.Name, header: u.AuthHeader, query: u.AuthQuery, token: u.AuthToken, tokenFile: u.AuthTokenFile,
+	})
+}
+
+// withHandshakeAuth resolves the credential source attached by
+// withUpstreamAuth into ctx. A token file is read on every dial, so rotating
+// it needs no reload.
+func withHandshakeAuth(ctx context.Context) (context.Context, error) {
+	src, ok := ctx.Value(handshakeAuthKey{}).(handshakeAuthSource)
+	if !ok {
+		return ctx, nil
+	}
+	name := src.name
+	cred := handshakeCred{header: src.header, value: src.token}
+	if cred.header == "" {
+		cred.query = src.query
+	}
+	if src.tokenFile != "" {
+		b, err := os.ReadFile(src.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: auth_token_file: %w", name, err)
+		}
+		cred.value = strings.TrimSpace(string(b))
+	}
+	if cred.value == "" {
+		return nil, fmt.Errorf("upstream %q: empty handshake token", name)
+	}
+	return context.WithValue(ctx, handshakeCredKey{}, cred), nil
+}
+
+func handshakeCredFrom(ctx context.Context) (handshakeCred, bool) {
+	c, ok := ctx.Value(handshakeCredKey{}).(handshakeCred)
+	return c, ok
+}
+
+// setHeader adds the token header to h (HTTP/1.1 and stdlib HTTP/2 dials).
+func (c handshakeCred) setHeader(h http.Header) {
+	if c.header != "" {
+		h.Set(c.header, c.value)
+	}
+}
+
+// withQuery appends the token parameter to a URL or request URI.
+func (c handshakeCred) withQuery(uri string) string {
+	if c.query == "" {
+		return uri
+	}
+	sep := "?"
+	if strings.Contains(uri, "?") {
+		sep = "&"
+	}
+	return uri + sep + url.QueryEscape(c.query) + "=" + url.QueryEscape(c.value)
+}
+
+// fields adds the credential to hand-encoded HTTP/2 and HTTP/3 request
+// fields: a lowercase header, or the parameter appended to :path.
+func (c handshakeCred) fields(fields [][2]string) [][2]string {
+	if c.header != "" {
+		return append(fields, [2]string{strings.ToLower(c.header), c.value})
+	}
+	out := append([][2]string(nil), fields...)
+	for i, f := range out {
+		if f[0] == ":path" {
+			out[i][1] = c.withQuery(f[1])
+		}
+	}
+	return out
+}
+
+// redact masks the token in a dial error; HTTP client errors quote the
+// request URL, query parameter included. errors.Is/As still see the cause.
+func (c handshakeCred) redact(err error) error {
+	msg := err.Error()
+	masked := strings.ReplaceAll(msg, url.QueryEscape(c.value), "[redacted]")
+	masked = strings.ReplaceAll(masked, c.value, "[redacted]")
+	if masked == msg {
+		return err
+	}
+	return &redactedError{msg: masked, err: err}
+}
+
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string { return e.msg }
+func (e *redactedError) Unwrap() error { return e.err }
@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"hash/fnv"
+	"math"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hashRingPointsPerWeight is how many ring points one unit of weight gets;
+// enough that shares track weights within a few percent.
+const hashRingPointsPerWeight = 100
+
+// hashRing maps destination hosts to upstreams for the consistent_hash
+// strategy. Every member owns points proportional to its weight, so a
+// member leaving only moves the destinations it owned.
+type hashRing struct {
+	members string // names the ring was built from, to detect changes
+	points  []uint64
+	owners  []*UpstreamState // owners[i] owns points[i]
+}
+
+func hashRingKey(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	// fnv clusters similar inputs; finish with a 64-bit mix (splitmix64).
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func newHashRing(members []*UpstreamState) *hashRing {
+	r := &hashRing{members: hashRingMembers(members)}
+	type point struct {
+		key   uint64
+		owner *UpstreamState
+	}
+	var pts []point
+	for _, s := range members {
+		w := s.cfg.Weight
+		if w <= 0 {
+			w = 1
+		}
+		n := int(math.Max(1, math.Round(w*hashRingPointsPerWeight)))
+		for i := 0; i < n; i++ {
+			pts = append(pts, point{hashRingKey(s.cfg.Name + "#" + strconv.Itoa(i)), s})
+		}
+	}
+	slices.SortFunc(pts, func(a, b point) int {
+		switch {
+		case a.key < b.key:
+			return -1
+		case a.key > b.key:
+			return 1
+		}
+		return 0
+	})
+	r.points = make([]uint64, len(pts))
+	r.owners = make([]*UpstreamState, len(pts))
+	for i, p := range pts {
+		r.points[i], r.owners[i] = p.key, p.owner
+	}
+	return r
+}
+
+func hashRingMembers(members []*UpstreamState) string {
+	names := make([]string, len(members))
+	for i, s := range members {
+		names[i] = s.cfg.Name
+	}
+	return strings.Join(names, "\x00")
+}
+
+// lookup returns the owner of the first point at or after dst's hash.
+func (r *hashRing) lookup(dst string) *UpstreamState {
+	if len(r.points) == 0 {
+		return nil
+	}
+	i, _ := slices.BinarySearch(r.points, hashRingKey(destinationHost(dst)))
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+// destinationHost strips the port so every port of a host hashes alike.
+func destinationHost(dst string) string {
+	if host, _, err := net.SplitHostPort(dst); err == nil {
+		return strings.ToLower(host)
+	}
+	return strings.ToLower(dst)
+}
+
+// pickByHash picks dst's upstream on the ring of usable upstreams: the
+// primaries, or the backups once no primary is usable. The ring is rebuilt
+// whenever that set changes (health, cooldown, draining).
+func (lb *LoadBalancer) pickByHash(pool []*UpstreamState, now time.Time, isTCP bool, dst string) (*UpstreamState, error) {
+	var members []*UpstreamState
+	for _, backup := range []bool{false, true} {
+		for _, s := range pool {
+			if s.cfg.isBackup() == backup && lb.usable(s, now, isTCP) {
+				members = append(members, s)
+			}
+		}
+		if len(members) > 0 {
+			break
+		}
+	}
+	if len(members) == 0 {
+		return nil, ErrNoHealthyUpstreams
+	}
+
+	ringp := &lb.udpRing
+	if isTCP {
+		ringp = &lb.tcpRing
+	}
+	lb.mu.Lock()
+	r := *ringp
+	if r == nil || r.members != hashRingMembers(members) {
+		r = newHashRing(members)
+		*ringp = r
+	}
+	lb.mu.Unlock()
+	return r.lookup(dst), nil
+}
+
+// usable reports whether s may take a new tunnel of the given protocol.
+func (lb *LoadBalancer) usable(s *UpstreamState, now time.Time, isTCP bool) bool {
+	if s.cfg.ProbeOnly || s.inMaintenance(now) {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if isTCP {
+		return s.tcp.healthy && !now.Before(s.tcpCooldownUntil) && !s.draining
+	}
+	return s.udp.healthy && !now.Before(s.udpCooldownUntil) && !s.draining
+}
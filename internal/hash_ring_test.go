@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPick_ConsistentHashIsStableAndMovesOnlyTheLeaversShare(t *testing.T) {
+	lb := NewLoadBalancer([]UpstreamConfig{
+		{Name: "a", Weight: 1},
+		{Name: "b", Weight: 1},
+		{Name: "c", Weight: 2},
+	}, HealthcheckConfig{}, SelectionConfig{Strategy: selectionConsistentHash}, ProbeConfig{}, 0)
+	for _, s := range lb.pool {
+		markHealthy(s, true, 10*time.Millisecond)
+	}
+
+	const n = 2000
+	before := map[string]string{}
+	share := map[string]int{}
+	for i := 0; i < n; i++ {
+		dst := fmt.Sprintf("host-%d.example:443", i)
+		up, err := lb.PickTCPFor(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before[dst] = up.cfg.Name
+		share[up.cfg.Name]++
+		// Same host, any port: same upstream, every time.
+		again, _ := lb.PickTCPFor(fmt.Sprintf("HOST-%d.example:80", i))
+		if again != up {
+			t.Fatalf("%s mapped to %s, then %s", dst, up.cfg.Name, again.cfg.Name)
+		}
+	}
+	// Weight 2 should own roughly half the destinations.
+	if share["c"] < n*4/10 || share["c"] > n*6/10 {
+		t.Fatalf("shares %v do not follow the weights", share)
+	}
+
+	lb.ReportTCPFailure(lb.pool[1], fmt.Errorf("down")) // b cools down
+	for dst, was := range before {
+		up, err := lb.PickTCPFor(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if was != "b" && up.cfg.Name != was {
+			t.Fatalf("%s moved %s -> %s though only b left", dst, was, up.cfg.Name)
+		}
+		if up.cfg.Name == "b" {
+			t.Fatalf("%s still mapped to the cooling upstream", dst)
+		}
+	}
+
+	// Without a destination the strategy falls back to the RTT score.
+	if _, err := lb.PickTCP(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultHookTimeout = 10 * time.Second
+
+// RunLifecycleHook executes the on_connect/on_disconnect command configured
+// for event ("connect" or "disconnect"), similar to OpenVPN up/down scripts.
+//
+// The command runs via /bin/sh -c with the daemon environment plus env and
+// OUTLINEWS_EVENT. Its combined output is logged line by line. An empty
+// command is a no-op.
+func RunLifecycleHook(ctx context.Context, hooks HooksConfig, event string, env map[string]string) error {
+	var command string
+	switch event {
+	case "connect":
+		command = hooks.OnConnect
+	case "disconnect":
+		command = hooks.OnDisconnect
+	default:
+		return fmt.Errorf("unknown hook event %q", event)
+	}
+	if strings.TrimSpace(command) == "" {
+		return nil
+	}
+
+	started := time.Now()
+	out, err := runHookCommand(ctx, command, hooks.Timeout, hookEnv(event, env))
+	sc := bufio.NewScanner(strings.NewReader(out))
+	for sc.Scan() {
+		log.Printf("[hook|%s] %s", event, sc.Text())
+	}
+	if err != nil {
+		log.Printf("[hook|%s] failed after %s: %v", event, time.Since(started), err)
+		return err
+	}
+	log.Printf("[hook|%s] done in %s", event, time.Since(started))
+	return nil
+}
+
+func hookEnv(event string, env map[string]string) []string {
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := append(os.Environ(), "OUTLINEWS_EVENT="+event)
+	for _, k := range keys {
+		out = append(out, k+"="+env[k])
+	}
+	return out
+}
+
+func runHookCommand(ctx context.Context, command string, timeout time.Duration, env []string) (string, error) {
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	cctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(cctx, "/bin/sh", "-c", command)
+	cmd.Env = env
+	out, err := cmd.CombinedOutput()
+	if err != nil && errors.Is(cctx.Err(), context.DeadlineExceeded) {
+		return string(out), fmt.Errorf("hook timed out after %s: %w", timeout, err)
+	}
+	return string(out), err
+}
@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunLifecycleHook_PassesEnvironment(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "hook.out")
+	hooks := HooksConfig{
+		OnConnect: `printf '%s|%s|%s|%s' "$OUTLINEWS_EVENT" "$OUTLINEWS_UPSTREAMS" "$OUTLINEWS_TUN_DEVICE" "$OUTLINEWS_SOCKS5" > "$HOOK_OUT"`,
+		Timeout:   5 * time.Second,
+	}
+	env := map[string]string{
+		"HOOK_OUT":             out,
+		"OUTLINEWS_UPSTREAMS":  "edge-1,edge-2",
+		"OUTLINEWS_TUN_DEVICE": "tun0",
+		"OUTLINEWS_SOCKS5":     "127.0.0.1:1080",
+	}
+
+	if err := RunLifecycleHook(context.Background(), hooks, "connect", env); err != nil {
+		t.Fatalf("RunLifecycleHook: %v", err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("read hook output: %v", err)
+	}
+	if want := "connect|edge-1,edge-2|tun0|127.0.0.1:1080"; string(got) != want {
+		t.Fatalf("hook env: got %q want %q", got, want)
+	}
+}
+
+func TestRunLifecycleHook_EmptyCommandIsNoop(t *testing.T) {
+	if err := RunLifecycleHook(context.Background(), HooksConfig{}, "disconnect", nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func TestRunHookCommand_Timeout(t *testing.T) {
+	_, err := runHookCommand(context.Background(), "sleep 5", 50*time.Millisecond, os.Environ())
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+}
@@ -2,16 +2,25 @@ package internal
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"log"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const repeatedSelectionLogInterval = 30 * time.Second
+
+// selection.strategy values.
+const (
+	selectionFastest        = "fastest"
+	selectionLeastConn      = "least_conn"
+	selectionConsistentHash = "consistent_hash"
+)
 const probeParallelLimit = 2
 const probeDialParallelLimit = 4
 
@@ -33,6 +42,15 @@ type hcState struct {
 
 	nextHC  time.Time
 	hcEvery time.Duration
+
+	// everUp is set by the first UP; upSince is the last UP after a DOWN,
+	// which starts selection.slow_start (the first UP at startup does not).
+	everUp  bool
+	upSince time.Time
+
+	// degraded: the last quality probe failed while the handshake worked
+	// (probe.quality_failure: degrade)
+	degraded bool
 }
 
 type UpstreamState struct {
@@ -47,10 +65,32 @@ type UpstreamState struct {
 	tcpCooldownUntil time.Time
 	udpCooldownUntil time.Time
 
+	// draining upstreams keep their live tunnels but get no new ones
+	draining bool
+	// maintenance windows act like draining while they are open (immutable)
+	maintenance []maintenanceWindow
+
+	// live tunnels (SOCKS5 CONNECT / UDP ASSOCIATE, TUN flows)
+	activeTCP atomic.Int64
+	activeUDP atomic.Int64
+
 	// warm-standby TCP
 	standbyMu  sync.Mutex
 	standbyTCP WSConn
 	standbyUDP WSConn
+	// when the current standby conns were dialed (for StandbyMaxIdle)
+	standbyTCPAt time.Time
+	standbyUDPAt time.Time
+	// spaces out warm-up dials after consecutive standby dial failures
+	standbyTCPBackoff standbyBackoff
+	standbyUDPBackoff standbyBackoff
+
+	// multiplexed WebSockets with a channel still free (upstream.multiplex)
+	muxMu    sync.Mutex
+	muxSpare []*wsMux
+
+	// removed from the pool by Reload; standbys dialed late are closed
+	retired atomic.Bool
 }
 
 type LoadBalancer struct {
@@ -64,6 +104,13 @@ type LoadBalancer struct {
 
 	current     *UpstreamState
 	stickyUntil time.Time
+	// UDP counterpart of current/stickyUntil, only used with
+	// selection.udp_sticky.
+	udpCurrent     *UpstreamState
+	udpStickyUntil time.Time
+
+	// consistent_hash rings, rebuilt when the usable set changes
+	tcpRing, udpRing *hashRing
 
 	// suppresses repetitive unchanged selection log lines by protocol.
 	lastSelectionLog   map[string]string
@@ -72,15 +119,45 @@ type LoadBalancer struct {
 	dialSem      chan struct{}
 	probeSem     chan struct{}
 	probeDialSem chan struct{}
+
+	// Health-check probes. nil fields fall back to the real implementations
+	// (see probeTransport, probeTCPQuality, probeUDPQuality); tests inject
+	// fakes here to drive the scheduler without network access.
+	transportProbe  func(ctx context.Context, rawurl string) (time.Duration, error)
+	tcpQualityProbe func(ctx context.Context, up UpstreamConfig, target string) (time.Duration, error)
+	udpQualityProbe func(ctx context.Context, up UpstreamConfig, target string) (time.Duration, error)
+	// tunnelDial replaces DialWSStream for tunnel and standby dials in tests.
+	tunnelDial func(ctx context.Context, rawurl string) (WSConn, error)
+	// probeDial replaces DialWSStream for coalesced health-check dials in tests.
+	probeDial func(ctx context.Context, rawurl string) (WSConn, error)
+
+	dnsProbeSeq atomic.Uint64 // rotates ProbeConfig.DNSNames
+
+	// global cap on client connections (see acquireConn)
+	maxConns     atomic.Int64
+	liveConns    atomic.Int64
+	connRejects  atomic.Uint64
+	connCapLogAt atomic.Int64 // unix nanos of the last cap log line
+
+	// listen.disable_udp: no UDP health checks, standbys or tunnels
+	udpDisabled atomic.Bool
+
+	// every upstream down (see outage.go); refreshed by the HC scheduler
+	outage atomic.Bool
+
+	// DisableBackgroundProbes was called: upstreams added by Reload start UP
+	probesOff atomic.Bool
+
+	// closed and replaced when the upstream addresses may have changed (see
+	// upstreamAddrsChanged); guarded by mu
+	addrsChanged chan struct{}
 }
 
 func NewLoadBalancer(ups []UpstreamConfig, hc HealthcheckConfig, sel SelectionConfig, probe ProbeConfig, fwmark uint32) *LoadBalancer {
 	pool := make([]*UpstreamState, 0, len(ups))
 	for _, u := range ups {
-		s := &UpstreamState{cfg: u}
-		s.tcp.healthy = false
-		s.udp.healthy = false
-		pool = append(pool, s)
+		pool = append(pool, newUpstreamState(u))
+		setDraining(u.Name, u.Drain)
 	}
 	lb := &LoadBalancer{hc: hc, sel: sel, probe: probe, fwmark: fwmark, pool: pool, lastSelectionLog: map[string]string{}, lastSelectionLogAt: map[string]time.Time{}}
 	lb.dialSem = make(chan struct{}, 32) // default parallel dials
@@ -89,36 +166,296 @@ func NewLoadBalancer(ups []UpstreamConfig, hc HealthcheckConfig, sel SelectionCo
 	return lb
 }
 
+// newUpstreamState builds the (DOWN, unchecked) state of one configured
+// upstream.
+func newUpstreamState(u UpstreamConfig) *UpstreamState {
+	u.TCPWSS = upstreamDialURL(u.TCPWSS, u)
+	u.UDPWSS = upstreamDialURL(u.UDPWSS, u)
+	if u.Weight <= 0 {
+		u.Weight = 1
+	}
+	s := &UpstreamState{cfg: u, draining: u.Drain}
+	if ws, err := parseMaintenanceWindows(u.MaintenanceWindows); err != nil {
+		log.Printf("[lb] upstream %q: ignoring maintenance_windows: %v", u.Name, err)
+	} else {
+		s.maintenance = ws
+	}
+	s.tcp.healthy = false
+	s.udp.healthy = false
+	return s
+}
+
+// upstreamDialURL folds per-upstream handshake settings into rawurl as dial
+// hints understood by DialWSStream.
+func upstreamDialURL(rawurl string, u UpstreamConfig) string {
+	rawurl = withDialHint(rawurl, "subprotocol", u.Subprotocol)
+	if u.H2WindowSize > 0 {
+		rawurl = withDialHint(rawurl, "h2_window", strconv.FormatUint(uint64(u.H2WindowSize), 10))
+	}
+	if u.DialTimeout > 0 {
+		rawurl = withDialHint(rawurl, "dial_timeout", u.DialTimeout.String())
+	}
+	if u.MaxMessageSize > 0 {
+		rawurl = withDialHint(rawurl, "max_message", strconv.FormatInt(u.MaxMessageSize, 10))
+	}
+	if u.AddressFamily == "ipv4" || u.AddressFamily == "ipv6" {
+		rawurl = withDialHint(rawurl, "address_family", u.AddressFamily)
+	}
+	if len(u.AcceptStatus) > 0 {
+		codes := make([]string, len(u.AcceptStatus))
+		for i, c := range u.AcceptStatus {
+			codes[i] = strconv.Itoa(c)
+		}
+		rawurl = withDialHint(rawurl, "accept_status", strings.Join(codes, ","))
+	}
+	if u.RequireAccept {
+		rawurl = withDialHint(rawurl, "require_accept", "1")
+	}
+	rawurl = withDialHint(rawurl, "quic_params", u.QUIC.dialHint())
+	rawurl = withDialHint(rawurl, "proxy_protocol", u.SendProxyProtocol)
+	rawurl = withDialHint(rawurl, "proxy_source", u.ProxyProtocolSource)
+	return withDialHint(rawurl, "transport", strings.Join(u.TransportOrder, ","))
+}
+
 func (lb *LoadBalancer) DisableBackgroundProbes() {
+	lb.probesOff.Store(true)
 	lb.mu.Lock()
 	pool := append([]*UpstreamState(nil), lb.pool...)
 	lb.mu.Unlock()
 
+	for _, s := range pool {
+		s.assumeHealthy()
+	}
+}
+
+// assumeHealthy marks s UP without a check (background probes disabled).
+func (s *UpstreamState) assumeHealthy() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tcp.healthy = true
+	s.udp.healthy = true
+	s.tcp.failCount = 0
+	s.udp.failCount = 0
+	s.tcp.successCount = 1
+	s.udp.successCount = 1
+	s.tcp.lastError = nil
+	s.udp.lastError = nil
+	now := time.Now()
+	s.tcp.lastCheckTime = now
+	s.udp.lastCheckTime = now
+	s.tcpCooldownUntil = time.Time{}
+	s.udpCooldownUntil = time.Time{}
+}
+
+// SetDraining toggles drain mode for the named upstream. A draining upstream
+// is skipped for new tunnels and warm standby, but its live tunnels and
+// health state are left alone. It reports whether the upstream exists.
+func (lb *LoadBalancer) SetDraining(name string, on bool) bool {
+	lb.mu.Lock()
+	pool := append([]*UpstreamState(nil), lb.pool...)
+	lb.mu.Unlock()
+
+	found := false
+	for _, s := range pool {
+		if s.cfg.Name != name {
+			continue
+		}
+		found = true
+		s.mu.Lock()
+		changed := s.draining != on
+		s.draining = on
+		s.mu.Unlock()
+		if changed {
+			log.Printf("[lb] upstream %q draining=%t (active tcp=%d udp=%d)", name, on, s.activeTCP.Load(), s.activeUDP.Load())
+		}
+		setDraining(name, on)
+		if on {
+			lb.mu.Lock()
+			lb.unstickLocked(s)
+			lb.mu.Unlock()
+		}
+	}
+	return found
+}
+
+// Draining reports whether s is in drain mode.
+func (s *UpstreamState) Draining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// UpstreamStatus is a point-in-time view of one upstream, as served by the
+// admin /status endpoint.
+type UpstreamStatus struct {
+	Name        string      `json:"name"`
+	Weight      float64     `json:"weight"`
+	Backup      bool        `json:"backup"`
+	Draining    bool        `json:"draining"`
+	ProbeOnly   bool        `json:"probe_only,omitempty"`  // health-checked, never picked
+	Maintenance bool        `json:"maintenance,omitempty"` // inside a maintenance window
+	Current     bool        `json:"current"`               // sticky TCP choice
+	TCP         ProtoStatus `json:"tcp"`
+	UDP         ProtoStatus `json:"udp"`
+}
+
+// ProtoStatus is the per-protocol half of UpstreamStatus.
+type ProtoStatus struct {
+	Healthy           bool       `json:"healthy"`
+	RTTMillis         float64    `json:"rtt_ms"`
+	FailCount         int        `json:"fail_count"`
+	LastError         string     `json:"last_error,omitempty"`
+	LastCheck         *time.Time `json:"last_check,omitempty"`
+	CooldownUntil     *time.Time `json:"cooldown_until,omitempty"`
+	ActiveConnections int64      `json:"active_connections"`
+	// TransportFallback is set ("h2->h1") while tunnel dials end on another
+	// transport than the first one tried.
+	TransportFallback string `json:"transport_fallback,omitempty"`
+	// Degraded is set while the quality probe fails but the handshake works
+	// (probe.quality_failure: degrade).
+	Degraded bool `json:"degraded,omitempty"`
+}
+
+// Snapshot returns the state of every upstream in config order.
+func (lb *LoadBalancer) Snapshot() []UpstreamStatus {
+	now := time.Now()
+	lb.mu.Lock()
+	pool := append([]*UpstreamState(nil), lb.pool...)
+	cur := lb.current
+	lb.mu.Unlock()
+
+	out := make([]UpstreamStatus, 0, len(pool))
 	for _, s := range pool {
 		s.mu.Lock()
-		s.tcp.healthy = true
-		s.udp.healthy = true
-		s.tcp.failCount = 0
-		s.udp.failCount = 0
-		s.tcp.successCount = 1
-		s.udp.successCount = 1
-		s.tcp.lastError = nil
-		s.udp.lastError = nil
-		now := time.Now()
-		s.tcp.lastCheckTime = now
-		s.udp.lastCheckTime = now
-		s.tcpCooldownUntil = time.Time{}
-		s.udpCooldownUntil = time.Time{}
+		st := UpstreamStatus{
+			Name:        s.cfg.Name,
+			Weight:      s.cfg.Weight,
+			Backup:      s.cfg.isBackup(),
+			Draining:    s.draining,
+			ProbeOnly:   s.cfg.ProbeOnly,
+			Maintenance: s.inMaintenance(now),
+			Current:     s == cur,
+			TCP:         protoStatus(s.tcp, s.tcpCooldownUntil, now, s.cfg),
+			UDP:         protoStatus(s.udp, s.udpCooldownUntil, now, s.cfg),
+		}
 		s.mu.Unlock()
+		st.TCP.ActiveConnections = s.activeTCP.Load()
+		st.UDP.ActiveConnections = s.activeUDP.Load()
+		st.TCP.TransportFallback = dialFallbackFor(s.cfg.TCPWSS)
+		st.UDP.TransportFallback = dialFallbackFor(s.cfg.UDPWSS)
+		out = append(out, st)
 	}
+	return out
 }
 
+func protoStatus(h hcState, cooldownUntil, now time.Time, cfg UpstreamConfig) ProtoStatus {
+	ps := ProtoStatus{
+		Healthy:   h.healthy,
+		RTTMillis: float64(h.rttEWMA) / float64(time.Millisecond),
+		FailCount: h.failCount,
+		Degraded:  h.degraded,
+	}
+	if h.lastError != nil {
+		ps.LastError = redactUpstreamError(h.lastError.Error(), cfg)
+	}
+	if !h.lastCheckTime.IsZero() {
+		t := h.lastCheckTime
+		ps.LastCheck = &t
+	}
+	if now.Before(cooldownUntil) {
+		t := cooldownUntil
+		ps.CooldownUntil = &t
+	}
+	return ps
+}
+
+// statusURLRe matches URLs embedded in error strings.
+var statusURLRe = regexp.MustCompile(`\b(?i:wss?|https?)://[^\s"'/?#]+[^\s"']*`)
+
+// redactUpstreamError strips credentials from an upstream's error before it
+// leaves the process: the Shadowsocks secret, and the path and query of any
+// URL, since Outline WebSocket paths usually double as access keys.
+func redactUpstreamError(msg string, cfg UpstreamConfig) string {
+	if cfg.Secret != "" {
+		msg = strings.ReplaceAll(msg, cfg.Secret, "[redacted]")
+	}
+	msg = statusURLRe.ReplaceAllStringFunc(msg, func(raw string) string {
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			return "[redacted-url]"
+		}
+		if u.Path == "" && u.RawQuery == "" && u.User == nil {
+			return raw
+		}
+		return u.Scheme + "://" + u.Host + "/[redacted]"
+	})
+	// Paths also show up on their own, e.g. in raw h2 handshake errors.
+	for _, raw := range []string{cfg.TCPWSS, cfg.UDPWSS} {
+		if u, err := url.Parse(raw); err == nil && len(u.Path) > 1 {
+			msg = strings.ReplaceAll(msg, u.Path, "/[redacted]")
+		}
+	}
+	return msg
+}
+
+// HealthyCount returns how many upstreams able to serve traffic currently
+// pass TCP health checks; probe-only upstreams do not count.
+func (lb *LoadBalancer) HealthyCount() int {
+	lb.mu.Lock()
+	pool := append([]*UpstreamState(nil), lb.pool...)
+	lb.mu.Unlock()
+
+	n := 0
+	for _, s := range pool {
+		if s.cfg.ProbeOnly {
+			continue
+		}
+		s.mu.Lock()
+		if s.tcp.healthy {
+			n++
+		}
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// trackConn counts a live tunnel on up until the returned func is called.
+func (lb *LoadBalancer) trackConn(up *UpstreamState, proto string) (done func()) {
+	if up == nil {
+		return func() {}
+	}
+	ctr := &up.activeTCP
+	if proto == "udp" {
+		ctr = &up.activeUDP
+	}
+	setActiveConns(up.cfg.Name, proto, ctr.Add(1))
+	var once sync.Once
+	return func() {
+		once.Do(func() { setActiveConns(up.cfg.Name, proto, ctr.Add(-1)) })
+	}
+}
+
+// PickTCP picks a TCP upstream when the destination is not known; see
+// PickTCPFor.
 func (lb *LoadBalancer) PickTCP() (*UpstreamState, error) {
-	return lb.pickByEndpoint(true)
+	return lb.PickTCPFor("")
 }
 
 func (lb *LoadBalancer) PickUDP() (*UpstreamState, error) {
-	return lb.pickByEndpoint(false)
+	return lb.PickUDPFor("")
+}
+
+// PickTCPFor picks the TCP upstream for a tunnel to dst ("host:port").
+// Strategies that route by destination (consistent_hash) use it; the
+// score-based ones ignore it.
+func (lb *LoadBalancer) PickTCPFor(dst string) (*UpstreamState, error) {
+	return lb.pickByEndpoint(true, dst)
+}
+
+// PickUDPFor is PickTCPFor for UDP sessions; dst is the first destination
+// the session carries.
+func (lb *LoadBalancer) PickUDPFor(dst string) (*UpstreamState, error) {
+	return lb.pickByEndpoint(false, dst)
 }
 
 func (lb *LoadBalancer) logSelectionIfChanged(proto, upstream, reason string) {
@@ -127,6 +464,9 @@ func (lb *LoadBalancer) logSelectionIfChanged(proto, upstream, reason string) {
 	lb.mu.Lock()
 	prev := lb.lastSelectionLog[proto]
 	lastAt := lb.lastSelectionLogAt[proto]
+	if prevUpstream, _, _ := strings.Cut(prev, "|"); prevUpstream != upstream {
+		publishEvent(Event{Type: EventSelected, Upstream: upstream, Proto: proto, Detail: reason})
+	}
 	if prev == k && now.Sub(lastAt) < repeatedSelectionLogInterval {
 		lb.mu.Unlock()
 		return
@@ -165,26 +505,59 @@ func (lb *LoadBalancer) udpCandidateSummary(pool []*UpstreamState, now time.Time
 	return strings.Join(parts, "; ")
 }
 
-func (lb *LoadBalancer) pickByEndpoint(isTCP bool) (*UpstreamState, error) {
+func (lb *LoadBalancer) pickByEndpoint(isTCP bool, dst string) (*UpstreamState, error) {
 	now := time.Now()
 
 	lb.mu.Lock()
 	pool := append([]*UpstreamState(nil), lb.pool...)
-	// sticky делаем только для TCP (как и warm-standby), для UDP можно тоже, но обычно не надо
-	cur := lb.current
-	stickyUntil := lb.stickyUntil
+	// sticky делаем для TCP (как и warm-standby); для UDP только с
+	// selection.udp_sticky (QUIC/WebRTC не любят смену апстрима)
+	cur, stickyUntil := lb.current, lb.stickyUntil
+	if !isTCP {
+		cur, stickyUntil = lb.udpCurrent, lb.udpStickyUntil
+	}
 	lb.mu.Unlock()
 
-	// sticky только TCP
-	if isTCP && cur != nil && now.Before(stickyUntil) {
+	proto := "udp"
+	if isTCP {
+		proto = "tcp"
+	}
+	// consistent_hash: the destination decides, no sticky or hysteresis.
+	// Callers without a destination get the fastest-first pick below.
+	if lb.sel.Strategy == selectionConsistentHash && dst != "" {
+		best, err := lb.pickByHash(pool, now, isTCP, dst)
+		if err != nil {
+			return nil, err
+		}
+		wsDebugf("[lb] selected upstream proto=%s upstream=%q reason=consistent-hash dst=%q", proto, best.cfg.Name, dst)
+		observeSelection(best.cfg.Name, proto)
+		return best, nil
+	}
+
+	// least_conn balances every new tunnel on occupancy, so it never sticks.
+	leastConn := lb.sel.Strategy == selectionLeastConn
+	sticky := isTCP || lb.sel.UDPSticky
+
+	if sticky && !leastConn && cur != nil && now.Before(stickyUntil) {
 		cur.mu.Lock()
-		ok := cur.tcp.healthy && now.After(cur.tcpCooldownUntil)
+		h, cooldownUntil := cur.tcp, cur.tcpCooldownUntil
+		if !isTCP {
+			h, cooldownUntil = cur.udp, cur.udpCooldownUntil
+		}
+		ok := h.healthy && now.After(cooldownUntil) && !cur.draining && !cur.inMaintenance(now)
+		slow := lb.overRTTCap(h.rttEWMA)
 		cur.mu.Unlock()
+		if ok && (slow || cur.cfg.isBackup()) {
+			// A primary came back, or cur got too slow: re-pick unless
+			// nothing better qualifies.
+			best, _, err := lb.pickBestCandidateByEndpoint(pool, now, isTCP)
+			ok = err == nil && (best == cur || (!slow && best.cfg.isBackup()))
+		}
 		if ok {
 			// Sticky выбор может происходить очень часто (на каждый новый flow),
 			// поэтому оставляем это в debug-логах, чтобы не зашумлять обычные логи.
-			wsDebugf("[lb] selected upstream proto=tcp upstream=%q reason=sticky", cur.cfg.Name)
-			observeSelection(cur.cfg.Name, "tcp")
+			wsDebugf("[lb] selected upstream proto=%s upstream=%q reason=sticky", proto, cur.cfg.Name)
+			observeSelection(cur.cfg.Name, proto)
 			return cur, nil
 		}
 	}
@@ -197,62 +570,168 @@ func (lb *LoadBalancer) pickByEndpoint(isTCP bool) (*UpstreamState, error) {
 		return nil, err
 	}
 
-	// hysteresis + sticky тоже только TCP
-	if isTCP && cur != nil {
+	// hysteresis — там же, где sticky
+	if sticky && !leastConn && cur != nil {
 		cur.mu.Lock()
-		curOK := cur.tcp.healthy && now.After(cur.tcpCooldownUntil)
-		curRTT := cur.tcp.rttEWMA
+		h, cooldownUntil := cur.tcp, cur.tcpCooldownUntil
+		if !isTCP {
+			h, cooldownUntil = cur.udp, cur.udpCooldownUntil
+		}
+		curRTT := h.rttEWMA
+		curOK := h.healthy && now.After(cooldownUntil) && !cur.draining && !cur.inMaintenance(now) && !lb.overRTTCap(curRTT)
 		cur.mu.Unlock()
 
-		if cur != best && curOK && curRTT > 0 && bestRTT > 0 {
+		// Never hold on to a backup when the best candidate is a primary.
+		holdable := !cur.cfg.isBackup() || best.cfg.isBackup()
+		if cur != best && curOK && holdable && curRTT > 0 && bestRTT > 0 {
 			if curRTT-bestRTT < lb.sel.MinSwitch {
-				lb.mu.Lock()
-				lb.current = cur
-				lb.stickyUntil = now.Add(lb.sel.StickyTTL)
-				lb.mu.Unlock()
-				lb.logSelectionIfChanged("tcp", cur.cfg.Name, "hysteresis")
-				wsDebugf("[lb] hysteresis details upstream=%q current_rtt=%s candidate_rtt=%s min_switch=%s", cur.cfg.Name, curRTT, bestRTT, lb.sel.MinSwitch)
-				observeSelection(cur.cfg.Name, "tcp")
+				lb.stick(isTCP, cur, now)
+				lb.logSelectionIfChanged(proto, cur.cfg.Name, "hysteresis")
+				wsDebugf("[lb] hysteresis details proto=%s upstream=%q current_rtt=%s candidate_rtt=%s min_switch=%s", proto, cur.cfg.Name, curRTT, bestRTT, lb.sel.MinSwitch)
+				observeSelection(cur.cfg.Name, proto)
 				return cur, nil
 			}
 		}
 	}
 
+	reason := "best-candidate"
+	if leastConn {
+		reason = "least-conn"
+	}
+	if sticky {
+		lb.stick(isTCP, best, now)
+	}
+	lb.logSelectionIfChanged(proto, best.cfg.Name, reason)
+	observeSelection(best.cfg.Name, proto)
+
+	return best, nil
+}
+
+// stick makes s the sticky choice for the protocol for selection.sticky_ttl.
+func (lb *LoadBalancer) stick(isTCP bool, s *UpstreamState, now time.Time) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
 	if isTCP {
-		lb.mu.Lock()
-		lb.current = best
-		lb.stickyUntil = now.Add(lb.sel.StickyTTL)
-		lb.mu.Unlock()
-		lb.logSelectionIfChanged("tcp", best.cfg.Name, "best-candidate")
-		observeSelection(best.cfg.Name, "tcp")
+		lb.current, lb.stickyUntil = s, now.Add(lb.sel.StickyTTL)
 	} else {
-		lb.logSelectionIfChanged("udp", best.cfg.Name, "best-candidate")
-		observeSelection(best.cfg.Name, "udp")
+		lb.udpCurrent, lb.udpStickyUntil = s, now.Add(lb.sel.StickyTTL)
 	}
+}
 
-	return best, nil
+// unstickLocked drops s as the sticky choice of both protocols. lb.mu must
+// be held.
+func (lb *LoadBalancer) unstickLocked(s *UpstreamState) {
+	if lb.current == s {
+		lb.current = nil
+		lb.stickyUntil = time.Time{}
+	}
+	if lb.udpCurrent == s {
+		lb.udpCurrent = nil
+		lb.udpStickyUntil = time.Time{}
+	}
 }
 
+// isBackup reports whether u is a backup upstream. Backups are only picked
+// when no primary upstream is usable.
+func (u UpstreamConfig) isBackup() bool { return u.Backup }
+
+// pickBestCandidateByEndpoint picks the best usable primary upstream and
+// falls back to the backup tier only when no primary qualifies. With
+// selection.max_eligible_rtt set, primaries slower than it are passed over
+// and only picked when no faster primary is usable; a slow primary still
+// wins over any backup. The backup tier applies the cap the same way.
 func (lb *LoadBalancer) pickBestCandidateByEndpoint(pool []*UpstreamState, now time.Time, isTCP bool) (*UpstreamState, time.Duration, error) {
-	var best *UpstreamState
-	bestScore := float64(1e18)
-	bestRTT := time.Duration(0)
+	passes := []bool{true}
+	if lb.sel.MaxEligibleRTT > 0 {
+		passes = []bool{true, false}
+	}
+	for _, backup := range []bool{false, true} {
+		for _, capped := range passes {
+			if best, bestRTT := lb.pickBestInTier(pool, now, isTCP, backup, capped); best != nil {
+				return best, bestRTT, nil
+			}
+		}
+	}
+	return nil, 0, ErrNoHealthyUpstreams
+}
+
+// slowStartFactor is the share of selections an upstream that came back UP
+// at upSince takes part in: 10% at recovery, rising linearly to all of them
+// once window has passed, so a recovered server is not handed every new
+// connection at once.
+func slowStartFactor(upSince, now time.Time, window time.Duration) float64 {
+	if window <= 0 || upSince.IsZero() {
+		return 1
+	}
+	elapsed := now.Sub(upSince)
+	if elapsed >= window {
+		return 1
+	}
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return 0.1 + 0.9*float64(elapsed)/float64(window)
+}
+
+// overRTTCap reports whether rtt exceeds selection.max_eligible_rtt. An
+// upstream without a measurement yet is not held against the cap.
+func (lb *LoadBalancer) overRTTCap(rtt time.Duration) bool {
+	return lb.sel.MaxEligibleRTT > 0 && rtt > lb.sel.MaxEligibleRTT
+}
+
+// tierPick is the running best of a pickBestInTier pass.
+type tierPick struct {
+	s     *UpstreamState
+	score float64
+	load  float64
+	rtt   time.Duration
+}
+
+func (p *tierPick) offer(s *UpstreamState, score, load float64, rtt time.Duration, leastConn bool) {
+	if leastConn {
+		// Fewest live tunnels per unit of weight; the RTT score breaks ties.
+		if p.s == nil || load < p.load || (load == p.load && score < p.score) {
+			*p = tierPick{s: s, score: score, load: load, rtt: rtt}
+		}
+		return
+	}
+	if p.s == nil || score < p.score {
+		*p = tierPick{s: s, score: score, load: load, rtt: rtt}
+	}
+}
+
+// pickBestInTier scores the usable upstreams of one tier. An upstream in its
+// selection.slow_start window only competes in a slowStartFactor share of
+// the calls, drawn at random, and is otherwise picked only when nothing
+// else in the tier is usable.
+func (lb *LoadBalancer) pickBestInTier(pool []*UpstreamState, now time.Time, isTCP, backup, capped bool) (*UpstreamState, time.Duration) {
+	var best, ramping tierPick
+	leastConn := lb.sel.Strategy == selectionLeastConn
 
 	for _, s := range pool {
+		if s.cfg.isBackup() != backup || s.cfg.ProbeOnly {
+			continue
+		}
 		s.mu.Lock()
 		var h hcState
 		var cooldownUntil time.Time
+		active := &s.activeUDP
 		if isTCP {
 			h = s.tcp
 			cooldownUntil = s.tcpCooldownUntil
+			active = &s.activeTCP
 		} else {
 			h = s.udp
 			cooldownUntil = s.udpCooldownUntil
 		}
 		w := s.cfg.Weight
+		draining := s.draining
 		s.mu.Unlock()
 
-		if !h.healthy || now.Before(cooldownUntil) {
+		if !h.healthy || now.Before(cooldownUntil) || draining || s.inMaintenance(now) {
+			continue
+		}
+		if capped && lb.overRTTCap(h.rttEWMA) {
 			continue
 		}
 
@@ -272,23 +751,33 @@ func (lb *LoadBalancer) pickBestCandidateByEndpoint(pool []*UpstreamState, now t
 		if h.lastError != nil {
 			errPenalty = 500
 		}
+		if h.degraded {
+			errPenalty += qualityDegradedPenalty
+		}
 
 		if w <= 0 {
 			w = 1
 		}
 		score := (base + stalePenalty + failPenalty + errPenalty) * (1.0 / float64(w))
+		load := float64(active.Load()) / w
 
-		if score < bestScore {
-			bestScore = score
-			best = s
-			bestRTT = h.rttEWMA
+		pick := &best
+		if f := slowStartFactor(h.upSince, now, lb.sel.SlowStart); f < 1 && randFloat64() >= f {
+			pick = &ramping
 		}
+		pick.offer(s, score, load, h.rttEWMA, leastConn)
 	}
-
-	if best == nil {
-		return nil, 0, errors.New("no healthy upstreams")
+	if best.s == nil {
+		best = ramping
 	}
-	return best, bestRTT, nil
+	return best.s, best.rtt
+}
+
+// SetUDPDisabled turns the UDP path off for the whole deployment: UDP
+// ASSOCIATE and TUN UDP flows are refused, and no UDP health checks or
+// standbys are run.
+func (lb *LoadBalancer) SetUDPDisabled(disabled bool) {
+	lb.udpDisabled.Store(disabled)
 }
 
 func (lb *LoadBalancer) RunHealthChecks(ctx context.Context) {
@@ -328,36 +817,126 @@ func (lb *LoadBalancer) RunHealthChecks(ctx context.Context) {
 	}
 }
 
+// CheckNow moves the next TCP and UDP health check of the named upstream
+// (every upstream for "all") to the next scheduler tick, e.g. to verify a
+// server right after maintenance. Checks already running are left alone.
+// It reports whether a matching upstream exists.
+func (lb *LoadBalancer) CheckNow(name string) bool {
+	lb.mu.Lock()
+	pool := append([]*UpstreamState(nil), lb.pool...)
+	lb.mu.Unlock()
+
+	now := time.Now()
+	found := false
+	for _, s := range pool {
+		if name != "all" && s.cfg.Name != name {
+			continue
+		}
+		found = true
+		s.mu.Lock()
+		for _, h := range []*hcState{&s.tcp, &s.udp} {
+			if !h.inFlight {
+				h.nextHC = now
+			}
+		}
+		s.mu.Unlock()
+	}
+	return found
+}
+
+// hcOverdueStale is how late a check must be before the scheduler treats it
+// as left over from a stall rather than a regular tick: the scheduler runs
+// every 200ms, so this only happens when the process was stopped, its VM
+// paused, or the wall clock and monotonic clock both jumped.
+const hcOverdueStale = 10 * time.Second
+
+// hcResumeSpread is the window over which stale checks are re-spread instead
+// of all firing on the first tick after the stall.
+const hcResumeSpread = 5 * time.Second
+
+type dueCheck struct {
+	st  *UpstreamState
+	udp bool
+}
+
+func (c dueCheck) hc() *hcState {
+	if c.udp {
+		return &c.st.udp
+	}
+	return &c.st.tcp
+}
+
 func (lb *LoadBalancer) runDueChecks(ctx context.Context) {
 	lb.mu.Lock()
 	pool := append([]*UpstreamState(nil), lb.pool...)
 	lb.mu.Unlock()
 
 	now := time.Now()
+	lb.refreshOutage(pool)
 
+	var due, stale []dueCheck
 	for _, st := range pool {
-		var launchTCP, launchUDP bool
-		st.mu.Lock()
-		// Mark as in-flight under the lock to avoid duplicate goroutines.
-		if !st.tcp.inFlight && !st.tcp.nextHC.After(now) {
-			st.tcp.inFlight = true
-			launchTCP = true
+		if st.cfg.MaintenanceSkipProbes && st.inMaintenance(now) {
+			continue
 		}
-		if !st.udp.inFlight && !st.udp.nextHC.After(now) {
-			st.udp.inFlight = true
-			launchUDP = true
+		st.mu.Lock()
+		for _, c := range []dueCheck{{st: st}, {st: st, udp: true}} {
+			h := c.hc()
+			if c.udp && lb.udpDisabled.Load() {
+				continue
+			}
+			if h.inFlight || h.nextHC.After(now) {
+				continue
+			}
+			if !h.nextHC.IsZero() && now.Sub(h.nextHC) > hcOverdueStale {
+				stale = append(stale, c)
+				continue
+			}
+			// Mark as in-flight under the lock to avoid duplicate goroutines.
+			h.inFlight = true
+			due = append(due, c)
 		}
 		st.mu.Unlock()
+	}
 
-		if launchTCP {
-			go lb.checkOneTCP(ctx, st)
+	// After a stall every check is overdue at once; run one now and spread
+	// the rest over hcResumeSpread so the upstreams (and the probe slots)
+	// are not stampeded.
+	if len(stale) > 1 {
+		log.Printf("[HC] %d checks overdue by more than %s; spreading them over %s", len(stale), hcOverdueStale, hcResumeSpread)
+	}
+	step := hcResumeSpread / time.Duration(max(len(stale), 1))
+	for k, c := range stale {
+		c.st.mu.Lock()
+		if h := c.hc(); k == 0 {
+			h.inFlight = true
+			due = append(due, c)
+		} else {
+			h.nextHC = now.Add(time.Duration(k) * step)
 		}
-		if launchUDP {
-			go lb.checkOneUDP(ctx, st)
+		c.st.mu.Unlock()
+	}
+
+	for _, c := range due {
+		if c.udp {
+			go lb.checkOneUDP(ctx, c.st)
+		} else {
+			go lb.checkOneTCP(ctx, c.st)
 		}
 	}
 }
 
+// failureCooldown is the cooldown after the failCount-th consecutive failure:
+// selection.cooldown, multiplied by failCount up to cooldown_max_factor so a
+// chronically failing upstream stays out longer than one with a single blip.
+func (lb *LoadBalancer) failureCooldown(failCount int) time.Duration {
+	factor := min(failCount, lb.sel.CooldownMaxFactor)
+	if factor <= 1 {
+		return lb.sel.Cooldown
+	}
+	return lb.sel.Cooldown * time.Duration(factor)
+}
+
 func (lb *LoadBalancer) ReportTCPFailure(s *UpstreamState, err error) {
 	if s == nil {
 		return
@@ -369,11 +948,11 @@ func (lb *LoadBalancer) ReportTCPFailure(s *UpstreamState, err error) {
 	s.tcp.failCount++
 	s.tcp.successCount = 0
 	s.tcp.healthy = false
-	s.tcpCooldownUntil = now.Add(lb.sel.Cooldown)
+	s.tcpCooldownUntil = now.Add(lb.failureCooldown(s.tcp.failCount))
 
 	// ускоряем TCP HC
-	s.tcp.hcEvery = lb.hc.MinInterval
-	s.tcp.nextHC = now.Add(applyJitter(lb.hc.MinInterval, lb.hc.Jitter))
+	s.tcp.hcEvery = lb.outageFloor(lb.hc.MinInterval)
+	s.tcp.nextHC = now.Add(applyJitter(s.tcp.hcEvery, lb.hc.Jitter))
 	s.mu.Unlock()
 
 	observeFailure(s.cfg.Name, "tcp", err)
@@ -397,14 +976,20 @@ func (lb *LoadBalancer) ReportUDPFailure(s *UpstreamState, err error) {
 	s.udp.failCount++
 	s.udp.successCount = 0
 	s.udp.healthy = false
-	s.udpCooldownUntil = now.Add(lb.sel.Cooldown)
+	s.udpCooldownUntil = now.Add(lb.failureCooldown(s.udp.failCount))
 
 	// ускоряем UDP HC
-	s.udp.hcEvery = lb.hc.MinInterval
-	s.udp.nextHC = now.Add(applyJitter(lb.hc.MinInterval, lb.hc.Jitter))
+	s.udp.hcEvery = lb.outageFloor(lb.hc.MinInterval)
+	s.udp.nextHC = now.Add(applyJitter(s.udp.hcEvery, lb.hc.Jitter))
 	s.mu.Unlock()
 
 	observeFailure(s.cfg.Name, "udp", err)
+
+	lb.mu.Lock()
+	if lb.udpCurrent == s {
+		lb.udpStickyUntil = time.Time{}
+	}
+	lb.mu.Unlock()
 }
 
 func (lb *LoadBalancer) pickTopN(now time.Time, n int) []*UpstreamState {
@@ -414,13 +999,15 @@ func (lb *LoadBalancer) pickTopN(now time.Time, n int) []*UpstreamState {
 
 	out := make([]*UpstreamState, 0, n)
 	used := map[*UpstreamState]bool{}
+	// Backups get standby connections only while no primary is usable.
+	backup := false
 
 	for len(out) < n {
 		var best *UpstreamState
 		bestScore := float64(1e18)
 
 		for _, s := range pool {
-			if used[s] {
+			if used[s] || s.cfg.isBackup() != backup || s.cfg.ProbeOnly {
 				continue
 			}
 			s.mu.Lock()
@@ -429,11 +1016,13 @@ func (lb *LoadBalancer) pickTopN(now time.Time, n int) []*UpstreamState {
 			cooldownUntil := s.tcpCooldownUntil
 			fail := s.tcp.failCount
 			lastErr := s.tcp.lastError
+			degraded := s.tcp.degraded
 			lastCheck := s.tcp.lastCheckTime
 			w := s.cfg.Weight
+			draining := s.draining
 			s.mu.Unlock()
 
-			if !healthy || now.Before(cooldownUntil) {
+			if !healthy || now.Before(cooldownUntil) || draining || s.inMaintenance(now) {
 				continue
 			}
 
@@ -451,6 +1040,9 @@ func (lb *LoadBalancer) pickTopN(now time.Time, n int) []*UpstreamState {
 			if lastErr != nil {
 				errPenalty = 500
 			}
+			if degraded {
+				errPenalty += qualityDegradedPenalty
+			}
 			if w <= 0 {
 				w = 1
 			}
@@ -463,6 +1055,10 @@ func (lb *LoadBalancer) pickTopN(now time.Time, n int) []*UpstreamState {
 		}
 
 		if best == nil {
+			if !backup && len(out) == 0 {
+				backup = true
+				continue
+			}
 			break
 		}
 		used[best] = true
@@ -491,31 +1087,25 @@ func (lb *LoadBalancer) RunWarmStandby(ctx context.Context) {
 			pool := append([]*UpstreamState(nil), lb.pool...)
 			lb.mu.Unlock()
 			for _, u := range pool {
-				u.standbyMu.Lock()
-				if u.standbyTCP != nil {
-					_ = u.standbyTCP.Close(WSStatusNormalClosure, "shutdown")
-					u.standbyTCP = nil
-				}
-				if u.standbyUDP != nil {
-					_ = u.standbyUDP.Close(WSStatusNormalClosure, "shutdown")
-					u.standbyUDP = nil
-				}
-				u.standbyMu.Unlock()
+				lb.dropStandbys(u, "shutdown")
 			}
 			return
 		case <-keepaliveC:
 			lb.checkStandbyKeepalive(ctx)
 		case <-t.C:
 			now := time.Now()
+			lb.recycleStaleStandbys(now)
 			n := lb.sel.WarmStandbyN
-			if n <= 0 {
+			if n <= 0 || lb.outage.Load() {
 				continue
 			}
 			top := lb.pickTopN(now, n)
 			for _, u := range top {
 				// прогреваем параллельно
 				go lb.EnsureStandbyTCP(ctx, u)
-				go lb.EnsureStandbyUDP(ctx, u)
+				if !lb.udpDisabled.Load() {
+					go lb.EnsureStandbyUDP(ctx, u)
+				}
 			}
 		}
 	}
@@ -541,6 +1131,72 @@ func wsDialTimeoutForURL(base time.Duration, rawurl string) time.Duration {
 	return base
 }
 
+// probeTransport checks that the websocket handshake to rawurl succeeds.
+func (lb *LoadBalancer) probeTransport(ctx context.Context, rawurl string) (time.Duration, error) {
+	if lb.transportProbe != nil {
+		return lb.transportProbe(ctx, rawurl)
+	}
+	if shouldUseH3Healthcheck(rawurl) {
+		return ProbeH3ExtendedConnect(ctx, rawurl)
+	}
+	return ProbeWSS(ctx, rawurl, lb.fwmark)
+}
+
+// probeTCPQuality measures a TCP round trip through up to target.
+func (lb *LoadBalancer) probeTCPQuality(ctx context.Context, up UpstreamConfig, target string) (time.Duration, error) {
+	if lb.tcpQualityProbe != nil {
+		return lb.tcpQualityProbe(ctx, up, target)
+	}
+	return ProbeTCPQuality(ctx, up, target, lb.fwmark)
+}
+
+// probeUDPQuality measures a DNS round trip through up to target.
+func (lb *LoadBalancer) probeUDPQuality(ctx context.Context, up UpstreamConfig, target string) (time.Duration, error) {
+	if lb.udpQualityProbe != nil {
+		return lb.udpQualityProbe(ctx, up, target)
+	}
+	return ProbeUDPQuality(ctx, up, target, lb.dnsProbeName(), lb.probe.DNSType, !lb.probe.DNSAcceptAnyReply, lb.fwmark)
+}
+
+// dnsProbeName returns the next QNAME for a UDP quality probe: DNSNames are
+// used round-robin (falling back to DNSName), optionally under a random label
+// so a cached answer cannot mask a broken path.
+func (lb *LoadBalancer) dnsProbeName() string {
+	name := lb.probe.DNSName
+	if n := len(lb.probe.DNSNames); n > 0 {
+		name = lb.probe.DNSNames[(lb.dnsProbeSeq.Add(1)-1)%uint64(n)]
+	}
+	if lb.probe.DNSRandomPrefix {
+		name = fmt.Sprintf("p%08x.%s", randInt63n(1<<32), strings.TrimPrefix(name, "."))
+	}
+	return name
+}
+
+// coalesceProbe reports whether one handshake to rawurl can serve both the
+// transport check and the quality probe: the probe is dialed once and the
+// quality exchange runs over that conn. Injected probe fakes and the staged
+// h3 check keep the two-step path.
+func (lb *LoadBalancer) coalesceProbe(rawurl string) bool {
+	return lb.transportProbe == nil && lb.tcpQualityProbe == nil && lb.udpQualityProbe == nil && !shouldUseH3Healthcheck(rawurl)
+}
+
+// dialProbeConn dials rawurl for a coalesced check and returns the conn with
+// the handshake time, which stands in for the transport probe's RTT.
+func (lb *LoadBalancer) dialProbeConn(ctx context.Context, rawurl string) (WSConn, time.Duration, error) {
+	start := time.Now()
+	dial := lb.probeDial
+	if dial == nil {
+		dial = func(ctx context.Context, rawurl string) (WSConn, error) {
+			return DialWSStream(ctx, rawurl, lb.fwmark)
+		}
+	}
+	c, err := dial(ctx, rawurl)
+	if err != nil {
+		return nil, 0, err
+	}
+	return c, time.Since(start), nil
+}
+
 func shouldUseH3Healthcheck(rawurl string) bool {
 	u, err := url.Parse(rawurl)
 	if err != nil {
@@ -550,6 +1206,50 @@ func shouldUseH3Healthcheck(rawurl string) bool {
 	return tryH3 || h3Only
 }
 
+// tcpProbeTarget returns the TCP quality probe target for up, preferring its
+// own override over the global probe.tcp_target.
+func (lb *LoadBalancer) tcpProbeTarget(up UpstreamConfig) string {
+	if up.ProbeTCPTarget != "" {
+		return up.ProbeTCPTarget
+	}
+	return lb.probe.TCPTarget
+}
+
+// udpProbeTarget is the UDP counterpart of tcpProbeTarget.
+func (lb *LoadBalancer) udpProbeTarget(up UpstreamConfig) string {
+	if up.ProbeUDPTarget != "" {
+		return up.ProbeUDPTarget
+	}
+	return lb.probe.UDPTarget
+}
+
+// Probe quality-failure modes (probe.quality_failure).
+const (
+	qualityFailureIgnore  = "ignore"
+	qualityFailureDegrade = "degrade"
+	qualityFailureFail    = "fail"
+)
+
+// qualityDegradedPenalty is added to the score (as milliseconds of RTT) of
+// an upstream whose quality probe fails under probe.quality_failure: degrade.
+const qualityDegradedPenalty = 1000
+
+// qualityFailed maps a failed quality probe, after a successful handshake,
+// to the check result: by default the handshake alone keeps the upstream UP,
+// since the probe target may be blocked or down while the tunnel works.
+func (lb *LoadBalancer) qualityFailed(name, proto string, perr error) (err error, degraded bool) {
+	switch lb.probe.QualityFailure {
+	case qualityFailureFail:
+		return fmt.Errorf("%s quality probe failed: %w", proto, perr), false
+	case qualityFailureDegrade:
+		log.Printf("[HC|%s] %s quality probe failed (degraded): %v", proto, name, perr)
+		return nil, true
+	default:
+		log.Printf("[HC|%s] %s quality probe failed (ignored): %v", proto, name, perr)
+		return nil, false
+	}
+}
+
 func (lb *LoadBalancer) checkOneTCP(parent context.Context, st *UpstreamState) {
 	if err := lb.acquireProbeSlot(parent); err != nil {
 		st.mu.Lock()
@@ -561,19 +1261,23 @@ func (lb *LoadBalancer) checkOneTCP(parent context.Context, st *UpstreamState) {
 
 	timeout := wsDialTimeoutForURL(lb.hc.Timeout, st.cfg.TCPWSS)
 	started := time.Now()
-	cctx, cancel := context.WithTimeout(parent, timeout)
+	cctx, cancel := context.WithTimeout(withUpstreamAuth(parent, st.cfg), timeout)
 	defer cancel()
 
 	var (
-		rtt time.Duration
-		err error
+		rtt      time.Duration
+		err      error
+		degraded bool
 	)
+	var wsc WSConn // set when the quality probe reuses the transport dial
 	transportStarted := time.Now()
 	rtt, err = lb.runProbeDialLimited(cctx, func() (time.Duration, error) {
-		if shouldUseH3Healthcheck(st.cfg.TCPWSS) {
-			return ProbeH3ExtendedConnect(cctx, st.cfg.TCPWSS)
+		if lb.probe.EnableTCP && lb.coalesceProbe(st.cfg.TCPWSS) {
+			c, d, err := lb.dialProbeConn(cctx, st.cfg.TCPWSS)
+			wsc = c
+			return d, err
 		}
-		return ProbeWSS(cctx, st.cfg.TCPWSS, lb.fwmark)
+		return lb.probeTransport(cctx, st.cfg.TCPWSS)
 	})
 	observeProbe(st.cfg.Name, "tcp", "transport", err, time.Since(transportStarted))
 	if err != nil {
@@ -582,16 +1286,23 @@ func (lb *LoadBalancer) checkOneTCP(parent context.Context, st *UpstreamState) {
 	if err == nil && lb.probe.EnableTCP {
 		qualityStarted := time.Now()
 		pctx, pcancel := context.WithTimeout(parent, lb.probe.Timeout)
-		prtt, perr := lb.runProbeDialLimited(pctx, func() (time.Duration, error) {
-			return ProbeTCPQuality(pctx, st.cfg, lb.probe.TCPTarget, lb.fwmark)
-		})
+		var (
+			prtt time.Duration
+			perr error
+		)
+		if wsc != nil {
+			// Count the handshake in, as a dialing quality probe would.
+			prtt, perr = probeTCPQualityOn(pctx, st.cfg, wsc, lb.tcpProbeTarget(st.cfg))
+			prtt += rtt
+		} else {
+			prtt, perr = lb.runProbeDialLimited(pctx, func() (time.Duration, error) {
+				return lb.probeTCPQuality(pctx, st.cfg, lb.tcpProbeTarget(st.cfg))
+			})
+		}
 		pcancel()
 		observeProbe(st.cfg.Name, "tcp", "quality", perr, time.Since(qualityStarted))
 		if perr != nil {
-			// Keep transport health green when websocket handshake itself is OK.
-			// Quality probes are best-effort and may fail due to target-specific
-			// routing/policy while the proxy remains usable for real traffic.
-			log.Printf("[HC|tcp] %s quality probe failed (ignored): %v", st.cfg.Name, perr)
+			err, degraded = lb.qualityFailed(st.cfg.Name, "tcp", perr)
 		} else {
 			rtt = prtt
 		}
@@ -602,6 +1313,7 @@ func (lb *LoadBalancer) checkOneTCP(parent context.Context, st *UpstreamState) {
 	defer func() { st.tcp.inFlight = false }()
 
 	lb.applyHCResult(&st.tcp, err, rtt, st.cfg.Name, "tcp")
+	st.tcp.degraded = degraded
 
 	// если TCP поднялся — можно снять TCP cooldown
 	if st.tcp.healthy {
@@ -620,19 +1332,23 @@ func (lb *LoadBalancer) checkOneUDP(parent context.Context, st *UpstreamState) {
 
 	timeout := wsDialTimeoutForURL(lb.hc.Timeout, st.cfg.UDPWSS)
 	started := time.Now()
-	cctx, cancel := context.WithTimeout(parent, timeout)
+	cctx, cancel := context.WithTimeout(withUpstreamAuth(parent, st.cfg), timeout)
 	defer cancel()
 
 	var (
-		rtt time.Duration
-		err error
+		rtt      time.Duration
+		err      error
+		degraded bool
 	)
+	var wsc WSConn // set when the quality probe reuses the transport dial
 	transportStarted := time.Now()
 	rtt, err = lb.runProbeDialLimited(cctx, func() (time.Duration, error) {
-		if shouldUseH3Healthcheck(st.cfg.UDPWSS) {
-			return ProbeH3ExtendedConnect(cctx, st.cfg.UDPWSS)
+		if lb.probe.EnableUDP && lb.coalesceProbe(st.cfg.UDPWSS) {
+			c, d, err := lb.dialProbeConn(cctx, st.cfg.UDPWSS)
+			wsc = c
+			return d, err
 		}
-		return ProbeWSS(cctx, st.cfg.UDPWSS, lb.fwmark)
+		return lb.probeTransport(cctx, st.cfg.UDPWSS)
 	})
 	observeProbe(st.cfg.Name, "udp", "transport", err, time.Since(transportStarted))
 	if err != nil {
@@ -641,13 +1357,23 @@ func (lb *LoadBalancer) checkOneUDP(parent context.Context, st *UpstreamState) {
 	if err == nil && lb.probe.EnableUDP {
 		qualityStarted := time.Now()
 		pctx, pcancel := context.WithTimeout(parent, lb.probe.Timeout)
-		prtt, perr := lb.runProbeDialLimited(pctx, func() (time.Duration, error) {
-			return ProbeUDPQuality(pctx, st.cfg, lb.probe.UDPTarget, lb.probe.DNSName, lb.probe.DNSType, lb.fwmark)
-		})
+		var (
+			prtt time.Duration
+			perr error
+		)
+		if wsc != nil {
+			// Count the handshake in, as a dialing quality probe would.
+			prtt, perr = probeUDPQualityOn(pctx, st.cfg, wsc, lb.udpProbeTarget(st.cfg), lb.dnsProbeName(), lb.probe.DNSType, !lb.probe.DNSAcceptAnyReply)
+			prtt += rtt
+		} else {
+			prtt, perr = lb.runProbeDialLimited(pctx, func() (time.Duration, error) {
+				return lb.probeUDPQuality(pctx, st.cfg, lb.udpProbeTarget(st.cfg))
+			})
+		}
 		pcancel()
 		observeProbe(st.cfg.Name, "udp", "quality", perr, time.Since(qualityStarted))
 		if perr != nil {
-			log.Printf("[HC|udp] %s quality probe failed (ignored): %v", st.cfg.Name, perr)
+			err, degraded = lb.qualityFailed(st.cfg.Name, "udp", perr)
 		} else {
 			rtt = prtt
 		}
@@ -658,6 +1384,7 @@ func (lb *LoadBalancer) checkOneUDP(parent context.Context, st *UpstreamState) {
 	defer func() { st.udp.inFlight = false }()
 
 	lb.applyHCResult(&st.udp, err, rtt, st.cfg.Name, "udp")
+	st.udp.degraded = degraded
 
 	// если UDP поднялся — можно снять UDP cooldown
 	if st.udp.healthy {
@@ -677,12 +1404,13 @@ func (lb *LoadBalancer) applyHCResult(h *hcState, err error, rtt time.Duration,
 		if h.failCount >= lb.hc.FailThreshold {
 			if h.healthy {
 				log.Printf("[HC|%s] %s DOWN: %v", proto, name, err)
+				publishEvent(Event{Type: EventUpstreamDown, Upstream: name, Proto: proto, Detail: err.Error()})
 			}
 			h.healthy = false
 			setHealthy(name, proto, false)
 		}
 
-		h.hcEvery = lb.nextIntervalOnFailure(*h)
+		h.hcEvery = lb.outageFloor(lb.nextIntervalOnFailure(*h))
 		h.nextHC = time.Now().Add(applyJitter(h.hcEvery, lb.hc.Jitter))
 		log.Printf("[HC|%s] %s probe failed: err=%v fail_count=%d/%d healthy=%t next_check_in=%s", proto, name, err, h.failCount, lb.hc.FailThreshold, h.healthy, time.Until(h.nextHC))
 		return
@@ -703,6 +1431,11 @@ func (lb *LoadBalancer) applyHCResult(h *hcState, err error, rtt time.Duration,
 	if h.successCount >= lb.hc.SuccessThreshold {
 		if !h.healthy {
 			log.Printf("[HC|%s] %s UP (rtt=%s)", proto, name, h.rttEWMA)
+			publishEvent(Event{Type: EventUpstreamUp, Upstream: name, Proto: proto, Detail: "rtt=" + h.rttEWMA.String()})
+			if h.everUp {
+				h.upSince = h.lastCheckTime
+			}
+			h.everUp = true
 		}
 		h.healthy = true
 		setHealthy(name, proto, true)
@@ -808,7 +1541,36 @@ func (lb *LoadBalancer) releaseDialSlot() {
 	}
 }
 
+// dialRetryBackoff is the pause before the second dial attempt; it doubles
+// for each further one and is jittered by half. A var for tests.
+var dialRetryBackoff = 250 * time.Millisecond
+
+// DialWSStreamLimited dials url under a dial slot, retrying failed dials up
+// to selection.dial_attempts times in all. The slot is given back during the
+// backoff so a retrying dial does not hold up others.
 func (lb *LoadBalancer) DialWSStreamLimited(ctx context.Context, url string) (WSConn, error) {
+	attempts := max(lb.sel.DialAttempts, 1)
+	backoff := dialRetryBackoff
+	for attempt := 1; ; attempt++ {
+		c, err := lb.dialWSStreamSlot(ctx, url)
+		// No retries while every upstream is down: the outage poll paces dials.
+		if err == nil || attempt >= attempts || ctx.Err() != nil || lb.outage.Load() || !isTransientDialError(err) {
+			return c, err
+		}
+		wait := applyJitter(backoff, backoff/2)
+		wsDebugf("dial attempt %d/%d failed url=%q err=%v; retrying in %s", attempt, attempts, url, err, wait)
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, err
+		case <-t.C:
+		}
+		backoff *= 2
+	}
+}
+
+func (lb *LoadBalancer) dialWSStreamSlot(ctx context.Context, url string) (WSConn, error) {
 	waitStarted := time.Now()
 	if err := lb.acquireDialSlot(ctx); err != nil {
 		wsDebugf("dial slot acquire failed url=%q waited=%s err=%v", url, time.Since(waitStarted), err)
@@ -819,5 +1581,8 @@ func (lb *LoadBalancer) DialWSStreamLimited(ctx context.Context, url string) (WS
 		wsDebugf("dial slot acquired url=%q waited=%s", url, waited)
 	}
 	defer lb.releaseDialSlot()
+	if lb.tunnelDial != nil {
+		return lb.tunnelDial(ctx, url)
+	}
 	return DialWSStream(ctx, url, lb.fwmark)
 }
@@ -0,0 +1,229 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestLoadBalancer_Stress hammers picks, failure reports and health checks
+// concurrently with probes that flip health and RTT at random. Run with -race.
+func TestLoadBalancer_Stress(t *testing.T) {
+	if testing.Short() {
+		t.Skip("stress test skipped in -short mode")
+	}
+	prevOut := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(prevOut)
+
+	ups := make([]UpstreamConfig, 0, 6)
+	for i := 0; i < 6; i++ {
+		ups = append(ups, UpstreamConfig{
+			Name:   fmt.Sprintf("s%d", i),
+			Weight: float64(1 + i%3),
+			Backup: i%3 == 0, // two backups among them
+			TCPWSS: fmt.Sprintf("wss://s%d.example/tcp", i),
+			UDPWSS: fmt.Sprintf("wss://s%d.example/udp", i),
+		})
+	}
+	hc := HealthcheckConfig{
+		Interval:         10 * time.Millisecond,
+		MinInterval:      5 * time.Millisecond,
+		MaxInterval:      40 * time.Millisecond,
+		Timeout:          time.Second,
+		FailThreshold:    1,
+		SuccessThreshold: 1,
+		BackoffFactor:    1.6,
+	}
+	sel := SelectionConfig{StickyTTL: 5 * time.Millisecond, Cooldown: 3 * time.Millisecond, MinSwitch: time.Millisecond}
+	lb := NewLoadBalancer(ups, hc, sel, ProbeConfig{}, 0)
+
+	var probes atomic.Int64
+	var rngMu sync.Mutex
+	rng := rand.New(rand.NewSource(1))
+	lb.transportProbe = func(ctx context.Context, rawurl string) (time.Duration, error) {
+		probes.Add(1)
+		rngMu.Lock()
+		fail := rng.Intn(3) == 0
+		rtt := time.Duration(1+rng.Intn(200)) * time.Millisecond
+		rngMu.Unlock()
+		if fail {
+			return 0, errors.New("mock probe failure")
+		}
+		return rtt, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	hcDone := make(chan struct{})
+	go func() {
+		defer close(hcDone)
+		lb.RunHealthChecks(ctx)
+	}()
+
+	var wg sync.WaitGroup
+	var picks atomic.Int64
+	errCh := make(chan error, 16)
+	deadline := time.Now().Add(time.Second)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(w)))
+			for time.Now().Before(deadline) {
+				var (
+					up  *UpstreamState
+					err error
+				)
+				isTCP := r.Intn(2) == 0
+				if isTCP {
+					up, err = lb.PickTCP()
+				} else {
+					up, err = lb.PickUDP()
+				}
+				picks.Add(1)
+				if err != nil {
+					if !errors.Is(err, ErrNoHealthyUpstreams) {
+						errCh <- fmt.Errorf("unexpected pick error: %w", err)
+						return
+					}
+					continue
+				}
+				if up == nil {
+					errCh <- errors.New("pick returned nil upstream without error")
+					return
+				}
+				switch r.Intn(10) {
+				case 0:
+					lb.ReportTCPFailure(up, errors.New("stress tcp failure"))
+				case 1:
+					lb.ReportUDPFailure(up, errors.New("stress udp failure"))
+				case 2:
+					lb.runDueChecks(ctx)
+				}
+			}
+		}(w)
+	}
+
+	waitDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(waitDone)
+	}()
+	select {
+	case <-waitDone:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("stress workers deadlocked")
+	}
+	cancel()
+	select {
+	case <-hcDone:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("RunHealthChecks did not stop")
+	}
+	close(errCh)
+	for err := range errCh {
+		t.Fatal(err)
+	}
+	if picks.Load() == 0 || probes.Load() == 0 {
+		t.Fatalf("stress did no work: picks=%d probes=%d", picks.Load(), probes.Load())
+	}
+	waitProbesIdle(t, lb)
+
+	// With the background churn stopped, every pick must honour health,
+	// cooldown and the backup tier exactly, across many random state
+	// assignments.
+	r := rand.New(rand.NewSource(42))
+	backupPicks := 0
+	for round := 0; round < 500; round++ {
+		now := time.Now()
+		for _, st := range lb.pool {
+			st.mu.Lock()
+			st.tcp.healthy = r.Intn(2) == 0
+			st.udp.healthy = r.Intn(2) == 0
+			st.tcp.rttEWMA = time.Duration(1+r.Intn(100)) * time.Millisecond
+			st.udp.rttEWMA = time.Duration(1+r.Intn(100)) * time.Millisecond
+			st.tcpCooldownUntil, st.udpCooldownUntil = time.Time{}, time.Time{}
+			if r.Intn(4) == 0 {
+				st.tcpCooldownUntil = now.Add(time.Minute)
+			}
+			if r.Intn(4) == 0 {
+				st.udpCooldownUntil = now.Add(time.Minute)
+			}
+			st.mu.Unlock()
+		}
+		for _, isTCP := range []bool{true, false} {
+			var (
+				up  *UpstreamState
+				err error
+			)
+			if isTCP {
+				up, err = lb.PickTCP()
+			} else {
+				up, err = lb.PickUDP()
+			}
+			usable, primaries := 0, 0
+			for _, st := range lb.pool {
+				if upstreamUsable(st, isTCP) {
+					usable++
+					if !st.cfg.Backup {
+						primaries++
+					}
+				}
+			}
+			if err != nil {
+				if usable > 0 {
+					t.Fatalf("round %d tcp=%v: pick failed with %d usable upstreams: %v", round, isTCP, usable, err)
+				}
+				continue
+			}
+			if !upstreamUsable(up, isTCP) {
+				t.Fatalf("round %d tcp=%v: picked unusable upstream %q", round, isTCP, up.cfg.Name)
+			}
+			if up.cfg.Backup && primaries > 0 {
+				t.Fatalf("round %d tcp=%v: picked backup %q with %d usable primaries", round, isTCP, up.cfg.Name, primaries)
+			}
+			if up.cfg.Backup {
+				backupPicks++
+			}
+		}
+	}
+	if backupPicks == 0 {
+		t.Fatal("the backup tier was never picked, not even with every primary down")
+	}
+}
+
+func upstreamUsable(st *UpstreamState, isTCP bool) bool {
+	now := time.Now()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if isTCP {
+		return st.tcp.healthy && now.After(st.tcpCooldownUntil)
+	}
+	return st.udp.healthy && now.After(st.udpCooldownUntil)
+}
+
+// waitProbesIdle waits for in-flight health checks to finish writing state.
+func waitProbesIdle(t *testing.T, lb *LoadBalancer) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		busy := false
+		for _, st := range lb.pool {
+			st.mu.Lock()
+			busy = busy || st.tcp.inFlight || st.udp.inFlight
+			st.mu.Unlock()
+		}
+		if !busy {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("health checks still in flight")
+}
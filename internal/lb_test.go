@@ -1,6 +1,17 @@
 package internal
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -97,6 +108,44 @@ func TestPickUDP_NoSticky(t *testing.T) {
 	}
 }
 
+func TestPickUDP_StickyWhenEnabled(t *testing.T) {
+	sel := SelectionConfig{StickyTTL: time.Minute, UDPSticky: true}
+	lb := NewLoadBalancer([]UpstreamConfig{{UDPWSS: "a"}, {UDPWSS: "b"}}, HealthcheckConfig{}, sel, ProbeConfig{}, 0)
+	u0 := lb.pool[0]
+	u1 := lb.pool[1]
+	markHealthy(u0, false, 10*time.Millisecond)
+	markHealthy(u1, false, 30*time.Millisecond)
+
+	got, err := lb.PickUDP()
+	if err != nil || got != u0 {
+		t.Fatalf("first PickUDP = %v, %v; want u0", got, err)
+	}
+
+	// u1 becomes the faster one; within the TTL UDP stays on u0.
+	markHealthy(u1, false, 2*time.Millisecond)
+	for range 3 {
+		if got, _ := lb.PickUDP(); got != u0 {
+			t.Fatalf("PickUDP within sticky_ttl = %v, want u0", got.cfg.UDPWSS)
+		}
+	}
+	if lb.current != nil {
+		t.Fatal("UDP stickiness must not set the TCP choice")
+	}
+
+	lb.mu.Lock()
+	lb.udpStickyUntil = time.Now().Add(-time.Second)
+	lb.mu.Unlock()
+	if got, _ := lb.PickUDP(); got != u1 {
+		t.Fatalf("PickUDP after sticky_ttl = %v, want u1", got.cfg.UDPWSS)
+	}
+
+	// A failing sticky upstream is left right away.
+	lb.ReportUDPFailure(u1, errors.New("boom"))
+	if got, _ := lb.PickUDP(); got != u0 {
+		t.Fatalf("PickUDP after failure = %v, want u0", got.cfg.UDPWSS)
+	}
+}
+
 func TestShouldUseH3Healthcheck(t *testing.T) {
 	cases := []struct {
 		raw  string
@@ -114,3 +163,834 @@ func TestShouldUseH3Healthcheck(t *testing.T) {
 		}
 	}
 }
+
+func TestPickTCP_NoHealthyUpstreamsIsTyped(t *testing.T) {
+	lb := NewLoadBalancer([]UpstreamConfig{{TCPWSS: "a"}}, HealthcheckConfig{}, SelectionConfig{}, ProbeConfig{}, 0)
+	if _, err := lb.PickTCP(); !errors.Is(err, ErrNoHealthyUpstreams) {
+		t.Fatalf("expected ErrNoHealthyUpstreams, got %v", err)
+	}
+}
+
+func TestProbeTargets_PerUpstreamOverride(t *testing.T) {
+	probe := ProbeConfig{TCPTarget: "example.com:80", UDPTarget: "1.1.1.1:53"}
+	lb := NewLoadBalancer([]UpstreamConfig{
+		{Name: "eu", ProbeTCPTarget: "example.eu:80", ProbeUDPTarget: "9.9.9.9:53"},
+		{Name: "default"},
+	}, HealthcheckConfig{}, SelectionConfig{}, probe, 0)
+
+	eu, def := lb.pool[0].cfg, lb.pool[1].cfg
+	if got := lb.tcpProbeTarget(eu); got != "example.eu:80" {
+		t.Fatalf("tcp override not used: %q", got)
+	}
+	if got := lb.udpProbeTarget(eu); got != "9.9.9.9:53" {
+		t.Fatalf("udp override not used: %q", got)
+	}
+	if got := lb.tcpProbeTarget(def); got != probe.TCPTarget {
+		t.Fatalf("tcp fallback: got %q want %q", got, probe.TCPTarget)
+	}
+	if got := lb.udpProbeTarget(def); got != probe.UDPTarget {
+		t.Fatalf("udp fallback: got %q want %q", got, probe.UDPTarget)
+	}
+}
+
+func TestNewLoadBalancer_ZeroWeightIsPrimaryWithDefaultWeight(t *testing.T) {
+	lb := NewLoadBalancer([]UpstreamConfig{
+		{Name: "a", TCPWSS: "a"},
+		{Name: "b", Weight: 1, TCPWSS: "b"},
+	}, HealthcheckConfig{}, SelectionConfig{}, ProbeConfig{}, 0)
+	a, b := lb.pool[0], lb.pool[1]
+	if a.cfg.isBackup() || a.cfg.Weight != 1 {
+		t.Fatalf("UpstreamConfig without weight: backup=%v weight=%v, want a weight-1 primary", a.cfg.isBackup(), a.cfg.Weight)
+	}
+
+	// a must compete with b, not wait behind it as a backup.
+	markHealthy(a, true, 10*time.Millisecond)
+	markHealthy(b, true, 100*time.Millisecond)
+	if got, err := lb.PickTCP(); err != nil || got != a {
+		t.Fatalf("expected a, got %v err=%v", got, err)
+	}
+}
+
+func TestPick_BackupOnlyWhenPrimariesDown(t *testing.T) {
+	lb := NewLoadBalancer([]UpstreamConfig{
+		{Name: "primary", Weight: 1, TCPWSS: "a", UDPWSS: "a"},
+		{Name: "backup", Backup: true, TCPWSS: "b", UDPWSS: "b"},
+	}, HealthcheckConfig{}, SelectionConfig{StickyTTL: time.Minute}, ProbeConfig{}, 0)
+	primary, backup := lb.pool[0], lb.pool[1]
+
+	// Backup is faster, but primaries win while healthy.
+	markHealthy(primary, true, 200*time.Millisecond)
+	markHealthy(backup, true, 5*time.Millisecond)
+	markHealthy(primary, false, 200*time.Millisecond)
+	markHealthy(backup, false, 5*time.Millisecond)
+	if got, err := lb.PickTCP(); err != nil || got != primary {
+		t.Fatalf("tcp: expected primary, got %v err=%v", got, err)
+	}
+	if got, err := lb.PickUDP(); err != nil || got != primary {
+		t.Fatalf("udp: expected primary, got %v err=%v", got, err)
+	}
+
+	// Primary down: backup takes over.
+	lb.ReportTCPFailure(primary, errors.New("down"))
+	lb.ReportUDPFailure(primary, errors.New("down"))
+	if got, err := lb.PickTCP(); err != nil || got != backup {
+		t.Fatalf("tcp: expected backup, got %v err=%v", got, err)
+	}
+	if got, err := lb.PickUDP(); err != nil || got != backup {
+		t.Fatalf("udp: expected backup, got %v err=%v", got, err)
+	}
+
+	// Primary recovers: leave the backup despite stickiness.
+	markHealthy(primary, true, 200*time.Millisecond)
+	if got, err := lb.PickTCP(); err != nil || got != primary {
+		t.Fatalf("tcp: expected primary after recovery, got %v err=%v", got, err)
+	}
+}
+
+func TestPick_MaxEligibleRTTSkipsSlowUpstreamWhileFasterExists(t *testing.T) {
+	lb := NewLoadBalancer([]UpstreamConfig{
+		{Name: "slow", Weight: 10, TCPWSS: "a", UDPWSS: "a"},
+		{Name: "fast", Weight: 1, TCPWSS: "b", UDPWSS: "b"},
+	}, HealthcheckConfig{}, SelectionConfig{StickyTTL: time.Minute, MaxEligibleRTT: time.Second}, ProbeConfig{}, 0)
+	slow, fast := lb.pool[0], lb.pool[1]
+
+	// Weight alone would favor slow (2000/10 < 300/1); the cap keeps it out.
+	markHealthy(slow, true, 2*time.Second)
+	markHealthy(fast, true, 300*time.Millisecond)
+	markHealthy(slow, false, 2*time.Second)
+	markHealthy(fast, false, 300*time.Millisecond)
+	if got, err := lb.PickTCP(); err != nil || got != fast {
+		t.Fatalf("tcp: expected fast, got %v err=%v", got, err)
+	}
+	if got, err := lb.PickUDP(); err != nil || got != fast {
+		t.Fatalf("udp: expected fast, got %v err=%v", got, err)
+	}
+
+	// Only the slow one left: better slow than nothing.
+	lb.ReportTCPFailure(fast, errors.New("down"))
+	lb.ReportUDPFailure(fast, errors.New("down"))
+	if got, err := lb.PickTCP(); err != nil || got != slow {
+		t.Fatalf("tcp: expected slow fallback, got %v err=%v", got, err)
+	}
+	if got, err := lb.PickUDP(); err != nil || got != slow {
+		t.Fatalf("udp: expected slow fallback, got %v err=%v", got, err)
+	}
+
+	// Fast recovers: stickiness does not hold on to the over-cap upstream.
+	markHealthy(fast, true, 300*time.Millisecond)
+	if got, err := lb.PickTCP(); err != nil || got != fast {
+		t.Fatalf("tcp: expected fast after recovery, got %v err=%v", got, err)
+	}
+}
+
+func TestPick_MaxEligibleRTTPrefersSlowPrimaryOverBackup(t *testing.T) {
+	lb := NewLoadBalancer([]UpstreamConfig{
+		{Name: "primary", Weight: 1, TCPWSS: "a"},
+		{Name: "backup", Backup: true, TCPWSS: "b"},
+	}, HealthcheckConfig{}, SelectionConfig{StickyTTL: time.Minute, MaxEligibleRTT: time.Second}, ProbeConfig{}, 0)
+	primary, backup := lb.pool[0], lb.pool[1]
+
+	// The cap ranks within a tier; it never promotes a backup over a primary.
+	markHealthy(primary, true, 2*time.Second)
+	markHealthy(backup, true, 100*time.Millisecond)
+	if got, err := lb.PickTCP(); err != nil || got != primary {
+		t.Fatalf("expected slow primary, got %v err=%v", got, err)
+	}
+
+	lb.ReportTCPFailure(primary, errors.New("down"))
+	if got, err := lb.PickTCP(); err != nil || got != backup {
+		t.Fatalf("expected backup once no primary is usable, got %v err=%v", got, err)
+	}
+}
+
+func TestPick_SlowStartRampsRecoveredUpstream(t *testing.T) {
+	const window = 10 * time.Second
+	lb := NewLoadBalancer([]UpstreamConfig{
+		{Name: "steady", Weight: 1, TCPWSS: "a"},
+		{Name: "recovered", Weight: 1, TCPWSS: "b"},
+	}, HealthcheckConfig{Interval: time.Hour, FailThreshold: 1, SuccessThreshold: 1}, SelectionConfig{SlowStart: window}, ProbeConfig{}, 0)
+	steady, recovered := lb.pool[0], lb.pool[1]
+
+	lb.applyHCResult(&steady.tcp, nil, 100*time.Millisecond, "steady", "tcp")
+	lb.applyHCResult(&recovered.tcp, nil, 50*time.Millisecond, "recovered", "tcp")
+	if !steady.tcp.upSince.IsZero() || !recovered.tcp.upSince.IsZero() {
+		t.Fatal("the first UP must not start slow start")
+	}
+	lb.applyHCResult(&recovered.tcp, errors.New("down"), 0, "recovered", "tcp")
+	lb.applyHCResult(&recovered.tcp, nil, 50*time.Millisecond, "recovered", "tcp")
+	upSince := recovered.tcp.upSince
+	if upSince.IsZero() {
+		t.Fatal("DOWN→UP did not record upSince")
+	}
+
+	// Twice as fast, so it wins whenever it competes: its share of the
+	// picks follows the ramp instead of jumping over at one point.
+	const picks = 2000
+	prevFactor := 0.0
+	for _, i := range []int{0, 5, 10} {
+		now := upSince.Add(window * time.Duration(i) / 10)
+		f := slowStartFactor(upSince, now, window)
+		if f <= prevFactor {
+			t.Fatalf("factor at %d/10 = %v, not above %v", i, f, prevFactor)
+		}
+		prevFactor = f
+		won := 0
+		for n := 0; n < picks; n++ {
+			if best, _ := lb.pickBestInTier(lb.pool, now, true, false, false); best == recovered {
+				won++
+			}
+		}
+		if share := float64(won) / picks; share < f-0.05 || share > f+0.05 {
+			t.Fatalf("at %d/10 of the window the recovered upstream got %.2f of the picks, want about %.2f", i, share, f)
+		}
+	}
+	if f := slowStartFactor(upSince, upSince.Add(2*window), window); f != 1 {
+		t.Fatalf("factor after the window = %v, want 1", f)
+	}
+
+	// Ramping or not, it is picked when nothing else is usable.
+	lb.applyHCResult(&steady.tcp, errors.New("down"), 0, "steady", "tcp")
+	for n := 0; n < 20; n++ {
+		if best, _ := lb.pickBestInTier(lb.pool, upSince, true, false, false); best != recovered {
+			t.Fatalf("pick with only the ramping upstream up = %v", best)
+		}
+	}
+}
+
+func TestPick_ProbeOnlyUpstreamIsCheckedButNeverPicked(t *testing.T) {
+	metricsMu.Lock()
+	metrics = telemetry{}
+	metricsMu.Unlock()
+	EnablePrometheusMetrics()
+
+	lb := NewLoadBalancer([]UpstreamConfig{
+		{Name: "monitor", Weight: 1, ProbeOnly: true},
+		{Name: "serving", Weight: 1},
+	}, HealthcheckConfig{Interval: time.Hour, FailThreshold: 1, SuccessThreshold: 1}, SelectionConfig{}, ProbeConfig{}, 0)
+	monitor, serving := lb.pool[0], lb.pool[1]
+	// monitor is healthier by every measure the scorer looks at.
+	lb.applyHCResult(&monitor.tcp, nil, time.Millisecond, "monitor", "tcp")
+	lb.applyHCResult(&monitor.udp, nil, time.Millisecond, "monitor", "udp")
+	markHealthy(serving, true, 300*time.Millisecond)
+	markHealthy(serving, false, 300*time.Millisecond)
+
+	metrics.mu.RLock()
+	healthy := metrics.healthy["upstream=monitor,proto=tcp"]
+	metrics.mu.RUnlock()
+	if healthy != 1 {
+		t.Fatalf("probe-only upstream health metric = %v, want 1", healthy)
+	}
+	if st := lb.Snapshot()[0]; !st.ProbeOnly || !st.TCP.Healthy {
+		t.Fatalf("status = %+v, want probe_only and healthy", st)
+	}
+
+	if got, err := lb.PickTCP(); err != nil || got != serving {
+		t.Fatalf("tcp: got %v err=%v, want serving", got, err)
+	}
+	if got, err := lb.PickUDP(); err != nil || got != serving {
+		t.Fatalf("udp: got %v err=%v, want serving", got, err)
+	}
+	if got := lb.pickTopN(time.Now(), 2); len(got) != 1 || got[0] != serving {
+		t.Fatalf("pickTopN (standbys, races) = %v, want only serving", got)
+	}
+	if n := lb.HealthyCount(); n != 1 {
+		t.Fatalf("HealthyCount = %d, want 1 (probe-only excluded)", n)
+	}
+
+	// With nothing else left, a probe-only upstream still does not serve.
+	lb.ReportTCPFailure(serving, errors.New("down"))
+	if got, err := lb.PickTCP(); err == nil {
+		t.Fatalf("picked %q with only a probe-only upstream usable", got.cfg.Name)
+	}
+}
+
+func TestPickTopN_SkipsBackupsWhilePrimaryUsable(t *testing.T) {
+	lb := NewLoadBalancer([]UpstreamConfig{
+		{Name: "primary", Weight: 1},
+		{Name: "backup", Backup: true},
+	}, HealthcheckConfig{}, SelectionConfig{}, ProbeConfig{}, 0)
+	markHealthy(lb.pool[0], true, 50*time.Millisecond)
+	markHealthy(lb.pool[1], true, 10*time.Millisecond)
+
+	if got := lb.pickTopN(time.Now(), 2); len(got) != 1 || got[0] != lb.pool[0] {
+		t.Fatalf("expected only primary in standby set, got %d entries", len(got))
+	}
+	lb.ReportTCPFailure(lb.pool[0], errors.New("down"))
+	if got := lb.pickTopN(time.Now(), 2); len(got) != 1 || got[0] != lb.pool[1] {
+		t.Fatalf("expected backup in standby set once primary is down")
+	}
+}
+
+func TestHealthCheck_InjectedProbesDriveDownToUp(t *testing.T) {
+	hc := HealthcheckConfig{Interval: time.Second, MinInterval: 100 * time.Millisecond, MaxInterval: 5 * time.Second, Timeout: time.Second, FailThreshold: 2, SuccessThreshold: 1, BackoffFactor: 2}
+	lb := NewLoadBalancer([]UpstreamConfig{{Name: "a", TCPWSS: "wss://a.example/tcp"}}, hc, SelectionConfig{}, ProbeConfig{EnableTCP: true, TCPTarget: "example.com:80", Timeout: time.Second}, 0)
+	up := lb.pool[0]
+
+	var transportErr error
+	var gotTarget string
+	lb.transportProbe = func(ctx context.Context, rawurl string) (time.Duration, error) {
+		return 40 * time.Millisecond, transportErr
+	}
+	lb.tcpQualityProbe = func(ctx context.Context, u UpstreamConfig, target string) (time.Duration, error) {
+		gotTarget = target
+		return 25 * time.Millisecond, nil
+	}
+
+	transportErr = errors.New("handshake refused")
+	for i := 0; i < 2; i++ {
+		lb.checkOneTCP(context.Background(), up)
+	}
+	up.mu.Lock()
+	healthy, fails, every := up.tcp.healthy, up.tcp.failCount, up.tcp.hcEvery
+	up.mu.Unlock()
+	if healthy || fails != 2 {
+		t.Fatalf("expected DOWN after 2 failures, healthy=%v fails=%d", healthy, fails)
+	}
+	if every < hc.MinInterval || every > hc.MaxInterval {
+		t.Fatalf("backoff interval %s outside [%s, %s]", every, hc.MinInterval, hc.MaxInterval)
+	}
+	if _, err := lb.PickTCP(); !errors.Is(err, ErrNoHealthyUpstreams) {
+		t.Fatalf("expected no healthy upstreams while DOWN, got %v", err)
+	}
+
+	transportErr = nil
+	lb.checkOneTCP(context.Background(), up)
+	up.mu.Lock()
+	healthy, rtt := up.tcp.healthy, up.tcp.lastRTT
+	up.mu.Unlock()
+	if !healthy {
+		t.Fatalf("expected UP after a successful probe")
+	}
+	if rtt != 25*time.Millisecond {
+		t.Fatalf("expected quality probe RTT to win, got %s", rtt)
+	}
+	if gotTarget != "example.com:80" {
+		t.Fatalf("quality probe target=%q", gotTarget)
+	}
+	if got, err := lb.PickTCP(); err != nil || got != up {
+		t.Fatalf("expected upstream to be picked after recovery, got %v err=%v", got, err)
+	}
+}
+
+func TestPick_DrainingUpstreamNotNewlyPicked(t *testing.T) {
+	lb := NewLoadBalancer([]UpstreamConfig{
+		{Name: "old", Weight: 1, TCPWSS: "wss://old/tcp", UDPWSS: "wss://old/udp"},
+		{Name: "new", Weight: 1, TCPWSS: "wss://new/tcp", UDPWSS: "wss://new/udp"},
+	}, HealthcheckConfig{Interval: time.Second}, SelectionConfig{StickyTTL: time.Minute}, ProbeConfig{}, 0)
+	old, fresh := lb.pool[0], lb.pool[1]
+	for _, isTCP := range []bool{true, false} {
+		markHealthy(old, isTCP, 10*time.Millisecond)
+		markHealthy(fresh, isTCP, 80*time.Millisecond)
+	}
+
+	// "old" is faster and becomes the sticky choice with a live tunnel.
+	up, err := lb.PickTCP()
+	if err != nil || up != old {
+		t.Fatalf("expected old to be picked first, got %v err=%v", up, err)
+	}
+	done := lb.trackConn(up, "tcp")
+
+	if !lb.SetDraining("old", true) {
+		t.Fatalf("SetDraining: upstream not found")
+	}
+	if lb.SetDraining("missing", true) {
+		t.Fatalf("SetDraining should report unknown upstreams")
+	}
+	for i := 0; i < 10; i++ {
+		if up, _ := lb.PickTCP(); up != fresh {
+			t.Fatalf("draining upstream picked for tcp: %v", up.cfg.Name)
+		}
+		if up, _ := lb.PickUDP(); up != fresh {
+			t.Fatalf("draining upstream picked for udp: %v", up.cfg.Name)
+		}
+	}
+	for _, s := range lb.pickTopN(time.Now(), 2) {
+		if s == old {
+			t.Fatalf("draining upstream selected for warm standby")
+		}
+	}
+
+	old.mu.Lock()
+	healthy := old.tcp.healthy && old.udp.healthy
+	old.mu.Unlock()
+	if !healthy {
+		t.Fatalf("draining must not mark the upstream unhealthy")
+	}
+	if n := old.activeTCP.Load(); n != 1 {
+		t.Fatalf("live tunnel should survive drain, active=%d", n)
+	}
+	done()
+	done()
+	if n := old.activeTCP.Load(); n != 0 {
+		t.Fatalf("active=%d after release, want 0", n)
+	}
+
+	lb.SetDraining("old", false)
+	if up, _ := lb.PickUDP(); up != old {
+		t.Fatalf("expected old to be pickable again after undrain")
+	}
+}
+
+func TestDNSProbeName_RotatesAndPrefixes(t *testing.T) {
+	lb := NewLoadBalancer(nil, HealthcheckConfig{}, SelectionConfig{}, ProbeConfig{DNSName: "fallback.example", DNSNames: []string{"a.example", "b.example"}}, 0)
+	got := []string{lb.dnsProbeName(), lb.dnsProbeName(), lb.dnsProbeName()}
+	if got[0] != "a.example" || got[1] != "b.example" || got[2] != "a.example" {
+		t.Fatalf("rotation = %v", got)
+	}
+
+	lb = NewLoadBalancer(nil, HealthcheckConfig{}, SelectionConfig{}, ProbeConfig{DNSName: "wild.example", DNSRandomPrefix: true}, 0)
+	first, second := lb.dnsProbeName(), lb.dnsProbeName()
+	if !strings.HasSuffix(first, ".wild.example") || first == "wild.example" {
+		t.Fatalf("expected random label under wild.example, got %q", first)
+	}
+	if first == second {
+		t.Fatalf("expected a fresh random label per probe, got %q twice", first)
+	}
+}
+
+func TestSnapshot_CarriesRedactedLastError(t *testing.T) {
+	hc := HealthcheckConfig{Interval: time.Second, MinInterval: 100 * time.Millisecond, MaxInterval: 5 * time.Second, Timeout: time.Second, FailThreshold: 1, SuccessThreshold: 1, BackoffFactor: 2}
+	up := UpstreamConfig{Name: "a", TCPWSS: "wss://edge.example/Zk3yPath/tcp", Secret: "hunter2"}
+	lb := NewLoadBalancer([]UpstreamConfig{up}, hc, SelectionConfig{}, ProbeConfig{}, 0)
+	lb.transportProbe = func(ctx context.Context, rawurl string) (time.Duration, error) {
+		return 0, errors.New(`dial "wss://edge.example/Zk3yPath/tcp?h2=only": handshake refused for /Zk3yPath/tcp (key hunter2)`)
+	}
+
+	lb.checkOneTCP(context.Background(), lb.pool[0])
+	st := lb.Snapshot()[0].TCP
+	if st.LastCheck == nil {
+		t.Fatalf("expected last_check after a probe")
+	}
+	if !strings.Contains(st.LastError, "handshake refused") || !strings.Contains(st.LastError, "wss://edge.example/") {
+		t.Fatalf("last_error lost the failure reason: %q", st.LastError)
+	}
+	for _, secret := range []string{"Zk3yPath", "hunter2"} {
+		if strings.Contains(st.LastError, secret) {
+			t.Fatalf("last_error leaks %q: %q", secret, st.LastError)
+		}
+	}
+}
+
+func TestPickTCP_LeastConnPicksLowestOccupancyPerWeight(t *testing.T) {
+	ups := []UpstreamConfig{
+		{Name: "a", Weight: 1},
+		{Name: "b", Weight: 1},
+		{Name: "c", Weight: 2},
+	}
+	lb := NewLoadBalancer(ups, HealthcheckConfig{Interval: time.Hour}, SelectionConfig{Strategy: selectionLeastConn, StickyTTL: time.Hour}, ProbeConfig{}, 0)
+	a, b, c := lb.pool[0], lb.pool[1], lb.pool[2]
+	markHealthy(a, true, 10*time.Millisecond)
+	markHealthy(b, true, 200*time.Millisecond) // slowest, but emptiest
+	markHealthy(c, true, 50*time.Millisecond)
+	markHealthy(b, false, 200*time.Millisecond)
+	markHealthy(c, false, 50*time.Millisecond)
+
+	a.activeTCP.Store(3)
+	b.activeTCP.Store(1)
+	c.activeTCP.Store(4) // 2 per unit of weight
+	if got, err := lb.PickTCP(); err != nil || got != b {
+		t.Fatalf("expected least-loaded b, got %v err=%v", got, err)
+	}
+
+	// No stickiness: occupancy changes move the next pick.
+	b.activeTCP.Store(5)
+	if got, err := lb.PickTCP(); err != nil || got != c {
+		t.Fatalf("expected c (4/2 conns per weight), got %v err=%v", got, err)
+	}
+
+	// UDP uses its own counters; ties fall back to the RTT score.
+	b.activeUDP.Store(1)
+	c.activeUDP.Store(2)
+	if got, err := lb.PickUDP(); err != nil || got != c {
+		t.Fatalf("expected c on a per-weight tie with lower RTT, got %v err=%v", got, err)
+	}
+}
+
+func TestRunDueChecks_SpreadsChecksOverdueAfterStall(t *testing.T) {
+	var ups []UpstreamConfig
+	for _, n := range []string{"a", "b", "c", "d"} {
+		ups = append(ups, UpstreamConfig{Name: n, Weight: 1, TCPWSS: "wss://" + n + "/tcp", UDPWSS: "wss://" + n + "/udp"})
+	}
+	lb := NewLoadBalancer(ups, HealthcheckConfig{Interval: time.Second, MinInterval: time.Second, Timeout: time.Second}, SelectionConfig{}, ProbeConfig{}, 0)
+	release := make(chan struct{})
+	lb.transportProbe = func(ctx context.Context, rawurl string) (time.Duration, error) {
+		<-release // keep the launched checks in flight while we inspect
+		return time.Millisecond, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer close(release)
+
+	// Simulate a stall: every check came due an hour ago.
+	jumped := time.Now().Add(-time.Hour)
+	for _, st := range lb.pool {
+		st.mu.Lock()
+		st.tcp.nextHC, st.udp.nextHC = jumped, jumped
+		st.mu.Unlock()
+	}
+
+	before := time.Now()
+	lb.runDueChecks(ctx)
+
+	launched := 0
+	seen := map[time.Time]bool{}
+	for _, st := range lb.pool {
+		st.mu.Lock()
+		for _, h := range []*hcState{&st.tcp, &st.udp} {
+			switch {
+			case h.inFlight:
+				launched++
+			case !h.nextHC.After(before) || h.nextHC.After(before.Add(hcResumeSpread+time.Second)):
+				t.Errorf("%s: deferred check at %s, want within %s of now", st.cfg.Name, h.nextHC.Sub(before), hcResumeSpread)
+			case seen[h.nextHC]:
+				t.Errorf("%s: deferred checks share a slot at %s", st.cfg.Name, h.nextHC.Sub(before))
+			default:
+				seen[h.nextHC] = true
+			}
+		}
+		st.mu.Unlock()
+	}
+	if launched != 1 || len(seen) != 2*len(ups)-1 {
+		t.Fatalf("launched=%d deferred=%d, want 1 and %d", launched, len(seen), 2*len(ups)-1)
+	}
+}
+
+func TestRunDueChecks_DisableUDPLaunchesNoUDPChecks(t *testing.T) {
+	lb := NewLoadBalancer([]UpstreamConfig{
+		{Name: "a", Weight: 1, TCPWSS: "wss://a/tcp", UDPWSS: "wss://a/udp"},
+		{Name: "b", Weight: 1, TCPWSS: "wss://b/tcp", UDPWSS: "wss://b/udp"},
+	}, HealthcheckConfig{Interval: time.Second, MinInterval: time.Second, Timeout: time.Second}, SelectionConfig{}, ProbeConfig{}, 0)
+	lb.SetUDPDisabled(true)
+	probed := make(chan string, 8)
+	release := make(chan struct{})
+	lb.transportProbe = func(ctx context.Context, rawurl string) (time.Duration, error) {
+		probed <- rawurl
+		<-release
+		return time.Millisecond, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer close(release)
+
+	lb.runDueChecks(ctx)
+	for _, st := range lb.pool {
+		st.mu.Lock()
+		tcp, udp := st.tcp.inFlight, st.udp.inFlight
+		st.mu.Unlock()
+		if !tcp || udp {
+			t.Fatalf("%s: tcp in flight=%t udp in flight=%t, want only tcp", st.cfg.Name, tcp, udp)
+		}
+	}
+	for i := 0; i < len(lb.pool); i++ {
+		if u := <-probed; strings.HasSuffix(u, "/udp") {
+			t.Fatalf("UDP probe launched with UDP disabled: %s", u)
+		}
+	}
+}
+
+func TestReportTCPFailure_CooldownScalesWithConsecutiveFailures(t *testing.T) {
+	const base = 10 * time.Second
+	lb := NewLoadBalancer([]UpstreamConfig{{Name: "a", Weight: 1, TCPWSS: "wss://a/tcp"}},
+		HealthcheckConfig{MinInterval: time.Second, SuccessThreshold: 1}, SelectionConfig{Cooldown: base, CooldownMaxFactor: 3}, ProbeConfig{}, 0)
+	up := lb.pool[0]
+	cooldown := func() time.Duration {
+		up.mu.Lock()
+		defer up.mu.Unlock()
+		return time.Until(up.tcpCooldownUntil).Round(time.Second)
+	}
+
+	for i, want := range []time.Duration{base, 2 * base, 3 * base, 3 * base} {
+		lb.ReportTCPFailure(up, errors.New("boom"))
+		if got := cooldown(); got != want {
+			t.Fatalf("failure %d: cooldown=%s want %s", i+1, got, want)
+		}
+	}
+
+	// A successful check resets the streak.
+	up.mu.Lock()
+	lb.applyHCResult(&up.tcp, nil, time.Millisecond, "a", "tcp")
+	up.mu.Unlock()
+	lb.ReportTCPFailure(up, errors.New("boom"))
+	if got := cooldown(); got != base {
+		t.Fatalf("after recovery: cooldown=%s want %s", got, base)
+	}
+
+	// Factor 0 keeps the flat cooldown.
+	lb.sel.CooldownMaxFactor = 0
+	for i := 0; i < 3; i++ {
+		lb.ReportTCPFailure(up, errors.New("boom"))
+	}
+	if got := cooldown(); got != base {
+		t.Fatalf("flat mode: cooldown=%s want %s", got, base)
+	}
+}
+
+func TestHealthCheck_QualityProbeReusesTransportDial(t *testing.T) {
+	hc := HealthcheckConfig{Interval: time.Second, MinInterval: 100 * time.Millisecond, MaxInterval: 5 * time.Second, Timeout: time.Second, FailThreshold: 1, SuccessThreshold: 1, BackoffFactor: 2}
+	probe := ProbeConfig{EnableTCP: true, EnableUDP: true, TCPTarget: "example.com:80", UDPTarget: "1.1.1.1:53", DNSName: "example.com", DNSType: "A", Timeout: time.Second}
+	lb := NewLoadBalancer([]UpstreamConfig{{
+		Name: "a", TCPWSS: "wss://a.example/tcp", UDPWSS: "wss://a.example/udp",
+		Cipher: "chacha20-ietf-poly1305", Secret: "secret",
+	}}, hc, SelectionConfig{}, probe, 0)
+	up := lb.pool[0]
+
+	var dials []string
+	var conns []*mockWSConn
+	lb.probeDial = func(ctx context.Context, rawurl string) (WSConn, error) {
+		dials = append(dials, rawurl)
+		m := &mockWSConn{}
+		conns = append(conns, m)
+		return m, nil
+	}
+
+	lb.checkOneTCP(context.Background(), up)
+	lb.checkOneUDP(context.Background(), up)
+
+	if len(dials) != 2 || dials[0] != up.cfg.TCPWSS || dials[1] != up.cfg.UDPWSS {
+		t.Fatalf("expected one dial per check, got %v", dials)
+	}
+	for i, m := range conns {
+		if !m.closed {
+			t.Fatalf("dial %d: conn not handed to and closed by the quality probe", i)
+		}
+	}
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	// The quality exchange fails against the mock; the handshake alone keeps the upstream up.
+	if !up.tcp.healthy || !up.udp.healthy {
+		t.Fatalf("expected healthy after successful handshakes, tcp=%v udp=%v", up.tcp.healthy, up.udp.healthy)
+	}
+}
+
+func TestDialWSStreamLimited_RetriesWithinBudgetAndFreesSlotBetween(t *testing.T) {
+	prev := dialRetryBackoff
+	dialRetryBackoff = 200 * time.Millisecond
+	t.Cleanup(func() { dialRetryBackoff = prev })
+
+	lb := NewLoadBalancer(nil, HealthcheckConfig{}, SelectionConfig{DialAttempts: 3}, ProbeConfig{}, 0)
+	lb.dialSem = make(chan struct{}, 1)
+	var calls atomic.Int32
+	failed := make(chan struct{})
+	lb.tunnelDial = func(context.Context, string) (WSConn, error) {
+		if calls.Add(1) == 1 {
+			close(failed)
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}
+		}
+		return &mockWSConn{}, nil
+	}
+
+	slotFree := make(chan error, 1)
+	go func() {
+		<-failed
+		// The lone slot must be free while the first attempt backs off.
+		ctx, cancel := context.WithTimeout(context.Background(), 80*time.Millisecond)
+		defer cancel()
+		err := lb.acquireDialSlot(ctx)
+		if err == nil {
+			lb.releaseDialSlot()
+		}
+		slotFree <- err
+	}()
+
+	c, err := lb.DialWSStreamLimited(context.Background(), "wss://flaky/tcp")
+	if err != nil || c == nil {
+		t.Fatalf("DialWSStreamLimited = %v, %v; want success on the second attempt", c, err)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("dials = %d, want 2", n)
+	}
+	if err := <-slotFree; err != nil {
+		t.Fatalf("dial slot held during the backoff: %v", err)
+	}
+
+	// The budget bounds a dial that keeps failing.
+	calls.Store(0)
+	lb.tunnelDial = func(context.Context, string) (WSConn, error) {
+		calls.Add(1)
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	}
+	dialRetryBackoff = time.Millisecond
+	if _, err := lb.DialWSStreamLimited(context.Background(), "wss://down/tcp"); err == nil {
+		t.Fatal("a dial failing every attempt succeeded")
+	}
+	if n := calls.Load(); n != 3 {
+		t.Fatalf("dials = %d, want the budget of 3", n)
+	}
+
+	// A refusal or TLS failure would only repeat: no retry.
+	for _, fail := range []error{
+		fmt.Errorf("%w: 403 Forbidden", ErrHandshakeRejected),
+		fmt.Errorf("%w: x509: certificate signed by unknown authority", ErrTLSFailure),
+		&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}},
+	} {
+		calls.Store(0)
+		lb.tunnelDial = func(context.Context, string) (WSConn, error) {
+			calls.Add(1)
+			return nil, fail
+		}
+		if _, err := lb.DialWSStreamLimited(context.Background(), "wss://refusing/tcp"); err == nil {
+			t.Fatal("a refused dial succeeded")
+		}
+		if n := calls.Load(); n != 1 {
+			t.Fatalf("%v: dials = %d, want 1", fail, n)
+		}
+	}
+}
+
+func TestRunHealthChecks_TotalOutageSlowsProbing(t *testing.T) {
+	lb := NewLoadBalancer([]UpstreamConfig{
+		{Name: "a", Weight: 1, TCPWSS: "wss://a/tcp"},
+	}, HealthcheckConfig{
+		Interval:         50 * time.Millisecond,
+		Timeout:          time.Second,
+		FailThreshold:    1,
+		SuccessThreshold: 1,
+		MinInterval:      50 * time.Millisecond,
+		MaxInterval:      100 * time.Millisecond,
+		BackoffFactor:    1,
+		OutagePoll:       time.Second,
+	}, SelectionConfig{}, ProbeConfig{}, 0)
+	lb.SetUDPDisabled(true)
+	var probes atomic.Int32
+	var down atomic.Bool
+	lb.transportProbe = func(context.Context, string) (time.Duration, error) {
+		probes.Add(1)
+		if down.Load() {
+			return 0, errors.New("network is unreachable")
+		}
+		return 10 * time.Millisecond, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lb.RunHealthChecks(ctx)
+	waitFor(t, func() bool { return lb.HealthyCount() == 1 }, "upstream up")
+	if lb.outage.Load() {
+		t.Fatal("outage flagged while an upstream is healthy")
+	}
+
+	down.Store(true)
+	waitFor(t, func() bool { return lb.outage.Load() }, "outage detected")
+
+	// Without the guard the failed upstream is probed on every 200ms tick.
+	probes.Store(0)
+	time.Sleep(1200 * time.Millisecond)
+	if n := probes.Load(); n > 2 {
+		t.Fatalf("%d probes in 1.2s of total outage, want at most 2 (outage_poll=1s)", n)
+	}
+
+	down.Store(false)
+	waitFor(t, func() bool { return !lb.outage.Load() }, "outage over")
+}
+
+func TestCheckOneTCP_QualityFailureModes(t *testing.T) {
+	handshakeErr := errors.New("tls: handshake failure")
+	targetErr := errors.New("dial example.com:80: connection refused")
+	for _, tc := range []struct {
+		mode                  string
+		handshake, quality    error
+		wantHealthy, degraded bool
+	}{
+		{"", nil, targetErr, true, false},
+		{"degrade", nil, targetErr, true, true},
+		{"degrade", nil, nil, true, false},
+		{"degrade", handshakeErr, nil, false, false},
+		{"fail", nil, targetErr, false, false},
+	} {
+		lb := NewLoadBalancer([]UpstreamConfig{{Name: "a", Weight: 1, TCPWSS: "wss://a/tcp"}},
+			HealthcheckConfig{Timeout: time.Second, FailThreshold: 1, SuccessThreshold: 1, MinInterval: time.Second, MaxInterval: time.Second, BackoffFactor: 1},
+			SelectionConfig{}, ProbeConfig{EnableTCP: true, Timeout: time.Second, QualityFailure: tc.mode}, 0)
+		lb.transportProbe = func(context.Context, string) (time.Duration, error) { return 20 * time.Millisecond, tc.handshake }
+		lb.tcpQualityProbe = func(context.Context, UpstreamConfig, string) (time.Duration, error) {
+			return 40 * time.Millisecond, tc.quality
+		}
+		st := lb.pool[0]
+		lb.checkOneTCP(context.Background(), st)
+		if st.tcp.healthy != tc.wantHealthy || st.tcp.degraded != tc.degraded {
+			t.Fatalf("mode=%q handshake=%v quality=%v: healthy=%v degraded=%v, want %v/%v",
+				tc.mode, tc.handshake, tc.quality, st.tcp.healthy, st.tcp.degraded, tc.wantHealthy, tc.degraded)
+		}
+	}
+
+	// A degraded upstream is still eligible but scores behind a clean one.
+	lb := NewLoadBalancer([]UpstreamConfig{
+		{Name: "degraded", Weight: 1, TCPWSS: "wss://a/tcp"},
+		{Name: "clean", Weight: 1, TCPWSS: "wss://b/tcp"},
+	}, HealthcheckConfig{Interval: time.Minute}, SelectionConfig{}, ProbeConfig{}, 0)
+	markHealthy(lb.pool[0], true, 20*time.Millisecond)
+	markHealthy(lb.pool[1], true, 200*time.Millisecond)
+	lb.pool[0].tcp.degraded = true
+	if got, _ := lb.pickBestInTier(lb.pool, time.Now(), true, false, false); got != lb.pool[1] {
+		t.Fatalf("picked %v, want the clean upstream over the degraded faster one", got.cfg.Name)
+	}
+	lb.pool[1].tcp.healthy = false
+	if got, _ := lb.pickBestInTier(lb.pool, time.Now(), true, false, false); got != lb.pool[0] {
+		t.Fatal("degraded upstream not picked when it is the only healthy one")
+	}
+}
+
+func TestCheckNow_RunsOnNextSchedulerTick(t *testing.T) {
+	lb := NewLoadBalancer([]UpstreamConfig{
+		{Name: "a", Weight: 1, TCPWSS: "wss://a/tcp"},
+		{Name: "b", Weight: 1, TCPWSS: "wss://b/tcp"},
+	}, HealthcheckConfig{Interval: time.Minute, Timeout: time.Second, FailThreshold: 1, SuccessThreshold: 1, MinInterval: time.Minute, MaxInterval: time.Minute, BackoffFactor: 1}, SelectionConfig{}, ProbeConfig{}, 0)
+	lb.SetUDPDisabled(true)
+	var mu sync.Mutex
+	probed := map[string]int{}
+	lb.transportProbe = func(_ context.Context, rawurl string) (time.Duration, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		probed[rawurl]++
+		return 10 * time.Millisecond, nil
+	}
+	later := time.Now().Add(time.Hour)
+	for _, s := range lb.pool {
+		s.tcp.nextHC, s.udp.nextHC = later, later
+	}
+	count := func(up string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return probed["wss://"+up+"/tcp"]
+	}
+
+	lb.runDueChecks(context.Background())
+	if count("a")+count("b") != 0 {
+		t.Fatal("checks ran before they were due")
+	}
+	if lb.CheckNow("missing") {
+		t.Fatal("CheckNow reported an unknown upstream as found")
+	}
+
+	if !lb.CheckNow("a") {
+		t.Fatal("CheckNow(a) did not find the upstream")
+	}
+	lb.runDueChecks(context.Background())
+	waitFor(t, func() bool { return count("a") == 1 }, "check of a")
+	if count("b") != 0 {
+		t.Fatal("CheckNow(a) also checked b")
+	}
+
+	// A running check is not doubled; "all" reschedules the rest.
+	waitFor(t, func() bool { lb.pool[0].mu.Lock(); defer lb.pool[0].mu.Unlock(); return !lb.pool[0].tcp.inFlight }, "check of a done")
+	lb.pool[0].mu.Lock()
+	lb.pool[0].tcp.inFlight = true
+	lb.pool[0].tcp.nextHC = later
+	lb.pool[0].mu.Unlock()
+	lb.CheckNow("all")
+	lb.runDueChecks(context.Background())
+	waitFor(t, func() bool { return count("b") == 1 }, "check of b")
+	if count("a") != 1 {
+		t.Fatal("CheckNow(all) started a second check of an upstream already being checked")
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool, what string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for: %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
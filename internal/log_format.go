@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log formats (log.format).
+const (
+	logFormatText = "text" // default: the standard logger's freeform lines
+	logFormatJSON = "json" // one JSON object per line
+)
+
+// SetLogFormat switches the standard logger between freeform text and JSON
+// lines. Every log.Printf in the tree goes through it, so the JSON writer
+// lifts the key=value tags the messages already carry into fields. Either
+// way the lines are also kept in the /logs ring.
+func SetLogFormat(format string) error {
+	switch format {
+	case "", logFormatText:
+		log.SetFlags(log.LstdFlags)
+		log.SetOutput(io.MultiWriter(os.Stderr, recentLogs))
+	case logFormatJSON:
+		log.SetFlags(0)
+		log.SetOutput(&jsonLogWriter{w: io.MultiWriter(os.Stderr, recentLogs), now: time.Now})
+	default:
+		return fmt.Errorf("log.format must be %q or %q, got %q", logFormatText, logFormatJSON, format)
+	}
+	return nil
+}
+
+type jsonLogLine struct {
+	TS       string `json:"ts"`
+	Level    string `json:"level"`
+	Msg      string `json:"msg"`
+	Upstream string `json:"upstream,omitempty"`
+	Proto    string `json:"proto,omitempty"`
+	TraceID  string `json:"trace_id,omitempty"`
+	Err      string `json:"err,omitempty"`
+}
+
+// jsonLogWriter turns each line the log package writes (one per call, flags
+// off) into a jsonLogLine.
+type jsonLogWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	now func() time.Time
+}
+
+// logTagRe matches the tags copied into fields; err is handled by
+// logErrValue since error texts contain spaces.
+var (
+	logTagRe     = regexp.MustCompile(`(?:^|\s)(upstream|proto|trace)=("(?:[^"\\]|\\.)*"|\S+)`)
+	logErrTagRe  = regexp.MustCompile(`(?:^|\s)err=`)
+	logNextTagRe = regexp.MustCompile(`\s\w+=`)
+)
+
+// logErrValue returns the err= value of msg: up to the next key= tag or the
+// end of the line. A nil error (%v prints "<nil>") yields "", so lines that
+// log err= unconditionally are not taken for failures.
+func logErrValue(msg string) string {
+	loc := logErrTagRe.FindStringIndex(msg)
+	if loc == nil {
+		return ""
+	}
+	v := msg[loc[1]:]
+	if next := logNextTagRe.FindStringIndex(v); next != nil {
+		v = v[:next[0]]
+	}
+	if v == "<nil>" {
+		return ""
+	}
+	return v
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	line := jsonLogLine{Level: "info", Msg: msg}
+	switch {
+	case strings.HasPrefix(msg, "[debug] "):
+		line.Level, line.Msg = "debug", strings.TrimPrefix(msg, "[debug] ")
+	case strings.HasPrefix(msg, "WARN: "):
+		line.Level, line.Msg = "warn", strings.TrimPrefix(msg, "WARN: ")
+	}
+	for _, m := range logTagRe.FindAllStringSubmatch(line.Msg, -1) {
+		v := m[2]
+		if u, err := strconv.Unquote(v); err == nil {
+			v = u
+		}
+		switch m[1] {
+		case "upstream":
+			line.Upstream = v
+		case "proto":
+			line.Proto = v
+		case "trace":
+			line.TraceID = v
+		}
+	}
+	line.Err = logErrValue(line.Msg)
+	if line.Err != "" && line.Level == "info" {
+		line.Level = "error"
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	line.TS = w.now().UTC().Format(time.RFC3339Nano)
+	b, err := json.Marshal(line)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.w.Write(append(b, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
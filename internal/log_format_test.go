@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestJSONLogWriter_EmitsStructuredLine(t *testing.T) {
+	var buf bytes.Buffer
+	w := &jsonLogWriter{w: &buf, now: func() time.Time { return time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC) }}
+	l := log.New(w, "", 0)
+	l.Printf("trace=1a2b3c4d [HC|tcp] probe failed upstream=%q proto=tcp err=%v fail_count=1/3", "s 1", "dial tcp: connection refused")
+
+	var got map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("not a JSON line: %q: %v", buf.String(), err)
+	}
+	want := map[string]string{
+		"ts":       "2025-01-02T03:04:05Z",
+		"level":    "error",
+		"msg":      `trace=1a2b3c4d [HC|tcp] probe failed upstream="s 1" proto=tcp err=dial tcp: connection refused fail_count=1/3`,
+		"upstream": "s 1",
+		"proto":    "tcp",
+		"trace_id": "1a2b3c4d",
+		"err":      "dial tcp: connection refused",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("unexpected fields in %v", got)
+	}
+
+	buf.Reset()
+	got = nil
+	l.Printf("[debug] dial start")
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil || got["level"] != "debug" || got["msg"] != "dial start" {
+		t.Fatalf("debug line = %q (err=%v)", buf.String(), err)
+	}
+
+	buf.Reset()
+	got = nil
+	l.Printf("[HC|tcp] probe done upstream=%q err=%v rtt=12ms", "s1", error(nil))
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil || got["level"] != "info" || got["err"] != "" {
+		t.Fatalf("nil err line = %q (err=%v), want level info and no err field", buf.String(), err)
+	}
+}
+
+func TestSetLogFormat_RejectsUnknownFormat(t *testing.T) {
+	if err := SetLogFormat("xml"); err == nil {
+		t.Fatal("unknown format accepted")
+	}
+}
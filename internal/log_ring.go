@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logRingSize bounds how many recent log lines the daemon keeps for
+// /logs (about a few hundred kilobytes).
+const logRingSize = 1000
+
+// LogRecord is one line the daemon logged, as served by /logs.
+type LogRecord struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Line string    `json:"line"`
+}
+
+// logRing keeps the last logRingSize lines written to the standard logger
+// (SetLogFormat tees into it), in whatever format the log uses.
+type logRing struct {
+	mu    sync.Mutex
+	buf   []LogRecord // circular once full
+	next  int         // write position in buf once full
+	seq   uint64
+	added chan struct{} // closed and replaced on every Write
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{buf: make([]LogRecord, 0, size), added: make(chan struct{})}
+}
+
+var recentLogs = newLogRing(logRingSize)
+
+func (r *logRing) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	rec := LogRecord{Seq: r.seq, Time: time.Now(), Line: line}
+	if len(r.buf) < cap(r.buf) {
+		r.buf = append(r.buf, rec)
+	} else {
+		r.buf[r.next] = rec
+		r.next = (r.next + 1) % len(r.buf)
+	}
+	close(r.added)
+	r.added = make(chan struct{})
+	return len(p), nil
+}
+
+// since returns the kept records after seq, oldest first, at most the last
+// tail of them when tail > 0, and a channel closed on the next Write.
+func (r *logRing) since(seq uint64, tail int) ([]LogRecord, <-chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ordered := append(append([]LogRecord(nil), r.buf[r.next:]...), r.buf[:r.next]...)
+	i := 0
+	for i < len(ordered) && ordered[i].Seq <= seq {
+		i++
+	}
+	out := ordered[i:]
+	if tail > 0 && len(out) > tail {
+		out = out[len(out)-tail:]
+	}
+	return out, r.added
+}
+
+// logsHandler serves recent log lines as JSON lines (LogRecord).
+// ?since=SEQ skips lines up to SEQ, ?n=N keeps the last N, and ?follow=1
+// keeps the response open and streams new lines as they are logged.
+func logsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	seq, _ := strconv.ParseUint(q.Get("since"), 10, 64)
+	tail, _ := strconv.Atoi(q.Get("n"))
+	follow := q.Get("follow") == "1" || q.Get("follow") == "true"
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	for {
+		recs, added := recentLogs.since(seq, tail)
+		tail = 0
+		for _, rec := range recs {
+			if err := enc.Encode(rec); err != nil {
+				return
+			}
+			seq = rec.Seq
+		}
+		if !follow {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-added:
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogRing_KeepsLastLinesInOrder(t *testing.T) {
+	r := newLogRing(3)
+	for i := 1; i <= 5; i++ {
+		fmt.Fprintf(r, "line %d\n", i)
+	}
+	recs, _ := r.since(0, 0)
+	if len(recs) != 3 || recs[0].Line != "line 3" || recs[2].Line != "line 5" || recs[2].Seq != 5 {
+		t.Fatalf("ring kept %+v, want lines 3..5", recs)
+	}
+	if recs, _ := r.since(4, 0); len(recs) != 1 || recs[0].Line != "line 5" {
+		t.Fatalf("since(4) = %+v, want line 5", recs)
+	}
+	if recs, _ := r.since(0, 2); len(recs) != 2 || recs[0].Line != "line 4" {
+		t.Fatalf("tail 2 = %+v, want lines 4..5", recs)
+	}
+}
+
+func TestLogsEndpoint_ReturnsAndFollowsLoggedLines(t *testing.T) {
+	if err := SetLogFormat(logFormatText); err != nil {
+		t.Fatal(err)
+	}
+	log.Printf("[lb] upstream %q DOWN (log ring test)", "edge-1")
+
+	lb := NewLoadBalancer(nil, HealthcheckConfig{}, SelectionConfig{}, ProbeConfig{}, 0)
+	srv := httptest.NewServer(newAdminMux(lb))
+	defer srv.Close()
+
+	var got []string
+	if err := FetchLogs(context.Background(), srv.URL, "", 0, false, func(rec LogRecord) { got = append(got, rec.Line) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) == 0 || !strings.Contains(got[len(got)-1], `upstream "edge-1" DOWN (log ring test)`) {
+		t.Fatalf("/logs did not return the logged line; got %q", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/logs?n=1&follow=1", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	sc := bufio.NewScanner(resp.Body)
+	if !sc.Scan() {
+		t.Fatalf("follow: no backlog line: %v", sc.Err())
+	}
+	log.Printf("[lb] upstream %q UP (log ring test)", "edge-1")
+	for sc.Scan() {
+		var rec LogRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatalf("follow: bad line %q: %v", sc.Text(), err)
+		}
+		if strings.Contains(rec.Line, `upstream "edge-1" UP (log ring test)`) {
+			return
+		}
+	}
+	t.Fatalf("follow: new line not streamed: %v", sc.Err())
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maintenanceWindow is one entry of upstream maintenance_windows:
+//
+//	"02:00-04:00"                     every day, local time
+//	"Sun 01:30-03:00 UTC"             weekly
+//	"Mon,Thu 22:00-01:00 Europe/Kyiv" crossing midnight; the day is the start day
+//
+// Inside a window the upstream is treated as draining.
+type maintenanceWindow struct {
+	days       uint8 // bit per time.Weekday; 0 = every day
+	start, end int   // minutes since midnight; end < start wraps past midnight
+	loc        *time.Location
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseMaintenanceWindows(specs []string) ([]maintenanceWindow, error) {
+	out := make([]maintenanceWindow, 0, len(specs))
+	for _, spec := range specs {
+		w, err := parseMaintenanceWindow(spec)
+		if err != nil {
+			return nil, fmt.Errorf("maintenance window %q: %w", spec, err)
+		}
+		out = append(out, w)
+	}
+	return out, nil
+}
+
+func parseMaintenanceWindow(spec string) (maintenanceWindow, error) {
+	w := maintenanceWindow{loc: time.Local}
+	fields := strings.Fields(spec)
+	if len(fields) > 0 && !strings.Contains(fields[0], ":") {
+		for _, d := range strings.Split(fields[0], ",") {
+			wd, ok := weekdayNames[strings.ToLower(d)]
+			if !ok {
+				return w, fmt.Errorf("unknown weekday %q", d)
+			}
+			w.days |= 1 << wd
+		}
+		fields = fields[1:]
+	}
+	switch len(fields) {
+	case 2:
+		loc, err := time.LoadLocation(fields[1])
+		if err != nil {
+			return w, err
+		}
+		w.loc = loc
+	case 1:
+	default:
+		return w, fmt.Errorf(`want "[days] HH:MM-HH:MM [timezone]"`)
+	}
+	from, to, ok := strings.Cut(fields[0], "-")
+	if !ok {
+		return w, fmt.Errorf("time range must be HH:MM-HH:MM")
+	}
+	var err error
+	if w.start, err = parseClockMinutes(from); err != nil {
+		return w, err
+	}
+	if w.end, err = parseClockMinutes(to); err != nil {
+		return w, err
+	}
+	if w.start == w.end {
+		return w, fmt.Errorf("empty time range")
+	}
+	return w, nil
+}
+
+func parseClockMinutes(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("bad time %q, want HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w maintenanceWindow) onDay(d time.Weekday) bool {
+	return w.days == 0 || w.days&(1<<d) != 0
+}
+
+// contains reports whether t falls inside the window, in the window's zone.
+func (w maintenanceWindow) contains(t time.Time) bool {
+	t = t.In(w.loc)
+	m := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return m >= w.start && m < w.end && w.onDay(t.Weekday())
+	}
+	// Wraps past midnight: the evening part belongs to today, the morning
+	// part to the window that started yesterday.
+	if m >= w.start {
+		return w.onDay(t.Weekday())
+	}
+	return m < w.end && w.onDay((t.Weekday()+6)%7)
+}
+
+// inMaintenance reports whether s is inside one of its maintenance windows.
+func (s *UpstreamState) inMaintenance(now time.Time) bool {
+	for _, w := range s.maintenance {
+		if w.contains(now) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindow_Contains(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.Parse("Mon 2006-01-02 15:04 MST", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	for _, tc := range []struct {
+		spec, at string
+		want     bool
+	}{
+		{"02:00-04:00 UTC", "Tue 2026-10-13 02:00 UTC", true},
+		{"02:00-04:00 UTC", "Tue 2026-10-13 04:00 UTC", false},
+		{"Sun 02:00-04:00 UTC", "Sun 2026-10-11 03:59 UTC", true},
+		{"Sun 02:00-04:00 UTC", "Mon 2026-10-12 03:00 UTC", false},
+		// Crossing midnight: Saturday 23:30 to Sunday 00:30.
+		{"Sat 23:00-01:00 UTC", "Sat 2026-10-10 23:30 UTC", true},
+		{"Sat 23:00-01:00 UTC", "Sun 2026-10-11 00:30 UTC", true},
+		{"Sat 23:00-01:00 UTC", "Sat 2026-10-10 00:30 UTC", false},
+		// The zone applies: 02:30 UTC is 05:30 in Kyiv (UTC+3 in October).
+		{"05:00-06:00 Europe/Kyiv", "Tue 2026-10-13 02:30 UTC", true},
+	} {
+		w, err := parseMaintenanceWindow(tc.spec)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.spec, err)
+		}
+		if got := w.contains(at(tc.at)); got != tc.want {
+			t.Fatalf("%q contains %s = %v, want %v", tc.spec, tc.at, got, tc.want)
+		}
+	}
+	for _, bad := range []string{"02:00", "Funday 02:00-03:00", "02:00-02:00", "25:00-26:00", "02:00-03:00 Mars/Base"} {
+		if _, err := parseMaintenanceWindow(bad); err == nil {
+			t.Fatalf("%q parsed", bad)
+		}
+	}
+}
+
+func TestPick_MaintenanceWindowExcludesUpstreamOnlyInsideIt(t *testing.T) {
+	lb := NewLoadBalancer([]UpstreamConfig{
+		{Name: "maint", Weight: 1, MaintenanceWindows: []string{"02:00-04:00 UTC"}},
+		{Name: "other", Weight: 1},
+	}, HealthcheckConfig{Interval: time.Hour}, SelectionConfig{}, ProbeConfig{}, 0)
+	maint, other := lb.pool[0], lb.pool[1]
+	markHealthy(maint, true, 10*time.Millisecond)
+	markHealthy(other, true, 300*time.Millisecond)
+
+	inside := time.Date(2026, 10, 13, 3, 0, 0, 0, time.UTC)
+	outside := time.Date(2026, 10, 13, 4, 30, 0, 0, time.UTC)
+	for _, s := range lb.pool {
+		s.tcp.lastCheckTime = inside // keep the staleness penalty out of it
+	}
+
+	if best, _ := lb.pickBestInTier(lb.pool, inside, true, false, false); best != other {
+		t.Fatalf("inside the window picked %v, want other", best.cfg.Name)
+	}
+	if top := lb.pickTopN(inside, 2); len(top) != 1 || top[0] != other {
+		t.Fatalf("inside the window pickTopN = %v, want only other", top)
+	}
+	if lb.usable(maint, inside, true) {
+		t.Fatal("consistent_hash ring would include the upstream inside the window")
+	}
+
+	for _, s := range lb.pool {
+		s.tcp.lastCheckTime = outside
+	}
+	if best, _ := lb.pickBestInTier(lb.pool, outside, true, false, false); best != maint {
+		t.Fatalf("after the window picked %v, want maint back", best.cfg.Name)
+	}
+	if !lb.usable(maint, outside, true) {
+		t.Fatal("upstream still excluded after the window")
+	}
+}
@@ -1,12 +1,14 @@
 package internal
 
 import (
+	"compress/gzip"
 	"context"
-	"errors"
+	"crypto/subtle"
 	"fmt"
 	"net/http"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -23,14 +25,34 @@ type telemetry struct {
 	wsBytes       map[string]uint64
 	wsDialSum     map[string]float64
 	wsDialCount   map[string]uint64
+	dialPhaseSum  map[string]float64
+	dialPhaseCnt  map[string]uint64
 	upstreamBytes map[string]uint64
 	tunPackets    map[string]uint64
 	tunBytes      map[string]uint64
 	tunDrops      map[string]uint64
+	fallbacks     map[string]uint64
 	tunErrors     map[string]uint64
 	probeRuns     map[string]uint64
 	probeDurSum   map[string]float64
 	probeDurCount map[string]uint64
+	activeConns   map[string]float64
+	wsConnsActive map[string]float64
+	draining      map[string]float64
+
+	// TUN UDP session table (see udpPortTable)
+	udpSessionsActive   float64
+	connsActive         float64
+	connsRejected       uint64
+	udpSessionsCreated  uint64
+	udpSessionsGC       uint64
+	udpSessionLifetimeS float64 // sum over GC'd sessions
+
+	// since is when the cumulative counters were last zeroed (OTLP start time).
+	since time.Time
+
+	// token, when non-empty, is required as "Authorization: Bearer <token>".
+	token string
 }
 
 var (
@@ -51,35 +73,81 @@ func EnablePrometheusMetrics() {
 	metrics.wsBytes = make(map[string]uint64)
 	metrics.wsDialSum = make(map[string]float64)
 	metrics.wsDialCount = make(map[string]uint64)
+	metrics.dialPhaseSum = make(map[string]float64)
+	metrics.dialPhaseCnt = make(map[string]uint64)
 	metrics.upstreamBytes = make(map[string]uint64)
 	metrics.tunPackets = make(map[string]uint64)
 	metrics.tunBytes = make(map[string]uint64)
 	metrics.tunDrops = make(map[string]uint64)
+	metrics.fallbacks = make(map[string]uint64)
 	metrics.tunErrors = make(map[string]uint64)
 	metrics.probeRuns = make(map[string]uint64)
 	metrics.probeDurSum = make(map[string]float64)
 	metrics.probeDurCount = make(map[string]uint64)
+	metrics.activeConns = make(map[string]float64)
+	metrics.wsConnsActive = make(map[string]float64)
+	metrics.draining = make(map[string]float64)
+	metrics.since = time.Now()
 	metrics.enabled = true
 }
 
-func StartMetricsServer(ctx context.Context, addr string) error {
-	if strings.TrimSpace(addr) == "" {
-		return errors.New("empty metrics address")
+// ResetMetrics zeroes every cumulative counter and summary. Gauges (health,
+// active connections, sessions, drain) describe current state and are kept.
+func ResetMetrics() {
+	metricsMu.RLock()
+	if !metrics.enabled {
+		metricsMu.RUnlock()
+		return
+	}
+	metrics.mu.Lock()
+	metricsMu.RUnlock()
+	defer metrics.mu.Unlock()
+	for _, m := range []map[string]uint64{
+		metrics.selectedTotal, metrics.failuresTotal, metrics.wsPackets, metrics.wsBytes,
+		metrics.wsDialCount, metrics.dialPhaseCnt, metrics.upstreamBytes, metrics.tunPackets, metrics.tunBytes,
+		metrics.tunDrops, metrics.tunErrors, metrics.probeRuns, metrics.probeDurCount, metrics.fallbacks,
+	} {
+		clear(m)
 	}
-	mux := http.NewServeMux()
-	mux.HandleFunc("/metrics", metricsHandler)
-	srv := &http.Server{Addr: addr, Handler: mux}
-	go func() {
-		<-ctx.Done()
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-		defer cancel()
-		_ = srv.Shutdown(shutdownCtx)
-	}()
-	err := srv.ListenAndServe()
-	if err != nil && !errors.Is(err, http.ErrServerClosed) {
-		return fmt.Errorf("metrics server: %w", err)
+	clear(metrics.wsDialSum)
+	clear(metrics.dialPhaseSum)
+	clear(metrics.probeDurSum)
+	metrics.connsRejected = 0
+	metrics.udpSessionsCreated = 0
+	metrics.udpSessionsGC = 0
+	metrics.udpSessionLifetimeS = 0
+	metrics.since = time.Now()
+}
+
+// SetMetricsToken protects /metrics (and the other admin routes except
+// /healthz) with a bearer token; empty disables auth.
+func SetMetricsToken(token string) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metrics.token = token
+}
+
+// metricsAuthorized checks r against the configured bearer token.
+func metricsAuthorized(r *http.Request) bool {
+	metricsMu.RLock()
+	token := metrics.token
+	metricsMu.RUnlock()
+	if token == "" {
+		return true
 	}
-	return nil
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+func writeUnauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
+// StartMetricsServer serves only /metrics on addr; see StartAdminServer for
+// the full admin endpoint set.
+func StartMetricsServer(ctx context.Context, addr string) error {
+	return StartAdminServer(ctx, addr, nil)
 }
 
 func observeSelection(upstream, proto string) {
@@ -123,7 +191,113 @@ func setHealthy(upstream, proto string, healthy bool) {
 	metrics.healthy[fmt.Sprintf("upstream=%s,proto=%s", upstream, proto)] = v
 }
 
-func observeWSFrame(direction string, bytes int) {
+func setActiveConns(upstream, proto string, n int64) {
+	metricsMu.RLock()
+	if !metrics.enabled {
+		metricsMu.RUnlock()
+		return
+	}
+	metrics.mu.Lock()
+	metricsMu.RUnlock()
+	defer metrics.mu.Unlock()
+	metrics.activeConns[fmt.Sprintf("upstream=%s,proto=%s", upstream, proto)] = float64(n)
+}
+
+func setDraining(upstream string, draining bool) {
+	metricsMu.RLock()
+	if !metrics.enabled {
+		metricsMu.RUnlock()
+		return
+	}
+	metrics.mu.Lock()
+	metricsMu.RUnlock()
+	defer metrics.mu.Unlock()
+	v := 0.0
+	if draining {
+		v = 1
+	}
+	metrics.draining[fmt.Sprintf("upstream=%s", upstream)] = v
+}
+
+func setUDPSessionsActive(n int) {
+	metricsMu.RLock()
+	if !metrics.enabled {
+		metricsMu.RUnlock()
+		return
+	}
+	metrics.mu.Lock()
+	metricsMu.RUnlock()
+	defer metrics.mu.Unlock()
+	metrics.udpSessionsActive = float64(n)
+}
+
+func setConnectionsActive(n int64) {
+	metricsMu.RLock()
+	if !metrics.enabled {
+		metricsMu.RUnlock()
+		return
+	}
+	metrics.mu.Lock()
+	metricsMu.RUnlock()
+	defer metrics.mu.Unlock()
+	metrics.connsActive = float64(n)
+}
+
+func observeConnectionRejected() {
+	metricsMu.RLock()
+	if !metrics.enabled {
+		metricsMu.RUnlock()
+		return
+	}
+	metrics.mu.Lock()
+	metricsMu.RUnlock()
+	defer metrics.mu.Unlock()
+	metrics.connsRejected++
+}
+
+func observeUDPSessionCreated() {
+	metricsMu.RLock()
+	if !metrics.enabled {
+		metricsMu.RUnlock()
+		return
+	}
+	metrics.mu.Lock()
+	metricsMu.RUnlock()
+	defer metrics.mu.Unlock()
+	metrics.udpSessionsCreated++
+}
+
+func observeUDPSessionGC(lifetime time.Duration) {
+	metricsMu.RLock()
+	if !metrics.enabled {
+		metricsMu.RUnlock()
+		return
+	}
+	metrics.mu.Lock()
+	metricsMu.RUnlock()
+	defer metrics.mu.Unlock()
+	metrics.udpSessionsGC++
+	metrics.udpSessionLifetimeS += lifetime.Seconds()
+}
+
+// observeWSFrame counts one WebSocket message and its payload bytes. kind is
+// "data" for tunnel payload or "control" for ping/pong/close, so keepalive
+// overhead on idle tunnels shows apart from traffic.
+func observeWSFrame(direction, kind string, bytes int) {
+	metricsMu.RLock()
+	if !metrics.enabled {
+		metricsMu.RUnlock()
+		return
+	}
+	metrics.mu.Lock()
+	metricsMu.RUnlock()
+	defer metrics.mu.Unlock()
+	key := fmt.Sprintf("dir=%s,kind=%s", direction, kind)
+	metrics.wsPackets[key]++
+	metrics.wsBytes[key] += uint64(bytes)
+}
+
+func observeTransportFallback(upstream, from, to string) {
 	metricsMu.RLock()
 	if !metrics.enabled {
 		metricsMu.RUnlock()
@@ -132,11 +306,10 @@ func observeWSFrame(direction string, bytes int) {
 	metrics.mu.Lock()
 	metricsMu.RUnlock()
 	defer metrics.mu.Unlock()
-	metrics.wsPackets[fmt.Sprintf("dir=%s", direction)]++
-	metrics.wsBytes[fmt.Sprintf("dir=%s", direction)] += uint64(bytes)
+	metrics.fallbacks[fmt.Sprintf("upstream=%s,from=%s,to=%s", upstream, from, to)]++
 }
 
-func observeDial(upstream, proto string, d time.Duration) {
+func observeDial(upstream, proto, transport string, d time.Duration) {
 	metricsMu.RLock()
 	if !metrics.enabled {
 		metricsMu.RUnlock()
@@ -145,11 +318,49 @@ func observeDial(upstream, proto string, d time.Duration) {
 	metrics.mu.Lock()
 	metricsMu.RUnlock()
 	defer metrics.mu.Unlock()
-	k := fmt.Sprintf("upstream=%s,proto=%s", upstream, proto)
+	k := fmt.Sprintf("upstream=%s,proto=%s,transport=%s", upstream, proto, transport)
 	metrics.wsDialCount[k]++
 	metrics.wsDialSum[k] += d.Seconds()
 }
 
+// observeDialPhase records one phase (dialPhaseConnect, ...) of a dial.
+func observeDialPhase(upstream, transport, phase string, d time.Duration) {
+	metricsMu.RLock()
+	if !metrics.enabled {
+		metricsMu.RUnlock()
+		return
+	}
+	metrics.mu.Lock()
+	metricsMu.RUnlock()
+	defer metrics.mu.Unlock()
+	k := fmt.Sprintf("upstream=%s,transport=%s,phase=%s", upstream, transport, phase)
+	metrics.dialPhaseCnt[k]++
+	metrics.dialPhaseSum[k] += d.Seconds()
+}
+
+// trackWSConn counts an open WebSocket conn by negotiated transport until the
+// returned func is called; standby and probe conns count while open too.
+func trackWSConn(upstream, transport string) (done func()) {
+	k := fmt.Sprintf("upstream=%s,transport=%s", upstream, transport)
+	if !addWSConnActive(k, 1) {
+		return func() {}
+	}
+	return func() { addWSConnActive(k, -1) }
+}
+
+func addWSConnActive(k string, d float64) bool {
+	metricsMu.RLock()
+	if !metrics.enabled {
+		metricsMu.RUnlock()
+		return false
+	}
+	metrics.mu.Lock()
+	metricsMu.RUnlock()
+	defer metrics.mu.Unlock()
+	metrics.wsConnsActive[k] += d
+	return true
+}
+
 func observeUpstreamTraffic(upstream, proto, direction string, bytes int) {
 	metricsMu.RLock()
 	if !metrics.enabled {
@@ -225,6 +436,10 @@ func failureReason(err error) string {
 	if err == nil {
 		return "unknown"
 	}
+	if reason, ok := typedFailureReason(err); ok {
+		return reason
+	}
+	// Untyped errors (mostly fmt.Errorf from transport internals).
 	e := strings.ToLower(err.Error())
 	switch {
 	case strings.Contains(e, "timeout") || strings.Contains(e, "deadline"):
@@ -240,7 +455,11 @@ func failureReason(err error) string {
 	}
 }
 
-func metricsHandler(w http.ResponseWriter, _ *http.Request) {
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !metricsAuthorized(r) {
+		writeUnauthorized(w)
+		return
+	}
 	metricsMu.RLock()
 	enabled := metrics.enabled
 	metricsMu.RUnlock()
@@ -250,6 +469,13 @@ func metricsHandler(w http.ResponseWriter, _ *http.Request) {
 		return
 	}
 	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Header().Add("Vary", "Accept-Encoding")
+	if acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		defer zw.Close()
+		w = gzipResponseWriter{ResponseWriter: w, zw: zw}
+	}
 
 	metrics.mu.RLock()
 	defer metrics.mu.RUnlock()
@@ -257,19 +483,56 @@ func metricsHandler(w http.ResponseWriter, _ *http.Request) {
 	writeCounterVec(w, "outlinews_upstream_selected_total", metrics.selectedTotal)
 	writeCounterVec(w, "outlinews_upstream_failures_total", metrics.failuresTotal)
 	writeGaugeVec(w, "outlinews_upstream_healthy", metrics.healthy)
+	writeGaugeVec(w, "outlinews_upstream_active_connections", metrics.activeConns)
+	writeGaugeVec(w, "outlinews_ws_connections_active", metrics.wsConnsActive)
+	writeGaugeVec(w, "outlinews_upstream_draining", metrics.draining)
 	writeCounterVec(w, "outlinews_ws_packets_total", metrics.wsPackets)
 	writeCounterVec(w, "outlinews_ws_bytes_total", metrics.wsBytes)
 	writeSummaryAsCountAndSum(w, "outlinews_ws_dial_duration_seconds", metrics.wsDialCount, metrics.wsDialSum)
+	writeSummaryAsCountAndSum(w, "outlinews_ws_dial_phase_seconds", metrics.dialPhaseCnt, metrics.dialPhaseSum)
+	writeCounterVec(w, "outlinews_transport_fallback_total", metrics.fallbacks)
 	writeCounterVec(w, "outlinews_upstream_bytes_total", metrics.upstreamBytes)
 	writeCounterVec(w, "outlinews_tun_packets_total", metrics.tunPackets)
 	writeCounterVec(w, "outlinews_tun_bytes_total", metrics.tunBytes)
 	writeCounterVec(w, "outlinews_tun_drops_total", metrics.tunDrops)
 	writeCounterVec(w, "outlinews_tun_errors_total", metrics.tunErrors)
+	writeGauge(w, "outlinews_connections_active", metrics.connsActive)
+	writeCounter(w, "outlinews_connections_rejected_total", float64(metrics.connsRejected))
+	writeGauge(w, "outlinews_udp_sessions_active", metrics.udpSessionsActive)
+	writeCounter(w, "outlinews_udp_sessions_created_total", float64(metrics.udpSessionsCreated))
+	writeCounter(w, "outlinews_udp_sessions_gc_total", float64(metrics.udpSessionsGC))
+	writeSummaryAsCountAndSum(w, "outlinews_udp_session_lifetime_seconds",
+		map[string]uint64{"": metrics.udpSessionsGC}, map[string]float64{"": metrics.udpSessionLifetimeS})
 	writeCounterVec(w, "outlinews_probe_runs_total", metrics.probeRuns)
 	writeSummaryAsCountAndSum(w, "outlinews_probe_duration_seconds", metrics.probeDurCount, metrics.probeDurSum)
 	writeRuntimeMemoryMetrics(w)
 }
 
+// gzipResponseWriter compresses the scrape body for clients that accept it;
+// with many upstreams the text format runs to hundreds of kilobytes.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	zw *gzip.Writer
+}
+
+func (g gzipResponseWriter) Write(p []byte) (int, error) { return g.zw.Write(p) }
+
+// acceptsGzip reports whether r's Accept-Encoding allows gzip (q=0 refuses).
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			continue
+		}
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, err := strconv.ParseFloat(v, 64)
+			return err == nil && q > 0
+		}
+		return true
+	}
+	return false
+}
+
 func writeRuntimeMemoryMetrics(w http.ResponseWriter) {
 	var ms runtime.MemStats
 	runtime.ReadMemStats(&ms)
@@ -320,9 +583,12 @@ func writeSummaryAsCountAndSum(w http.ResponseWriter, name string, counts map[st
 	}
 	sort.Strings(keys)
 	for _, k := range keys {
-		labels := toPromLabels(k)
-		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, counts[k])
-		fmt.Fprintf(w, "%s_sum{%s} %f\n", name, labels, sums[k])
+		labels := ""
+		if k != "" { // "" is the single series of an unlabelled summary
+			labels = "{" + toPromLabels(k) + "}"
+		}
+		fmt.Fprintf(w, "%s_count%s %d\n", name, labels, counts[k])
+		fmt.Fprintf(w, "%s_sum%s %f\n", name, labels, sums[k])
 	}
 }
 
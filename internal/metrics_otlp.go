@@ -0,0 +1,303 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultOTLPInterval = 15 * time.Second
+	otlpPushTimeout     = 10 * time.Second
+	otlpServiceName     = "outline-cli-ws"
+)
+
+// OTLP/HTTP JSON encoding of ExportMetricsServiceRequest. 64-bit integers
+// are strings, as in the protobuf JSON mapping.
+type otlpExportRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpMetric struct {
+	Name    string       `json:"name"`
+	Sum     *otlpSum     `json:"sum,omitempty"`
+	Gauge   *otlpGauge   `json:"gauge,omitempty"`
+	Summary *otlpSummary `json:"summary,omitempty"`
+}
+
+// otlpCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE.
+const otlpCumulative = 2
+
+type otlpSum struct {
+	DataPoints             []otlpNumberPoint `json:"dataPoints"`
+	AggregationTemporality int               `json:"aggregationTemporality"`
+	IsMonotonic            bool              `json:"isMonotonic"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberPoint `json:"dataPoints"`
+}
+
+type otlpSummary struct {
+	DataPoints []otlpSummaryPoint `json:"dataPoints"`
+}
+
+type otlpNumberPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsInt             string         `json:"asInt,omitempty"`
+	AsDouble          *float64       `json:"asDouble,omitempty"`
+}
+
+type otlpSummaryPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	Count             string         `json:"count"`
+	Sum               float64        `json:"sum"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func otlpNanos(t time.Time) string { return strconv.FormatInt(t.UnixNano(), 10) }
+
+// otlpAttrs turns a "k=v,k=v" metrics key into attributes.
+func otlpAttrs(key string) []otlpKeyValue {
+	if key == "" {
+		return nil
+	}
+	var attrs []otlpKeyValue
+	for _, p := range strings.Split(key, ",") {
+		k, v, ok := strings.Cut(p, "=")
+		if !ok {
+			continue
+		}
+		attrs = append(attrs, otlpKeyValue{Key: k, Value: otlpAnyValue{StringValue: v}})
+	}
+	return attrs
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// otlpBatch collects one export; start is when the cumulative counters were
+// last zeroed.
+type otlpBatch struct {
+	start, now string
+	metrics    []otlpMetric
+}
+
+func (b *otlpBatch) counterVec(name string, data map[string]uint64) {
+	if len(data) == 0 {
+		return
+	}
+	sum := &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+	for _, k := range sortedKeys(data) {
+		sum.DataPoints = append(sum.DataPoints, otlpNumberPoint{
+			Attributes: otlpAttrs(k), StartTimeUnixNano: b.start, TimeUnixNano: b.now,
+			AsInt: strconv.FormatUint(data[k], 10),
+		})
+	}
+	b.metrics = append(b.metrics, otlpMetric{Name: name, Sum: sum})
+}
+
+func (b *otlpBatch) counter(name string, v uint64) {
+	b.counterVec(name, map[string]uint64{"": v})
+}
+
+func (b *otlpBatch) gaugeVec(name string, data map[string]float64) {
+	if len(data) == 0 {
+		return
+	}
+	g := &otlpGauge{}
+	for _, k := range sortedKeys(data) {
+		v := data[k]
+		g.DataPoints = append(g.DataPoints, otlpNumberPoint{Attributes: otlpAttrs(k), TimeUnixNano: b.now, AsDouble: &v})
+	}
+	b.metrics = append(b.metrics, otlpMetric{Name: name, Gauge: g})
+}
+
+func (b *otlpBatch) gauge(name string, v float64) {
+	b.gaugeVec(name, map[string]float64{"": v})
+}
+
+func (b *otlpBatch) summary(name string, counts map[string]uint64, sums map[string]float64) {
+	if len(counts) == 0 {
+		return
+	}
+	s := &otlpSummary{}
+	for _, k := range sortedKeys(counts) {
+		s.DataPoints = append(s.DataPoints, otlpSummaryPoint{
+			Attributes: otlpAttrs(k), StartTimeUnixNano: b.start, TimeUnixNano: b.now,
+			Count: strconv.FormatUint(counts[k], 10), Sum: sums[k],
+		})
+	}
+	b.metrics = append(b.metrics, otlpMetric{Name: name, Summary: s})
+}
+
+// otlpSnapshot maps the telemetry maps to an export request; ok is false
+// while metrics are disabled.
+func otlpSnapshot(now time.Time) (req otlpExportRequest, ok bool) {
+	metricsMu.RLock()
+	if !metrics.enabled {
+		metricsMu.RUnlock()
+		return req, false
+	}
+	metrics.mu.RLock()
+	metricsMu.RUnlock()
+	defer metrics.mu.RUnlock()
+
+	b := &otlpBatch{start: otlpNanos(metrics.since), now: otlpNanos(now)}
+	b.counterVec("outlinews_upstream_selected_total", metrics.selectedTotal)
+	b.counterVec("outlinews_upstream_failures_total", metrics.failuresTotal)
+	b.gaugeVec("outlinews_upstream_healthy", metrics.healthy)
+	b.gaugeVec("outlinews_upstream_active_connections", metrics.activeConns)
+	b.gaugeVec("outlinews_ws_connections_active", metrics.wsConnsActive)
+	b.gaugeVec("outlinews_upstream_draining", metrics.draining)
+	b.counterVec("outlinews_ws_packets_total", metrics.wsPackets)
+	b.counterVec("outlinews_ws_bytes_total", metrics.wsBytes)
+	b.summary("outlinews_ws_dial_duration_seconds", metrics.wsDialCount, metrics.wsDialSum)
+	b.summary("outlinews_ws_dial_phase_seconds", metrics.dialPhaseCnt, metrics.dialPhaseSum)
+	b.counterVec("outlinews_transport_fallback_total", metrics.fallbacks)
+	b.counterVec("outlinews_upstream_bytes_total", metrics.upstreamBytes)
+	b.counterVec("outlinews_tun_packets_total", metrics.tunPackets)
+	b.counterVec("outlinews_tun_bytes_total", metrics.tunBytes)
+	b.counterVec("outlinews_tun_drops_total", metrics.tunDrops)
+	b.counterVec("outlinews_tun_errors_total", metrics.tunErrors)
+	b.gauge("outlinews_connections_active", metrics.connsActive)
+	b.counter("outlinews_connections_rejected_total", metrics.connsRejected)
+	b.gauge("outlinews_udp_sessions_active", metrics.udpSessionsActive)
+	b.counter("outlinews_udp_sessions_created_total", metrics.udpSessionsCreated)
+	b.counter("outlinews_udp_sessions_gc_total", metrics.udpSessionsGC)
+	b.summary("outlinews_udp_session_lifetime_seconds",
+		map[string]uint64{"": metrics.udpSessionsGC}, map[string]float64{"": metrics.udpSessionLifetimeS})
+	b.counterVec("outlinews_probe_runs_total", metrics.probeRuns)
+	b.summary("outlinews_probe_duration_seconds", metrics.probeDurCount, metrics.probeDurSum)
+
+	req.ResourceMetrics = []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			{Key: "service.name", Value: otlpAnyValue{StringValue: otlpServiceName}},
+		}},
+		ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: otlpServiceName}, Metrics: b.metrics}},
+	}}
+	return req, true
+}
+
+// otlpMetricsURL resolves metrics.otlp_endpoint: a bare collector address
+// (no path) gets the standard /v1/metrics path.
+func otlpMetricsURL(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return "", fmt.Errorf("want an http(s)://host[:port][/path] URL, got %q", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/metrics"
+	}
+	return u.String(), nil
+}
+
+// pushOTLP sends one export to endpoint (already resolved by otlpMetricsURL).
+func pushOTLP(ctx context.Context, client *http.Client, endpoint string, now time.Time) error {
+	req, ok := otlpSnapshot(now)
+	if !ok {
+		return nil
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	hr, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hr.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(hr)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// RunOTLPExporter pushes the metrics to the OTLP/HTTP collector at endpoint
+// (metrics.otlp_endpoint) every interval (0 = 15s) until ctx is done: the
+// counters and gauges of the /metrics scrape, JSON-encoded and named exactly
+// like the Prometheus series. Failures are logged once per streak; the next
+// push carries the cumulative values, so nothing is lost.
+func RunOTLPExporter(ctx context.Context, endpoint string, every time.Duration) {
+	target, err := otlpMetricsURL(endpoint)
+	if err != nil {
+		log.Printf("[metrics] otlp exporter disabled: metrics.otlp_endpoint: %v", err)
+		return
+	}
+	if every <= 0 {
+		every = defaultOTLPInterval
+	}
+	client := &http.Client{Timeout: otlpPushTimeout}
+	t := time.NewTicker(every)
+	defer t.Stop()
+	failing := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			err := pushOTLP(ctx, client, target, time.Now())
+			switch {
+			case err != nil && !failing && ctx.Err() == nil:
+				log.Printf("[metrics] otlp push to %s failed: %v", target, err)
+			case err == nil && failing:
+				log.Printf("[metrics] otlp push to %s recovered", target)
+			}
+			failing = err != nil
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRunOTLPExporter_PushesTelemetry(t *testing.T) {
+	metricsMu.Lock()
+	metrics = telemetry{}
+	metricsMu.Unlock()
+
+	EnablePrometheusMetrics()
+	observeSelection("edge-1", "tcp")
+	observeSelection("edge-1", "tcp")
+	setHealthy("edge-1", "tcp", true)
+	observeDial("edge-1", "tcp", "h2", 300*time.Millisecond)
+
+	pushed := make(chan otlpExportRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/metrics" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("push %s %s (%s), want POST /v1/metrics as JSON", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		var req otlpExportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode push: %v", err)
+		}
+		select {
+		case pushed <- req:
+		default:
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go RunOTLPExporter(ctx, srv.URL, 20*time.Millisecond)
+
+	var req otlpExportRequest
+	select {
+	case req = <-pushed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no OTLP push within 2s")
+	}
+	if len(req.ResourceMetrics) != 1 || len(req.ResourceMetrics[0].ScopeMetrics) != 1 {
+		t.Fatalf("unexpected request shape: %+v", req)
+	}
+	byName := map[string]otlpMetric{}
+	for _, m := range req.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		byName[m.Name] = m
+	}
+
+	sel := byName["outlinews_upstream_selected_total"].Sum
+	if sel == nil || !sel.IsMonotonic || sel.AggregationTemporality != otlpCumulative || len(sel.DataPoints) != 1 {
+		t.Fatalf("outlinews_upstream_selected_total = %+v, want one cumulative monotonic sum", sel)
+	}
+	p := sel.DataPoints[0]
+	if p.AsInt != "2" || len(p.Attributes) != 2 || p.Attributes[0].Key != "upstream" || p.Attributes[0].Value.StringValue != "edge-1" {
+		t.Fatalf("selected point = %+v, want 2 with upstream=edge-1,proto=tcp", p)
+	}
+	if g := byName["outlinews_upstream_healthy"].Gauge; g == nil || *g.DataPoints[0].AsDouble != 1 {
+		t.Fatalf("outlinews_upstream_healthy = %+v, want gauge 1", g)
+	}
+	if s := byName["outlinews_ws_dial_duration_seconds"].Summary; s == nil || s.DataPoints[0].Count != "1" || s.DataPoints[0].Sum != 0.3 {
+		t.Fatalf("outlinews_ws_dial_duration_seconds = %+v, want count 1 sum 0.3", s)
+	}
+	if _, ok := byName["outlinews_connections_active"]; !ok {
+		t.Fatal("unlabeled gauge outlinews_connections_active not exported")
+	}
+}
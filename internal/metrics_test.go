@@ -1,11 +1,18 @@
 package internal
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/x509"
 	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -147,6 +154,28 @@ func TestProbeMetricsExposed(t *testing.T) {
 	}
 }
 
+func TestUDPSessionLifetimeExposed(t *testing.T) {
+	metricsMu.Lock()
+	metrics = telemetry{}
+	metricsMu.Unlock()
+
+	EnablePrometheusMetrics()
+	observeUDPSessionGC(time.Second)
+	observeUDPSessionGC(2 * time.Second)
+
+	rr := httptest.NewRecorder()
+	metricsHandler(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rr.Body.String()
+	for _, want := range []string{
+		"outlinews_udp_session_lifetime_seconds_count 2\n",
+		"outlinews_udp_session_lifetime_seconds_sum 3.000000\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("metrics output missing %q\nbody:\n%s", want, body)
+		}
+	}
+}
+
 func TestRuntimeMemoryMetricsExposed(t *testing.T) {
 	metricsMu.Lock()
 	metrics = telemetry{}
@@ -176,3 +205,106 @@ func TestRuntimeMemoryMetricsExposed(t *testing.T) {
 		}
 	}
 }
+
+func TestFailureReason_TypedErrors(t *testing.T) {
+	cases := []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("pick: %w", ErrNoHealthyUpstreams), "no_upstream"},
+		{fmt.Errorf("%w: rfc9220 connect failed: status=403", ErrHandshakeRejected), "handshake"},
+		{wrapTLSError(x509.UnknownAuthorityError{}), "tls"},
+		{fmt.Errorf("dial: %w", ErrH2NotSupported), "unsupported"},
+		{fmt.Errorf("probe: %w", context.DeadlineExceeded), "timeout"},
+		{&net.DNSError{Err: "server misbehaving", Name: "example.com"}, "dns"},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, "refused"},
+	}
+	for _, tc := range cases {
+		if got := failureReason(tc.err); got != tc.want {
+			t.Fatalf("failureReason(%v)=%q want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestMetricsHandler_BearerToken(t *testing.T) {
+	metricsMu.Lock()
+	metrics = telemetry{}
+	metricsMu.Unlock()
+	EnablePrometheusMetrics()
+	SetMetricsToken("s3cret")
+	defer SetMetricsToken("")
+
+	cases := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"missing", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer nope", http.StatusUnauthorized},
+		{"wrong scheme", "Basic s3cret", http.StatusUnauthorized},
+		{"valid", "Bearer s3cret", http.StatusOK},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+		rr := httptest.NewRecorder()
+		metricsHandler(rr, req)
+		if rr.Code != tc.want {
+			t.Fatalf("%s: status=%d want %d", tc.name, rr.Code, tc.want)
+		}
+		if tc.want == http.StatusUnauthorized && strings.Contains(rr.Body.String(), "outlinews_") {
+			t.Fatalf("%s: metrics leaked without auth", tc.name)
+		}
+	}
+
+	SetMetricsToken("")
+	rr := httptest.NewRecorder()
+	metricsHandler(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("no token configured: status=%d want 200", rr.Code)
+	}
+}
+
+func TestMetricsHandler_GzipWhenAccepted(t *testing.T) {
+	metricsMu.Lock()
+	metrics = telemetry{}
+	metricsMu.Unlock()
+
+	EnablePrometheusMetrics()
+	observeUpstreamTraffic("edge-1", "tcp", "in", 4096)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept-Encoding", "deflate, gzip;q=0.8")
+	rr := httptest.NewRecorder()
+	metricsHandler(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("status=%d Content-Encoding=%q, want 200 gzip", rr.Code, rr.Header().Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatalf("gzip reader: %v", err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("decompress: %v", err)
+	}
+	if want := `outlinews_upstream_bytes_total{upstream="edge-1",proto="tcp",dir="in"} 4096`; !strings.Contains(string(body), want) {
+		t.Fatalf("decompressed output missing %q\nbody:\n%s", want, body)
+	}
+
+	// Refused or absent gzip: plain text, as before.
+	for _, ae := range []string{"", "identity", "gzip;q=0"} {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if ae != "" {
+			req.Header.Set("Accept-Encoding", ae)
+		}
+		rr := httptest.NewRecorder()
+		metricsHandler(rr, req)
+		if rr.Header().Get("Content-Encoding") != "" || !strings.Contains(rr.Body.String(), "outlinews_upstream_bytes_total") {
+			t.Fatalf("Accept-Encoding %q: got encoding %q", ae, rr.Header().Get("Content-Encoding"))
+		}
+	}
+}
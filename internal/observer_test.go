@@ -0,0 +1,40 @@
+//go:build observer
+
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestObserverBuild_TunUnavailable(t *testing.T) {
+	if err := RunTunNative(context.Background(), TunConfig{Device: "tun0"}, nil); err == nil {
+		t.Fatal("expected RunTunNative to fail in the observer build")
+	}
+}
+
+func TestObserverBuild_HealthChecksRun(t *testing.T) {
+	hc := HealthcheckConfig{
+		Interval:         10 * time.Millisecond,
+		MinInterval:      5 * time.Millisecond,
+		MaxInterval:      20 * time.Millisecond,
+		Timeout:          time.Second,
+		FailThreshold:    1,
+		SuccessThreshold: 1,
+		BackoffFactor:    1.5,
+	}
+	lb := NewLoadBalancer([]UpstreamConfig{{Name: "a", TCPWSS: "wss://a.example/tcp", UDPWSS: "wss://a.example/udp"}}, hc, SelectionConfig{}, ProbeConfig{}, 0)
+	lb.transportProbe = func(ctx context.Context, rawurl string) (time.Duration, error) {
+		return 5 * time.Millisecond, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lb.RunHealthChecks(ctx)
+
+	waitFor(t, func() bool {
+		s := lb.Snapshot()[0]
+		return s.TCP.Healthy && s.UDP.Healthy && s.TCP.LastCheck != nil
+	}, "observer health checks to mark the upstream healthy")
+}
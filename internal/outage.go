@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"log"
+	"time"
+)
+
+// defaultOutagePoll is how often checks and dials are allowed per upstream
+// while every upstream is down (healthcheck.outage_poll = 0).
+const defaultOutagePoll = 5 * time.Second
+
+func (lb *LoadBalancer) outagePoll() time.Duration {
+	if lb.hc.OutagePoll > 0 {
+		return lb.hc.OutagePoll
+	}
+	return defaultOutagePoll
+}
+
+// refreshOutage recomputes lb.outage from the pool: set when no upstream
+// that serves traffic passes TCP checks although one has been UP before
+// (so startup, before the first UP, is not an outage). That is what a
+// local network drop looks like; without the outage floor, failed tunnels
+// would pull checks down to min_interval and re-dial the whole pool in
+// lockstep until one upstream answers again.
+func (lb *LoadBalancer) refreshOutage(pool []*UpstreamState) {
+	healthy, everUp := false, false
+	for _, s := range pool {
+		if s.cfg.ProbeOnly {
+			continue
+		}
+		s.mu.Lock()
+		healthy = healthy || s.tcp.healthy
+		everUp = everUp || s.tcp.everUp
+		s.mu.Unlock()
+	}
+	outage := everUp && !healthy
+	if lb.outage.Swap(outage) != outage {
+		if outage {
+			log.Printf("[lb] all upstreams down: checks and dials slowed to every %s until one recovers", lb.outagePoll())
+		} else {
+			log.Printf("[lb] an upstream is healthy again: outage over")
+		}
+	}
+}
+
+// outageFloor stretches a check or dial delay to the outage poll while in
+// an outage; otherwise d is returned as is.
+func (lb *LoadBalancer) outageFloor(d time.Duration) time.Duration {
+	if lb.outage.Load() {
+		return max(d, lb.outagePoll())
+	}
+	return d
+}
@@ -6,16 +6,57 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const tcpRelayCopyBufferSize = 256 * 1024
+// tcpRelayCopyBufferSize is the default per-direction relay buffer
+// (copy_buffer_size: 0).
+const tcpRelayCopyBufferSize = 32 * 1024
 
-var tcpRelayBufPool = sync.Pool{
-	New: func() any {
-		b := make([]byte, tcpRelayCopyBufferSize)
-		return &b
-	},
+// relayBufSize is the configured copy_buffer_size; 0 = tcpRelayCopyBufferSize.
+var relayBufSize atomic.Int64
+
+var tcpRelayBufPool sync.Pool
+
+// SetRelayBufferSize sets the per-direction copy buffer used by SOCKS5 and
+// TUN relays; n <= 0 restores the default.
+func SetRelayBufferSize(n int) {
+	relayBufSize.Store(int64(n))
+}
+
+func relayBufferSize() int {
+	if n := relayBufSize.Load(); n > 0 {
+		return int(n)
+	}
+	return tcpRelayCopyBufferSize
+}
+
+// getRelayBuf returns a pooled buffer of the current size; buffers of a
+// previous size are dropped rather than reused.
+func getRelayBuf() *[]byte {
+	size := relayBufferSize()
+	if b, ok := tcpRelayBufPool.Get().(*[]byte); ok && len(*b) == size {
+		return b
+	}
+	b := make([]byte, size)
+	return &b
+}
+
+func putRelayBuf(b *[]byte) {
+	if len(*b) == relayBufferSize() {
+		tcpRelayBufPool.Put(b)
+	}
+}
+
+// relayCopy copies src to dst through a pooled buffer of the configured size.
+// Both ends are wrapped so io.CopyBuffer cannot hand off to ReaderFrom or
+// WriterTo: net.TCPConn and the Shadowsocks stream implement those with
+// their own fixed-size buffers, which would make copy_buffer_size a no-op.
+func relayCopy(dst io.Writer, src io.Reader) (int64, error) {
+	bufPtr := getRelayBuf()
+	defer putRelayBuf(bufPtr)
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *bufPtr)
 }
 
 type relayResult struct {
@@ -25,15 +66,20 @@ type relayResult struct {
 }
 
 func ProxyTCPOverOutlineWS(ctx context.Context, flowID uint64, client net.Conn, wsc WSConn, up UpstreamConfig, dst string) error {
-	wsDebugf("tcp relay init flow=%d upstream=%q dst=%q", flowID, up.Name, dst)
+	wsTracef(ctx, "tcp relay init flow=%d upstream=%q dst=%q", flowID, up.Name, dst)
 	ssconn, err := newSSTCPConn(ctx, wsc, up, dst)
 	if err != nil {
-		wsDebugf("tcp relay init failed flow=%d upstream=%q dst=%q err=%v", flowID, up.Name, dst, err)
+		wsTracef(ctx, "tcp relay init failed flow=%d upstream=%q dst=%q err=%v", flowID, up.Name, dst, err)
 		return err
 	}
 	defer ssconn.Close()
-	wsDebugf("tcp relay init done flow=%d upstream=%q dst=%q", flowID, up.Name, dst)
+	wsTracef(ctx, "tcp relay init done flow=%d upstream=%q dst=%q", flowID, up.Name, dst)
+	return relayTCPOverSS(ctx, flowID, client, ssconn, up, dst)
+}
 
+// relayTCPOverSS relays client over the established Shadowsocks stream
+// ssconn until either side finishes.
+func relayTCPOverSS(ctx context.Context, flowID uint64, client, ssconn net.Conn, up UpstreamConfig, dst string) error {
 	// Full-duplex relay.
 	//
 	// Important: do not proactively CloseWrite() on one side when the opposite
@@ -41,22 +87,18 @@ func ProxyTCPOverOutlineWS(ctx context.Context, flowID uint64, client net.Conn,
 	// break remaining reverse-direction traffic.
 	errC := make(chan relayResult, 2)
 
-	wsDebugf("tcp relay start flow=%d upstream=%q dst=%q", flowID, up.Name, dst)
+	wsTracef(ctx, "tcp relay start flow=%d upstream=%q dst=%q", flowID, up.Name, dst)
 	go func() {
-		bufPtr := tcpRelayBufPool.Get().(*[]byte)
-		defer tcpRelayBufPool.Put(bufPtr)
-		n, e := io.CopyBuffer(ssconn, client, *bufPtr)
+		n, e := relayCopy(ssconn, client)
 		errC <- relayResult{dir: "client->upstream", bytes: n, err: e}
 	}()
 	go func() {
-		bufPtr := tcpRelayBufPool.Get().(*[]byte)
-		defer tcpRelayBufPool.Put(bufPtr)
-		n, e := io.CopyBuffer(client, ssconn, *bufPtr)
+		n, e := relayCopy(client, ssconn)
 		errC <- relayResult{dir: "upstream->client", bytes: n, err: e}
 	}()
 
 	r1 := <-errC
-	wsDebugf("tcp relay side done flow=%d upstream=%q dst=%q dir=%s bytes=%d err=%v", flowID, up.Name, dst, r1.dir, r1.bytes, r1.err)
+	wsTracef(ctx, "tcp relay side done flow=%d upstream=%q dst=%q dir=%s bytes=%d err=%v", flowID, up.Name, dst, r1.dir, r1.bytes, r1.err)
 	e1 := r1.err
 	if e1 != nil && !errors.Is(e1, io.EOF) {
 		// Hard error: force teardown so the other copy unblocks.
@@ -78,7 +120,7 @@ func ProxyTCPOverOutlineWS(ctx context.Context, flowID uint64, client net.Conn,
 	var e2 error
 	select {
 	case r2 = <-errC:
-		wsDebugf("tcp relay side done flow=%d upstream=%q dst=%q dir=%s bytes=%d err=%v", flowID, up.Name, dst, r2.dir, r2.bytes, r2.err)
+		wsTracef(ctx, "tcp relay side done flow=%d upstream=%q dst=%q dir=%s bytes=%d err=%v", flowID, up.Name, dst, r2.dir, r2.bytes, r2.err)
 		e2 = r2.err
 	case <-ctx.Done():
 		_ = ssconn.Close()
@@ -90,14 +132,14 @@ func ProxyTCPOverOutlineWS(ctx context.Context, flowID uint64, client net.Conn,
 	}
 
 	if e1 != nil && !errors.Is(e1, io.EOF) {
-		wsDebugf("tcp relay returning hard error flow=%d upstream=%q dst=%q dir=%s err=%v", flowID, up.Name, dst, r1.dir, e1)
+		wsTracef(ctx, "tcp relay returning hard error flow=%d upstream=%q dst=%q dir=%s err=%v", flowID, up.Name, dst, r1.dir, e1)
 		return e1
 	}
 	if e2 != nil && !errors.Is(e2, io.EOF) {
-		wsDebugf("tcp relay returning hard error flow=%d upstream=%q dst=%q dir=%s err=%v", flowID, up.Name, dst, r2.dir, e2)
+		wsTracef(ctx, "tcp relay returning hard error flow=%d upstream=%q dst=%q dir=%s err=%v", flowID, up.Name, dst, r2.dir, e2)
 		return e2
 	}
-	wsDebugf("tcp relay completed cleanly flow=%d upstream=%q dst=%q first_dir=%s first_err=%v second_dir=%s second_err=%v", flowID, up.Name, dst, r1.dir, e1, r2.dir, e2)
+	wsTracef(ctx, "tcp relay completed cleanly flow=%d upstream=%q dst=%q first_dir=%s first_err=%v second_dir=%s second_err=%v", flowID, up.Name, dst, r1.dir, e1, r2.dir, e2)
 	return nil
 }
 
@@ -109,12 +151,29 @@ type WSStreamConn struct {
 
 	c        WSConn
 	rb       []byte
+	release  func() // returns rb's pooled buffer once it is drained
 	upstream string
 	proto    string
 
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
 	closeOnce sync.Once
 }
 
+// WSStreamStats are the payload byte totals a WSStreamConn has handed to its
+// reader (In) and accepted from its writer (Out).
+type WSStreamStats struct {
+	BytesIn  int64
+	BytesOut int64
+}
+
+// Stats returns the running byte totals. It is safe to call concurrently with
+// Read and Write, and after Close.
+func (w *WSStreamConn) Stats() WSStreamStats {
+	return WSStreamStats{BytesIn: w.bytesIn.Load(), BytesOut: w.bytesOut.Load()}
+}
+
 func NewWSStreamConn(ctx context.Context, c WSConn, upstream, proto string) *WSStreamConn {
 	ctx2, cancel := context.WithCancel(ctx)
 	return &WSStreamConn{ctx: ctx2, cancel: cancel, c: c, upstream: upstream, proto: proto}
@@ -122,20 +181,31 @@ func NewWSStreamConn(ctx context.Context, c WSConn, upstream, proto string) *WSS
 
 func (w *WSStreamConn) Read(p []byte) (int, error) {
 	for len(w.rb) == 0 {
-		typ, data, err := w.c.Read(w.ctx)
+		typ, data, release, err := readPooled(w.ctx, w.c)
 		if err != nil {
 			return 0, err
 		}
 		if typ != WSMessageBinary {
+			release()
 			continue
 		}
-		observeWSFrame("in", len(data))
+		observeWSFrame("in", "data", len(data))
 		observeUpstreamTraffic(w.upstream, w.proto, "in", len(data))
 		wsDebugPayload("in", w.upstream, w.proto, data)
+		if len(data) == 0 {
+			release()
+			continue
+		}
 		w.rb = data
+		w.release = release
 	}
 	n := copy(p, w.rb)
 	w.rb = w.rb[n:]
+	if len(w.rb) == 0 {
+		w.release()
+		w.release = nil
+	}
+	w.bytesIn.Add(int64(n))
 	return n, nil
 }
 
@@ -143,7 +213,8 @@ func (w *WSStreamConn) Write(p []byte) (int, error) {
 	if err := w.c.Write(w.ctx, WSMessageBinary, p); err != nil {
 		return 0, err
 	}
-	observeWSFrame("out", len(p))
+	w.bytesOut.Add(int64(len(p)))
+	observeWSFrame("out", "data", len(p))
 	observeUpstreamTraffic(w.upstream, w.proto, "out", len(p))
 	wsDebugPayload("out", w.upstream, w.proto, p)
 	return len(p), nil
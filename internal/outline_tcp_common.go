@@ -4,7 +4,10 @@ package internal
 
 import (
 	"context"
+	"crypto/sha256"
+	"fmt"
 	"net"
+	"sync"
 
 	"github.com/shadowsocks/go-shadowsocks2/core"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
@@ -17,7 +20,7 @@ import (
 func newSSTCPConn(ctx context.Context, wsc WSConn, up UpstreamConfig, dst string) (net.Conn, error) {
 	wsconn := NewWSStreamConn(ctx, wsc, up.Name, "tcp")
 
-	ciph, err := core.PickCipher(up.Cipher, nil, up.Secret)
+	ciph, err := pickCipher(up.Cipher, up.Secret)
 	if err != nil {
 		return nil, err
 	}
@@ -36,3 +39,65 @@ func newSSTCPConn(ctx context.Context, wsc WSConn, up UpstreamConfig, dst string
 
 	return ssconn, nil
 }
+
+var errPlainCipherDisabled = fmt.Errorf("cipher is unencrypted passthrough; enable it with -insecure-plain-cipher (debugging only)")
+
+// newCipher builds a cipher from its name and secret; replaced in tests.
+var newCipher = core.PickCipher
+
+// cipherKey identifies a cipher+secret pair by hash, so the cache does not
+// hold the plaintext secrets.
+type cipherKey [sha256.Size]byte
+
+func newCipherKey(name, secret string) cipherKey {
+	return sha256.Sum256([]byte(name + "\x00" + secret))
+}
+
+// cipherCache holds one core.Cipher per cipher+secret. A cipher only carries
+// the derived key (each stream or packet picks its own salt), so every
+// connection to an upstream can share it instead of re-deriving the key.
+// Reload prunes it to the configured upstreams (see pruneCipherCache).
+var cipherCache sync.Map // cipherKey -> core.Cipher
+
+// cacheCipherName maps name to the cipher pickCipher builds for it.
+func cacheCipherName(name string) string {
+	if isPlainCipher(name) {
+		return "dummy"
+	}
+	return name
+}
+
+// pruneCipherCache drops the cached ciphers no upstream in ups uses, so the
+// keys of rotated or removed secrets do not stay in memory.
+func pruneCipherCache(ups []UpstreamConfig) {
+	keep := make(map[cipherKey]bool, len(ups))
+	for _, u := range ups {
+		keep[newCipherKey(cacheCipherName(u.Cipher), u.Secret)] = true
+	}
+	cipherCache.Range(func(k, _ any) bool {
+		if !keep[k.(cipherKey)] {
+			cipherCache.Delete(k)
+		}
+		return true
+	})
+}
+
+// pickCipher is core.PickCipher plus the "none"/"plain" passthrough, which
+// is refused unless SetAllowPlainCipher(true). The legacy "dummy" goes to
+// core.PickCipher as before.
+func pickCipher(name, secret string) (core.Cipher, error) {
+	if isPlainCipher(name) && !allowPlainCipher.Load() {
+		return nil, fmt.Errorf("%q: %w", name, errPlainCipherDisabled)
+	}
+	name = cacheCipherName(name)
+	key := newCipherKey(name, secret)
+	if c, ok := cipherCache.Load(key); ok {
+		return c.(core.Cipher), nil
+	}
+	c, err := newCipher(name, nil, secret)
+	if err != nil {
+		return nil, err
+	}
+	actual, _ := cipherCache.LoadOrStore(key, c)
+	return actual.(core.Cipher), nil
+}
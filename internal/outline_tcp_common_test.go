@@ -0,0 +1,61 @@
+//go:build !unit
+
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+)
+
+func TestPickCipher_ConstructedOncePerSecret(t *testing.T) {
+	var built int
+	prev := newCipher
+	newCipher = func(name string, key []byte, password string) (core.Cipher, error) {
+		built++
+		return prev(name, key, password)
+	}
+	t.Cleanup(func() { newCipher = prev })
+
+	up := UpstreamConfig{Name: "a", Cipher: "chacha20-ietf-poly1305", Secret: t.Name()}
+	for range 3 {
+		c, err := newSSTCPConn(context.Background(), &mockWSConn{}, up, "example.com:443")
+		if err != nil {
+			t.Fatalf("newSSTCPConn: %v", err)
+		}
+		_ = c.Close()
+	}
+	if built != 1 {
+		t.Fatalf("cipher constructed %d times for 3 dials, want 1", built)
+	}
+
+	a, _ := pickCipher(up.Cipher, up.Secret)
+	b, err := pickCipher(up.Cipher, up.Secret+"-rotated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if built != 2 || a == b {
+		t.Fatalf("a new secret must build its own cipher (built=%d, shared=%v)", built, a == b)
+	}
+}
+
+func TestPruneCipherCache_DropsRotatedSecrets(t *testing.T) {
+	old := UpstreamConfig{Name: "a", Cipher: "chacha20-ietf-poly1305", Secret: t.Name()}
+	cur := old
+	cur.Secret += "-rotated"
+	for _, up := range []UpstreamConfig{old, cur} {
+		if _, err := pickCipher(up.Cipher, up.Secret); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	NewLoadBalancer([]UpstreamConfig{old}, HealthcheckConfig{}, SelectionConfig{}, ProbeConfig{}, 0).Reload([]UpstreamConfig{cur})
+
+	if _, ok := cipherCache.Load(newCipherKey(old.Cipher, old.Secret)); ok {
+		t.Fatal("cipher of the rotated-out secret still cached")
+	}
+	if _, ok := cipherCache.Load(newCipherKey(cur.Cipher, cur.Secret)); !ok {
+		t.Fatal("cipher of the current secret was dropped")
+	}
+}
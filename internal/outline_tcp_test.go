@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// readSizeRecorder records the buffer length of every Read. It implements
+// io.WriterTo like net.TCPConn does, which relayCopy must not use.
+type readSizeRecorder struct {
+	r     io.Reader
+	sizes []int
+}
+
+func (s *readSizeRecorder) Read(p []byte) (int, error) {
+	s.sizes = append(s.sizes, len(p))
+	return s.r.Read(p)
+}
+
+func (s *readSizeRecorder) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, s.r)
+}
+
+func TestRelayCopy_HonorsConfiguredBufferSize(t *testing.T) {
+	t.Cleanup(func() { SetRelayBufferSize(0) })
+
+	for _, size := range []int{0, 64 * 1024} {
+		SetRelayBufferSize(size)
+		want := size
+		if want == 0 {
+			want = tcpRelayCopyBufferSize
+		}
+
+		payload := bytes.Repeat([]byte("x"), 3*want/2)
+		src := &readSizeRecorder{r: bytes.NewReader(payload)}
+		var dst bytes.Buffer
+		n, err := relayCopy(&dst, src)
+		if err != nil || n != int64(len(payload)) {
+			t.Fatalf("size=%d: relayCopy = %d, %v", size, n, err)
+		}
+		if len(src.sizes) == 0 {
+			t.Fatalf("size=%d: WriteTo was used instead of the relay buffer", size)
+		}
+		for _, got := range src.sizes {
+			if got != want {
+				t.Fatalf("size=%d: read buffer = %d, want %d", size, got, want)
+			}
+		}
+	}
+}
+
+// benchmarkRelayCopy pushes 64 MiB over loopback TCP through relayCopy.
+func benchmarkRelayCopy(b *testing.B, size int) {
+	SetRelayBufferSize(size)
+	b.Cleanup(func() { SetRelayBufferSize(0) })
+
+	const total = 64 << 20
+	chunk := make([]byte, 64*1024)
+	b.SetBytes(total)
+	for i := 0; i < b.N; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			b.Fatal(err)
+		}
+		go func() {
+			c, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				return
+			}
+			for sent := 0; sent < total; sent += len(chunk) {
+				if _, err := c.Write(chunk); err != nil {
+					break
+				}
+			}
+			_ = c.Close()
+		}()
+		c, err := ln.Accept()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if n, err := relayCopy(io.Discard, c); err != nil || n != total {
+			b.Fatalf("relayCopy = %d, %v", n, err)
+		}
+		_ = c.Close()
+		_ = ln.Close()
+	}
+}
+
+func BenchmarkRelayCopy_32KiB(b *testing.B)  { benchmarkRelayCopy(b, 32*1024) }
+func BenchmarkRelayCopy_256KiB(b *testing.B) { benchmarkRelayCopy(b, 256*1024) }
@@ -4,64 +4,154 @@ package internal
 
 import (
 	"context"
+	"log"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/shadowsocks/go-shadowsocks2/core"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
 )
 
+// Redial backoff of a UDP association failover; tests shorten it.
+var (
+	udpFailoverMinBackoff = 200 * time.Millisecond
+	udpFailoverMaxBackoff = 5 * time.Second
+)
+
+// udpFailoverAttempts bounds the redials of one failover (about 6s with the
+// default backoff); after that the association is closed.
+const udpFailoverAttempts = 6
+
+// udpUplink is the upstream leg of a UDPAssociation: one WS stream plus the
+// Shadowsocks PacketConn layered on it.
+type udpUplink struct {
+	up   *UpstreamState // nil when the association is pinned to a bare UpstreamConfig
+	name string
+	wsc  WSConn
+	enc  net.PacketConn // Shadowsocks-encrypted PacketConn over WS packet transport
+	// untrack ends the live-connection count on up (see trackConn)
+	untrack func()
+}
+
+func newUDPUplink(ctx context.Context, cfg UpstreamConfig, wsc WSConn) (*udpUplink, error) {
+	ciph, err := pickCipher(cfg.Cipher, cfg.Secret)
+	if err != nil {
+		_ = wsc.Close(WSStatusNormalClosure, "close")
+		return nil, err
+	}
+	// Underlying packet transport: WS binary message <-> datagram bytes
+	wsPC := NewWSPacketConn(ctx, wsc, cfg.Name, "udp")
+	// Encrypted PacketConn: WriteTo expects plaintext (addr+payload), ReadFrom returns plaintext
+	return &udpUplink{name: cfg.Name, wsc: wsc, enc: ciph.PacketConn(wsPC)}, nil
+}
+
+func (l *udpUplink) close() {
+	_ = l.enc.Close()
+	_ = l.wsc.Close(WSStatusNormalClosure, "")
+	if l.untrack != nil {
+		l.untrack()
+	}
+}
+
 type UDPAssociation struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 
-	uc  net.PacketConn // local UDP relay for SOCKS5 client
-	wsc WSConn
+	uc net.PacketConn // local UDP relay for SOCKS5 client
 
-	enc net.PacketConn // Shadowsocks-encrypted PacketConn over WS packet transport
+	// redial replaces a failed uplink; nil pins the association to its
+	// first upstream (it ends once that one fails).
+	redial   func(ctx context.Context, failed *udpUplink, cause error) (*udpUplink, error)
+	switchMu sync.Mutex // serializes failovers
 
 	mu      sync.Mutex
+	link    *udpUplink
+	closed  bool
 	peerUDP *net.UDPAddr // learned from first client packet
+
+	lastActive atomic.Int64 // unix nanos of the last datagram either way
 }
 
+// NewUDPAssociation opens a SOCKS5 UDP relay pinned to up.
 func NewUDPAssociation(parent context.Context, up UpstreamConfig, fwmark uint32) (*UDPAssociation, error) {
-	ctx, cancel := context.WithCancel(parent)
+	return newUDPAssociation(parent, func(ctx context.Context) (*udpUplink, error) {
+		wsc, err := DialWSStream(withUpstreamAuth(ctx, up), up.UDPWSS, fwmark)
+		if err != nil {
+			return nil, err
+		}
+		return newUDPUplink(ctx, up, dedicatedMuxChannel(up, wsc, wsMuxDatagram))
+	}, nil, fwmark)
+}
 
-	uc, err := net.ListenPacket("udp", ":0")
-	if err != nil {
-		cancel()
-		return nil, err
+// NewFailoverUDPAssociation opens a SOCKS5 UDP relay on up, which pick
+// returned. When the upstream transport fails, the failure is reported to lb
+// and the association moves to the upstream pick returns next, so selection
+// (udp_sticky, the strategy) works as it did for the first one; the
+// client-facing relay socket and learned peer address are kept, so the client
+// sees at most a few dropped datagrams. The association counts as a live
+// connection on the upstream it currently uses.
+func NewFailoverUDPAssociation(parent context.Context, lb *LoadBalancer, up *UpstreamState, pick func() (*UpstreamState, error)) (*UDPAssociation, error) {
+	connect := func(ctx context.Context, st *UpstreamState) (*udpUplink, error) {
+		wsc, err := lb.AcquireUDPWS(ctx, st)
+		if err != nil {
+			return nil, err
+		}
+		l, err := newUDPUplink(ctx, st.cfg, wsc)
+		if err != nil {
+			return nil, err
+		}
+		l.up = st
+		l.untrack = lb.trackConn(st, "udp")
+		return l, nil
 	}
+	return newUDPAssociation(parent, func(ctx context.Context) (*udpUplink, error) {
+		return connect(ctx, up)
+	}, func(ctx context.Context, failed *udpUplink, cause error) (*udpUplink, error) {
+		lb.ReportUDPFailure(failed.up, cause)
+		next, err := pick()
+		if err != nil {
+			return nil, err
+		}
+		l, err := connect(ctx, next)
+		if err != nil {
+			lb.ReportUDPFailure(next, err)
+			return nil, err
+		}
+		return l, nil
+	}, lb.fwmark)
+}
 
-	wsc, err := DialWSStream(ctx, up.UDPWSS, fwmark)
+// udpRelayListenConfig builds the listener of the client-facing relay socket;
+// tests replace it to observe the socket options.
+var udpRelayListenConfig = newMarkedListenConfig
+
+func newUDPAssociation(parent context.Context, dial func(ctx context.Context) (*udpUplink, error), redial func(ctx context.Context, failed *udpUplink, cause error) (*udpUplink, error), fwmark uint32) (*UDPAssociation, error) {
+	ctx, cancel := context.WithCancel(parent)
+
+	// The relay socket honors fwmark too, so policy routing sees it.
+	uc, err := udpRelayListenConfig(fwmark).ListenPacket(ctx, "udp", ":0")
 	if err != nil {
-		_ = uc.Close()
 		cancel()
 		return nil, err
 	}
 
-	ciph, err := core.PickCipher(up.Cipher, nil, up.Secret)
+	link, err := dial(ctx)
 	if err != nil {
-		_ = wsc.Close(WSStatusNormalClosure, "close")
 		_ = uc.Close()
 		cancel()
 		return nil, err
 	}
 
-	// Underlying packet transport: WS binary message <-> datagram bytes
-	wsPC := NewWSPacketConn(ctx, wsc, up.Name, "udp")
-
-	// Encrypted PacketConn: WriteTo expects plaintext (addr+payload), ReadFrom returns plaintext
-	encPC := ciph.PacketConn(wsPC)
-
 	a := &UDPAssociation{
 		ctx:    ctx,
 		cancel: cancel,
 		uc:     uc,
-		wsc:    wsc,
-		enc:    encPC,
+		redial: redial,
+		link:   link,
 	}
 
+	a.lastActive.Store(time.Now().UnixNano())
 	go a.readFromClientLoop()
 	go a.readFromUpstreamLoop()
 
@@ -70,11 +160,90 @@ func NewUDPAssociation(parent context.Context, up UpstreamConfig, fwmark uint32)
 
 func (a *UDPAssociation) LocalAddr() net.Addr { return a.uc.LocalAddr() }
 
+// Done is closed once the association has ended: closed by its owner, or
+// given up after its upstream failed and no other one could be reached.
+func (a *UDPAssociation) Done() <-chan struct{} { return a.ctx.Done() }
+
+// IdleFor reports how long no datagram crossed the association in either
+// direction.
+func (a *UDPAssociation) IdleFor() time.Duration {
+	return time.Since(time.Unix(0, a.lastActive.Load()))
+}
+
 func (a *UDPAssociation) Close() {
 	a.cancel()
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	link := a.link
+	a.mu.Unlock()
 	_ = a.uc.Close()
-	_ = a.enc.Close()
-	_ = a.wsc.Close(WSStatusNormalClosure, "")
+	link.close()
+}
+
+// Upstream names the upstream the association currently relays through.
+func (a *UDPAssociation) Upstream() string { return a.currentLink().name }
+
+func (a *UDPAssociation) currentLink() *udpUplink {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.link
+}
+
+// failover swaps out failed for a new uplink. It returns false when the
+// association should stop: pinned or out of redial attempts (it is closed
+// then, see Done), or closed meanwhile. Concurrent callers reporting the
+// same failed uplink trigger a single redial.
+func (a *UDPAssociation) failover(failed *udpUplink, cause error) bool {
+	if a.ctx.Err() != nil {
+		return false
+	}
+	if a.redial == nil {
+		a.Close()
+		return false
+	}
+	a.switchMu.Lock()
+	defer a.switchMu.Unlock()
+	if a.currentLink() != failed {
+		return true // someone else already switched
+	}
+
+	backoff := udpFailoverMinBackoff
+	for attempt := 1; ; attempt++ {
+		next, err := a.redial(a.ctx, failed, cause)
+		if err == nil {
+			a.mu.Lock()
+			if a.closed {
+				// Close ran while redialing and already closed failed.
+				a.mu.Unlock()
+				next.close()
+				return false
+			}
+			a.link = next
+			a.mu.Unlock()
+			failed.close()
+			log.Printf("[udp] association moved upstream %q -> %q after: %v", failed.name, next.name, cause)
+			publishEvent(Event{Type: EventConnClose, Upstream: failed.name, Proto: "udp", Detail: "failover to=" + next.name})
+			publishEvent(Event{Type: EventFailover, Upstream: next.name, Proto: "udp", Detail: "from=" + failed.name})
+			publishEvent(Event{Type: EventConnOpen, Upstream: next.name, Proto: "udp", Detail: "failover from=" + failed.name})
+			return true
+		}
+		if attempt == udpFailoverAttempts {
+			log.Printf("[udp] association on upstream %q closed: no upstream after %d redials: %v", failed.name, attempt, err)
+			a.Close()
+			return false
+		}
+		wsDebugf("udp association redial failed upstream=%q err=%v (retry in %s)", failed.name, err, backoff)
+		select {
+		case <-a.ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff = minDur(backoff*2, udpFailoverMaxBackoff)
+	}
 }
 
 // SOCKS5 UDP request/response:
@@ -94,6 +263,7 @@ func (a *UDPAssociation) readFromClientLoop() {
 		if n < 4+2+2 { // minimal-ish
 			continue
 		}
+		a.lastActive.Store(time.Now().UnixNano())
 
 		if ua, ok := addr.(*net.UDPAddr); ok {
 			a.mu.Lock()
@@ -129,10 +299,13 @@ func (a *UDPAssociation) readFromClientLoop() {
 		}
 		plain := append(ssAddr, data...)
 
-		// Encrypt+send as one WS binary message (via wsPC underneath)
-		_, err = a.enc.WriteTo(plain, dummyAddr{})
-		if err != nil {
-			return
+		// Encrypt+send as one WS binary message (via wsPC underneath).
+		// On failure the datagram is dropped and the uplink replaced.
+		link := a.currentLink()
+		if _, err := link.enc.WriteTo(plain, dummyAddr{}); err != nil {
+			if !a.failover(link, err) {
+				return
+			}
 		}
 	}
 }
@@ -141,11 +314,16 @@ func (a *UDPAssociation) readFromUpstreamLoop() {
 	buf := make([]byte, 65535)
 	for {
 		// Read decrypted SS UDP plaintext = [socks addr][data]
-		n, _, err := a.enc.ReadFrom(buf)
+		link := a.currentLink()
+		n, _, err := link.enc.ReadFrom(buf)
 		if err != nil {
-			return
+			if !a.failover(link, err) {
+				return
+			}
+			continue
 		}
 		plain := buf[:n]
+		a.lastActive.Store(time.Now().UnixNano())
 
 		// parse addr header length (so we can rebuild SOCKS5 UDP response)
 		_, _, off, err := parseSocksAddrFromPlain(plain)
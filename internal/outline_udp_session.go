@@ -8,7 +8,6 @@ import (
 	"strconv"
 	"sync"
 
-	"github.com/shadowsocks/go-shadowsocks2/core"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
 )
 
@@ -59,7 +58,7 @@ func NewOutlineUDPSession(parent context.Context, lb *LoadBalancer, up *Upstream
 		return nil, err
 	}
 
-	ciph, err := core.PickCipher(up.cfg.Cipher, nil, up.cfg.Secret)
+	ciph, err := pickCipher(up.cfg.Cipher, up.cfg.Secret)
 	if err != nil {
 		_ = wsc.Close(WSStatusNormalClosure, "close")
 		cancel()
@@ -258,7 +257,11 @@ func parseAddrKeyFromPlain(plain []byte) (k addrKey, off int, ok bool) {
 		return k, 0, false
 	}
 
-	// port
+	// port: the per-type checks above already cover it, but keep the read
+	// itself guarded so a future address type cannot turn into a panic.
+	if len(plain) < off+2 {
+		return k, 0, false
+	}
 	k.port = uint16(plain[off])<<8 | uint16(plain[off+1])
 	off += 2
 	return k, off, true
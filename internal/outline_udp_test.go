@@ -0,0 +1,386 @@
+//go:build !unit
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// chanWSConn is a blocking in-memory WSConn: Read waits for queued messages
+// and fails once the conn is killed or closed.
+type chanWSConn struct {
+	reads  chan []byte
+	writes chan []byte
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newChanWSConn() *chanWSConn {
+	return &chanWSConn{reads: make(chan []byte, 8), writes: make(chan []byte, 8), done: make(chan struct{})}
+}
+
+func (c *chanWSConn) Read(ctx context.Context) (WSMessageType, []byte, error) {
+	select {
+	case b := <-c.reads:
+		return WSMessageBinary, b, nil
+	case <-c.done:
+		return 0, nil, errors.New("upstream gone")
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+}
+
+func (c *chanWSConn) Write(ctx context.Context, typ WSMessageType, data []byte) error {
+	select {
+	case <-c.done:
+		return errors.New("upstream gone")
+	default:
+	}
+	c.writes <- append([]byte(nil), data...)
+	return nil
+}
+
+func (c *chanWSConn) Close(code WSStatusCode, reason string) error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+// plainUplink skips Shadowsocks so the test can inspect SS-plaintext datagrams.
+func plainUplink(ctx context.Context, name string, c WSConn) *udpUplink {
+	return &udpUplink{name: name, wsc: c, enc: NewWSPacketConn(ctx, c, name, "udp")}
+}
+
+func TestUDPAssociation_FailsOverMidAssociation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	first, second := newChanWSConn(), newChanWSConn()
+	redialed := make(chan error, 1)
+	assoc, err := newUDPAssociation(ctx, func(ctx context.Context) (*udpUplink, error) {
+		return plainUplink(ctx, "a", first), nil
+	}, func(ctx context.Context, failed *udpUplink, cause error) (*udpUplink, error) {
+		if failed.name != "a" {
+			t.Errorf("failed uplink=%q want a", failed.name)
+		}
+		redialed <- cause
+		return plainUplink(ctx, "b", second), nil
+	}, 0)
+	if err != nil {
+		t.Fatalf("newUDPAssociation: %v", err)
+	}
+	defer assoc.Close()
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen client: %v", err)
+	}
+	defer client.Close()
+	relay := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: assoc.LocalAddr().(*net.UDPAddr).Port}
+
+	// SOCKS5 UDP request to 1.2.3.4:53 with payload "q".
+	req := []byte{0, 0, 0, 0x01, 1, 2, 3, 4, 0, 53, 'q'}
+	ssPlain := []byte{0x01, 1, 2, 3, 4, 0, 53, 'q'}
+
+	if _, err := client.WriteTo(req, relay); err != nil {
+		t.Fatalf("client write: %v", err)
+	}
+	expectWrite(t, first, ssPlain)
+
+	// Upstream "a" dies mid-association.
+	_ = first.Close(WSStatusNormalClosure, "")
+	select {
+	case <-redialed:
+	case <-ctx.Done():
+		t.Fatalf("association did not redial after upstream failure")
+	}
+
+	if _, err := client.WriteTo(req, relay); err != nil {
+		t.Fatalf("client write after failover: %v", err)
+	}
+	expectWrite(t, second, ssPlain)
+
+	// Replies from the new upstream reach the same client relay socket.
+	second.reads <- []byte{0x01, 1, 2, 3, 4, 0, 53, 'r'}
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 64)
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("client read: %v", err)
+	}
+	if want := []byte{0, 0, 0, 0x01, 1, 2, 3, 4, 0, 53, 'r'}; !bytes.Equal(buf[:n], want) {
+		t.Fatalf("client got %v want %v", buf[:n], want)
+	}
+}
+
+func TestUDPAssociation_PinnedStopsOnFailure(t *testing.T) {
+	c := newChanWSConn()
+	assoc, err := newUDPAssociation(context.Background(), func(ctx context.Context) (*udpUplink, error) {
+		return plainUplink(ctx, "a", c), nil
+	}, nil, 0)
+	if err != nil {
+		t.Fatalf("newUDPAssociation: %v", err)
+	}
+	defer assoc.Close()
+
+	if assoc.failover(assoc.currentLink(), errors.New("boom")) {
+		t.Fatalf("pinned association must not fail over")
+	}
+}
+
+func TestUDPAssociation_CloseDuringRedialClosesNewLink(t *testing.T) {
+	first, next := newChanWSConn(), newChanWSConn()
+	redialing, release := make(chan struct{}), make(chan struct{})
+	assoc, err := newUDPAssociation(context.Background(), func(ctx context.Context) (*udpUplink, error) {
+		return plainUplink(ctx, "a", first), nil
+	}, func(ctx context.Context, failed *udpUplink, cause error) (*udpUplink, error) {
+		close(redialing)
+		<-release // a dial that ignores cancellation
+		return plainUplink(context.Background(), "b", next), nil
+	}, 0)
+	if err != nil {
+		t.Fatalf("newUDPAssociation: %v", err)
+	}
+
+	_ = first.Close(WSStatusNormalClosure, "")
+	<-redialing
+	assoc.Close()
+	close(release)
+
+	select {
+	case <-next.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("link dialed after Close was leaked")
+	}
+}
+
+func TestUDPAssociation_GivesUpAfterBoundedRedials(t *testing.T) {
+	defer func(lo, hi time.Duration) { udpFailoverMinBackoff, udpFailoverMaxBackoff = lo, hi }(udpFailoverMinBackoff, udpFailoverMaxBackoff)
+	udpFailoverMinBackoff, udpFailoverMaxBackoff = time.Millisecond, time.Millisecond
+
+	first := newChanWSConn()
+	var mu sync.Mutex
+	redials := 0
+	assoc, err := newUDPAssociation(context.Background(), func(ctx context.Context) (*udpUplink, error) {
+		return plainUplink(ctx, "a", first), nil
+	}, func(ctx context.Context, failed *udpUplink, cause error) (*udpUplink, error) {
+		mu.Lock()
+		redials++
+		mu.Unlock()
+		return nil, errors.New("no upstream")
+	}, 0)
+	if err != nil {
+		t.Fatalf("newUDPAssociation: %v", err)
+	}
+	defer assoc.Close()
+
+	if assoc.failover(assoc.currentLink(), errors.New("boom")) {
+		t.Fatal("failover must give up when every redial fails")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if redials != udpFailoverAttempts {
+		t.Fatalf("redials=%d want %d", redials, udpFailoverAttempts)
+	}
+	if assoc.ctx.Err() == nil {
+		t.Fatal("association must be closed after giving up")
+	}
+}
+
+func expectWrite(t *testing.T, c *chanWSConn, want []byte) {
+	t.Helper()
+	select {
+	case got := <-c.writes:
+		if !bytes.Equal(got, want) {
+			t.Fatalf("upstream got %v want %v", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for upstream write")
+	}
+}
+
+func TestUDPAssociation_RelaySocketCarriesFwmark(t *testing.T) {
+	var gotMark uint32
+	var controlled bool
+	orig := udpRelayListenConfig
+	udpRelayListenConfig = func(fwmark uint32) *net.ListenConfig {
+		gotMark = fwmark
+		lc := orig(0) // fwmark itself needs CAP_NET_ADMIN
+		inner := lc.Control
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			controlled = true
+			return inner(network, address, c)
+		}
+		return lc
+	}
+	defer func() { udpRelayListenConfig = orig }()
+
+	c := newChanWSConn()
+	assoc, err := newUDPAssociation(context.Background(), func(ctx context.Context) (*udpUplink, error) {
+		return plainUplink(ctx, "a", c), nil
+	}, nil, 0x2a)
+	if err != nil {
+		t.Fatalf("newUDPAssociation: %v", err)
+	}
+	defer assoc.Close()
+
+	if !controlled || gotMark != 0x2a {
+		t.Fatalf("relay socket control ran=%t with fwmark=%#x, want true and 0x2a", controlled, gotMark)
+	}
+}
+
+func FuzzParseAddrKeyFromPlain(f *testing.F) {
+	f.Add([]byte{0x01, 1, 2, 3, 4, 0, 53, 'd', 'a', 't', 'a'})
+	f.Add([]byte{0x03, 3, 'a', '.', 'b', 1, 187})
+	f.Add(append([]byte{0x04}, make([]byte, 18)...))
+	f.Add([]byte{0x03, 5, 'a'})
+	f.Fuzz(func(t *testing.T, plain []byte) {
+		k, off, ok := parseAddrKeyFromPlain(plain)
+		_, port, soff, err := parseSocksAddrFromPlain(plain)
+		if ok != (err == nil) {
+			t.Fatalf("parsers disagree: key ok=%t, socks err=%v", ok, err)
+		}
+		if !ok {
+			return
+		}
+		if off <= 0 || off > len(plain) || off != soff {
+			t.Fatalf("offset %d out of bounds or != %d (len %d)", off, soff, len(plain))
+		}
+		if strconv.Itoa(int(k.port)) != port {
+			t.Fatalf("port %d != %s", k.port, port)
+		}
+	})
+}
+
+func TestParseAddrKeyFromPlain_TruncatedPackets(t *testing.T) {
+	domain := []byte{0x03, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0x01, 0xbb}
+	for n := 0; n < len(domain); n++ {
+		if _, _, ok := parseAddrKeyFromPlain(domain[:n]); ok {
+			t.Fatalf("domain packet truncated to %d bytes parsed", n)
+		}
+	}
+	k, off, ok := parseAddrKeyFromPlain(domain)
+	if !ok || off != len(domain) || k.domain != "example.com" || k.port != 443 {
+		t.Fatalf("full domain packet: key=%+v off=%d ok=%t", k, off, ok)
+	}
+
+	for _, pkt := range [][]byte{
+		{0x01, 1, 2, 3, 4, 0},                     // IPv4, one port byte
+		append([]byte{0x04}, make([]byte, 17)...), // IPv6, one port byte
+		{0x03, 0}, // empty domain, no port
+	} {
+		if _, _, ok := parseAddrKeyFromPlain(pkt); ok {
+			t.Fatalf("truncated packet % x parsed", pkt)
+		}
+	}
+}
+
+func TestSocks5UDPAssociate_ControlConnClosedWhenEveryUpstreamFails(t *testing.T) {
+	defer func(lo, hi time.Duration) { udpFailoverMinBackoff, udpFailoverMaxBackoff = lo, hi }(udpFailoverMinBackoff, udpFailoverMaxBackoff)
+	udpFailoverMinBackoff, udpFailoverMaxBackoff = time.Millisecond, time.Millisecond
+
+	lb := NewLoadBalancer([]UpstreamConfig{
+		{Name: "a", UDPWSS: "wss://a.example/udp", Cipher: "chacha20-ietf-poly1305", Secret: t.Name()},
+	}, HealthcheckConfig{}, SelectionConfig{}, ProbeConfig{}, 0)
+	markHealthy(lb.pool[0], false, 10*time.Millisecond)
+	first := newChanWSConn()
+	var dials atomic.Int32
+	lb.tunnelDial = func(context.Context, string) (WSConn, error) {
+		if dials.Add(1) == 1 {
+			return first, nil
+		}
+		return nil, errors.New("upstream unreachable")
+	}
+	srv := &Socks5Server{LB: lb}
+
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		srv.HandleConn(context.Background(), server)
+		close(done)
+	}()
+
+	_, _ = client.Write([]byte{0x05, 0x01, 0x00})
+	greet := make([]byte, 2)
+	if _, err := io.ReadFull(client, greet); err != nil {
+		t.Fatalf("read greeting: %v", err)
+	}
+	_, _ = client.Write([]byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0}) // UDP ASSOCIATE 0.0.0.0:0
+	rep := make([]byte, 4)
+	if _, err := io.ReadFull(client, rep); err != nil || rep[1] != 0x00 {
+		t.Fatalf("associate reply=%v err=%v", rep, err)
+	}
+	bind := 4 + 2 // IPv4 relay address
+	if rep[3] == 0x04 {
+		bind = 16 + 2
+	}
+	if _, err := io.ReadFull(client, make([]byte, bind)); err != nil {
+		t.Fatalf("read relay address: %v", err)
+	}
+
+	_ = first.Close(WSStatusNormalClosure, "") // the upstream drops
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("control connection kept open after the association gave up")
+	}
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Fatal("client control connection still readable")
+	}
+}
+
+func TestFailoverUDPAssociation_MovesTrackingAndPicksThroughCaller(t *testing.T) {
+	lb := NewLoadBalancer([]UpstreamConfig{
+		{Name: "a", UDPWSS: "wss://a.example/udp", Cipher: "chacha20-ietf-poly1305", Secret: t.Name()},
+		{Name: "b", UDPWSS: "wss://b.example/udp", Cipher: "chacha20-ietf-poly1305", Secret: t.Name()},
+	}, HealthcheckConfig{}, SelectionConfig{}, ProbeConfig{}, 0)
+	a, b := lb.pool[0], lb.pool[1]
+	conns := map[string]*chanWSConn{"wss://a.example/udp": newChanWSConn(), "wss://b.example/udp": newChanWSConn()}
+	lb.tunnelDial = func(_ context.Context, rawurl string) (WSConn, error) {
+		for prefix, c := range conns {
+			if strings.HasPrefix(rawurl, prefix) {
+				return c, nil
+			}
+		}
+		return nil, errors.New("unexpected url " + rawurl)
+	}
+	var picks atomic.Int32
+	pick := func() (*UpstreamState, error) {
+		picks.Add(1)
+		return b, nil
+	}
+
+	assoc, err := NewFailoverUDPAssociation(context.Background(), lb, a, pick)
+	if err != nil {
+		t.Fatalf("NewFailoverUDPAssociation: %v", err)
+	}
+	defer assoc.Close()
+	if a.activeUDP.Load() != 1 || b.activeUDP.Load() != 0 {
+		t.Fatalf("active udp a=%d b=%d, want 1/0", a.activeUDP.Load(), b.activeUDP.Load())
+	}
+
+	_ = conns["wss://a.example/udp"].Close(WSStatusNormalClosure, "")
+	waitFor(t, func() bool { return assoc.Upstream() == "b" }, "failover to b")
+	if picks.Load() != 1 {
+		t.Fatalf("redial picked %d times through the caller's pick, want 1", picks.Load())
+	}
+	if a.activeUDP.Load() != 0 || b.activeUDP.Load() != 1 {
+		t.Fatalf("after failover active udp a=%d b=%d, want 0/1", a.activeUDP.Load(), b.activeUDP.Load())
+	}
+
+	assoc.Close()
+	if b.activeUDP.Load() != 0 {
+		t.Fatalf("closed association still counted on b: %d", b.activeUDP.Load())
+	}
+}
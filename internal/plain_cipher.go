@@ -0,0 +1,34 @@
+package internal
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// allowPlainCipher gates cipher "none"/"plain": Shadowsocks is skipped and
+// tunnel bytes cross the WebSocket unencrypted. For debugging only.
+var allowPlainCipher atomic.Bool
+
+// SetAllowPlainCipher permits upstreams with cipher "none" or "plain". Only
+// for isolating WebSocket-layer problems against a plain echo/HTTP server:
+// traffic is neither encrypted nor authenticated.
+func SetAllowPlainCipher(enabled bool) {
+	allowPlainCipher.Store(enabled)
+}
+
+// isPlainCipher reports whether name selects the gated passthrough cipher.
+func isPlainCipher(name string) bool {
+	switch strings.ToLower(name) {
+	case "none", "plain":
+		return true
+	}
+	return false
+}
+
+// isLegacyPlainCipher reports go-shadowsocks2's own spelling of the
+// passthrough, "dummy". Configs used it before the opt-in existed, so it is
+// still accepted without SetAllowPlainCipher; LoadConfig warns that it is
+// deprecated.
+func isLegacyPlainCipher(name string) bool {
+	return strings.EqualFold(name, "dummy")
+}
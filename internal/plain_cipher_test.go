@@ -0,0 +1,90 @@
+//go:build !unit
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+func TestPlainCipher_LoopbackCarriesRawBytes(t *testing.T) {
+	up := UpstreamConfig{Name: "dbg", Cipher: "none"}
+
+	SetAllowPlainCipher(false)
+	if _, err := newSSTCPConn(context.Background(), &mockWSConn{}, up, "example.com:80"); !errors.Is(err, errPlainCipherDisabled) {
+		t.Fatalf("plain cipher without opt-in: err=%v, want errPlainCipherDisabled", err)
+	}
+
+	SetAllowPlainCipher(true)
+	defer SetAllowPlainCipher(false)
+
+	m := &mockWSConn{}
+	m.enqueueRead(WSMessageBinary, []byte("pong"), nil)
+	conn, err := newSSTCPConn(context.Background(), m, up, "example.com:80")
+	if err != nil {
+		t.Fatalf("newSSTCPConn: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "pong" {
+		t.Fatalf("read=%q err=%v, want pong", got, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.writes) != 2 {
+		t.Fatalf("writes=%d want 2 (target header, payload)", len(m.writes))
+	}
+	if want := socks.ParseAddr("example.com:80"); string(m.writes[0].data) != string(want) {
+		t.Fatalf("target header=%x want plain socks addr %x", m.writes[0].data, want)
+	}
+	if string(m.writes[1].data) != "ping" {
+		t.Fatalf("payload=%q want plain ping", m.writes[1].data)
+	}
+}
+
+func TestLoadConfig_PlainCipherNeedsOptIn(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	cfg := "upstreams:\n  - name: dbg\n    tcp_wss: ws://127.0.0.1:8080/tcp\n    cipher: plain\n"
+	if err := os.WriteFile(path, []byte(cfg), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	SetAllowPlainCipher(false)
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), "-insecure-plain-cipher") {
+		t.Fatalf("expected opt-in error, got %v", err)
+	}
+
+	SetAllowPlainCipher(true)
+	defer SetAllowPlainCipher(false)
+	if _, err := LoadConfig(path); err != nil {
+		t.Fatalf("LoadConfig with opt-in: %v", err)
+	}
+}
+
+func TestLoadConfig_LegacyDummyCipherStillAccepted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	cfg := "upstreams:\n  - name: dbg\n    tcp_wss: ws://127.0.0.1:8080/tcp\n    cipher: dummy\n"
+	if err := os.WriteFile(path, []byte(cfg), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	SetAllowPlainCipher(false)
+	if _, err := LoadConfig(path); err != nil {
+		t.Fatalf("LoadConfig with cipher dummy: %v", err)
+	}
+	if _, err := pickCipher("dummy", ""); err != nil {
+		t.Fatalf("pickCipher(dummy): %v", err)
+	}
+}
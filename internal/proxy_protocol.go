@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+)
+
+// PROXY protocol (HAProxy, v1 text and v2 binary) written at the start of the
+// outbound TCP connection, ahead of TLS, for upstreams that sit behind a
+// load balancer expecting it (upstream.send_proxy_protocol).
+
+// proxyProtocolHint ("v1"/"v2") and proxySourceHint carry the upstream's
+// send_proxy_protocol and proxy_protocol_source to DialWSStream.
+var (
+	proxyProtocolHint = dialHint("proxy_protocol")
+	proxySourceHint   = dialHint("proxy_source")
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+type proxySourceKey struct{}
+
+// withProxySource records the client address a tunnel is dialed for, to be
+// declared as the source in the PROXY header.
+func withProxySource(ctx context.Context, src net.Addr) context.Context {
+	return context.WithValue(ctx, proxySourceKey{}, src)
+}
+
+func proxySourceFrom(ctx context.Context) net.Addr {
+	src, _ := ctx.Value(proxySourceKey{}).(net.Addr)
+	return src
+}
+
+func addrPort(a net.Addr) (netip.AddrPort, bool) {
+	if a == nil {
+		return netip.AddrPort{}, false
+	}
+	if ta, ok := a.(*net.TCPAddr); ok {
+		ap := ta.AddrPort()
+		return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), ap.IsValid()
+	}
+	ap, err := netip.ParseAddrPort(a.String())
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), true
+}
+
+// proxyProtocolHeader builds a PROXY header declaring a TCP connection from
+// src to dst. Without a usable src (health checks, standbys) or when the
+// address families differ, it declares an unknown/local connection so the
+// server falls back to the real peer address.
+func proxyProtocolHeader(version string, src, dst net.Addr) ([]byte, error) {
+	s, sok := addrPort(src)
+	d, dok := addrPort(dst)
+	known := sok && dok && s.Addr().Is4() == d.Addr().Is4()
+
+	switch version {
+	case "v1":
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		fam := "TCP4"
+		if s.Addr().Is6() {
+			fam = "TCP6"
+		}
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", fam, s.Addr(), d.Addr(), s.Port(), d.Port()), nil
+	case "v2":
+		h := append([]byte(nil), proxyV2Signature...)
+		if !known {
+			return append(h, 0x20, 0x00, 0, 0), nil // LOCAL, AF_UNSPEC
+		}
+		fam, addrs := byte(0x11), make([]byte, 0, 36) // TCP over IPv4
+		if s.Addr().Is6() {
+			fam = 0x21 // TCP over IPv6
+		}
+		addrs = append(addrs, s.Addr().AsSlice()...)
+		addrs = append(addrs, d.Addr().AsSlice()...)
+		addrs = binary.BigEndian.AppendUint16(addrs, s.Port())
+		addrs = binary.BigEndian.AppendUint16(addrs, d.Port())
+		h = append(h, 0x21, fam) // v2, PROXY
+		h = binary.BigEndian.AppendUint16(h, uint16(len(addrs)))
+		return append(h, addrs...), nil
+	}
+	return nil, fmt.Errorf("unknown PROXY protocol version %q", version)
+}
+
+type dialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// proxyProtocolDial wraps dial so every connection starts with a PROXY
+// header. The declared source is source ("ip:port") when set, otherwise the
+// client recorded by withProxySource.
+func proxyProtocolDial(dial dialContextFunc, version, source string) dialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		src := proxySourceFrom(ctx)
+		if source != "" {
+			if ap, err := netip.ParseAddrPort(source); err == nil {
+				src = net.TCPAddrFromAddrPort(ap)
+			}
+		}
+		h, err := proxyProtocolHeader(version, src, c.RemoteAddr())
+		if err == nil {
+			_, err = c.Write(h)
+		}
+		if err != nil {
+			_ = c.Close()
+			return nil, fmt.Errorf("send PROXY header: %w", err)
+		}
+		return c, nil
+	}
+}
+
+// proxyPerClient reports whether u declares each tunnel's own client in its
+// PROXY header, so a connection dialed ahead of time cannot be reused.
+func (u UpstreamConfig) proxyPerClient() bool {
+	return u.SendProxyProtocol != "" && u.ProxyProtocolSource == ""
+}
+
+// mayDialH3 reports whether a tunnel dial of u can end on h3, where QUIC
+// leaves no TCP stream to put a PROXY header on: an h3 mode hint in either
+// URL, or an h3 rung in the transport ladder that no mode hint overrides.
+func (u UpstreamConfig) mayDialH3() bool {
+	for _, raw := range []string{u.TCPWSS, u.UDPWSS} {
+		if raw == "" {
+			continue
+		}
+		parsed, err := url.Parse(upstreamDialURL(raw, u))
+		if err != nil {
+			continue
+		}
+		q := parsed.Query()
+		tryH2, _, tryH3, _, connectOnly := parseTransportHints(q)
+		if tryH3 {
+			return true
+		}
+		if tryH2 || connectOnly {
+			continue
+		}
+		if order, err := parseTransportOrder(q.Get(transportOrderHint)); err == nil && slices.Contains(order, "h3") {
+			return true
+		}
+	}
+	return false
+}
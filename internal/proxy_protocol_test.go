@@ -0,0 +1,84 @@
+//go:build !unit
+
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyProtocolHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 4242}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 4242}
+
+	cases := []struct {
+		name     string
+		version  string
+		src, dst net.Addr
+		want     []byte
+	}{
+		{"v1 tcp4", "v1", src, dst, []byte("PROXY TCP4 203.0.113.7 198.51.100.1 4242 443\r\n")},
+		{"v1 no client", "v1", nil, dst, []byte("PROXY UNKNOWN\r\n")},
+		{"v1 mixed families", "v1", src6, dst, []byte("PROXY UNKNOWN\r\n")},
+		{"v2 tcp4", "v2", src, dst, append(append([]byte(nil), proxyV2Signature...),
+			0x21, 0x11, 0x00, 0x0c, 203, 0, 113, 7, 198, 51, 100, 1, 0x10, 0x92, 0x01, 0xbb)},
+		{"v2 no client", "v2", nil, dst, append(append([]byte(nil), proxyV2Signature...), 0x20, 0x00, 0x00, 0x00)},
+	}
+	for _, tc := range cases {
+		got, err := proxyProtocolHeader(tc.version, tc.src, tc.dst)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Fatalf("%s:\n got % x\nwant % x", tc.name, got, tc.want)
+		}
+	}
+	if _, err := proxyProtocolHeader("v3", src, dst); err == nil {
+		t.Fatal("unknown version accepted")
+	}
+}
+
+// TestDialWSStream_ProxyHeaderPrecedesTLS checks that the PROXY header is the
+// first thing on the wire, ahead of the TLS ClientHello, on h1 and raw h2.
+func TestDialWSStream_ProxyHeaderPrecedesTLS(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 4242}
+	for _, hint := range []string{"", "&h2=only"} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := ln.Addr().(*net.TCPAddr).Port
+		got := make(chan []byte, 1)
+		go func() {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+			br := bufio.NewReader(c)
+			line, _ := br.ReadBytes('\n')
+			next := make([]byte, 1)
+			_, _ = io.ReadFull(br, next)
+			got <- append(line, next...)
+		}()
+
+		ctx, cancel := context.WithTimeout(withProxySource(context.Background(), client), 3*time.Second)
+		rawurl := fmt.Sprintf("wss://127.0.0.1:%d/tcp?proxy_protocol=v1%s", port, hint)
+		_, _ = DialWSStream(ctx, rawurl, 0) // the listener never completes TLS
+		cancel()
+		_ = ln.Close()
+
+		want := fmt.Sprintf("PROXY TCP4 203.0.113.7 127.0.0.1 4242 %d\r\n\x16", port) // 0x16: TLS handshake record
+		if b := <-got; string(b) != want {
+			t.Fatalf("hint=%q: wire starts with %q, want %q", hint, b, want)
+		}
+	}
+}
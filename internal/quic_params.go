@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (c QUICConfig) validate() error {
+	for name, v := range map[string]int64{
+		"max_bidi_streams":    c.MaxBidiStreams,
+		"max_uni_streams":     c.MaxUniStreams,
+		"stream_read_buffer":  c.StreamReadBuffer,
+		"stream_write_buffer": c.StreamWriteBuffer,
+		"conn_read_buffer":    c.ConnReadBuffer,
+	} {
+		if v < 0 {
+			return fmt.Errorf("quic.%s must be >= 0, got %d", name, v)
+		}
+	}
+	if c.KeepAlivePeriod < 0 {
+		return fmt.Errorf("quic.keepalive_period must be >= 0, got %s", c.KeepAlivePeriod)
+	}
+	return nil
+}
+
+// dialHint encodes c as the quic_params hint, "idle=30s,keepalive=10s,
+// bidi=100,...": QUICConfig travels to the h3 dialer in the URL like the
+// other per-upstream dial settings.
+func (c QUICConfig) dialHint() string {
+	var parts []string
+	if c.MaxIdleTimeout != 0 {
+		parts = append(parts, "idle="+c.MaxIdleTimeout.String())
+	}
+	if c.KeepAlivePeriod != 0 {
+		parts = append(parts, "keepalive="+c.KeepAlivePeriod.String())
+	}
+	for _, kv := range []struct {
+		key string
+		v   int64
+	}{
+		{"bidi", c.MaxBidiStreams},
+		{"uni", c.MaxUniStreams},
+		{"stream_rbuf", c.StreamReadBuffer},
+		{"stream_wbuf", c.StreamWriteBuffer},
+		{"conn_rbuf", c.ConnReadBuffer},
+	} {
+		if kv.v != 0 {
+			parts = append(parts, kv.key+"="+strconv.FormatInt(kv.v, 10))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// quicParamsHint carries UpstreamConfig.QUIC to the h3 dialer.
+var quicParamsHint = dialHint("quic_params")
+
+// parseQUICHint decodes a quic_params hint; unknown or malformed entries are
+// ignored and leave the library default.
+func parseQUICHint(s string) QUICConfig {
+	var c QUICConfig
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "idle", "keepalive":
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				continue
+			}
+			if k == "idle" {
+				c.MaxIdleTimeout = d
+			} else {
+				c.KeepAlivePeriod = d
+			}
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			continue
+		}
+		switch k {
+		case "bidi":
+			c.MaxBidiStreams = n
+		case "uni":
+			c.MaxUniStreams = n
+		case "stream_rbuf":
+			c.StreamReadBuffer = n
+		case "stream_wbuf":
+			c.StreamWriteBuffer = n
+		case "conn_rbuf":
+			c.ConnReadBuffer = n
+		}
+	}
+	return c
+}
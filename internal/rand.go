@@ -1,6 +1,8 @@
 package internal
 
 import (
+	crand "crypto/rand"
+	"encoding/binary"
 	"math/rand"
 	"sync"
 	"time"
@@ -20,3 +22,20 @@ func randInt63n(n int64) int64 {
 	rngMu.Unlock()
 	return v
 }
+
+// randFloat64 returns a pseudo-random number in [0, 1).
+func randFloat64() float64 {
+	rngMu.Lock()
+	v := rng.Float64()
+	rngMu.Unlock()
+	return v
+}
+
+// dnsTxID returns an unpredictable DNS transaction ID, so probe queries can
+// neither be guessed by an off-path spoofer nor collide with the previous
+// probe's still-in-flight reply.
+func dnsTxID() uint16 {
+	var b [2]byte
+	_, _ = crand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
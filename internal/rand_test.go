@@ -33,3 +33,24 @@ func TestRandInt63n_Range(t *testing.T) {
 		}
 	}
 }
+
+func TestDNSTxID_NotSequential(t *testing.T) {
+	const n = 64
+	ids := make([]uint16, n)
+	for i := range ids {
+		ids[i] = dnsTxID()
+	}
+	seen := map[uint16]bool{}
+	sequential := 0
+	for i, id := range ids {
+		seen[id] = true
+		if i > 0 && id-ids[i-1] <= 1 {
+			sequential++
+		}
+	}
+	// Clock-derived IDs taken back to back repeat or step by one; random
+	// ones almost never do.
+	if sequential > 2 || len(seen) < n-2 {
+		t.Fatalf("txids look sequential: %v", ids)
+	}
+}
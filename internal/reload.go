@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"log"
+	"reflect"
+	"time"
+)
+
+// Reload replaces the upstream list of a running balancer, e.g. after the
+// config file was edited and SIGHUP sent. Upstreams whose config did not
+// change keep their state (health, cooldowns, standbys, live tunnels).
+// Added and changed ones get a fresh state that is checked on the next
+// scheduler tick. The state of a removed or changed upstream is retired: it
+// leaves the pool, is marked draining and its warm standbys are closed, so
+// no new tunnel uses the old URL or credentials; tunnels already open on it
+// run until their clients close them.
+func (lb *LoadBalancer) Reload(ups []UpstreamConfig) {
+	now := time.Now()
+	lb.mu.Lock()
+	prev := make(map[string]*UpstreamState, len(lb.pool))
+	for _, s := range lb.pool {
+		prev[s.cfg.Name] = s
+	}
+	pool := make([]*UpstreamState, 0, len(ups))
+	var fresh, retired []*UpstreamState
+	for _, u := range ups {
+		s := newUpstreamState(u)
+		if old, ok := prev[u.Name]; ok {
+			delete(prev, u.Name)
+			if reflect.DeepEqual(old.cfg, s.cfg) {
+				pool = append(pool, old)
+				continue
+			}
+			retired = append(retired, old)
+			log.Printf("[lb] reload: upstream %q changed", u.Name)
+		} else {
+			log.Printf("[lb] reload: upstream %q added", u.Name)
+		}
+		s.tcp.nextHC, s.udp.nextHC = now, now
+		s.tcp.hcEvery, s.udp.hcEvery = lb.hc.Interval, lb.hc.Interval
+		pool = append(pool, s)
+		fresh = append(fresh, s)
+	}
+	var removed []string
+	for name, old := range prev {
+		retired = append(retired, old)
+		removed = append(removed, name)
+		log.Printf("[lb] reload: upstream %q removed (active tcp=%d udp=%d)", name, old.activeTCP.Load(), old.activeUDP.Load())
+	}
+	lb.pool = pool
+	for _, s := range retired {
+		lb.unstickLocked(s)
+	}
+	lb.mu.Unlock()
+	pruneCipherCache(ups)
+
+	for _, s := range fresh {
+		setDraining(s.cfg.Name, s.cfg.Drain)
+		if lb.probesOff.Load() {
+			s.assumeHealthy()
+		}
+	}
+	for _, s := range retired {
+		lb.retire(s)
+	}
+	for _, name := range removed {
+		setDraining(name, true)
+	}
+	lb.notifyUpstreamAddrs()
+}
+
+// upstreamAddrsChanged returns a channel that is closed the next time the
+// upstream addresses may have changed: after Reload, or when the DNS refresh
+// sees a host resolve differently. Callers caching those addresses (the TUN
+// loop guard) rebuild then and ask again.
+func (lb *LoadBalancer) upstreamAddrsChanged() <-chan struct{} {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if lb.addrsChanged == nil {
+		lb.addrsChanged = make(chan struct{})
+	}
+	return lb.addrsChanged
+}
+
+func (lb *LoadBalancer) notifyUpstreamAddrs() {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if lb.addrsChanged != nil {
+		close(lb.addrsChanged)
+		lb.addrsChanged = nil
+	}
+}
+
+// retire drains s after Reload took it out of the pool.
+func (lb *LoadBalancer) retire(s *UpstreamState) {
+	s.retired.Store(true)
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+	lb.dropStandbys(s, "config-reload")
+}
@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReload_ChangedUpstreamDropsStaleStandby(t *testing.T) {
+	lb := NewLoadBalancer([]UpstreamConfig{
+		{Name: "a", Weight: 1, TCPWSS: "wss://old.example/tcp"},
+		{Name: "b", Weight: 1, TCPWSS: "wss://b.example/tcp"},
+		{Name: "c", Weight: 1, TCPWSS: "wss://c.example/tcp"},
+	}, HealthcheckConfig{Interval: time.Second}, SelectionConfig{}, ProbeConfig{}, 0)
+	a, b, c := lb.pool[0], lb.pool[1], lb.pool[2]
+	ma, mb, mc := &mockWSConn{}, &mockWSConn{}, &mockWSConn{}
+	a.standbyTCP, b.standbyTCP, c.standbyTCP = ma, mb, mc
+
+	lb.Reload([]UpstreamConfig{
+		{Name: "a", Weight: 1, TCPWSS: "wss://new.example/tcp"},
+		{Name: "b", Weight: 1, TCPWSS: "wss://b.example/tcp"},
+	})
+
+	if len(lb.pool) != 2 {
+		t.Fatalf("pool has %d upstreams after reload, want 2", len(lb.pool))
+	}
+	if !ma.closed || a.standbyTCP != nil {
+		t.Fatal("standby dialed with the old URL was kept")
+	}
+	if !a.Draining() || !a.retired.Load() {
+		t.Fatal("replaced state is not drained")
+	}
+	na := lb.pool[0]
+	if na == a || !strings.HasPrefix(na.cfg.TCPWSS, "wss://new.example/tcp") || na.standbyTCP != nil {
+		t.Fatalf("changed upstream not rebuilt with the new URL: %q", na.cfg.TCPWSS)
+	}
+	if na.tcp.hcEvery != time.Second || na.tcp.nextHC.IsZero() {
+		t.Fatal("rebuilt upstream is not scheduled for a health check")
+	}
+
+	if lb.pool[1] != b || mb.closed || b.standbyTCP != mb {
+		t.Fatal("unchanged upstream lost its state or standby")
+	}
+	if !mc.closed || !c.Draining() {
+		t.Fatal("removed upstream kept its standby or was not drained")
+	}
+
+	// A warm-up that was already running for the old state does not park
+	// its conn there.
+	late := &mockWSConn{}
+	lb.tunnelDial = func(context.Context, string) (WSConn, error) { return late, nil }
+	markHealthy(a, true, 10*time.Millisecond)
+	lb.EnsureStandbyTCP(context.Background(), a)
+	if a.standbyTCP != nil || !late.closed {
+		t.Fatal("standby dialed after reload kept on the retired upstream")
+	}
+}
@@ -5,16 +5,13 @@ package internal
 import (
 	"bufio"
 	"context"
-	"crypto/rand"
-	"crypto/sha1"
 	"crypto/tls"
-	"encoding/base64"
-	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -26,9 +23,18 @@ import (
 const (
 	rawH2MaxDataFrameChunk = 16 * 1024
 	rawH2WindowUpdateBatch = 64 * 1024
+	// rawH2DefaultWindow is the receive window we advertise unless the
+	// upstream sets h2_window_size; the protocol default of 65535 caps a
+	// high-BDP path at 64 KiB in flight.
+	rawH2DefaultWindow = 1 << 20
+	http2InitialWindow = 65535
+	http2MaxWindow     = 1<<31 - 1
+	// rawH2CloseGrace bounds how long Close waits for the server's END_STREAM
+	// after our own END_STREAM before falling back to RST_STREAM(CANCEL).
+	rawH2CloseGrace = time.Second
 )
 
-var errRFC8441HandshakeFailed = errors.New("rfc8441 handshake failed")
+var errRFC8441HandshakeFailed = fmt.Errorf("rfc8441 handshake failed: %w", ErrHandshakeRejected)
 
 // dialRFC8441RawH2 speaks RFC 8441 (Extended CONNECT) directly over HTTP/2.
 //
@@ -40,7 +46,7 @@ var errRFC8441HandshakeFailed = errors.New("rfc8441 handshake failed")
 //   - One HTTP/2 connection per WS connection.
 func dialRFC8441RawH2(ctx context.Context, u *url.URL, tr *http.Transport) (WSConn, error) {
 	if u.Scheme != "wss" {
-		return nil, fmt.Errorf("rfc8441 raw h2 requires wss, got %q", u.Scheme)
+		return nil, fmt.Errorf("%w: rfc8441 raw h2 requires wss, got %q", ErrH2NotSupported, u.Scheme)
 	}
 
 	host := u.Host
@@ -51,18 +57,21 @@ func dialRFC8441RawH2(ctx context.Context, u *url.URL, tr *http.Transport) (WSCo
 	// Dial TCP using the same dialer (fwmark/proxy settings already applied).
 	dialCtx := tr.DialContext
 	if dialCtx == nil {
-		dialer := &net.Dialer{Timeout: 10 * time.Second}
+		dialer := &net.Dialer{Timeout: wsDialTimeout(u.Query())}
 		dialCtx = dialer.DialContext
 	}
 
-	wsDebugf("h2raw: dial tcp host=%q sni=%q path=%q", host, u.Hostname(), u.Path)
+	phases := newDialPhaseTimer(ctx, u, "h2")
+	wsTracef(ctx, "h2raw: dial tcp host=%q sni=%q path=%q", host, u.Hostname(), u.Path)
+	start := time.Now()
 	tcpConn, err := dialCtx(ctx, "tcp", host)
 	if err != nil {
 		return nil, err
 	}
+	phases.done(dialPhaseConnect, start)
 
 	// TLS handshake with ALPN h2.
-	tlsConf := &tls.Config{MinVersion: tls.VersionTLS12}
+	tlsConf := withUpstreamTLS(&tls.Config{MinVersion: tls.VersionTLS12})
 	if tr.TLSClientConfig != nil {
 		tlsConf = tr.TLSClientConfig.Clone()
 	}
@@ -90,34 +99,58 @@ func dialRFC8441RawH2(ctx context.Context, u *url.URL, tr *http.Transport) (WSCo
 		}
 	}
 
+	handshakeTimeout := tr.TLSHandshakeTimeout
+	if handshakeTimeout <= 0 {
+		handshakeTimeout = wsDialTimeout(u.Query())
+	}
+	hctx, hcancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer hcancel()
 	tlsConn := tls.Client(tcpConn, tlsConf)
-	wsDebugf("h2raw: tls handshake start servername=%q", tlsConf.ServerName)
-	if err := tlsConn.HandshakeContext(ctx); err != nil {
+	wsTracef(ctx, "h2raw: tls handshake start servername=%q", tlsConf.ServerName)
+	start = time.Now()
+	if err := tlsConn.HandshakeContext(hctx); err != nil {
 		_ = tlsConn.Close()
-		return nil, err
+		return nil, wrapTLSError(err)
 	}
-	wsDebugf("h2raw: tls handshake done negotiated_alpn=%q", tlsConn.ConnectionState().NegotiatedProtocol)
+	phases.done(dialPhaseTLS, start)
+	wsTracef(ctx, "h2raw: tls handshake done negotiated_alpn=%q", tlsConn.ConnectionState().NegotiatedProtocol)
 	if tlsConn.ConnectionState().NegotiatedProtocol != "h2" {
 		_ = tlsConn.Close()
-		return nil, fmt.Errorf("rfc8441 requires h2 ALPN, negotiated %q", tlsConn.ConnectionState().NegotiatedProtocol)
+		// An HTTP/1.1-only server: h2=1 falls back to the h1 upgrade.
+		return nil, fmt.Errorf("%w: rfc8441 requires h2 ALPN, negotiated %q", ErrH2NotSupported, tlsConn.ConnectionState().NegotiatedProtocol)
 	}
 
 	cc := newRawH2Conn(tlsConn)
-	wsDebugf("h2raw: init connection")
+	cc.connWindow, cc.strWindow = rawH2WindowHint(u), rawH2WindowHint(u)
+	wsTracef(ctx, "h2raw: init connection window=%d", cc.strWindow)
+	start = time.Now()
 	if err := cc.init(ctx); err != nil {
 		_ = cc.Close()
 		return nil, err
 	}
 
-	wsDebugf("h2raw: open websocket stream")
+	wsTracef(ctx, "h2raw: open websocket stream")
 	ws, err := cc.openWebSocketStream(ctx, u)
 	if err != nil {
 		_ = cc.Close()
 		return nil, err
 	}
+	phases.done(dialPhaseHandshake, start)
 	return ws, nil
 }
 
+// h2WindowHint carries UpstreamConfig.H2WindowSize to the raw h2 dialer.
+var h2WindowHint = dialHint("h2_window")
+
+// rawH2WindowHint returns the h2_window dial hint, or rawH2DefaultWindow.
+func rawH2WindowHint(u *url.URL) uint32 {
+	v, err := strconv.ParseUint(u.Query().Get(h2WindowHint), 10, 32)
+	if err != nil || v < http2InitialWindow || v > http2MaxWindow {
+		return rawH2DefaultWindow
+	}
+	return uint32(v)
+}
+
 // ---- raw HTTP/2 connection + single stream ----
 
 type rawH2Conn struct {
@@ -127,7 +160,8 @@ type rawH2Conn struct {
 	rmu sync.Mutex
 	wmu sync.Mutex
 
-	// flow control
+	// Receive windows we grant the server (connection and stream 1).
+	// They start at the protocol default; init advertises anything larger.
 	connWindow uint32
 	strWindow  uint32
 
@@ -145,8 +179,8 @@ func newRawH2Conn(c net.Conn) *rawH2Conn {
 		c:          c,
 		bw:         bw,
 		fr:         fr,
-		connWindow: 65535,
-		strWindow:  65535,
+		connWindow: http2InitialWindow,
+		strWindow:  http2InitialWindow,
 		closed:     make(chan struct{}),
 	}
 }
@@ -169,8 +203,20 @@ func (c *rawH2Conn) init(ctx context.Context) error {
 	// Some servers won't accept ":protocol" unless the client also advertises
 	// this setting.
 	const settingEnableConnectProtocol http2.SettingID = 0x8
+	settings := []http2.Setting{{ID: settingEnableConnectProtocol, Val: 1}}
+	if c.strWindow != http2InitialWindow {
+		settings = append(settings, http2.Setting{ID: http2.SettingInitialWindowSize, Val: c.strWindow})
+	}
 	if err := c.writeFrame(func() error {
-		return c.fr.WriteSettings(http2.Setting{ID: settingEnableConnectProtocol, Val: 1})
+		if err := c.fr.WriteSettings(settings...); err != nil {
+			return err
+		}
+		// SETTINGS only covers streams; the connection window grows by
+		// WINDOW_UPDATE on stream 0.
+		if c.connWindow > http2InitialWindow {
+			return c.fr.WriteWindowUpdate(0, c.connWindow-http2InitialWindow)
+		}
+		return nil
 	}); err != nil {
 		return err
 	}
@@ -205,9 +251,9 @@ func (c *rawH2Conn) init(ctx context.Context) error {
 		}); err != nil {
 			return err // или: return fmt.Errorf("foreach setting: %w", err)
 		}
-		wsDebugf("h2raw: server SETTINGS_ENABLE_CONNECT_PROTOCOL present=%v val=%d", found, serverEnable)
+		wsTracef(ctx, "h2raw: server SETTINGS_ENABLE_CONNECT_PROTOCOL present=%v val=%d", found, serverEnable)
 		if !found || serverEnable != 1 {
-			return fmt.Errorf("rfc8441 not supported by server: SETTINGS_ENABLE_CONNECT_PROTOCOL=%d (present=%v)", serverEnable, found)
+			return fmt.Errorf("%w: server SETTINGS_ENABLE_CONNECT_PROTOCOL=%d (present=%v)", ErrH2NotSupported, serverEnable, found)
 		}
 		// ACK settings
 		return c.writeFrame(func() error { return c.fr.WriteSettingsAck() })
@@ -216,12 +262,10 @@ func (c *rawH2Conn) init(ctx context.Context) error {
 
 func (c *rawH2Conn) openWebSocketStream(ctx context.Context, u *url.URL) (WSConn, error) {
 	// RFC6455 key/accept
-	keyRaw := make([]byte, 16)
-	if _, err := rand.Read(keyRaw); err != nil {
+	key, err := newWebSocketKey()
+	if err != nil {
 		return nil, err
 	}
-	key := base64.StdEncoding.EncodeToString(keyRaw)
-	accept := computeAccept(key)
 
 	// Do not forward client-side control query params (h2/h2only/http2/h2c).
 	// Many servers route by path+query and will reject unknown query values.
@@ -229,22 +273,35 @@ func (c *rawH2Conn) openWebSocketStream(ctx context.Context, u *url.URL) (WSConn
 	// Use authority from URL (includes port when non-default).
 	authority := u.Host
 
+	cred, hasCred := handshakeCredFrom(ctx)
+	reqPath := path
+	if hasCred {
+		reqPath = cred.withQuery(path)
+	}
+
 	// HPACK encode request headers
 	var hb strings.Builder
 	enc := hpack.NewEncoder(&hb)
 	_ = enc.WriteField(hpack.HeaderField{Name: ":method", Value: "CONNECT"})
 	_ = enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "https"})
 	_ = enc.WriteField(hpack.HeaderField{Name: ":authority", Value: authority})
-	_ = enc.WriteField(hpack.HeaderField{Name: ":path", Value: path})
+	_ = enc.WriteField(hpack.HeaderField{Name: ":path", Value: reqPath})
 	_ = enc.WriteField(hpack.HeaderField{Name: ":protocol", Value: "websocket"})
 	_ = enc.WriteField(hpack.HeaderField{Name: "sec-websocket-version", Value: "13"})
 	_ = enc.WriteField(hpack.HeaderField{Name: "sec-websocket-key", Value: key})
 	if origin := u.Query().Get("origin"); origin != "" {
 		_ = enc.WriteField(hpack.HeaderField{Name: "origin", Value: origin})
 	}
+	subprotocol := u.Query().Get("subprotocol")
+	if subprotocol != "" {
+		_ = enc.WriteField(hpack.HeaderField{Name: "sec-websocket-protocol", Value: subprotocol})
+	}
+	if hasCred && cred.header != "" {
+		_ = enc.WriteField(hpack.HeaderField{Name: strings.ToLower(cred.header), Value: cred.value})
+	}
 
 	// Send HEADERS on stream 1.
-	wsDebugf("h2raw: send CONNECT :authority=%q :path=%q", authority, path)
+	wsTracef(ctx, "h2raw: send CONNECT :authority=%q :path=%q", authority, path)
 	if err := c.writeFrame(func() error {
 		return c.fr.WriteHeaders(http2.HeadersFrameParam{
 			StreamID:      1,
@@ -261,39 +318,38 @@ func (c *rawH2Conn) openWebSocketStream(ctx context.Context, u *url.URL) (WSConn
 	if err != nil {
 		return nil, err
 	}
-	wsDebugf("h2raw: response status=%q", status)
-	if status != "200" {
-		return nil, fmt.Errorf("%w: unexpected status %s", errRFC8441HandshakeFailed, status)
+	wsTracef(ctx, "h2raw: response status=%q", status)
+	if code, _ := strconv.Atoi(status); !wsStatusAccepted(u.Query(), code) {
+		h := make(http.Header, len(hdrs))
+		for k, v := range hdrs {
+			h[k] = []string{v}
+		}
+		return nil, fmt.Errorf("%w: unexpected status %s (headers: %s)", errRFC8441HandshakeFailed, status, formatHandshakeHeaders(h))
 	}
-	if got := hdrs["sec-websocket-accept"]; got != "" && got != accept {
-		return nil, fmt.Errorf("%w: bad sec-websocket-accept", errRFC8441HandshakeFailed)
+	if err := checkAccept(u.Query(), key, hdrs["sec-websocket-accept"]); err != nil {
+		return nil, fmt.Errorf("%w: %w", errRFC8441HandshakeFailed, err)
+	}
+	if err := checkSubprotocol(subprotocol, hdrs["sec-websocket-protocol"]); err != nil {
+		return nil, err
 	}
 
 	// Stream data pump.
 	pr, pw := io.Pipe()
 	ws := &rawH2Stream{
-		parent: c,
-		r:      pr,
-		w:      pw,
+		parent:      c,
+		r:           pr,
+		w:           pw,
+		remoteEnded: make(chan struct{}),
 	}
 	go ws.readLoop(ctx)
-	return newFramedWSConn(ws), nil
+	fc := newFramedWSConn(ws)
+	fc.transport = "h2"
+	return fc, nil
 }
 
 func cleanedRequestURI(u *url.URL) string {
 	// Keep path as-is, but remove our internal control parameters.
-	q := u.Query()
-	q.Del("h2")
-	q.Del("http2")
-	q.Del("h2only")
-	q.Del("h2c")
-	q.Del("h3")
-	q.Del("http3")
-	q.Del("h3only")
-	q.Del("quic")
-	q.Del("test_path")
-	q.Del("health_path")
-	q.Del("hc_path")
+	q := stripDialHints(u).Query()
 
 	// Rebuild a copy so we don't mutate caller URL.
 	path := u.EscapedPath()
@@ -307,12 +363,6 @@ func cleanedRequestURI(u *url.URL) string {
 	return path + "?" + qs
 }
 
-func computeAccept(key string) string {
-	// RFC6455 magic GUID
-	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
-	return base64.StdEncoding.EncodeToString(sum[:])
-}
-
 func (c *rawH2Conn) readResponseHeaders(ctx context.Context, streamID uint32) (status string, hdrs map[string]string, err error) {
 	hdrs = map[string]string{}
 	var block []byte
@@ -417,6 +467,10 @@ type rawH2Stream struct {
 	parent *rawH2Conn
 	r      *io.PipeReader
 	w      *io.PipeWriter // writes into reader? (fed by readLoop)
+
+	writeClosed bool          // END_STREAM sent; guarded by parent.wmu
+	remoteEnded chan struct{} // closed when readLoop exits (END_STREAM, RST, error)
+	closeOnce   sync.Once
 }
 
 func (s *rawH2Stream) Read(p []byte) (int, error) { return s.r.Read(p) }
@@ -425,6 +479,9 @@ func (s *rawH2Stream) Write(p []byte) (int, error) {
 	// Send DATA on stream 1.
 	s.parent.wmu.Lock()
 	defer s.parent.wmu.Unlock()
+	if s.writeClosed {
+		return 0, io.ErrClosedPipe
+	}
 
 	off := 0
 	for off < len(p) {
@@ -444,21 +501,57 @@ func (s *rawH2Stream) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
+// CloseWrite half-closes the stream: it sends an empty DATA frame with
+// END_STREAM (the h2 analogue of TCP FIN) and keeps the read side open so the
+// server can finish sending.
+func (s *rawH2Stream) CloseWrite() error {
+	s.parent.wmu.Lock()
+	defer s.parent.wmu.Unlock()
+	if s.writeClosed {
+		return nil
+	}
+	s.writeClosed = true
+	if err := s.parent.fr.WriteData(1, true, nil); err != nil {
+		return err
+	}
+	return s.parent.bw.Flush()
+}
+
+// Close half-closes the stream and waits up to rawH2CloseGrace for the
+// server's END_STREAM, so in-flight response data is not cut off. Only if the
+// server does not finish in time is the stream reset with CANCEL.
 func (s *rawH2Stream) Close() error {
-	// Best-effort stream close.
-	_ = s.parent.writeFrame(func() error { return s.parent.fr.WriteRSTStream(1, http2.ErrCodeCancel) })
-	_ = s.parent.Close()
-	return s.w.Close()
+	s.closeOnce.Do(func() {
+		if err := s.CloseWrite(); err == nil {
+			select {
+			case <-s.remoteEnded:
+			case <-s.parent.closed:
+			case <-time.After(rawH2CloseGrace):
+				wsDebugf("h2raw: no END_STREAM from server within %s, resetting stream", rawH2CloseGrace)
+				_ = s.parent.writeFrame(func() error { return s.parent.fr.WriteRSTStream(1, http2.ErrCodeCancel) })
+			}
+		}
+		_ = s.parent.Close()
+		_ = s.w.Close()
+	})
+	return nil
 }
 
 func (s *rawH2Stream) readLoop(ctx context.Context) {
+	defer close(s.remoteEnded)
 	defer s.w.Close()
+	// Return credit once half the window (at most one batch) is consumed, so
+	// the server never stalls on an exhausted window.
+	batch := uint32(rawH2WindowUpdateBatch)
+	if half := s.parent.strWindow / 2; half < batch {
+		batch = half
+	}
 	var pendingWindowUpdate uint32
 	flushWindowUpdate := func(force bool) {
 		if pendingWindowUpdate == 0 {
 			return
 		}
-		if !force && pendingWindowUpdate < rawH2WindowUpdateBatch {
+		if !force && pendingWindowUpdate < batch {
 			return
 		}
 		v := pendingWindowUpdate
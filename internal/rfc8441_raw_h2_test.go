@@ -0,0 +1,238 @@
+//go:build !unit
+
+package internal
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// newTestRawH2Stream wires a rawH2Stream (stream 1) to an in-memory peer and
+// returns the server-side framer.
+func newTestRawH2Stream(t *testing.T) (*rawH2Stream, *http2.Framer) {
+	t.Helper()
+	clientSide, serverSide := net.Pipe()
+	t.Cleanup(func() { _ = serverSide.Close() })
+
+	cc := newRawH2Conn(clientSide)
+	pr, pw := io.Pipe()
+	s := &rawH2Stream{parent: cc, r: pr, w: pw, remoteEnded: make(chan struct{})}
+	go s.readLoop(context.Background())
+	return s, http2.NewFramer(serverSide, serverSide)
+}
+
+func TestRawH2Stream_ServerDataAfterClientHalfClose(t *testing.T) {
+	s, srv := newTestRawH2Stream(t)
+
+	serverErr := make(chan error, 1)
+	sawRST := make(chan bool, 1)
+	go func() {
+		// Expect the request DATA, then the client's empty END_STREAM.
+		for {
+			f, err := srv.ReadFrame()
+			if err != nil {
+				serverErr <- err
+				return
+			}
+			if df, ok := f.(*http2.DataFrame); ok && df.StreamEnded() {
+				break
+			}
+		}
+		// Server keeps sending after the client half-closed, then ends its side.
+		if err := srv.WriteData(1, false, []byte("tail-1 ")); err != nil {
+			serverErr <- err
+			return
+		}
+		if err := srv.WriteData(1, true, []byte("tail-2")); err != nil {
+			serverErr <- err
+			return
+		}
+		serverErr <- nil
+		rst := false
+		for {
+			f, err := srv.ReadFrame()
+			if err != nil {
+				break
+			}
+			if _, ok := f.(*http2.RSTStreamFrame); ok {
+				rst = true
+			}
+		}
+		sawRST <- rst
+	}()
+
+	if _, err := s.Write([]byte("req")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := s.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	if _, err := s.Write([]byte("late")); err == nil {
+		t.Fatalf("write after CloseWrite must fail")
+	}
+
+	got, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatalf("read after half-close: %v", err)
+	}
+	if string(got) != "tail-1 tail-2" {
+		t.Fatalf("got %q, server data after half-close was truncated", got)
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() { _ = s.Close(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(rawH2CloseGrace / 2):
+		t.Fatalf("Close waited for grace period although server already ended the stream")
+	}
+	if <-sawRST {
+		t.Fatalf("RST_STREAM sent on a cleanly finished stream")
+	}
+}
+
+func TestRawH2Stream_CloseResetsWhenServerNeverEnds(t *testing.T) {
+	s, srv := newTestRawH2Stream(t)
+
+	sawRST := make(chan bool, 1)
+	go func() {
+		for {
+			f, err := srv.ReadFrame()
+			if err != nil {
+				sawRST <- false
+				return
+			}
+			if _, ok := f.(*http2.RSTStreamFrame); ok {
+				sawRST <- true
+				return
+			}
+		}
+	}()
+
+	_ = s.Close()
+	if !<-sawRST {
+		t.Fatalf("expected RST_STREAM after close grace expired")
+	}
+}
+
+func TestRawH2Conn_InitAdvertisesWindow(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	defer serverSide.Close()
+
+	cc := newRawH2Conn(clientSide)
+	cc.connWindow, cc.strWindow = 4<<20, 4<<20
+
+	type seen struct {
+		initialWindow uint32
+		connIncrement uint32
+	}
+	got := make(chan seen, 1)
+	go func() {
+		var out seen
+		preface := make([]byte, len(http2.ClientPreface))
+		if _, err := io.ReadFull(serverSide, preface); err != nil {
+			got <- out
+			return
+		}
+		srv := http2.NewFramer(serverSide, serverSide)
+		for i := 0; i < 2; i++ {
+			f, err := srv.ReadFrame()
+			if err != nil {
+				break
+			}
+			switch ff := f.(type) {
+			case *http2.SettingsFrame:
+				if v, ok := ff.Value(http2.SettingInitialWindowSize); ok {
+					out.initialWindow = v
+				}
+			case *http2.WindowUpdateFrame:
+				if ff.StreamID == 0 {
+					out.connIncrement = ff.Increment
+				}
+			}
+		}
+		_ = srv.WriteSettings(http2.Setting{ID: 0x8, Val: 1})
+		_, _ = srv.ReadFrame() // our SETTINGS ACK
+		got <- out
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := cc.init(ctx); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	out := <-got
+	if out.initialWindow != 4<<20 {
+		t.Fatalf("SETTINGS_INITIAL_WINDOW_SIZE=%d want %d", out.initialWindow, 4<<20)
+	}
+	if want := uint32(4<<20 - 65535); out.connIncrement != want {
+		t.Fatalf("connection WINDOW_UPDATE=%d want %d", out.connIncrement, want)
+	}
+}
+
+func TestRawH2Stream_WindowUpdateBeforeDefaultWindowExhausted(t *testing.T) {
+	s, srv := newTestRawH2Stream(t) // protocol-default 65535 window
+	go func() { _, _ = io.Copy(io.Discard, s) }()
+
+	updates := make(chan *http2.WindowUpdateFrame, 4)
+	go func() {
+		for {
+			f, err := srv.ReadFrame()
+			if err != nil {
+				return
+			}
+			if wu, ok := f.(*http2.WindowUpdateFrame); ok {
+				updates <- wu
+			}
+		}
+	}()
+
+	// 48000 bytes: under a 64 KiB batch, so only a half-window batch
+	// returns credit before the peer would stall.
+	chunk := make([]byte, 16000)
+	for i := 0; i < 3; i++ {
+		if err := srv.WriteData(1, false, chunk); err != nil {
+			t.Fatalf("server write: %v", err)
+		}
+	}
+
+	seenStreams := map[uint32]bool{}
+	for len(seenStreams) < 2 {
+		select {
+		case wu := <-updates:
+			if wu.Increment < 32000 {
+				t.Fatalf("WINDOW_UPDATE stream=%d increment=%d, want >= 32000", wu.StreamID, wu.Increment)
+			}
+			seenStreams[wu.StreamID] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no WINDOW_UPDATE for streams 0 and 1 (saw %v)", seenStreams)
+		}
+	}
+}
+
+func TestRawH2WindowHint(t *testing.T) {
+	for raw, want := range map[string]uint32{
+		"wss://h/tcp":                   rawH2DefaultWindow,
+		"wss://h/tcp?h2_window=8388608": 8 << 20,
+		"wss://h/tcp?h2_window=1000":    rawH2DefaultWindow,
+		"wss://h/tcp?h2_window=junk":    rawH2DefaultWindow,
+	} {
+		u, _ := url.Parse(raw)
+		if got := rawH2WindowHint(u); got != want {
+			t.Errorf("%s: window=%d want %d", raw, got, want)
+		}
+	}
+	u, _ := url.Parse("wss://h/tcp?h2_window=8388608&x=1")
+	if got := cleanedRequestURI(u); got != "/tcp?x=1" {
+		t.Fatalf("h2_window hint leaked into :path: %q", got)
+	}
+}
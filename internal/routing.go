@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// routeRules is a compiled list of destination patterns. A pattern is an IP
+// ("192.0.2.1"), a CIDR ("10.0.0.0/8"), an exact domain ("example.org") or a
+// domain suffix ("*.corp.example" or ".corp.example", which also matches
+// "corp.example" itself). Domains compare case-insensitively.
+type routeRules struct {
+	prefixes []netip.Prefix
+	exact    map[string]struct{}
+	suffixes []string // with leading dot
+}
+
+func newRouteRules(patterns []string) (*routeRules, error) {
+	r := &routeRules{exact: map[string]struct{}{}}
+	for _, raw := range patterns {
+		p := strings.ToLower(strings.TrimSpace(raw))
+		switch {
+		case p == "":
+			return nil, fmt.Errorf("empty pattern")
+		case strings.Contains(p, "/"):
+			pfx, err := netip.ParsePrefix(p)
+			if err != nil {
+				return nil, fmt.Errorf("pattern %q: %w", raw, err)
+			}
+			r.prefixes = append(r.prefixes, pfx.Masked())
+		case strings.HasPrefix(p, "*.") || strings.HasPrefix(p, "."):
+			base := strings.TrimPrefix(strings.TrimPrefix(p, "*"), ".")
+			if base == "" {
+				return nil, fmt.Errorf("pattern %q: empty domain suffix", raw)
+			}
+			r.suffixes = append(r.suffixes, "."+base)
+		default:
+			if ip, err := netip.ParseAddr(p); err == nil {
+				r.prefixes = append(r.prefixes, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+				continue
+			}
+			r.exact[strings.TrimSuffix(p, ".")] = struct{}{}
+		}
+	}
+	return r, nil
+}
+
+// match reports whether dst (host:port or bare host) hits any rule. A nil
+// *routeRules matches nothing.
+func (r *routeRules) match(dst string) bool {
+	if r == nil {
+		return false
+	}
+	host := dst
+	if h, _, err := net.SplitHostPort(dst); err == nil {
+		host = h
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ip = ip.Unmap()
+		for _, p := range r.prefixes {
+			if p.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if _, ok := r.exact[host]; ok {
+		return true
+	}
+	for _, s := range r.suffixes {
+		if strings.HasSuffix(host, s) || host == s[1:] {
+			return true
+		}
+	}
+	return false
+}
+
+// newMarkedDialer returns a dialer whose sockets carry fwmark (0 = unmarked).
+func newMarkedDialer(timeout time.Duration, fwmark uint32) *net.Dialer {
+	return &net.Dialer{Timeout: timeout, Control: markControl(fwmark)}
+}
+
+// newMarkedListenConfig is newMarkedDialer for listening sockets, such as
+// the local SOCKS5 UDP relay.
+func newMarkedListenConfig(fwmark uint32) *net.ListenConfig {
+	return &net.ListenConfig{Control: markControl(fwmark)}
+}
+
+func markControl(fwmark uint32) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var ctrlErr error
+		if err := c.Control(func(fd uintptr) {
+			ctrlErr = setSocketMark(fd, fwmark)
+		}); err != nil {
+			return err
+		}
+		return ctrlErr
+	}
+}
@@ -0,0 +1,38 @@
+package internal
+
+import "testing"
+
+func TestRouteRules_Match(t *testing.T) {
+	r, err := newRouteRules([]string{"10.0.0.0/8", "192.0.2.7", "Example.ORG", "*.corp.example", "2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("newRouteRules: %v", err)
+	}
+	cases := map[string]bool{
+		"10.1.2.3:443":          true,
+		"11.0.0.1:443":          false,
+		"192.0.2.7:80":          true,
+		"[::ffff:192.0.2.7]:80": true,
+		"example.org:443":       true,
+		"www.example.org:443":   false,
+		"corp.example:22":       true,
+		"git.CORP.example.:22":  true,
+		"notcorp.example:22":    false,
+		"[2001:db8::1]:443":     true,
+		"example.com":           false,
+	}
+	for dst, want := range cases {
+		if got := r.match(dst); got != want {
+			t.Errorf("match(%q)=%v want %v", dst, got, want)
+		}
+	}
+
+	var none *routeRules
+	if none.match("10.1.2.3:443") {
+		t.Fatalf("nil rules must match nothing")
+	}
+	for _, bad := range []string{"", "10.0.0.0/99", "*."} {
+		if _, err := newRouteRules([]string{bad}); err == nil {
+			t.Errorf("expected error for pattern %q", bad)
+		}
+	}
+}
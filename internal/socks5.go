@@ -4,10 +4,13 @@ import (
 	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -17,16 +20,39 @@ import (
 
 type Socks5Server struct {
 	LB *LoadBalancer
+
+	// Routing.Direct destinations bypass the tunnel on CONNECT.
+	Routing RoutingConfig
+
+	// UDPIdleTimeout ends a UDP association, and its control connection,
+	// after this long without a datagram either way; 0 keeps it until the
+	// client closes the control connection.
+	UDPIdleTimeout time.Duration
+
+	// UpstreamSelect honors "<host>.<upstream>.select.outline" CONNECT
+	// targets, pinning the connection to the named upstream. Debugging aid,
+	// off by default.
+	UpstreamSelect bool
+
+	rulesOnce sync.Once
+	direct    *routeRules
 }
 
 var socks5ConnectFlowSeq uint64
 
 func (s *Socks5Server) HandleConn(ctx context.Context, c net.Conn) {
 	defer c.Close()
+	release, ok := s.LB.acquireConn("socks5")
+	if !ok {
+		return
+	}
+	defer release()
+	ctx = withTraceID(ctx)
+	ctx = withProxySource(ctx, c.RemoteAddr())
 
 	// handshake
 	if err := socks5Handshake(c); err != nil {
-		log.Printf("socks handshake: %v", err)
+		log.Printf("%ssocks handshake: %v", tracePrefix(ctx), err)
 		return
 	}
 	_ = c.SetDeadline(time.Time{})
@@ -34,7 +60,13 @@ func (s *Socks5Server) HandleConn(ctx context.Context, c net.Conn) {
 	// request
 	cmd, dst, err := socks5ReadRequest(c)
 	if err != nil {
-		log.Printf("socks req: %v", err)
+		log.Printf("%ssocks req: %v", tracePrefix(ctx), err)
+		switch {
+		case errors.Is(err, errSocks5BadAtyp):
+			_ = socks5Reply(c, 0x08, "0.0.0.0:0") // Address type not supported
+		case errors.Is(err, errSocks5BadDomain):
+			_ = socks5Reply(c, 0x01, "0.0.0.0:0") // General failure
+		}
 		return
 	}
 
@@ -42,7 +74,12 @@ func (s *Socks5Server) HandleConn(ctx context.Context, c net.Conn) {
 	case 0x01: // CONNECT
 		s.handleConnect(ctx, c, dst)
 	case 0x03: // UDP ASSOCIATE
-		log.Printf("socks5 UDP ASSOCIATE requested client=%s", c.RemoteAddr())
+		if s.LB.udpDisabled.Load() {
+			log.Printf("%ssocks5 UDP ASSOCIATE refused (listen.disable_udp) client=%s", tracePrefix(ctx), c.RemoteAddr())
+			_ = socks5Reply(c, 0x07, "0.0.0.0:0") // Command not supported
+			return
+		}
+		log.Printf("%ssocks5 UDP ASSOCIATE requested client=%s", tracePrefix(ctx), c.RemoteAddr())
 		s.handleUDPAssociate(ctx, c)
 	default:
 		_ = socks5Reply(c, 0x07, "0.0.0.0:0") // Command not supported
@@ -51,8 +88,29 @@ func (s *Socks5Server) HandleConn(ctx context.Context, c net.Conn) {
 
 func (s *Socks5Server) handleConnect(ctx context.Context, c net.Conn, dst string) {
 	flowID := atomic.AddUint64(&socks5ConnectFlowSeq, 1)
-	wsDebugf("socks5 CONNECT requested flow=%d dst=%q", flowID, dst)
-	up, err := s.LB.PickTCP()
+	wsTracef(ctx, "socks5 CONNECT requested flow=%d dst=%q", flowID, dst)
+	var pinned *UpstreamState
+	if s.UpstreamSelect {
+		if realDst, name, ok := parseSelectTarget(dst); ok {
+			pinned = s.LB.upstreamByName(name)
+			if pinned == nil || realDst == "" {
+				log.Printf("%ssocks5 CONNECT %s: no upstream %q or no destination host", tracePrefix(ctx), dst, name)
+				_ = socks5Reply(c, 0x04, "0.0.0.0:0")
+				return
+			}
+			log.Printf("%ssocks5 CONNECT pinned to upstream=%q dst=%s", tracePrefix(ctx), name, realDst)
+			dst = realDst
+		}
+	}
+	if pinned == nil && s.directRules().match(dst) {
+		s.handleDirectConnect(ctx, flowID, c, dst)
+		return
+	}
+	up := pinned
+	var err error
+	if up == nil {
+		up, err = s.LB.PickTCPFor(dst)
+	}
 	if err != nil {
 		s.LB.ReportTCPFailure(up, err)
 		_ = socks5Reply(c, 0x04, "0.0.0.0:0") // Host unreachable
@@ -60,40 +118,131 @@ func (s *Socks5Server) handleConnect(ctx context.Context, c net.Conn, dst string
 	}
 
 	// Open WS stream to upstream TCP endpoint
-	wsDebugf("socks5 CONNECT picked flow=%d upstream=%q dst=%q", flowID, up.cfg.Name, dst)
+	wsTracef(ctx, "socks5 CONNECT picked flow=%d upstream=%q dst=%q", flowID, up.cfg.Name, dst)
 	acquireStarted := time.Now()
-	wsc, err := s.LB.AcquireTCPWSForFlow(ctx, up, flowID)
-	if err != nil {
-		s.LB.ReportTCPFailure(up, err)
-		_ = socks5Reply(c, 0x04, "0.0.0.0:0")
-		return
-	}
-	wsDebugf("socks5 CONNECT acquired ws flow=%d upstream=%q dst=%q elapsed=%s", flowID, up.cfg.Name, dst, time.Since(acquireStarted))
-	defer wsc.Close(WSStatusNormalClosure, "close")
+	var relay func() error
+	if n := s.LB.sel.RaceN; n > 1 && pinned == nil && s.LB.sel.Strategy != selectionConsistentHash {
+		// raceTCPFlow reports health failures itself, and replies success
+		// as soon as the first tunnel is up.
+		var ss net.Conn
+		var replied bool
+		up, ss, replied, err = s.LB.raceTCPFlow(ctx, s.LB.raceCandidates(up, n), flowID, dst, func() ([]byte, error) {
+			if err := socks5Reply(c, 0x00, "0.0.0.0:0"); err != nil {
+				return nil, err
+			}
+			return readClientFirst(c, raceClientWait)
+		})
+		if err != nil {
+			wsTracef(ctx, "socks5 CONNECT race failed flow=%d dst=%q err=%v", flowID, dst, err)
+			if !replied {
+				_ = socks5Reply(c, 0x04, "0.0.0.0:0")
+			}
+			return
+		}
+		defer ss.Close()
+		relay = func() error { return relayTCPOverSS(ctx, flowID, c, ss, up.cfg, dst) }
+	} else {
+		wsc, err := s.LB.AcquireTCPWSForFlow(ctx, up, flowID)
+		if err != nil {
+			s.LB.ReportTCPFailure(up, err)
+			_ = socks5Reply(c, 0x04, "0.0.0.0:0")
+			return
+		}
+		defer wsc.Close(WSStatusNormalClosure, "close")
 
-	// Reply success (bound addr can be 0.0.0.0:0 for our proxy)
-	if err := socks5Reply(c, 0x00, "0.0.0.0:0"); err != nil {
-		wsDebugf("socks5 CONNECT reply failed flow=%d upstream=%q dst=%q err=%v", flowID, up.cfg.Name, dst, err)
-		return
+		// Reply success (bound addr can be 0.0.0.0:0 for our proxy)
+		if err := socks5Reply(c, 0x00, "0.0.0.0:0"); err != nil {
+			wsTracef(ctx, "socks5 CONNECT reply failed flow=%d upstream=%q dst=%q err=%v", flowID, up.cfg.Name, dst, err)
+			return
+		}
+		relay = func() error { return ProxyTCPOverOutlineWS(ctx, flowID, c, wsc, up.cfg, dst) }
 	}
+	wsTracef(ctx, "socks5 CONNECT acquired ws flow=%d upstream=%q dst=%q elapsed=%s", flowID, up.cfg.Name, dst, time.Since(acquireStarted))
 
-	wsDebugf("socks5 CONNECT reply sent flow=%d upstream=%q dst=%q", flowID, up.cfg.Name, dst)
+	wsTracef(ctx, "socks5 CONNECT reply sent flow=%d upstream=%q dst=%q", flowID, up.cfg.Name, dst)
+	publishEvent(Event{Type: EventConnOpen, Upstream: up.cfg.Name, Proto: "tcp", Flow: flowID, Dst: dst})
+	defer s.LB.trackConn(up, "tcp")()
 
 	// Tunnel: local TCP <-> Shadowsocks-over-WS
-	err = ProxyTCPOverOutlineWS(ctx, flowID, c, wsc, up.cfg, dst)
-	wsDebugf("socks5 CONNECT finished flow=%d upstream=%q dst=%q err=%v", flowID, up.cfg.Name, dst, err)
+	err = relay()
+	wsTracef(ctx, "socks5 CONNECT finished flow=%d upstream=%q dst=%q err=%v", flowID, up.cfg.Name, dst, err)
+	closeEv := Event{Type: EventConnClose, Upstream: up.cfg.Name, Proto: "tcp", Flow: flowID, Dst: dst}
+	if err != nil && !errors.Is(err, io.EOF) {
+		closeEv.Detail = err.Error()
+	}
+	publishEvent(closeEv)
 	if err != nil && !errors.Is(err, io.EOF) {
 		// Do not penalize upstream health on per-flow tunnel errors.
 		// These are often destination/client specific (curl aborts, remote TLS reset,
 		// target host policy), while the transport path itself remains healthy.
 		if isExpectedTunnelCloseError(err) {
-			wsDebugf("tcp tunnel closed by peer flow=%d upstream=%q dst=%q err=%v", flowID, up.cfg.Name, dst, err)
+			wsTracef(ctx, "tcp tunnel closed by peer flow=%d upstream=%q dst=%q err=%v", flowID, up.cfg.Name, dst, err)
 		} else {
-			log.Printf("tcp tunnel err (non-health): %v", err)
+			log.Printf("%stcp tunnel err (non-health): %v", tracePrefix(ctx), err)
 		}
 	}
 }
 
+func (s *Socks5Server) directRules() *routeRules {
+	s.rulesOnce.Do(func() {
+		r, err := newRouteRules(s.Routing.Direct)
+		if err != nil {
+			// LoadConfig rejects bad rules; this only guards embedders.
+			log.Printf("socks5: ignoring routing.direct: %v", err)
+			return
+		}
+		s.direct = r
+	})
+	return s.direct
+}
+
+// handleDirectConnect serves a CONNECT matched by routing.direct: the
+// destination is dialed from this host (with the LB fwmark) and bytes are
+// copied as-is, with no Shadowsocks or WebSocket layer.
+func (s *Socks5Server) handleDirectConnect(ctx context.Context, flowID uint64, c net.Conn, dst string) {
+	d := newMarkedDialer(10*time.Second, s.LB.fwmark)
+	remote, err := d.DialContext(ctx, "tcp", dst)
+	if err != nil {
+		wsTracef(ctx, "socks5 CONNECT direct dial failed flow=%d dst=%q err=%v", flowID, dst, err)
+		_ = socks5Reply(c, 0x05, "0.0.0.0:0") // Connection refused
+		return
+	}
+	defer remote.Close()
+
+	if err := socks5Reply(c, 0x00, remote.LocalAddr().String()); err != nil {
+		return
+	}
+	publishEvent(Event{Type: EventConnOpen, Upstream: "direct", Proto: "tcp", Flow: flowID, Dst: dst})
+	defer publishEvent(Event{Type: EventConnClose, Upstream: "direct", Proto: "tcp", Flow: flowID, Dst: dst})
+
+	done := make(chan struct{}, 2)
+	pipe := func(dstConn, srcConn net.Conn) {
+		// Plain TCP on both ends: let io.CopyBuffer use splice where it can.
+		bufPtr := getRelayBuf()
+		defer putRelayBuf(bufPtr)
+		_, _ = io.CopyBuffer(dstConn, srcConn, *bufPtr)
+		if cw, ok := dstConn.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go pipe(remote, c)
+	go pipe(c, remote)
+
+	select {
+	case <-done:
+		// One side hit EOF and half-closed its peer; let the other drain.
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	case <-ctx.Done():
+	}
+	_ = c.Close()
+	_ = remote.Close()
+	wsTracef(ctx, "socks5 CONNECT direct finished flow=%d dst=%q", flowID, dst)
+}
+
 func isExpectedTunnelCloseError(err error) bool {
 	if err == nil {
 		return false
@@ -114,14 +263,15 @@ func isExpectedTunnelCloseError(err error) bool {
 }
 
 func (s *Socks5Server) handleUDPAssociate(ctx context.Context, c net.Conn) {
-	up, err := s.LB.PickUDP()
+	pick := s.LB.PickUDP
+	up, err := pick()
 	if err != nil {
 		s.LB.ReportUDPFailure(up, err)
 		_ = socks5Reply(c, 0x04, "0.0.0.0:0")
 		return
 	}
 
-	assoc, err := NewUDPAssociation(ctx, up.cfg, s.LB.fwmark)
+	assoc, err := NewFailoverUDPAssociation(ctx, s.LB, up, pick)
 	if err != nil {
 		s.LB.ReportUDPFailure(up, err)
 		_ = socks5Reply(c, 0x04, "0.0.0.0:0")
@@ -130,17 +280,87 @@ func (s *Socks5Server) handleUDPAssociate(ctx context.Context, c net.Conn) {
 	defer assoc.Close()
 
 	// tell client where to send UDP packets
-	relayAddr := assoc.LocalAddr().String()
+	relayAddr := socks5RelayAddr(assoc.LocalAddr(), c)
 	if err := socks5Reply(c, 0x00, relayAddr); err != nil {
 		return
 	}
+	// The association tracks the live connection itself and reports
+	// failovers; conn_close names the upstream it ended on.
+	publishEvent(Event{Type: EventConnOpen, Upstream: up.cfg.Name, Proto: "udp", Detail: "relay=" + relayAddr})
+	defer func() {
+		publishEvent(Event{Type: EventConnClose, Upstream: assoc.Upstream(), Proto: "udp", Detail: "relay=" + relayAddr})
+	}()
+
+	// Returning closes c, which tells the client the association is over.
+	switch waitUDPAssociation(ctx, c, assoc.Done(), assoc.IdleFor, s.UDPIdleTimeout) {
+	case "idle":
+		log.Printf("%ssocks5 UDP association idle for %s, closing client=%s", tracePrefix(ctx), s.UDPIdleTimeout, c.RemoteAddr())
+	case "ended":
+		log.Printf("%ssocks5 UDP association lost its upstream, closing client=%s", tracePrefix(ctx), c.RemoteAddr())
+	}
+}
 
-	// keep TCP control connection open until client closes it
-	_, _ = io.Copy(io.Discard, c)
+// waitUDPAssociation holds a UDP association for as long as its control
+// connection c stays open, as RFC 1928 ties them together. With idle > 0 it
+// also returns "idle" once idleFor exceeds it, so an associate-and-vanish
+// client whose control connection never errors does not pin the relay and
+// upstream session forever. Other results: "closed" (client side),
+// "shutdown" (ctx) and "ended" (done, the relay gave up).
+func waitUDPAssociation(ctx context.Context, c net.Conn, done <-chan struct{}, idleFor func() time.Duration, idle time.Duration) string {
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		_, _ = io.Copy(io.Discard, c)
+	}()
+
+	var tick <-chan time.Time
+	if idle > 0 {
+		t := time.NewTicker(min(idle/4, time.Second))
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-closed:
+			return "closed"
+		case <-ctx.Done():
+			return "shutdown"
+		case <-done:
+			if ctx.Err() != nil {
+				return "shutdown"
+			}
+			return "ended"
+		case <-tick:
+			if idleFor() >= idle {
+				return "idle"
+			}
+		}
+	}
 }
 
 // ---- minimal SOCKS5 helpers ----
 
+// socks5RelayAddr is the UDP relay address to hand the client. The relay
+// socket is bound to the wildcard address, which a client cannot send to, so
+// an unspecified IP is replaced by the local IP of the control connection:
+// the address the client already reached us on, of the right family.
+func socks5RelayAddr(relay net.Addr, ctrl net.Conn) string {
+	ua, ok := relay.(*net.UDPAddr)
+	if !ok {
+		return relay.String()
+	}
+	ip := ua.IP
+	if ip == nil || ip.IsUnspecified() {
+		if ta, ok := ctrl.LocalAddr().(*net.TCPAddr); ok && ta.IP != nil && !ta.IP.IsUnspecified() {
+			ip = ta.IP
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(ua.Port))
+}
+
 func socks5Handshake(c net.Conn) error {
 	h := make([]byte, 2)
 	if _, err := io.ReadFull(c, h); err != nil {
@@ -226,6 +446,25 @@ func socks5Reply(c net.Conn, rep byte, bind string) error {
 	return err
 }
 
+var (
+	errSocks5BadAtyp   = errors.New("bad atyp")
+	errSocks5BadDomain = errors.New("bad domain name")
+)
+
+// validSocksDomain rejects names no resolver would accept and that must not
+// reach a dial: empty, or containing spaces or control characters.
+func validSocksDomain(host string) bool {
+	if host == "" {
+		return false
+	}
+	for i := 0; i < len(host); i++ {
+		if c := host[i]; c <= 0x20 || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
 func readAddrPort(r io.Reader, atyp byte) (host, port string, err error) {
 	switch atyp {
 	case 0x01: // IPv4
@@ -244,6 +483,9 @@ func readAddrPort(r io.Reader, atyp byte) (host, port string, err error) {
 			return
 		}
 		host = string(b)
+		if !validSocksDomain(host) {
+			return "", "", fmt.Errorf("%w %q", errSocks5BadDomain, host)
+		}
 	case 0x04: // IPv6
 		b := make([]byte, 16)
 		if _, err = io.ReadFull(r, b); err != nil {
@@ -251,7 +493,7 @@ func readAddrPort(r io.Reader, atyp byte) (host, port string, err error) {
 		}
 		host = net.IP(b).String()
 	default:
-		return "", "", errors.New("bad atyp")
+		return "", "", errSocks5BadAtyp
 	}
 	pb := make([]byte, 2)
 	if _, err = io.ReadFull(r, pb); err != nil {
@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"net"
+	"strings"
+)
+
+// selectTargetSuffix marks a CONNECT destination that names its upstream
+// (listen.debug_upstream_select): "<host>.<upstream>.select.outline:<port>"
+// is tunneled to <host>:<port> through <upstream>, bypassing the scorer,
+// so one upstream can be tried from a browser or curl without touching
+// the config. Upstream names with dots cannot be addressed this way.
+const selectTargetSuffix = ".select.outline"
+
+// parseSelectTarget splits a select target into the real destination and
+// the upstream name; ok is false for ordinary destinations. realDst is ""
+// when the target names no host.
+func parseSelectTarget(dst string) (realDst, upstream string, ok bool) {
+	host, port, err := net.SplitHostPort(dst)
+	if err != nil {
+		return "", "", false
+	}
+	rest, found := strings.CutSuffix(strings.ToLower(host), selectTargetSuffix)
+	if !found || rest == "" {
+		return "", "", false
+	}
+	// Keep the caller's case for the upstream name and real host.
+	rest = host[:len(rest)]
+	i := strings.LastIndexByte(rest, '.')
+	if i < 0 {
+		return "", rest, true
+	}
+	return net.JoinHostPort(rest[:i], port), rest[i+1:], true
+}
+
+// upstreamByName returns the configured upstream called name, or nil.
+func (lb *LoadBalancer) upstreamByName(name string) *UpstreamState {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	for _, s := range lb.pool {
+		if s.cfg.Name == name {
+			return s
+		}
+	}
+	return nil
+}
@@ -1,8 +1,14 @@
 package internal
 
 import (
+	"context"
+	"errors"
+	"io"
 	"net"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestSocks5Handshake_NoAuthAccepted(t *testing.T) {
@@ -54,3 +60,356 @@ func TestSocks5Handshake_NoAcceptableMethod(t *testing.T) {
 		t.Fatalf("expected error")
 	}
 }
+
+func TestSocks5Connect_DirectRuleBypassesTunnel(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		c, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = io.Copy(c, c)
+	}()
+
+	// No upstreams: anything that reached the tunnel path would get
+	// "host unreachable" instead of a success reply.
+	lb := NewLoadBalancer(nil, HealthcheckConfig{}, SelectionConfig{}, ProbeConfig{}, 0)
+	srv := &Socks5Server{LB: lb, Routing: RoutingConfig{Direct: []string{"127.0.0.0/8"}}}
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go srv.HandleConn(context.Background(), server)
+
+	port := echo.Addr().(*net.TCPAddr).Port
+	_, _ = client.Write([]byte{0x05, 0x01, 0x00})
+	greet := make([]byte, 2)
+	if _, err := io.ReadFull(client, greet); err != nil {
+		t.Fatalf("read greeting: %v", err)
+	}
+	_, _ = client.Write([]byte{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, byte(port >> 8), byte(port)})
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if reply[1] != 0x00 {
+		t.Fatalf("CONNECT reply code=%#x want 0x00", reply[1])
+	}
+
+	_, _ = client.Write([]byte("ping"))
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatalf("read echo: %v", err)
+	}
+	if string(got) != "ping" {
+		t.Fatalf("echo=%q want ping", got)
+	}
+}
+
+func TestSocks5Request_RejectsMalformedDomain(t *testing.T) {
+	lb := NewLoadBalancer(nil, HealthcheckConfig{}, SelectionConfig{}, ProbeConfig{}, 0)
+	srv := &Socks5Server{LB: lb}
+
+	cases := []struct {
+		name string
+		req  []byte
+		rep  byte
+	}{
+		{"empty domain", []byte{0x05, 0x01, 0x00, 0x03, 0x00, 0x01, 0xbb}, 0x01},
+		{"control char", append([]byte{0x05, 0x01, 0x00, 0x03, 0x0c}, append([]byte("example\x00.com"), 0x01, 0xbb)...), 0x01},
+		{"unknown atyp", []byte{0x05, 0x01, 0x00, 0x09, 0x00}, 0x08},
+	}
+	for _, tc := range cases {
+		server, client := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			srv.HandleConn(context.Background(), server)
+			close(done)
+		}()
+
+		_, _ = client.Write([]byte{0x05, 0x01, 0x00})
+		greet := make([]byte, 2)
+		if _, err := io.ReadFull(client, greet); err != nil {
+			t.Fatalf("%s: read greeting: %v", tc.name, err)
+		}
+		go func() { _, _ = client.Write(tc.req) }()
+		reply := make([]byte, 10)
+		if _, err := io.ReadFull(client, reply); err != nil {
+			t.Fatalf("%s: read reply: %v", tc.name, err)
+		}
+		if reply[1] != tc.rep {
+			t.Errorf("%s: reply code=%#x want %#x", tc.name, reply[1], tc.rep)
+		}
+		<-done
+		client.Close()
+	}
+}
+
+func TestValidSocksDomain(t *testing.T) {
+	for host, want := range map[string]bool{
+		"example.com":  true,
+		"xn--e1a.test": true,
+		"":             false,
+		"a b":          false,
+		"evil\r\nhost": false,
+		"del\x7f":      false,
+	} {
+		if got := validSocksDomain(host); got != want {
+			t.Errorf("validSocksDomain(%q)=%v want %v", host, got, want)
+		}
+	}
+}
+
+// addrConn overrides LocalAddr on a net.Pipe end.
+type addrConn struct {
+	net.Conn
+	local net.Addr
+}
+
+func (c addrConn) LocalAddr() net.Addr { return c.local }
+
+func TestSocks5RelayAddr_IPv6ReplyUsesATYP4(t *testing.T) {
+	relay, err := net.ListenPacket("udp", "[::]:0")
+	if err != nil {
+		t.Skipf("no IPv6 wildcard UDP: %v", err)
+	}
+	defer relay.Close()
+	port := relay.LocalAddr().(*net.UDPAddr).Port
+
+	server, client := net.Pipe()
+	defer client.Close()
+	ctrl := addrConn{Conn: server, local: &net.TCPAddr{IP: net.ParseIP("2001:db8::5"), Port: 1080}}
+
+	addr := socks5RelayAddr(relay.LocalAddr(), ctrl)
+	if want := net.JoinHostPort("2001:db8::5", strconv.Itoa(port)); addr != want {
+		t.Fatalf("relay addr=%q want %q", addr, want)
+	}
+
+	go func() { _ = socks5Reply(ctrl, 0x00, addr) }()
+	reply := make([]byte, 4+16+2)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if reply[3] != 0x04 {
+		t.Fatalf("ATYP=%#x want 0x04", reply[3])
+	}
+	if got := net.IP(reply[4:20]); !got.Equal(net.ParseIP("2001:db8::5")) {
+		t.Fatalf("addr=%v want 2001:db8::5", got)
+	}
+	if got := int(reply[20])<<8 | int(reply[21]); got != port {
+		t.Fatalf("port=%d want %d", got, port)
+	}
+}
+
+func TestSocks5RelayAddr_WildcardFollowsControlConn(t *testing.T) {
+	relay := &net.UDPAddr{IP: net.IPv6unspecified, Port: 4000}
+	for local, want := range map[string]string{
+		"127.0.0.1":       "127.0.0.1:4000",
+		"::ffff:10.0.0.7": "10.0.0.7:4000",
+		"fe80::1":         "[fe80::1]:4000",
+	} {
+		ctrl := addrConn{local: &net.TCPAddr{IP: net.ParseIP(local), Port: 1080}}
+		if got := socks5RelayAddr(relay, ctrl); got != want {
+			t.Errorf("control %s: relay=%q want %q", local, got, want)
+		}
+	}
+
+	bound := &net.UDPAddr{IP: net.ParseIP("192.0.2.9"), Port: 5000}
+	if got := socks5RelayAddr(bound, addrConn{local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}}); got != "192.0.2.9:5000" {
+		t.Fatalf("bound relay rewritten to %q", got)
+	}
+}
+
+func TestSocks5HandleConn_MaxConnectionsRejectsThenRecovers(t *testing.T) {
+	lb := NewLoadBalancer(nil, HealthcheckConfig{}, SelectionConfig{}, ProbeConfig{}, 0)
+	lb.SetMaxConnections(1)
+	srv := &Socks5Server{LB: lb}
+
+	serve := func() (client net.Conn, done chan struct{}) {
+		server, client := net.Pipe()
+		done = make(chan struct{})
+		go func() {
+			srv.HandleConn(context.Background(), server)
+			close(done)
+		}()
+		return client, done
+	}
+
+	// The first session holds the only slot while it waits for a greeting.
+	first, firstDone := serve()
+	waitFor(t, func() bool { return lb.liveConns.Load() == 1 }, "first session to take the slot")
+
+	second, secondDone := serve()
+	<-secondDone
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("over-cap session: read err=%v, want EOF (closed)", err)
+	}
+	second.Close()
+
+	first.Close()
+	<-firstDone
+	if n := lb.liveConns.Load(); n != 0 {
+		t.Fatalf("slot not released: live=%d", n)
+	}
+
+	third, thirdDone := serve()
+	defer func() {
+		third.Close()
+		<-thirdDone
+	}()
+	_, _ = third.Write([]byte{0x05, 0x01, 0x00})
+	greet := make([]byte, 2)
+	if _, err := io.ReadFull(third, greet); err != nil || greet[0] != 0x05 || greet[1] != 0x00 {
+		t.Fatalf("session after release: greeting=%v err=%v", greet, err)
+	}
+}
+
+func TestSocks5HandleConn_DisableUDPRefusesAssociate(t *testing.T) {
+	lb := NewLoadBalancer(nil, HealthcheckConfig{}, SelectionConfig{}, ProbeConfig{}, 0)
+	lb.SetUDPDisabled(true)
+	srv := &Socks5Server{LB: lb}
+
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		srv.HandleConn(context.Background(), server)
+		close(done)
+	}()
+
+	_, _ = client.Write([]byte{0x05, 0x01, 0x00})
+	greet := make([]byte, 2)
+	if _, err := io.ReadFull(client, greet); err != nil {
+		t.Fatalf("read greeting: %v", err)
+	}
+	_, _ = client.Write([]byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0}) // UDP ASSOCIATE 0.0.0.0:0
+	rep := make([]byte, 10)
+	if _, err := io.ReadFull(client, rep); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if rep[1] != 0x07 {
+		t.Fatalf("reply=%#x want 0x07 (command not supported)", rep[1])
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("HandleConn did not return after refusing UDP ASSOCIATE")
+	}
+}
+
+func TestWaitUDPAssociation_IdleControlConnReclaimsAssociation(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	// The client associated and vanished: no datagrams, control conn open.
+	lastActive := time.Now()
+	idleFor := func() time.Duration { return time.Since(lastActive) }
+
+	start := time.Now()
+	if got := waitUDPAssociation(context.Background(), server, nil, idleFor, 100*time.Millisecond); got != "idle" {
+		t.Fatalf("wait ended with %q, want idle", got)
+	}
+	if took := time.Since(start); took < 100*time.Millisecond || took > 5*time.Second {
+		t.Fatalf("idle association reclaimed after %s, want just past 100ms", took)
+	}
+
+	// Without a timeout only the client closing ends it.
+	server2, client2 := net.Pipe()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = client2.Close()
+	}()
+	if got := waitUDPAssociation(context.Background(), server2, nil, idleFor, 0); got != "closed" {
+		t.Fatalf("wait ended with %q, want closed", got)
+	}
+}
+
+func TestWaitUDPAssociation_TrafficKeepsAssociation(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	// Datagrams keep flowing: the association is never idle.
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if got := waitUDPAssociation(ctx, server, nil, func() time.Duration { return 0 }, 50*time.Millisecond); got != "shutdown" {
+		t.Fatalf("active association ended with %q", got)
+	}
+}
+
+func TestSocks5Connect_SelectTargetPinsNamedUpstream(t *testing.T) {
+	lb := NewLoadBalancer([]UpstreamConfig{
+		{Name: "fast", TCPWSS: "wss://fast.example/tcp"},
+		{Name: "slow", TCPWSS: "wss://slow.example/tcp"},
+	}, HealthcheckConfig{}, SelectionConfig{}, ProbeConfig{}, 0)
+	markHealthy(lb.pool[0], true, 5*time.Millisecond)
+	markHealthy(lb.pool[1], true, 200*time.Millisecond)
+
+	dialed := make(chan string, 1)
+	lb.tunnelDial = func(_ context.Context, rawurl string) (WSConn, error) {
+		dialed <- rawurl
+		return nil, errors.New("refused")
+	}
+
+	connect := func(srv *Socks5Server, host string) byte {
+		t.Helper()
+		server, client := net.Pipe()
+		defer client.Close()
+		go srv.HandleConn(context.Background(), server)
+		_, _ = client.Write([]byte{0x05, 0x01, 0x00})
+		greet := make([]byte, 2)
+		if _, err := io.ReadFull(client, greet); err != nil {
+			t.Fatalf("read greeting: %v", err)
+		}
+		req := append([]byte{0x05, 0x01, 0x00, 0x03, byte(len(host))}, host...)
+		_, _ = client.Write(append(req, 0x01, 0xbb))
+		reply := make([]byte, 10)
+		if _, err := io.ReadFull(client, reply); err != nil {
+			t.Fatalf("read reply: %v", err)
+		}
+		return reply[1]
+	}
+
+	srv := &Socks5Server{LB: lb, UpstreamSelect: true}
+	connect(srv, "example.com.slow.select.outline")
+	if got := <-dialed; !strings.Contains(got, "slow.example") {
+		t.Fatalf("select target dialed %s, want the slow upstream", got)
+	}
+	if code := connect(srv, "example.com.nosuch.select.outline"); code != 0x04 {
+		t.Fatalf("unknown upstream reply=%#x want 0x04", code)
+	}
+	select {
+	case got := <-dialed:
+		t.Fatalf("unknown upstream still dialed %s", got)
+	default:
+	}
+
+	// With the flag off the name is an ordinary host and the scorer picks.
+	connect(&Socks5Server{LB: lb}, "example.com.slow.select.outline")
+	if got := <-dialed; !strings.Contains(got, "fast.example") {
+		t.Fatalf("flag off dialed %s, want the scorer's pick", got)
+	}
+}
+
+func TestParseSelectTarget(t *testing.T) {
+	for _, tc := range []struct {
+		in, dst, up string
+		ok          bool
+	}{
+		{"example.com.de-1.select.outline:443", "example.com:443", "de-1", true},
+		{"1.2.3.4.Up.SELECT.outline:80", "1.2.3.4:80", "Up", true},
+		{"up.select.outline:0", "", "up", true},
+		{"example.com:443", "", "", false},
+		{"select.outline:443", "", "", false},
+	} {
+		dst, up, ok := parseSelectTarget(tc.in)
+		if dst != tc.dst || up != tc.up || ok != tc.ok {
+			t.Fatalf("parseSelectTarget(%q) = %q, %q, %v", tc.in, dst, up, ok)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package internal
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ListenSocks5 opens the SOCKS5 listener on addr. With certFile and keyFile
+// set (listen.tls_cert/tls_key) every accepted connection is wrapped in a TLS
+// server, so remote clients speak SOCKS5 over TLS; the TLS handshake runs on
+// the first read, under the deadline HandleConn's caller sets. Without them
+// the listener is plain TCP.
+func ListenSocks5(addr, certFile, keyFile string) (net.Listener, error) {
+	var tlsCfg *tls.Config
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("listen.tls_cert and listen.tls_key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("listen tls certificate: %w", err)
+		}
+		tlsCfg = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsCfg != nil {
+		ln = tls.NewListener(ln, tlsCfg)
+	}
+	return ln, nil
+}
@@ -0,0 +1,90 @@
+//go:build !unit
+
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListenSocks5_TLSHandshakeThenSocks5Greeting(t *testing.T) {
+	cert, _ := testTLSCert(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "socks.pem"), filepath.Join(dir, "socks.key")
+	writeCertPEM(t, certFile, cert.Certificate[0])
+	der, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := ListenSocks5("127.0.0.1:0", certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	srv := &Socks5Server{LB: NewLoadBalancer(nil, HealthcheckConfig{}, SelectionConfig{}, ProbeConfig{}, 0)}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+			go srv.HandleConn(context.Background(), c)
+		}
+	}()
+
+	client, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("tls dial: %v", err)
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, _ = client.Write([]byte{0x05, 0x01, 0x00})
+	greet := make([]byte, 2)
+	if _, err := io.ReadFull(client, greet); err != nil {
+		t.Fatalf("read greeting over TLS: %v", err)
+	}
+	if greet[0] != 0x05 || greet[1] != 0x00 {
+		t.Fatalf("greeting=%#v want [0x05 0x00]", greet)
+	}
+	// No upstreams: the CONNECT is answered (over TLS) with a failure reply.
+	_, _ = client.Write([]byte{0x05, 0x01, 0x00, 0x01, 192, 0, 2, 1, 0, 80})
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("read CONNECT reply: %v", err)
+	}
+	if reply[0] != 0x05 || reply[1] == 0x00 {
+		t.Fatalf("CONNECT reply=%#v, want a SOCKS5 failure", reply)
+	}
+
+	// A plaintext client gets no SOCKS5 greeting back.
+	plain, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	_ = plain.SetDeadline(time.Now().Add(300 * time.Millisecond))
+	_, _ = plain.Write([]byte{0x05, 0x01, 0x00})
+	if _, err := io.ReadFull(plain, greet); err == nil && greet[0] == 0x05 && greet[1] == 0x00 {
+		t.Fatal("plaintext SOCKS5 accepted on a TLS listener")
+	}
+}
+
+func TestListenSocks5_CertAndKeyTogether(t *testing.T) {
+	if _, err := ListenSocks5("127.0.0.1:0", "cert.pem", ""); err == nil {
+		t.Fatal("tls_cert without tls_key accepted")
+	}
+}
@@ -12,7 +12,7 @@ func itoa(i int) string { return strconv.Itoa(i) }
 // parseSocksAddrAt parses a SOCKS address that starts at b[off] (ATYP byte).
 // Returns host, port, and the offset of the first byte AFTER DST.PORT.
 func parseSocksAddrAt(b []byte, off int) (host, port string, newOff int, err error) {
-	if len(b) < off+1 {
+	if off < 0 || off >= len(b) {
 		return "", "", 0, errors.New("short")
 	}
 	atyp := b[off]
@@ -1,8 +1,10 @@
 package internal
 
 import (
+	"bytes"
 	"encoding/binary"
 	"net"
+	"strconv"
 	"testing"
 )
 
@@ -69,3 +71,41 @@ func TestParseSocksAddrAt_Errors(t *testing.T) {
 		t.Fatal("expected error")
 	}
 }
+
+func FuzzParseSocksAddrAt(f *testing.F) {
+	f.Add([]byte{0x01, 1, 2, 3, 4, 0, 53}, 0)
+	f.Add([]byte{0x00, 0x03, 3, 'a', '.', 'b', 1, 187}, 1)
+	f.Add(append([]byte{0x04}, make([]byte, 18)...), 0)
+	f.Add([]byte{0x03, 0xff, 'x'}, 0)
+	f.Fuzz(func(t *testing.T, b []byte, off int) {
+		host, port, newOff, err := parseSocksAddrAt(b, off)
+		if err != nil {
+			return
+		}
+		if newOff <= off || newOff > len(b) {
+			t.Fatalf("offset %d out of bounds (start %d, len %d)", newOff, off, len(b))
+		}
+		if p, perr := strconv.Atoi(port); perr != nil || p < 0 || p > 65535 {
+			t.Fatalf("bad port %q", port)
+		}
+		if host == "" && b[off] != 0x03 {
+			t.Fatalf("empty host for atyp %#x", b[off])
+		}
+	})
+}
+
+func FuzzReadAddrPort(f *testing.F) {
+	f.Add(byte(0x01), []byte{1, 2, 3, 4, 0, 53})
+	f.Add(byte(0x03), []byte{3, 'a', '.', 'b', 1, 187})
+	f.Add(byte(0x04), make([]byte, 18))
+	f.Fuzz(func(t *testing.T, atyp byte, b []byte) {
+		r := bytes.NewReader(b)
+		_, port, err := readAddrPort(r, atyp)
+		if err != nil {
+			return
+		}
+		if p, perr := strconv.Atoi(port); perr != nil || p < 0 || p > 65535 {
+			t.Fatalf("bad port %q", port)
+		}
+	})
+}
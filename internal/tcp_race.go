@@ -0,0 +1,233 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// raceClientWait bounds how long a race waits for the client's first bytes.
+// A client that stays silent (the server speaks first) gets the first
+// tunnel that came up instead.
+const raceClientWait = 300 * time.Millisecond
+
+// raceFirstReadSize caps the first read from the client and from each racer.
+const raceFirstReadSize = 32 * 1024
+
+// raceCandidates returns picked followed by up to n-1 other usable upstreams
+// in pickTopN order: the field for a selection.race_n dial race.
+func (lb *LoadBalancer) raceCandidates(picked *UpstreamState, n int) []*UpstreamState {
+	out := []*UpstreamState{picked}
+	for _, up := range lb.pickTopN(time.Now(), n) {
+		if len(out) == n {
+			break
+		}
+		if up != picked {
+			out = append(out, up)
+		}
+	}
+	return out
+}
+
+// raceConn is the winning Shadowsocks stream of a race, with the upstream
+// bytes it won on put back in front. Each racer dials under its own context
+// (the raw h2 and h3 transports keep using it after the handshake), so the
+// winner's is only released when the stream closes.
+type raceConn struct {
+	net.Conn
+	first  []byte
+	cancel context.CancelFunc
+}
+
+func (c *raceConn) Read(p []byte) (int, error) {
+	if len(c.first) > 0 {
+		n := copy(p, c.first)
+		c.first = c.first[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *raceConn) Close() error {
+	err := c.Conn.Close()
+	c.cancel()
+	return err
+}
+
+// raceTCPFlow opens the flow to dst over every candidate at once and keeps
+// the first to answer. Each candidate dials a fresh tunnel, so no warm
+// standby is spent on a racer that loses. Once the first tunnel is up,
+// ready is called to confirm the flow to the client and return the client's
+// first bytes; those are sent over every tunnel that came up and the first
+// one to read a reply wins. When the client sends nothing, the first tunnel
+// up wins. The losers are cancelled and closed.
+//
+// Failures are reported to health only when no tunnel comes up, so a lost
+// race never penalizes an upstream. replied tells the caller whether ready
+// ran, i.e. whether the client was already told the flow is open.
+func (lb *LoadBalancer) raceTCPFlow(ctx context.Context, cands []*UpstreamState, flowID uint64, dst string, ready func() ([]byte, error)) (win *UpstreamState, conn net.Conn, replied bool, err error) {
+	type result struct {
+		i     int
+		ws    WSConn   // set by a dial
+		ss    net.Conn // set by an open
+		first []byte
+		err   error
+	}
+	dials := make(chan result, len(cands))
+	opens := make(chan result, len(cands))
+	cancels := make([]context.CancelFunc, len(cands))
+	ctxs := make([]context.Context, len(cands))
+	for i, up := range cands {
+		ctxs[i], cancels[i] = context.WithCancel(ctx)
+		go func() {
+			c, err := lb.dialTCPWS(ctxs[i], up)
+			dials <- result{i: i, ws: c, err: err}
+		}()
+	}
+
+	var payload []byte
+	open := func(i int, ws WSConn) {
+		ss, err := newSSTCPConn(ctxs[i], ws, cands[i].cfg, dst)
+		if err == nil && len(payload) > 0 {
+			_, err = ss.Write(payload)
+		}
+		var first []byte
+		if err == nil {
+			buf := make([]byte, raceFirstReadSize)
+			var n int
+			n, err = ss.Read(buf)
+			if n > 0 {
+				first, err = buf[:n], nil
+			}
+		}
+		if err != nil {
+			if ss != nil {
+				_ = ss.Close()
+				ss = nil
+			} else {
+				_ = ws.Close(WSStatusNormalClosure, "race-open-failed")
+			}
+		}
+		opens <- result{i: i, ss: ss, first: first, err: err}
+	}
+	// finish cancels every racer but keep (-1 for none) and closes whatever
+	// they still produce in the background.
+	finish := func(keep, pendingDials, pendingOpens int) {
+		for i, cancel := range cancels {
+			if i != keep {
+				cancel()
+			}
+		}
+		go func() {
+			for ; pendingDials > 0; pendingDials-- {
+				if r := <-dials; r.ws != nil {
+					_ = r.ws.Close(WSStatusNormalClosure, "race-lost")
+				}
+			}
+			for ; pendingOpens > 0; pendingOpens-- {
+				if r := <-opens; r.ss != nil {
+					_ = r.ss.Close()
+				}
+			}
+		}()
+	}
+
+	// Stage 1: the first tunnel up lets the client go ahead.
+	errs := make([]error, len(cands))
+	pendingDials := len(cands)
+	first := -1
+	var firstWS WSConn
+	for first < 0 && pendingDials > 0 {
+		r := <-dials
+		pendingDials--
+		if r.err != nil {
+			cancels[r.i]()
+			errs[r.i] = r.err
+			continue
+		}
+		first, firstWS = r.i, r.ws
+	}
+	if first < 0 {
+		var joined []error
+		for i, up := range cands {
+			if !errors.Is(errs[i], context.Canceled) {
+				lb.ReportTCPFailure(up, errs[i])
+			}
+			joined = append(joined, fmt.Errorf("%s: %w", up.cfg.Name, errs[i]))
+		}
+		return cands[0], nil, false, errors.Join(joined...)
+	}
+
+	payload, err = ready()
+	if err != nil {
+		finish(-1, pendingDials, 0)
+		_ = firstWS.Close(WSStatusNormalClosure, "client-gone")
+		return cands[first], nil, true, err
+	}
+	if len(payload) == 0 {
+		finish(first, pendingDials, 0)
+		ss, err := newSSTCPConn(ctxs[first], firstWS, cands[first].cfg, dst)
+		if err != nil {
+			_ = firstWS.Close(WSStatusNormalClosure, "race-open-failed")
+			cancels[first]()
+			return cands[first], nil, true, err
+		}
+		wsTracef(ctx, "flow=%d race won by upstream=%q among %d (client silent)", flowID, cands[first].cfg.Name, len(cands))
+		return cands[first], &raceConn{Conn: ss, cancel: cancels[first]}, true, nil
+	}
+
+	// Stage 2: every tunnel that comes up carries the client's first bytes;
+	// the first reply wins.
+	pendingOpens := 1
+	go open(first, firstWS)
+	for pendingDials+pendingOpens > 0 {
+		select {
+		case r := <-dials:
+			pendingDials--
+			if r.err != nil {
+				cancels[r.i]()
+				errs[r.i] = r.err
+				continue
+			}
+			pendingOpens++
+			go open(r.i, r.ws)
+		case r := <-opens:
+			pendingOpens--
+			if r.err != nil {
+				cancels[r.i]()
+				errs[r.i] = r.err
+				continue
+			}
+			wsTracef(ctx, "flow=%d race won by upstream=%q among %d", flowID, cands[r.i].cfg.Name, len(cands))
+			finish(r.i, pendingDials, pendingOpens)
+			return cands[r.i], &raceConn{Conn: r.ss, first: r.first, cancel: cancels[r.i]}, true, nil
+		}
+	}
+
+	// Tunnels came up but none got a reply: more likely the destination
+	// than the upstreams, so health is left alone.
+	var joined []error
+	for i, up := range cands {
+		joined = append(joined, fmt.Errorf("%s: %w", up.cfg.Name, errs[i]))
+	}
+	return cands[first], nil, true, errors.Join(joined...)
+}
+
+// readClientFirst returns what the client sends on c within wait: nil when
+// it stays silent, an error when it goes away.
+func readClientFirst(c net.Conn, wait time.Duration) ([]byte, error) {
+	_ = c.SetReadDeadline(time.Now().Add(wait))
+	defer func() { _ = c.SetReadDeadline(time.Time{}) }()
+	buf := make([]byte, raceFirstReadSize)
+	n, err := c.Read(buf)
+	if n > 0 {
+		return buf[:n], nil
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return nil, nil
+	}
+	return nil, err
+}
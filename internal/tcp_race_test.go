@@ -0,0 +1,199 @@
+//go:build !unit
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// raceTestWS is a tunnel to a plain-cipher upstream: it records what the
+// client writes and answers the first payload with reply, if any.
+type raceTestWS struct {
+	reply  []byte
+	mu     sync.Mutex
+	writes [][]byte
+	in     chan []byte
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newRaceTestWS(reply string) *raceTestWS {
+	w := &raceTestWS{in: make(chan []byte, 4), done: make(chan struct{})}
+	if reply != "" {
+		w.reply = []byte(reply)
+	}
+	return w
+}
+
+func (w *raceTestWS) Read(ctx context.Context) (WSMessageType, []byte, error) {
+	select {
+	case b := <-w.in:
+		return WSMessageBinary, b, nil
+	case <-w.done:
+		return 0, nil, net.ErrClosed
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+}
+
+func (w *raceTestWS) Write(ctx context.Context, typ WSMessageType, data []byte) error {
+	w.mu.Lock()
+	w.writes = append(w.writes, append([]byte(nil), data...))
+	payload := len(w.writes) == 2 // the target header comes first
+	w.mu.Unlock()
+	if payload && w.reply != nil {
+		w.in <- w.reply
+	}
+	return nil
+}
+
+func (w *raceTestWS) Close(code WSStatusCode, reason string) error {
+	w.once.Do(func() { close(w.done) })
+	return nil
+}
+
+func (w *raceTestWS) isClosed() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func newRaceTestLB(t *testing.T, names ...string) *LoadBalancer {
+	t.Helper()
+	SetAllowPlainCipher(true)
+	t.Cleanup(func() { SetAllowPlainCipher(false) })
+	var ups []UpstreamConfig
+	for _, n := range names {
+		ups = append(ups, UpstreamConfig{Name: n, TCPWSS: "wss://" + n + "/tcp", Cipher: "none"})
+	}
+	return NewLoadBalancer(ups, HealthcheckConfig{}, SelectionConfig{RaceN: len(names)}, ProbeConfig{}, 0)
+}
+
+func sendFirst(b string) func() ([]byte, error) {
+	return func() ([]byte, error) { return []byte(b), nil }
+}
+
+func TestRaceTCPFlow_FirstReplyWinsOverFirstHandshake(t *testing.T) {
+	lb := newRaceTestLB(t, "mute", "slow")
+	mute, slow := newRaceTestWS(""), newRaceTestWS("pong")
+	lb.tunnelDial = func(ctx context.Context, rawurl string) (WSConn, error) {
+		if strings.Contains(rawurl, "mute") {
+			return mute, nil // handshakes at once, but never answers
+		}
+		time.Sleep(30 * time.Millisecond)
+		return slow, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	winner, c, replied, err := lb.raceTCPFlow(ctx, lb.pool, 1, "example.com:443", sendFirst("ping"))
+	if err != nil || !replied {
+		t.Fatalf("raceTCPFlow: replied=%v err=%v", replied, err)
+	}
+	if winner.cfg.Name != "slow" {
+		t.Fatalf("winner=%q want slow", winner.cfg.Name)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(c, got); err != nil || string(got) != "pong" {
+		t.Fatalf("first read=%q err=%v, want pong replayed", got, err)
+	}
+	waitFor(t, mute.isClosed, "mute loser closed")
+	mute.mu.Lock()
+	if len(mute.writes) != 2 || !bytes.Equal(mute.writes[1], []byte("ping")) {
+		t.Errorf("every tunnel up must carry the first bytes, mute saw %q", mute.writes)
+	}
+	mute.mu.Unlock()
+
+	_ = c.Close()
+	if !slow.isClosed() {
+		t.Fatalf("closing the race conn must close the winner")
+	}
+	for _, up := range lb.pool {
+		up.mu.Lock()
+		fails := up.tcp.failCount
+		up.mu.Unlock()
+		if fails != 0 {
+			t.Fatalf("losing a race must not count as a health failure, %q failCount=%d", up.cfg.Name, fails)
+		}
+	}
+}
+
+func TestRaceTCPFlow_SilentClientTakesFirstTunnel(t *testing.T) {
+	lb := newRaceTestLB(t, "fast", "late")
+	fast, late := newRaceTestWS(""), newRaceTestWS("")
+	lb.tunnelDial = func(ctx context.Context, rawurl string) (WSConn, error) {
+		if strings.Contains(rawurl, "late") {
+			time.Sleep(50 * time.Millisecond) // ignores cancellation
+			return late, nil
+		}
+		return fast, nil
+	}
+
+	winner, c, _, err := lb.raceTCPFlow(context.Background(), lb.pool, 1, "example.com:22", sendFirst(""))
+	if err != nil || winner.cfg.Name != "fast" {
+		t.Fatalf("winner=%v err=%v, want fast", winner, err)
+	}
+	defer c.Close()
+	waitFor(t, late.isClosed, "late loser closed")
+	if fast.isClosed() {
+		t.Fatal("winner closed")
+	}
+}
+
+func TestRaceTCPFlow_DialsFreshAndKeepsStandbys(t *testing.T) {
+	lb := newRaceTestLB(t, "a", "b")
+	standby := newRaceTestWS("")
+	lb.pool[0].standbyTCP = standby
+	lb.tunnelDial = func(ctx context.Context, rawurl string) (WSConn, error) {
+		return newRaceTestWS("pong"), nil
+	}
+
+	_, c, _, err := lb.raceTCPFlow(context.Background(), lb.pool, 1, "example.com:443", sendFirst("ping"))
+	if err != nil {
+		t.Fatalf("raceTCPFlow: %v", err)
+	}
+	_ = c.Close()
+	lb.pool[0].standbyMu.Lock()
+	kept := lb.pool[0].standbyTCP == standby
+	lb.pool[0].standbyMu.Unlock()
+	if !kept || standby.isClosed() {
+		t.Fatal("a race must not spend the warm standby")
+	}
+}
+
+func TestRaceTCPFlow_AllFailReportsHealth(t *testing.T) {
+	lb := newRaceTestLB(t, "a", "b")
+	lb.hc.FailThreshold = 5
+	lb.tunnelDial = func(ctx context.Context, rawurl string) (WSConn, error) {
+		return nil, errors.New("handshake refused")
+	}
+
+	var ready atomic.Bool
+	_, c, replied, err := lb.raceTCPFlow(context.Background(), lb.pool, 1, "example.com:443", func() ([]byte, error) {
+		ready.Store(true)
+		return nil, nil
+	})
+	if err == nil || c != nil || replied || ready.Load() {
+		t.Fatalf("expected failure before replying, got conn=%v replied=%v err=%v", c, replied, err)
+	}
+	for _, up := range lb.pool {
+		up.mu.Lock()
+		fails := up.tcp.failCount
+		up.mu.Unlock()
+		if fails != 1 {
+			t.Fatalf("upstream %q failCount=%d want 1", up.cfg.Name, fails)
+		}
+	}
+}
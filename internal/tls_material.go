@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// upstreamTLSMaterial holds the trust roots and client certificate of every
+// upstream TLS handshake (h1, h2 and h3 dials, h3 health checks). Dials read
+// it when they build their tls.Config, so LoadTLSMaterial, run at startup and
+// again on SIGHUP, applies rotated files to the next dial without a restart.
+type upstreamTLSMaterial struct {
+	mu    sync.RWMutex
+	roots *x509.CertPool // nil = system roots
+	certs []tls.Certificate
+}
+
+var upstreamTLS upstreamTLSMaterial
+
+// LoadTLSMaterial (re)reads cfg's CA bundle and client key pair. On error
+// nothing is replaced and the material loaded before stays in use.
+func LoadTLSMaterial(cfg TLSConfig) error {
+	var roots *x509.CertPool
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return fmt.Errorf("tls.ca_file: %w", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("tls.ca_file %s: no PEM certificates found", cfg.CAFile)
+		}
+	}
+	var certs []tls.Certificate
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return errors.New("tls.cert_file and tls.key_file must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return fmt.Errorf("tls client certificate: %w", err)
+		}
+		certs = []tls.Certificate{cert}
+	}
+
+	upstreamTLS.mu.Lock()
+	defer upstreamTLS.mu.Unlock()
+	upstreamTLS.roots = roots
+	upstreamTLS.certs = certs
+	return nil
+}
+
+// withUpstreamTLS sets the current roots and client certificate on c.
+func withUpstreamTLS(c *tls.Config) *tls.Config {
+	upstreamTLS.mu.RLock()
+	defer upstreamTLS.mu.RUnlock()
+	c.RootCAs = upstreamTLS.roots
+	c.Certificates = upstreamTLS.certs
+	return c
+}
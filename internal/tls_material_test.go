@@ -0,0 +1,81 @@
+//go:build !unit
+
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeCertPEM(t *testing.T, path string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadTLSMaterial_SwappedCAFileAppliesToNextDial(t *testing.T) {
+	srv := newH1EchoServer(t)
+	t.Cleanup(func() { _ = LoadTLSMaterial(TLSConfig{}) })
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "unrelated CA"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}
+	unrelated, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	rawurl := "wss" + strings.TrimPrefix(srv.URL, "https") + "/tcp"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	writeCertPEM(t, caFile, unrelated)
+	if err := LoadTLSMaterial(TLSConfig{CAFile: caFile}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DialWSStream(ctx, rawurl, 0); err == nil {
+		t.Fatal("dial trusted a server outside tls.ca_file")
+	}
+
+	writeCertPEM(t, caFile, srv.Certificate().Raw)
+	if err := LoadTLSMaterial(TLSConfig{CAFile: caFile}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := DialWSStream(ctx, rawurl, 0)
+	if err != nil {
+		t.Fatalf("dial after swapping in the server's CA: %v", err)
+	}
+	_ = c.Close(WSStatusNormalClosure, "")
+
+	// A broken file on reload keeps the working roots.
+	if err := os.WriteFile(caFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadTLSMaterial(TLSConfig{CAFile: caFile}); err == nil {
+		t.Fatal("reload of a file without certificates succeeded")
+	}
+	c, err = DialWSStream(ctx, rawurl, 0)
+	if err != nil {
+		t.Fatalf("dial after failed reload: %v", err)
+	}
+	_ = c.Close(WSStatusNormalClosure, "")
+}
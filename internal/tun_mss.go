@@ -0,0 +1,110 @@
+package internal
+
+import "encoding/binary"
+
+// tunAutoMSSOverhead is subtracted from the TUN MTU for the automatic clamp:
+// IPv6 + TCP headers (60) plus headroom for the TLS/WebSocket/Shadowsocks
+// framing the payload picks up on its way to the upstream (40).
+const tunAutoMSSOverhead = 100
+
+// tunMSSClamp resolves tun.mss_clamp against the device MTU: 0 derives the
+// value from mtu, a negative value disables clamping (returns 0).
+func tunMSSClamp(setting, mtu int) uint16 {
+	switch {
+	case setting < 0:
+		return 0
+	case setting > 0:
+		return uint16(setting)
+	}
+	mss := mtu - tunAutoMSSOverhead
+	if mss < 536 {
+		mss = 536
+	}
+	return uint16(mss)
+}
+
+// clampTCPMSS lowers the MSS option of a TCP SYN in the raw IPv4/IPv6 packet
+// pkt to mss, fixing the TCP checksum incrementally. Anything else (non-TCP,
+// non-SYN, fragments, IPv6 extension headers, no MSS option, MSS already
+// small enough) is left untouched. It reports whether pkt was modified.
+func clampTCPMSS(pkt []byte, mss uint16) bool {
+	if mss == 0 || len(pkt) < 1 {
+		return false
+	}
+	var tcp []byte
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 || pkt[9] != 6 {
+			return false
+		}
+		if binary.BigEndian.Uint16(pkt[6:8])&0x1FFF != 0 {
+			return false // non-first fragment
+		}
+		ihl := int(pkt[0]&0x0F) * 4
+		if ihl < 20 || len(pkt) < ihl {
+			return false
+		}
+		tcp = pkt[ihl:]
+	case 6:
+		if len(pkt) < 40 || pkt[6] != 6 {
+			return false
+		}
+		tcp = pkt[40:]
+	default:
+		return false
+	}
+
+	if len(tcp) < 20 || tcp[13]&0x02 == 0 { // SYN
+		return false
+	}
+	dataOff := int(tcp[12]>>4) * 4
+	if dataOff < 20 || len(tcp) < dataOff {
+		return false
+	}
+
+	opts := tcp[20:dataOff]
+	for i := 0; i < len(opts); {
+		switch kind := opts[i]; kind {
+		case 0: // end of option list
+			return false
+		case 1: // NOP
+			i++
+			continue
+		}
+		if i+1 >= len(opts) {
+			return false
+		}
+		l := int(opts[i+1])
+		if l < 2 || i+l > len(opts) {
+			return false
+		}
+		if opts[i] == 2 && l == 4 {
+			off := 20 + i + 2 // MSS value offset within the TCP header
+			old := binary.BigEndian.Uint16(tcp[off:])
+			if old <= mss {
+				return false
+			}
+			binary.BigEndian.PutUint16(tcp[off:], mss)
+			oldW, newW := old, mss
+			if off%2 == 1 {
+				// The field straddles two checksum words; the one's
+				// complement sum is byte-order independent, so swap.
+				oldW, newW = oldW>>8|oldW<<8, newW>>8|newW<<8
+			}
+			sum := binary.BigEndian.Uint16(tcp[16:18])
+			binary.BigEndian.PutUint16(tcp[16:18], checksumReplace(sum, oldW, newW))
+			return true
+		}
+		i += l
+	}
+	return false
+}
+
+// checksumReplace updates an Internet checksum after one 16-bit word
+// changed from old to new (RFC 1624, eqn. 3).
+func checksumReplace(sum, old, new uint16) uint16 {
+	s := uint32(^sum) + uint32(^old) + uint32(new)
+	s = (s & 0xFFFF) + (s >> 16)
+	s = (s & 0xFFFF) + (s >> 16)
+	return ^uint16(s)
+}
@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// tcpChecksum computes the TCP checksum of pkt from scratch (pseudo header
+// included), with the checksum field treated as zero.
+func tcpChecksum(pkt []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i:]))
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	var tcp []byte
+	if pkt[0]>>4 == 4 {
+		ihl := int(pkt[0]&0x0F) * 4
+		tcp = pkt[ihl:]
+		add(pkt[12:20])
+	} else {
+		tcp = pkt[40:]
+		add(pkt[8:40])
+	}
+	sum += 6 + uint32(len(tcp))
+	tmp := append([]byte(nil), tcp...)
+	tmp[16], tmp[17] = 0, 0
+	add(tmp)
+	for sum > 0xFFFF {
+		sum = (sum & 0xFFFF) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// synPacket builds a SYN carrying opts; pad with NOPs to shift the MSS
+// option onto an odd offset.
+func synPacket(v6 bool, flags byte, opts []byte) []byte {
+	for len(opts)%4 != 0 {
+		opts = append(opts, 0)
+	}
+	tcp := make([]byte, 20+len(opts))
+	binary.BigEndian.PutUint16(tcp[0:], 40000)
+	binary.BigEndian.PutUint16(tcp[2:], 443)
+	tcp[12] = byte(len(tcp)/4) << 4
+	tcp[13] = flags
+	copy(tcp[20:], opts)
+
+	var ip []byte
+	if v6 {
+		ip = make([]byte, 40)
+		ip[0] = 6 << 4
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = 6
+		ip[8], ip[23] = 0xfd, 1
+		ip[24], ip[39] = 0x20, 2
+	} else {
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		ip[9] = 6
+		copy(ip[12:], []byte{10, 0, 0, 2, 93, 184, 216, 34})
+	}
+	pkt := append(ip, tcp...)
+	binary.BigEndian.PutUint16(pkt[len(ip)+16:], tcpChecksum(pkt))
+	return pkt
+}
+
+func mssOf(pkt []byte) uint16 {
+	off := 20
+	if pkt[0]>>4 == 6 {
+		off = 40
+	}
+	opts := pkt[off+20 : off+int(pkt[off+12]>>4)*4]
+	for i := 0; i+1 < len(opts); {
+		if opts[i] == 1 {
+			i++
+			continue
+		}
+		if opts[i] == 2 {
+			return binary.BigEndian.Uint16(opts[i+2:])
+		}
+		if opts[i] == 0 || opts[i+1] < 2 {
+			break
+		}
+		i += int(opts[i+1])
+	}
+	return 0
+}
+
+func TestClampTCPMSS(t *testing.T) {
+	mss1460 := []byte{2, 4, 0x05, 0xb4}
+	cases := []struct {
+		name  string
+		pkt   []byte
+		want  uint16
+		clamp bool
+	}{
+		{"v4 syn", synPacket(false, 0x02, mss1460), 1400, true},
+		{"v6 syn-ack", synPacket(true, 0x12, mss1460), 1400, true},
+		{"odd offset", synPacket(false, 0x02, append([]byte{1}, mss1460...)), 1400, true},
+		{"after wscale", synPacket(true, 0x02, append([]byte{3, 3, 7}, mss1460...)), 1400, true},
+		{"already small", synPacket(false, 0x02, []byte{2, 4, 0x04, 0x00}), 1024, false},
+		{"not syn", synPacket(false, 0x10, mss1460), 1460, false},
+		{"no mss", synPacket(false, 0x02, []byte{1, 1, 4, 2}), 0, false},
+	}
+	for _, tc := range cases {
+		got := clampTCPMSS(tc.pkt, 1400)
+		if got != tc.clamp {
+			t.Errorf("%s: clamped=%v want %v", tc.name, got, tc.clamp)
+		}
+		if m := mssOf(tc.pkt); m != tc.want {
+			t.Errorf("%s: mss=%d want %d", tc.name, m, tc.want)
+		}
+		off := 20
+		if tc.pkt[0]>>4 == 6 {
+			off = 40
+		}
+		if sum := binary.BigEndian.Uint16(tc.pkt[off+16:]); sum != tcpChecksum(tc.pkt) {
+			t.Errorf("%s: checksum %#04x, recomputed %#04x", tc.name, sum, tcpChecksum(tc.pkt))
+		}
+	}
+
+	if clampTCPMSS(synPacket(false, 0x02, mss1460), 0) {
+		t.Fatalf("mss=0 must disable clamping")
+	}
+	if clampTCPMSS([]byte{0x45, 0, 0}, 1400) {
+		t.Fatalf("truncated packet must be left alone")
+	}
+}
+
+func TestTunMSSClamp(t *testing.T) {
+	if got := tunMSSClamp(0, 1500); got != 1400 {
+		t.Fatalf("auto for mtu 1500 = %d, want 1400", got)
+	}
+	if got := tunMSSClamp(0, 576); got != 536 {
+		t.Fatalf("auto for tiny mtu = %d, want floor 536", got)
+	}
+	if got := tunMSSClamp(1200, 1500); got != 1200 {
+		t.Fatalf("explicit = %d, want 1200", got)
+	}
+	if got := tunMSSClamp(-1, 1500); got != 0 {
+		t.Fatalf("disabled = %d, want 0", got)
+	}
+}
@@ -1,16 +1,18 @@
-//go:build !unit && linux
+//go:build !unit && !observer && linux
 
 package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
+	"io/fs"
 	"log"
 	"net"
 	"net/netip"
 	"os"
 	"runtime"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -44,7 +46,7 @@ func openExistingTun(name string, debug bool) (*water.Interface, int, error) {
 	cfg.Name = name
 	ifce, err := water.New(cfg)
 	if err != nil {
-		return nil, 0, fmt.Errorf("open tun %q: %w", name, err)
+		return nil, 0, tunOpenError(name, err)
 	}
 
 	if err := ensureTunPersistent(ifce, name, debug); err != nil {
@@ -64,6 +66,45 @@ func openExistingTun(name string, debug bool) (*water.Interface, int, error) {
 	return ifce, mtu, nil
 }
 
+// tunDevicePath is the clone device every TUN open goes through.
+const tunDevicePath = "/dev/net/tun"
+
+// tunOpenError turns a failed TUN open into an actionable message: missing
+// privileges and a missing clone device are by far the common causes, and a
+// bare "operation not permitted" says nothing about how to fix either.
+func tunOpenError(name string, err error) error {
+	switch {
+	case errors.Is(err, fs.ErrPermission):
+		return fmt.Errorf("open tun %q: %w: run as root, grant CAP_NET_ADMIN "+
+			"(setcap cap_net_admin+ep <binary>, or cap_add: NET_ADMIN in Docker), "+
+			"or open the device in a privileged helper and pass it via tun.fd", name, err)
+	case errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("open tun %q: %s is missing: %w: load the tun module (modprobe tun) "+
+			"or expose the device to the container (--device /dev/net/tun)", name, tunDevicePath, err)
+	}
+	return fmt.Errorf("open tun %q: %w", name, err)
+}
+
+// openTunFD wraps an already-open TUN fd (e.g. created by a privileged helper
+// and inherited across exec), so the data plane can run without CAP_NET_ADMIN.
+// There is no interface name to query, so mtu comes from the config.
+func openTunFD(fd, mtu int) (*water.Interface, int, error) {
+	if fd <= 0 {
+		return nil, 0, fmt.Errorf("tun.fd must be > 0, got %d", fd)
+	}
+	if _, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0); err != nil {
+		return nil, 0, fmt.Errorf("tun.fd %d is not an open descriptor: %w", fd, err)
+	}
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("tun-fd-%d", fd))
+	if f == nil {
+		return nil, 0, fmt.Errorf("tun.fd %d: invalid descriptor", fd)
+	}
+	if mtu <= 0 {
+		mtu = 1500
+	}
+	return &water.Interface{ReadWriteCloser: f}, mtu, nil
+}
+
 func ensureTunPersistent(ifce *water.Interface, name string, debug bool) error {
 	f, ok := ifce.ReadWriteCloser.(*os.File)
 	if !ok {
@@ -128,8 +169,11 @@ func isDNSDestination(dst string) bool {
 // ----- Main -----
 
 func RunTunNative(ctx context.Context, cfg TunConfig, lb *LoadBalancer) error {
-	if cfg.Device == "" {
-		return fmt.Errorf("tun.device is empty")
+	if cfg.Device == "" && cfg.FD <= 0 {
+		return fmt.Errorf("tun.device and tun.fd are both empty")
+	}
+	if cfg.Device != "" && cfg.FD > 0 {
+		return fmt.Errorf("tun: set either device or fd, not both")
 	}
 
 	// defaults
@@ -143,29 +187,50 @@ func RunTunNative(ctx context.Context, cfg TunConfig, lb *LoadBalancer) error {
 		cfg.UDPGCInterval = 10 * time.Second
 	}
 
-	log.Printf("TUN mode enabled (native), expecting existing interface %q", cfg.Device)
-	if cfg.NetNS != "" {
+	if cfg.FD > 0 {
+		log.Printf("TUN mode enabled (native), using inherited fd %d", cfg.FD)
+	} else {
+		log.Printf("TUN mode enabled (native), expecting existing interface %q", cfg.Device)
+	}
+	if cfg.NetNS != "" && cfg.FD <= 0 {
 		log.Printf("TUN netns enabled: opening %q inside %q", cfg.Device, cfg.NetNS)
 	}
 	if cfg.Debug {
 		log.Printf("TUN debug logging is enabled")
 	}
+	if cfg.FailOpen {
+		log.Printf("TUN fail-open enabled: with no healthy upstream, flows go direct (unencrypted)")
+	}
 
 	var (
 		ifce *water.Interface
 		mtu  int
+		err  error
 	)
-	err := withNetNS(cfg.NetNS, func() error {
-		var openErr error
-		ifce, mtu, openErr = openExistingTun(cfg.Device, cfg.Debug)
-		return openErr
-	})
+	if cfg.FD > 0 {
+		ifce, mtu, err = openTunFD(cfg.FD, cfg.MTU)
+	} else {
+		err = withNetNS(cfg.NetNS, func() error {
+			var openErr error
+			ifce, mtu, openErr = openExistingTun(cfg.Device, cfg.Debug)
+			return openErr
+		})
+	}
 	if err != nil {
 		return err
 	}
 	defer ifce.Close()
 
-	log.Printf("TUN opened: %s (mtu=%d)", cfg.Device, mtu)
+	if cfg.FD > 0 {
+		log.Printf("TUN opened: fd %d (mtu=%d)", cfg.FD, mtu)
+	} else {
+		log.Printf("TUN opened: %s (mtu=%d)", cfg.Device, mtu)
+	}
+
+	mss := tunMSSClamp(cfg.MSSClamp, mtu)
+	if mss > 0 {
+		log.Printf("TUN: clamping TCP MSS to %d", mss)
+	}
 
 	st := stack.New(stack.Options{
 		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
@@ -190,13 +255,46 @@ func RunTunNative(ctx context.Context, cfg TunConfig, lb *LoadBalancer) error {
 	})
 
 	portTable := newUDPPortTable(lb, cfg)
+	sniRouter := newTunSNIRouter(cfg)
+	if sniRouter != nil {
+		log.Printf("TUN: routing TCP flows by TLS SNI")
+	}
+
+	// Shutdown is ordered: when ctx ends, new flows are refused, live TCP
+	// flows get the shutdown grace to finish (the pumps keep moving their
+	// packets meanwhile), then the remaining flows and UDP sessions are
+	// closed, and only then the stack and the interface go away.
+	flowCtx, stopFlows := context.WithCancel(context.WithoutCancel(ctx))
+	pumpCtx, stopPumps := context.WithCancel(context.WithoutCancel(ctx))
+	var tcpFlows, udpFlows flowGroup
+	defer func() {
+		stopFlows()
+		portTable.closeAll()
+		st.Close()
+		stopPumps()
+	}()
+
+	// Traffic to the upstream servers themselves must never enter the tunnel.
+	guard := newSelfDstGuard(ctx, lb, nil)
+	tunDebugf(cfg.Debug, "loop guard: %d upstream address(es) excluded from tunneling", guard.size())
+	go func() {
+		for {
+			select {
+			case <-flowCtx.Done():
+				return
+			case <-lb.upstreamAddrsChanged():
+				guard.rebuild(flowCtx, lb)
+				tunDebugf(cfg.Debug, "loop guard: rebuilt, %d upstream address(es) excluded from tunneling", guard.size())
+			}
+		}
+	}()
 
 	go func() {
 		t := time.NewTicker(cfg.UDPGCInterval)
 		defer t.Stop()
 		for {
 			select {
-			case <-ctx.Done():
+			case <-flowCtx.Done():
 				return
 			case <-t.C:
 				portTable.gcOnce()
@@ -207,46 +305,111 @@ func RunTunNative(ctx context.Context, cfg TunConfig, lb *LoadBalancer) error {
 	// TCP forwarder
 	tcpFwd := tcp.NewForwarder(st, 0, 65535, func(r *tcp.ForwarderRequest) {
 		id := r.ID()
+		if dst, ok := netip.AddrFromSlice(id.LocalAddress.AsSlice()); ok && guard.blocks(dst) {
+			observeTunDrop("upstream_dst")
+			tunDebugf(cfg.Debug, "tcp flow to upstream address %s dropped (routing loop)", dst)
+			r.Complete(true)
+			return
+		}
+
+		if !tcpFlows.enter() {
+			observeTunDrop("shutdown")
+			r.Complete(true)
+			return
+		}
+		release, ok := lb.acquireConn("tun tcp")
+		if !ok {
+			tcpFlows.leave()
+			observeTunDrop("max_connections")
+			r.Complete(true)
+			return
+		}
 
 		var wq waiter.Queue
 		epTCP, err := r.CreateEndpoint(&wq)
 		if err != nil {
+			release()
+			tcpFlows.leave()
 			r.Complete(true)
 			return
 		}
 		r.Complete(false)
 
-		go tunHandleTCP(ctx, lb, epTCP, id, &wq, cfg.Debug)
+		go func() {
+			defer tcpFlows.leave()
+			defer release()
+			tunHandleTCP(flowCtx, lb, epTCP, id, &wq, sniRouter, cfg.FailOpen, cfg.Debug)
+		}()
 	})
 	st.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpFwd.HandlePacket)
 
 	// UDP forwarder
 	udpFwd := udp.NewForwarder(st, func(r *udp.ForwarderRequest) {
 		id := r.ID()
+		if dst, ok := netip.AddrFromSlice(id.LocalAddress.AsSlice()); ok && guard.blocks(dst) {
+			observeTunDrop("upstream_dst")
+			tunDebugf(cfg.Debug, "udp flow to upstream address %s dropped (routing loop)", dst)
+			return
+		}
+
+		if lb.udpDisabled.Load() {
+			observeTunDrop("udp_disabled")
+			return
+		}
+
+		if !udpFlows.enter() {
+			observeTunDrop("shutdown")
+			return
+		}
+		release, ok := lb.acquireConn("tun udp")
+		if !ok {
+			udpFlows.leave()
+			observeTunDrop("max_connections")
+			return
+		}
 
 		var wq waiter.Queue
 		epUDP, err := r.CreateEndpoint(&wq)
 		if err != nil {
+			release()
+			udpFlows.leave()
 			return
 		}
-		go tunHandleUDP(ctx, lb, portTable, epUDP, id, &wq, cfg.Debug)
+		go func() {
+			defer udpFlows.leave()
+			defer release()
+			tunHandleUDP(flowCtx, lb, portTable, epUDP, id, &wq, cfg.Debug)
+		}()
 	})
 	st.SetTransportProtocolHandler(udp.ProtocolNumber, udpFwd.HandlePacket)
 
 	// Pumps
 	errCh := make(chan error, 2)
-	go func() { errCh <- tunToStack(ctx, ifce, ep, cfg.Debug) }()
-	go func() { errCh <- stackToTun(ctx, ifce, ep, cfg.Debug) }()
+	go func() { errCh <- tunToStack(pumpCtx, ifce, ep, mss, cfg.Debug) }()
+	go func() { errCh <- stackToTun(pumpCtx, ifce, ep, mss, cfg.Debug) }()
+	if cfg.Ready != nil {
+		cfg.Ready()
+	}
 
 	select {
 	case <-ctx.Done():
-		return nil
 	case err := <-errCh:
+		// The interface is gone; nothing left to flush.
 		return err
 	}
+
+	// UDP has nothing to flush: refuse new datagram flows and close the
+	// sessions with the rest. TCP flows keep their grace window.
+	udpFlows.drain(0)
+	grace := shutdownGrace(cfg.ShutdownGrace)
+	if n := tcpFlows.drain(grace); n > 0 {
+		log.Printf("TUN shutdown: closing %d tcp flow(s) still open after %s", n, grace)
+	}
+	return nil
 }
 
-func tunToStack(ctx context.Context, ifce *water.Interface, ep *channel.Endpoint, debug bool) error {
+// mss, when non-zero, clamps the MSS option of SYNs in both directions.
+func tunToStack(ctx context.Context, ifce *water.Interface, ep *channel.Endpoint, mss uint16, debug bool) error {
 	buf := make([]byte, 65535)
 	for {
 		select {
@@ -275,6 +438,7 @@ func tunToStack(ctx context.Context, ifce *water.Interface, ep *channel.Endpoint
 			continue
 		}
 		observeTunFrame("in", len(pkt))
+		clampTCPMSS(pkt, mss)
 
 		pb := stack.NewPacketBuffer(stack.PacketBufferOptions{
 			Payload: buffer.MakeWithData(append([]byte(nil), pkt...)),
@@ -284,7 +448,7 @@ func tunToStack(ctx context.Context, ifce *water.Interface, ep *channel.Endpoint
 	}
 }
 
-func stackToTun(ctx context.Context, ifce *water.Interface, ep *channel.Endpoint, debug bool) error {
+func stackToTun(ctx context.Context, ifce *water.Interface, ep *channel.Endpoint, mss uint16, debug bool) error {
 	for {
 		select {
 		case <-ctx.Done():
@@ -300,6 +464,7 @@ func stackToTun(ctx context.Context, ifce *water.Interface, ep *channel.Endpoint
 		v := pb.ToView()
 		b := append([]byte(nil), v.AsSlice()...)
 		pb.DecRef()
+		clampTCPMSS(b, mss)
 
 		if _, err := ifce.Write(b); err != nil {
 			observeTunError("write")
@@ -310,7 +475,7 @@ func stackToTun(ctx context.Context, ifce *water.Interface, ep *channel.Endpoint
 	}
 }
 
-func tunHandleTCP(ctx context.Context, lb *LoadBalancer, epTCP tcpip.Endpoint, id stack.TransportEndpointID, wq *waiter.Queue, debug bool) {
+func tunHandleTCP(ctx context.Context, lb *LoadBalancer, epTCP tcpip.Endpoint, id stack.TransportEndpointID, wq *waiter.Queue, sni *tunSNIRouter, failOpen, debug bool) {
 	defer epTCP.Close()
 
 	nsConn := gonet.NewTCPConn(wq, epTCP)
@@ -320,12 +485,31 @@ func tunHandleTCP(ctx context.Context, lb *LoadBalancer, epTCP tcpip.Endpoint, i
 	// For outbound packets from namespace workload: remote=workload, local=real destination.
 	dst := net.JoinHostPort(net.IP(id.LocalAddress.AsSlice()).String(), fmt.Sprintf("%d", id.LocalPort))
 	tunDebugf(debug, "tcp flow: %s:%d -> %s", net.IP(id.RemoteAddress.AsSlice()).String(), id.RemotePort, dst)
+	ctx = withProxySource(ctx, &net.TCPAddr{IP: net.IP(id.RemoteAddress.AsSlice()), Port: int(id.RemotePort)})
+	tunRelayTCP(ctx, lb, nsConn, dst, sni, failOpen, debug)
+}
 
-	up, err := lb.PickTCP()
+// tunRelayTCP carries one TUN TCP flow (nsConn, the stack side) to dst.
+func tunRelayTCP(ctx context.Context, lb *LoadBalancer, nsConn net.Conn, dst string, sni *tunSNIRouter, failOpen, debug bool) {
+	pickDst, direct, name, peeked := sni.route(nsConn, dst)
+	if name != "" {
+		tunDebugf(debug, "tcp flow: %s has sni %q (direct=%t)", dst, name, direct)
+	}
+	if direct {
+		tunDirectTCP(ctx, lb, nsConn, dst, peeked, debug)
+		return
+	}
+
+	up, err := lb.PickTCPFor(pickDst)
 	if err != nil {
-		tunDebugf(debug, "PickTCP failed for dst=%s: %v", dst, err)
+		tunDebugf(debug, "PickTCPFor failed for dst=%s: %v", pickDst, err)
+		if failOpen {
+			tunFailOpen(true)
+			tunDirectTCP(ctx, lb, nsConn, dst, peeked, debug)
+		}
 		return
 	}
+	tunFailOpen(false)
 	out, err := DialOutlineTCP(ctx, lb, up, dst)
 	if err != nil {
 		tunDebugf(debug, "DialOutlineTCP failed dst=%s via upstream=%s: %v", dst, up.cfg.Name, err)
@@ -333,14 +517,123 @@ func tunHandleTCP(ctx context.Context, lb *LoadBalancer, epTCP tcpip.Endpoint, i
 		return
 	}
 	defer out.Close()
+	defer lb.trackConn(up, "tcp")()
+	if len(peeked) > 0 {
+		if _, err := out.Write(peeked); err != nil {
+			tunDebugf(debug, "replay of sniffed bytes dst=%s via upstream=%s: %v", dst, up.cfg.Name, err)
+			return
+		}
+	}
+	// Past the shutdown grace the relay is cut from both ends.
+	stop := context.AfterFunc(ctx, func() {
+		_ = out.Close()
+		_ = nsConn.Close()
+	})
+	defer stop()
 
 	go func() {
-		if _, err := io.Copy(out, nsConn); err != nil {
+		if _, err := relayCopy(out, nsConn); err != nil {
 			// минимум: лог, иначе errcheck будет ругаться
-			log.Printf("tun: io.Copy nsConn->out: %v", err)
+			log.Printf("tun: relay nsConn->out: %v", err)
+		}
+	}()
+	_, _ = relayCopy(nsConn, out)
+}
+
+// tunDirectTCP dials dst from this host, with the LB fwmark so the socket
+// does not loop back into the TUN, and relays nsConn over it unencrypted.
+// peeked is what was already read from nsConn.
+func tunDirectTCP(ctx context.Context, lb *LoadBalancer, nsConn net.Conn, dst string, peeked []byte, debug bool) {
+	remote, err := newMarkedDialer(10*time.Second, lb.fwmark).DialContext(ctx, "tcp", dst)
+	if err != nil {
+		tunDebugf(debug, "direct dial failed dst=%s: %v", dst, err)
+		return
+	}
+	defer remote.Close()
+	if len(peeked) > 0 {
+		if _, err := remote.Write(peeked); err != nil {
+			return
+		}
+	}
+	publishEvent(Event{Type: EventConnOpen, Upstream: "direct", Proto: "tcp", Dst: dst})
+	defer publishEvent(Event{Type: EventConnClose, Upstream: "direct", Proto: "tcp", Dst: dst})
+	stop := context.AfterFunc(ctx, func() {
+		_ = remote.Close()
+		_ = nsConn.Close()
+	})
+	defer stop()
+
+	go func() {
+		_, _ = relayCopy(remote, nsConn)
+		if cw, ok := remote.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
 		}
 	}()
-	_, _ = io.Copy(nsConn, out)
+	_, _ = relayCopy(nsConn, remote)
+}
+
+// tunFailingOpen is set while tun.fail_open sends flows direct, so the
+// switch is logged once each way rather than per flow.
+var tunFailingOpen atomic.Bool
+
+func tunFailOpen(on bool) {
+	if tunFailingOpen.CompareAndSwap(!on, on) {
+		if on {
+			log.Printf("TUN: no healthy upstream, sending new flows direct (tun.fail_open)")
+		} else {
+			log.Printf("TUN: upstream available again, new flows are tunneled")
+		}
+	}
+}
+
+// tunDirectUDP is tunDirectTCP for one TUN UDP flow; it ends after idle
+// without a datagram either way.
+func tunDirectUDP(ctx context.Context, lb *LoadBalancer, nsUDP net.Conn, dst string, idle time.Duration, debug bool) {
+	remote, err := newMarkedDialer(10*time.Second, lb.fwmark).DialContext(ctx, "udp", dst)
+	if err != nil {
+		tunDebugf(debug, "direct udp dial failed dst=%s: %v", dst, err)
+		return
+	}
+	defer remote.Close()
+	if idle <= 0 {
+		idle = 60 * time.Second
+	}
+	closeBoth := func() {
+		_ = remote.Close()
+		_ = nsUDP.Close()
+	}
+	idleTimer := time.AfterFunc(idle, closeBoth)
+	defer idleTimer.Stop()
+	stop := context.AfterFunc(ctx, closeBoth)
+	defer stop()
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, err := remote.Read(buf)
+			if err != nil {
+				closeBoth()
+				return
+			}
+			idleTimer.Reset(idle)
+			if _, err := nsUDP.Write(buf[:n]); err != nil {
+				closeBoth()
+				return
+			}
+		}
+	}()
+	buf := make([]byte, 65535)
+	for {
+		n, err := nsUDP.Read(buf)
+		if err != nil {
+			return
+		}
+		idleTimer.Reset(idle)
+		if _, err := remote.Write(buf[:n]); err != nil {
+			tunDebugf(debug, "direct udp send failed dst=%s: %v", dst, err)
+			return
+		}
+	}
 }
 
 func tunHandleUDP(ctx context.Context, lb *LoadBalancer, pt *udpPortTable, epUDP tcpip.Endpoint, id stack.TransportEndpointID, wq *waiter.Queue, debug bool) {
@@ -366,20 +659,18 @@ func tunHandleUDP(ctx context.Context, lb *LoadBalancer, pt *udpPortTable, epUDP
 		tunDebugf(debug, "udp flow: %s:%d -> %s", srcIP.String(), id.RemotePort, dst)
 	}
 
-	pk := udpPortKey{
-		netProto: 4,
-		srcIP:    srcIP,
-		srcPort:  id.RemotePort,
-	}
-	if srcIP.Is6() {
-		pk.netProto = 6
-	}
+	pk := udpSessionKey(pt.cfg.UDPSessionMode, netip.AddrPortFrom(srcIP, id.RemotePort), netip.AddrPortFrom(dstAddr, id.LocalPort))
 
-	ps, err := pt.getOrCreate(ctx, pk)
+	ps, err := pt.getOrCreate(ctx, pk, dst)
 	if err != nil {
 		tunDebugf(debug, "udp session create failed for %s:%d -> %s: %v", srcIP.String(), id.LocalPort, dst, err)
+		if pt.cfg.FailOpen && errors.Is(err, ErrNoHealthyUpstreams) {
+			tunFailOpen(true)
+			tunDirectUDP(ctx, lb, nsUDP, dst, pt.cfg.UDPIdleTimeout, debug)
+		}
 		return
 	}
+	tunFailOpen(false)
 
 	// subscribe once per dst inside this port-session
 	ps.mu.Lock()
@@ -1,4 +1,4 @@
-//go:build !unit && !linux
+//go:build !unit && !observer && !linux
 
 package internal
 
@@ -0,0 +1,164 @@
+//go:build !unit && !observer && linux
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestOpenTunFD_WrapsInheritedDescriptor(t *testing.T) {
+	// A SOCK_SEQPACKET pair keeps packet boundaries, like a real TUN fd.
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("socketpair: %v", err)
+	}
+	peer := os.NewFile(uintptr(fds[1]), "peer")
+	defer peer.Close()
+
+	ifce, mtu, err := openTunFD(fds[0], 1400)
+	if err != nil {
+		t.Fatalf("openTunFD: %v", err)
+	}
+	defer ifce.Close()
+	if mtu != 1400 {
+		t.Fatalf("mtu=%d, want 1400", mtu)
+	}
+
+	pkt := []byte{0x45, 0, 0, 20, 1, 2, 3, 4}
+	if _, err := peer.Write(pkt); err != nil {
+		t.Fatalf("peer write: %v", err)
+	}
+	buf := make([]byte, 64)
+	n, err := ifce.Read(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(buf[:n], pkt) {
+		t.Fatalf("read %x, want %x", buf[:n], pkt)
+	}
+
+	if _, err := ifce.Write(pkt); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	n, err = peer.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], pkt) {
+		t.Fatalf("peer read %x err=%v, want %x", buf[:n], err, pkt)
+	}
+}
+
+func TestOpenTunFD_RejectsClosedDescriptor(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe: %v", err)
+	}
+	fd := int(r.Fd())
+	_ = r.Close()
+	_ = w.Close()
+
+	if _, _, err := openTunFD(fd, 0); err == nil {
+		t.Fatalf("expected error for closed fd")
+	}
+	if _, _, err := openTunFD(0, 0); err == nil {
+		t.Fatalf("expected error for fd 0")
+	}
+}
+
+func TestTunOpenError_ClassifiesPermissionAndMissingDevice(t *testing.T) {
+	perm := tunOpenError("tun0", os.NewSyscallError("ioctl", unix.EPERM))
+	if !errors.Is(perm, fs.ErrPermission) {
+		t.Fatalf("permission error lost its cause: %v", perm)
+	}
+	for _, want := range []string{`"tun0"`, "CAP_NET_ADMIN", "tun.fd"} {
+		if !strings.Contains(perm.Error(), want) {
+			t.Fatalf("permission error %q does not mention %s", perm, want)
+		}
+	}
+
+	missing := tunOpenError("tun0", &fs.PathError{Op: "open", Path: tunDevicePath, Err: unix.ENOENT})
+	if !errors.Is(missing, fs.ErrNotExist) || !strings.Contains(missing.Error(), "/dev/net/tun is missing") || !strings.Contains(missing.Error(), "modprobe tun") {
+		t.Fatalf("missing device error is not actionable: %v", missing)
+	}
+
+	other := tunOpenError("tun0", unix.EBUSY)
+	if strings.Contains(other.Error(), "CAP_NET_ADMIN") || !errors.Is(other, unix.EBUSY) {
+		t.Fatalf("unrelated error misclassified: %v", other)
+	}
+}
+
+func TestTunRelayTCP_FailOpenDialsDirect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	// No upstreams at all: every pick fails.
+	lb := NewLoadBalancer(nil, HealthcheckConfig{}, SelectionConfig{}, ProbeConfig{}, 0)
+	if _, err := lb.PickTCP(); !errors.Is(err, ErrNoHealthyUpstreams) {
+		t.Fatalf("PickTCP = %v, want ErrNoHealthyUpstreams", err)
+	}
+
+	// Fail-closed (default): the flow is dropped, nothing is dialed.
+	app, ns := net.Pipe()
+	tunRelayTCP(context.Background(), lb, ns, ln.Addr().String(), nil, false, false)
+	_ = app.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+		t.Fatal("fail-closed flow was dialed direct")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	app, ns = net.Pipe()
+	defer app.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tunRelayTCP(context.Background(), lb, ns, ln.Addr().String(), nil, true, false)
+	}()
+	var remote net.Conn
+	select {
+	case remote = <-accepted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("fail-open flow was not dialed direct")
+	}
+	defer remote.Close()
+
+	go func() { _, _ = app.Write([]byte("ping")) }()
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(remote, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("direct side read %q, %v", buf, err)
+	}
+	go func() { _, _ = remote.Write([]byte("pong")) }()
+	if _, err := io.ReadFull(app, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("app side read %q, %v", buf, err)
+	}
+
+	_ = remote.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("relay did not end after the remote closed")
+	}
+}
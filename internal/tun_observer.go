@@ -0,0 +1,17 @@
+//go:build !unit && observer
+
+package internal
+
+import (
+	"context"
+	"fmt"
+)
+
+// RunTunNative is unavailable in the observer build, which leaves out the
+// TUN device and the gVisor netstack.
+func RunTunNative(ctx context.Context, cfg TunConfig, lb *LoadBalancer) error {
+	_ = ctx
+	_ = cfg
+	_ = lb
+	return fmt.Errorf("tun mode is not available in the observer build")
+}
@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"context"
+	"net/netip"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// selfDstGuard remembers the IPs of the configured upstream servers so TUN
+// mode can refuse to tunnel traffic addressed to them. Without it, a default
+// route through the TUN device captures the client's own WebSocket dials and
+// the tunnel recursively tunnels itself. TUN mode rebuilds the set whenever
+// the upstreams can have moved (see LoadBalancer.upstreamAddrsChanged).
+type selfDstGuard struct {
+	lookup func(ctx context.Context, host string) ([]netip.Addr, error)
+	addrs  atomic.Pointer[map[netip.Addr]struct{}]
+}
+
+// newSelfDstGuard resolves every upstream host. Hosts the DNS refresh loop
+// has a current answer for use that answer; resolution errors are skipped:
+// an unresolvable host cannot be looped back into the TUN anyway.
+func newSelfDstGuard(ctx context.Context, lb *LoadBalancer, lookup func(ctx context.Context, host string) ([]netip.Addr, error)) *selfDstGuard {
+	if lookup == nil {
+		lookup = func(ctx context.Context, host string) ([]netip.Addr, error) {
+			if addrs := upstreamDNS.get(host, time.Now()); addrs != nil {
+				return addrs, nil
+			}
+			return lookupUpstreamIPs(ctx, "ip", host)
+		}
+	}
+	g := &selfDstGuard{lookup: lookup}
+	g.rebuild(ctx, lb)
+	return g
+}
+
+// rebuild replaces the address set with the current addresses of the pool.
+func (g *selfDstGuard) rebuild(ctx context.Context, lb *LoadBalancer) {
+	addrs := map[netip.Addr]struct{}{}
+	defer g.addrs.Store(&addrs)
+	if lb == nil {
+		return
+	}
+
+	lb.mu.Lock()
+	pool := append([]*UpstreamState(nil), lb.pool...)
+	lb.mu.Unlock()
+
+	seen := map[string]bool{}
+	for _, up := range pool {
+		for _, raw := range []string{up.cfg.TCPWSS, up.cfg.UDPWSS} {
+			u, err := url.Parse(raw)
+			if err != nil || u.Hostname() == "" {
+				continue
+			}
+			host := u.Hostname()
+			if seen[host] {
+				continue
+			}
+			seen[host] = true
+			if a, err := netip.ParseAddr(host); err == nil {
+				addrs[a.Unmap()] = struct{}{}
+				continue
+			}
+			ips, err := g.lookup(ctx, host)
+			if err != nil {
+				continue
+			}
+			for _, a := range ips {
+				addrs[a.Unmap()] = struct{}{}
+			}
+		}
+	}
+}
+
+// blocks reports whether dst is one of the upstream server addresses.
+func (g *selfDstGuard) blocks(dst netip.Addr) bool {
+	if g == nil {
+		return false
+	}
+	_, ok := (*g.addrs.Load())[dst.Unmap()]
+	return ok
+}
+
+// size returns the number of cached upstream addresses.
+func (g *selfDstGuard) size() int {
+	if g == nil {
+		return 0
+	}
+	return len(*g.addrs.Load())
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSelfDstGuard_BlocksUpstreamIPs(t *testing.T) {
+	lb := NewLoadBalancer([]UpstreamConfig{
+		{Name: "a", TCPWSS: "wss://edge.example/tcp", UDPWSS: "wss://edge.example/udp"},
+		{Name: "b", TCPWSS: "wss://198.51.100.7/tcp", UDPWSS: "wss://[2001:db8::7]/udp"},
+		{Name: "c", TCPWSS: "wss://broken.example/tcp"},
+	}, HealthcheckConfig{}, SelectionConfig{}, ProbeConfig{}, 0)
+
+	lookups := 0
+	g := newSelfDstGuard(context.Background(), lb, func(_ context.Context, host string) ([]netip.Addr, error) {
+		lookups++
+		switch host {
+		case "edge.example":
+			return []netip.Addr{netip.MustParseAddr("203.0.113.10")}, nil
+		default:
+			return nil, errors.New("no such host")
+		}
+	})
+
+	if lookups != 2 {
+		t.Fatalf("expected one lookup per distinct hostname, got %d", lookups)
+	}
+	for _, ip := range []string{"203.0.113.10", "198.51.100.7", "2001:db8::7", "::ffff:203.0.113.10"} {
+		if !g.blocks(netip.MustParseAddr(ip)) {
+			t.Fatalf("expected %s to bypass the tunnel", ip)
+		}
+	}
+	if g.blocks(netip.MustParseAddr("192.0.2.1")) {
+		t.Fatalf("unrelated destination must be tunneled")
+	}
+}
+
+func TestSelfDstGuard_RebuiltOnReloadAndDNSChange(t *testing.T) {
+	r := useFakeResolver(t)
+	const host = "guard.dns-refresh.test"
+	r.set(host, "198.51.100.1")
+
+	lb := NewLoadBalancer([]UpstreamConfig{
+		{Name: "a", TCPWSS: "wss://" + host + "/tcp"},
+	}, HealthcheckConfig{}, SelectionConfig{DNSRefreshInterval: time.Minute}, ProbeConfig{}, 0)
+	ctx := context.Background()
+	g := newSelfDstGuard(ctx, lb, nil)
+	if !g.blocks(netip.MustParseAddr("198.51.100.1")) {
+		t.Fatal("initial upstream address not blocked")
+	}
+
+	// The first refresh only seeds the cache; nothing changed yet.
+	lb.refreshUpstreamDNS(ctx)
+	changed := lb.upstreamAddrsChanged()
+	r.set(host, "198.51.100.2")
+	lb.refreshUpstreamDNS(ctx)
+	select {
+	case <-changed:
+	default:
+		t.Fatal("changed DNS answer not reported")
+	}
+	g.rebuild(ctx, lb)
+	if !g.blocks(netip.MustParseAddr("198.51.100.2")) || g.blocks(netip.MustParseAddr("198.51.100.1")) {
+		t.Fatal("guard does not follow the new DNS answer")
+	}
+
+	changed = lb.upstreamAddrsChanged()
+	lb.Reload([]UpstreamConfig{{Name: "b", TCPWSS: "wss://192.0.2.50/tcp"}})
+	select {
+	case <-changed:
+	default:
+		t.Fatal("reload not reported")
+	}
+	g.rebuild(ctx, lb)
+	if !g.blocks(netip.MustParseAddr("192.0.2.50")) || g.blocks(netip.MustParseAddr("198.51.100.2")) {
+		t.Fatal("guard does not follow the reloaded upstreams")
+	}
+}
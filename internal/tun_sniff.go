@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// tunSniffTimeout bounds how long a TUN TCP flow waits for the client's
+// first bytes under tun.sniff_sni. Protocols where the server speaks first
+// (SSH, SMTP) pay it once per connection.
+const tunSniffTimeout = 300 * time.Millisecond
+
+var errSNISniffed = errors.New("client hello read")
+
+// sniffConn feeds a throwaway TLS server: reads come from r, and the alert
+// it writes on abort is dropped.
+type sniffConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c sniffConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+func (sniffConn) Write(p []byte) (int, error)  { return len(p), nil }
+
+// sniffSNI reads the TLS ClientHello the client sends first on c and returns
+// its server name: "" when the flow is not TLS, has no SNI or stays silent
+// past timeout. peeked holds every byte consumed from c; the caller must
+// send it on before relaying the rest.
+func sniffSNI(c net.Conn, timeout time.Duration) (sni string, peeked []byte) {
+	var buf bytes.Buffer
+	_ = c.SetReadDeadline(time.Now().Add(timeout))
+	defer func() { _ = c.SetReadDeadline(time.Time{}) }()
+
+	// crypto/tls does the parsing (records, fragmented hellos) and stops
+	// right after the ClientHello, before anything would be written.
+	srv := tls.Server(sniffConn{Conn: c, r: io.TeeReader(c, &buf)}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = h.ServerName
+			return nil, errSNISniffed
+		},
+	})
+	_ = srv.Handshake()
+	return sni, buf.Bytes()
+}
+
+// tunSNIRouter applies tun.sniff_sni to TUN TCP flows: routing.direct is
+// matched against the ClientHello server name, and consistent_hash hashes
+// the name rather than the IP. nil when sniffing is off.
+type tunSNIRouter struct {
+	direct  *routeRules
+	timeout time.Duration
+}
+
+func newTunSNIRouter(cfg TunConfig) *tunSNIRouter {
+	if !cfg.SniffSNI {
+		return nil
+	}
+	r := &tunSNIRouter{timeout: tunSniffTimeout}
+	direct, err := newRouteRules(cfg.Direct)
+	if err != nil {
+		// LoadConfig rejects bad rules; this only guards embedders.
+		log.Printf("tun: ignoring routing.direct: %v", err)
+	} else {
+		r.direct = direct
+	}
+	return r
+}
+
+// route sniffs the flow to dst on c. It returns the destination to pick the
+// upstream for (sni:port when a name was found), whether the flow goes
+// direct, the server name and the bytes to replay.
+func (r *tunSNIRouter) route(c net.Conn, dst string) (pickDst string, direct bool, sni string, peeked []byte) {
+	if r == nil {
+		return dst, false, "", nil
+	}
+	sni, peeked = sniffSNI(c, r.timeout)
+	if sni == "" {
+		return dst, false, "", peeked
+	}
+	pickDst = sni
+	if _, port, err := net.SplitHostPort(dst); err == nil {
+		pickDst = net.JoinHostPort(sni, port)
+	}
+	return pickDst, r.direct.match(sni), sni, peeked
+}
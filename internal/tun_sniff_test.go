@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTunSNIRouter_RoutesByClientHello(t *testing.T) {
+	r := newTunSNIRouter(TunConfig{SniffSNI: true, Direct: []string{"*.intranet.example"}})
+	if r == nil {
+		t.Fatal("sniff_sni on but no router")
+	}
+
+	hello := func(name string) (net.Conn, *bytes.Buffer) {
+		client, server := net.Pipe()
+		t.Cleanup(func() { _ = client.Close(); _ = server.Close() })
+		var sent bytes.Buffer
+		go func() {
+			c := tls.Client(teeConn{Conn: client, w: &sent}, &tls.Config{ServerName: name, InsecureSkipVerify: true})
+			_ = c.Handshake()
+		}()
+		return server, &sent
+	}
+
+	nsConn, sent := hello("wiki.intranet.example")
+	pickDst, direct, sni, peeked := r.route(nsConn, "192.0.2.10:443")
+	if sni != "wiki.intranet.example" || !direct || pickDst != "wiki.intranet.example:443" {
+		t.Fatalf("route = %q, direct=%t, sni=%q; want wiki.intranet.example:443 direct", pickDst, direct, sni)
+	}
+	if len(peeked) == 0 || !bytes.Equal(peeked, sent.Bytes()[:len(peeked)]) || peeked[0] != 0x16 {
+		t.Fatalf("peeked %d bytes that are not the start of the ClientHello", len(peeked))
+	}
+
+	nsConn, _ = hello("video.example.com")
+	pickDst, direct, _, _ = r.route(nsConn, "198.51.100.7:443")
+	if direct || pickDst != "video.example.com:443" {
+		t.Fatalf("route = %q, direct=%t; want tunneled, picked by video.example.com:443", pickDst, direct)
+	}
+
+	// Not TLS: nothing matched, and what was read is handed back.
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() { _, _ = client.Write([]byte("SSH-2.0-OpenSSH_9.6\r\n")) }()
+	pickDst, direct, sni, peeked = r.route(server, "203.0.113.5:22")
+	if sni != "" || direct || pickDst != "203.0.113.5:22" || !bytes.HasPrefix([]byte("SSH-2.0-OpenSSH_9.6\r\n"), peeked) || len(peeked) == 0 {
+		t.Fatalf("ssh flow: route = %q, direct=%t, sni=%q, peeked=%q", pickDst, direct, sni, peeked)
+	}
+
+	// Server speaks first: the sniff gives up after the timeout.
+	r.timeout = 20 * time.Millisecond
+	_, server = net.Pipe()
+	start := time.Now()
+	if _, _, sni, peeked = r.route(server, "203.0.113.5:25"); sni != "" || len(peeked) != 0 {
+		t.Fatalf("silent flow: sni=%q peeked=%q", sni, peeked)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("sniff did not honor its timeout")
+	}
+
+	off := newTunSNIRouter(TunConfig{})
+	if pickDst, direct, _, peeked := off.route(server, "203.0.113.5:25"); off != nil || direct || pickDst != "203.0.113.5:25" || peeked != nil {
+		t.Fatal("with sniff_sni off flows must pass through unsniffed")
+	}
+}
+
+// teeConn records what the TLS client writes.
+type teeConn struct {
+	net.Conn
+	w *bytes.Buffer
+}
+
+func (c teeConn) Write(p []byte) (int, error) {
+	c.w.Write(p)
+	return c.Conn.Write(p)
+}
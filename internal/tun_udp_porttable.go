@@ -15,13 +15,36 @@ type udpPortKey struct {
 	netProto uint8
 	srcIP    netip.Addr
 	srcPort  uint16
+	// dst is set only in "flow" session mode, giving every destination of a
+	// source port its own upstream session.
+	dst netip.AddrPort
+}
+
+// UDP session granularity (TunConfig.UDPSessionMode).
+const (
+	udpSessionModePort = "port" // one session per srcIP:srcPort (default)
+	udpSessionModeFlow = "flow" // one session per srcIP:srcPort -> dstIP:dstPort
+)
+
+// udpSessionKey builds the session-table key for a packet from src to dst.
+func udpSessionKey(mode string, src, dst netip.AddrPort) udpPortKey {
+	k := udpPortKey{netProto: 4, srcIP: src.Addr(), srcPort: src.Port()}
+	if k.srcIP.Is6() {
+		k.netProto = 6
+	}
+	if mode == udpSessionModeFlow {
+		k.dst = dst
+	}
+	return k
 }
 
 type udpPortSession struct {
 	key      udpPortKey
 	up       *UpstreamState
 	sess     *OutlineUDPSession
+	created  time.Time
 	lastSeen time.Time
+	untrack  func() // releases the upstream's active-connection count
 
 	mu    sync.Mutex
 	flows map[string]time.Time
@@ -42,7 +65,8 @@ func newUDPPortTable(lb *LoadBalancer, cfg TunConfig) *udpPortTable {
 	}
 }
 
-func (t *udpPortTable) getOrCreate(ctx context.Context, key udpPortKey) (*udpPortSession, error) {
+// getOrCreate returns key's session, creating it for a first flow to dst.
+func (t *udpPortTable) getOrCreate(ctx context.Context, key udpPortKey, dst string) (*udpPortSession, error) {
 	now := time.Now()
 
 	t.mu.Lock()
@@ -62,7 +86,7 @@ func (t *udpPortTable) getOrCreate(ctx context.Context, key udpPortKey) (*udpPor
 	}
 	t.mu.Unlock()
 
-	up, err := t.lb.PickUDP()
+	up, err := t.lb.PickUDPFor(dst)
 	if err != nil {
 		log.Printf("[tun|udp] upstream selection failed src=%s:%d proto=%d err=%v", key.srcIP, key.srcPort, key.netProto, err)
 		return nil, err
@@ -78,6 +102,7 @@ func (t *udpPortTable) getOrCreate(ctx context.Context, key udpPortKey) (*udpPor
 		key:      key,
 		up:       up,
 		sess:     sess,
+		created:  now,
 		lastSeen: now,
 		flows:    make(map[string]time.Time),
 	}
@@ -91,8 +116,12 @@ func (t *udpPortTable) getOrCreate(ctx context.Context, key udpPortKey) (*udpPor
 		sess.Close()
 		return existing, nil
 	}
+	ps.untrack = t.lb.trackConn(up, "udp")
 	t.ports[key] = ps
+	active := len(t.ports)
 	t.mu.Unlock()
+	observeUDPSessionCreated()
+	setUDPSessionsActive(active)
 
 	return ps, nil
 }
@@ -134,9 +163,32 @@ func (t *udpPortTable) gcOnce() {
 			toClose = append(toClose, ps)
 		}
 	}
+	active := len(t.ports)
 	t.mu.Unlock()
+	setUDPSessionsActive(active)
 
 	for _, ps := range toClose {
 		ps.sess.Close()
+		ps.untrack()
+		observeUDPSessionGC(now.Sub(ps.created))
+	}
+}
+
+// closeAll closes every port session; used at TUN shutdown.
+func (t *udpPortTable) closeAll() {
+	t.mu.Lock()
+	all := make([]*udpPortSession, 0, len(t.ports))
+	for k, ps := range t.ports {
+		delete(t.ports, k)
+		if ps != nil {
+			all = append(all, ps)
+		}
+	}
+	t.mu.Unlock()
+	setUDPSessionsActive(0)
+
+	for _, ps := range all {
+		ps.sess.Close()
+		ps.untrack()
 	}
 }
@@ -0,0 +1,158 @@
+//go:build !unit
+
+package internal
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestUDPSessionKey_Modes(t *testing.T) {
+	src := netip.MustParseAddrPort("10.0.0.2:40000")
+	dnsA := netip.MustParseAddrPort("1.1.1.1:53")
+	dnsB := netip.MustParseAddrPort("8.8.8.8:53")
+
+	if udpSessionKey(udpSessionModePort, src, dnsA) != udpSessionKey(udpSessionModePort, src, dnsB) {
+		t.Fatalf("port mode: destinations of one source port must share a session")
+	}
+	if udpSessionKey(udpSessionModeFlow, src, dnsA) == udpSessionKey(udpSessionModeFlow, src, dnsB) {
+		t.Fatalf("flow mode: each destination must get its own session")
+	}
+	if udpSessionKey(udpSessionModeFlow, src, dnsA) != udpSessionKey(udpSessionModeFlow, src, dnsA) {
+		t.Fatalf("flow mode: same 5-tuple must map to the same session")
+	}
+	if k := udpSessionKey(udpSessionModePort, netip.MustParseAddrPort("[fd00::2]:5000"), dnsA); k.netProto != 6 {
+		t.Fatalf("netProto=%d for IPv6 source, want 6", k.netProto)
+	}
+}
+
+func TestUDPPortTable_SessionGranularity(t *testing.T) {
+	src := netip.MustParseAddrPort("10.0.0.2:40000")
+	dstA := netip.MustParseAddrPort("192.0.2.1:3478")
+	dstB := netip.MustParseAddrPort("192.0.2.2:3478")
+
+	for _, tc := range []struct {
+		mode      string
+		wantReuse bool
+	}{
+		{udpSessionModePort, true},
+		{udpSessionModeFlow, false},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			// A limit of one session means a second key cannot be created
+			// without hitting the limit, so no upstream is ever dialed.
+			pt := newUDPPortTable(nil, TunConfig{UDPMaxFlows: 1, UDPSessionMode: tc.mode})
+			existing := &udpPortSession{key: udpSessionKey(tc.mode, src, dstA)}
+			pt.ports[existing.key] = existing
+
+			ps, err := pt.getOrCreate(context.Background(), udpSessionKey(tc.mode, src, dstB), dstB.String())
+			if tc.wantReuse {
+				if err != nil || ps != existing {
+					t.Fatalf("expected the existing session to be reused, got %v err=%v", ps, err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected a new session (hitting the limit), got reuse of %v", ps)
+			}
+		})
+	}
+}
+
+func TestUDPPortTable_SessionMetricsTrackLifecycle(t *testing.T) {
+	metricsMu.Lock()
+	metrics = telemetry{}
+	metricsMu.Unlock()
+	EnablePrometheusMetrics()
+
+	lb := NewLoadBalancer([]UpstreamConfig{{
+		Name: "edge-1", UDPWSS: "wss://edge-1/udp",
+		Cipher: "chacha20-ietf-poly1305", Secret: "test-secret",
+	}}, HealthcheckConfig{}, SelectionConfig{}, ProbeConfig{}, 0)
+	markHealthy(lb.pool[0], false, 10*time.Millisecond)
+	lb.tunnelDial = func(ctx context.Context, rawurl string) (WSConn, error) {
+		return &mockWSConn{}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pt := newUDPPortTable(lb, TunConfig{UDPSessionMode: udpSessionModePort, UDPIdleTimeout: time.Hour})
+
+	src1 := netip.MustParseAddrPort("10.0.0.2:40000")
+	src2 := netip.MustParseAddrPort("10.0.0.2:40001")
+	dst := netip.MustParseAddrPort("1.1.1.1:53")
+	for _, src := range []netip.AddrPort{src1, src2, src1} { // third is a reuse
+		if _, err := pt.getOrCreate(ctx, udpSessionKey(udpSessionModePort, src, dst), dst.String()); err != nil {
+			t.Fatalf("getOrCreate %s: %v", src, err)
+		}
+	}
+
+	snapshot := func() (active float64, created, gc uint64, life float64) {
+		metrics.mu.RLock()
+		defer metrics.mu.RUnlock()
+		return metrics.udpSessionsActive, metrics.udpSessionsCreated, metrics.udpSessionsGC, metrics.udpSessionLifetimeS
+	}
+	if active, created, gc, _ := snapshot(); active != 2 || created != 2 || gc != 0 {
+		t.Fatalf("after create: active=%v created=%d gc=%d, want 2/2/0", active, created, gc)
+	}
+
+	pt.gcOnce() // nothing idle yet
+	if active, _, gc, _ := snapshot(); active != 2 || gc != 0 {
+		t.Fatalf("after no-op gc: active=%v gc=%d, want 2/0", active, gc)
+	}
+
+	pt.cfg.UDPIdleTimeout = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	pt.gcOnce()
+	active, created, gc, life := snapshot()
+	if active != 0 || created != 2 || gc != 2 {
+		t.Fatalf("after gc: active=%v created=%d gc=%d, want 0/2/2", active, created, gc)
+	}
+	if life <= 0 {
+		t.Fatalf("lifetime sum=%v, want > 0", life)
+	}
+}
+
+func TestUDPPortTable_DestinationReachesStrategy(t *testing.T) {
+	lb := NewLoadBalancer([]UpstreamConfig{
+		{Name: "a", Weight: 1, UDPWSS: "wss://a/udp", Cipher: "chacha20-ietf-poly1305", Secret: "test-secret"},
+		{Name: "b", Weight: 1, UDPWSS: "wss://b/udp", Cipher: "chacha20-ietf-poly1305", Secret: "test-secret"},
+	}, HealthcheckConfig{}, SelectionConfig{Strategy: selectionConsistentHash}, ProbeConfig{}, 0)
+	markHealthy(lb.pool[0], false, 10*time.Millisecond)
+	markHealthy(lb.pool[1], false, 10*time.Millisecond)
+	lb.tunnelDial = func(ctx context.Context, rawurl string) (WSConn, error) {
+		return &mockWSConn{}, nil
+	}
+
+	// One destination owned by each upstream.
+	owned := map[string]netip.AddrPort{}
+	for i := 1; len(owned) < 2 && i < 255; i++ {
+		dst := netip.AddrPortFrom(netip.AddrFrom4([4]byte{192, 0, 2, byte(i)}), 3478)
+		up, err := lb.PickUDPFor(dst.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := owned[up.cfg.Name]; !ok {
+			owned[up.cfg.Name] = dst
+		}
+	}
+	if len(owned) != 2 {
+		t.Fatalf("no destination split across upstreams: %v", owned)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pt := newUDPPortTable(lb, TunConfig{UDPSessionMode: udpSessionModeFlow, UDPIdleTimeout: time.Hour})
+	src := netip.MustParseAddrPort("10.0.0.2:40000")
+	for name, dst := range owned {
+		ps, err := pt.getOrCreate(ctx, udpSessionKey(udpSessionModeFlow, src, dst), dst.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ps.up.cfg.Name != name {
+			t.Fatalf("session to %s went through %s, want %s", dst, ps.up.cfg.Name, name)
+		}
+	}
+}
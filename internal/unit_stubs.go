@@ -22,7 +22,15 @@ func LoadConfig(path string) (*Config, error) { return nil, ErrNotImplemented }
 func ProbeTCPQuality(ctx context.Context, up UpstreamConfig, target string, fwmark uint32) (time.Duration, error) {
 	return 0, ErrNotImplemented
 }
-func ProbeUDPQuality(ctx context.Context, up UpstreamConfig, target string, dnsName string, dnsType string, fwmark uint32) (time.Duration, error) {
+func ProbeUDPQuality(ctx context.Context, up UpstreamConfig, target string, dnsName string, dnsType string, strict bool, fwmark uint32) (time.Duration, error) {
+	return 0, ErrNotImplemented
+}
+func probeTCPQualityOn(ctx context.Context, up UpstreamConfig, wsc WSConn, target string) (time.Duration, error) {
+	_ = wsc.Close(WSStatusNormalClosure, "tcp-probe")
+	return 0, ErrNotImplemented
+}
+func probeUDPQualityOn(ctx context.Context, up UpstreamConfig, wsc WSConn, target string, dnsName string, dnsType string, strict bool) (time.Duration, error) {
+	_ = wsc.Close(WSStatusNormalClosure, "udp-probe")
 	return 0, ErrNotImplemented
 }
 
@@ -40,10 +48,15 @@ func newSSTCPConn(ctx context.Context, wsc WSConn, up UpstreamConfig, dst string
 	return nil, ErrNotImplemented
 }
 
+// pruneCipherCache has no cache to prune in unit build.
+func pruneCipherCache(ups []UpstreamConfig) {}
+
 // --- UDP association is disabled in unit build.
 type UDPAssociation struct{ addr net.Addr }
 
-func (a *UDPAssociation) Close() error { return nil }
+func (a *UDPAssociation) Close() error           { return nil }
+func (a *UDPAssociation) IdleFor() time.Duration { return 0 }
+func (a *UDPAssociation) Done() <-chan struct{}  { return nil }
 func (a *UDPAssociation) LocalAddr() net.Addr {
 	if a.addr == nil {
 		a.addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
@@ -53,9 +66,13 @@ func (a *UDPAssociation) LocalAddr() net.Addr {
 func NewUDPAssociation(ctx context.Context, up UpstreamConfig, fwmark uint32) (*UDPAssociation, error) {
 	return &UDPAssociation{}, nil
 }
+func (a *UDPAssociation) Upstream() string { return "" }
+func NewFailoverUDPAssociation(ctx context.Context, lb *LoadBalancer, up *UpstreamState, pick func() (*UpstreamState, error)) (*UDPAssociation, error) {
+	return &UDPAssociation{}, nil
+}
 
 // --- Websocket dialers are disabled in unit build.
-func dialCoderWebSocket(ctx context.Context, rawurl string, tr *http.Transport) (WSConn, error) {
+func dialCoderWebSocket(ctx context.Context, rawurl string, tr *http.Transport, subprotocol string) (WSConn, error) {
 	return nil, ErrNotImplemented
 }
 
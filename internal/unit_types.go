@@ -9,11 +9,43 @@ import "time"
 type UpstreamConfig struct {
 	Name   string
 	Weight float64
+	Backup bool
+	Drain  bool
+
+	ProbeOnly bool
+
+	MaintenanceWindows    []string
+	MaintenanceSkipProbes bool
+
+	AuthHeader    string
+	AuthQuery     string
+	AuthToken     string
+	AuthTokenFile string
 
 	TCPWSS string
 	UDPWSS string
 	Cipher string
 	Secret string
+
+	Subprotocol    string
+	TransportOrder []string
+	H2WindowSize   uint32
+	Multiplex      bool
+	DialTimeout    time.Duration
+
+	MaxMessageSize      int64
+	AcceptStatus        []int
+	RequireAccept       bool
+	AddressFamily       string
+	QUIC                QUICConfig
+	SendProxyProtocol   string
+	ProxyProtocolSource string
+
+	ProbeTCPTarget string
+	ProbeUDPTarget string
+
+	HeartbeatText     string
+	HeartbeatInterval time.Duration
 }
 
 type HealthcheckConfig struct {
@@ -26,6 +58,7 @@ type HealthcheckConfig struct {
 	FailThreshold    int
 	SuccessThreshold int
 	RTTScale         float64
+	OutagePoll       time.Duration
 }
 
 type SelectionConfig struct {
@@ -37,6 +70,15 @@ type SelectionConfig struct {
 	StandbyKeepalive             bool
 	StandbyKeepaliveInterval     time.Duration
 	StandbyKeepaliveProbeTimeout time.Duration
+	StandbyMaxIdle               time.Duration
+	RaceN                        int
+	Strategy                     string
+	CooldownMaxFactor            int
+	DNSRefreshInterval           time.Duration
+	MaxEligibleRTT               time.Duration
+	SlowStart                    time.Duration
+	DialAttempts                 int
+	UDPSticky                    bool
 }
 
 type ProbeConfig struct {
@@ -47,18 +89,66 @@ type ProbeConfig struct {
 	UDPTarget string
 	DNSName   string
 	DNSType   string
+
+	DNSNames        []string
+	DNSRandomPrefix bool
+
+	DNSAcceptAnyReply bool
+
+	QualityFailure string
 }
 
 type TunConfig struct {
 	Device string
+	FD     int
 
 	UDPMaxFlows        int
 	UDPIdleTimeout     time.Duration
 	UDPFlowIdleTimeout time.Duration
+	ShutdownGrace      time.Duration
+	SniffSNI           bool
+	Direct             []string
 }
 
 type WebSocketConfig struct {
-	Debug bool
+	Debug       bool
+	PooledReads bool
+}
+
+type QUICConfig struct {
+	MaxIdleTimeout    time.Duration
+	KeepAlivePeriod   time.Duration
+	MaxBidiStreams    int64
+	MaxUniStreams     int64
+	StreamReadBuffer  int64
+	StreamWriteBuffer int64
+	ConnReadBuffer    int64
+}
+
+type LogConfig struct {
+	Format string
+}
+
+type MetricsConfig struct {
+	Token        string
+	OTLPEndpoint string
+	OTLPInterval time.Duration
+}
+
+type TLSConfig struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+type RoutingConfig struct {
+	Direct []string
+}
+
+type HooksConfig struct {
+	OnConnect    string
+	OnDisconnect string
+	Timeout      time.Duration
 }
 
 type Config struct {
@@ -70,5 +160,12 @@ type Config struct {
 	Fwmark        uint32
 	Tun           TunConfig
 	WebSocket     WebSocketConfig
+	Hooks         HooksConfig
+	Metrics       MetricsConfig
+	Routing       RoutingConfig
+	TLS           TLSConfig
+	Log           LogConfig
 	Socks5Listen  string
+
+	CopyBufferSize int
 }
@@ -37,6 +37,53 @@ func wsAliveCheck(ctx context.Context, c WSConn) bool {
 	}
 }
 
+// standbyMaxBackoff caps the wait between warm-up attempts to an upstream
+// whose standby dials keep failing.
+const standbyMaxBackoff = 5 * time.Minute
+
+// standbyBackoff tracks consecutive standby dial failures for one protocol
+// of an upstream. Guarded by UpstreamState.standbyMu.
+type standbyBackoff struct {
+	fails   int
+	retryAt time.Time
+}
+
+// ready reports whether a warm-up dial may be attempted at now.
+func (b *standbyBackoff) ready(now time.Time) bool {
+	return !now.Before(b.retryAt)
+}
+
+// fail records a dial started at started that failed and returns the delay
+// before the next attempt: base after the first failure, doubling with each
+// further one up to standbyMaxBackoff. Attempts run on warm-standby ticks
+// (base apart), so the deadline is set half a tick early to land the retry
+// on the tick nearest the delay rather than the one after it.
+func (b *standbyBackoff) fail(started time.Time, base time.Duration) time.Duration {
+	b.fails++
+	d := base
+	for i := 1; i < b.fails && d < standbyMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > standbyMaxBackoff {
+		d = standbyMaxBackoff
+	}
+	b.retryAt = started.Add(d - base/2)
+	return d
+}
+
+func (b *standbyBackoff) reset() {
+	*b = standbyBackoff{}
+}
+
+// dialStandby dials a warm-standby websocket. Unlike tunnel dials it does not
+// take a dial slot, so warm-up never queues ahead of user traffic.
+func (lb *LoadBalancer) dialStandby(ctx context.Context, rawurl string) (WSConn, error) {
+	if lb.tunnelDial != nil {
+		return lb.tunnelDial(ctx, rawurl)
+	}
+	return DialWSStream(ctx, rawurl, lb.fwmark)
+}
+
 // AcquireTCPWS отдаёт прогретый WS (если есть) или делает Dial.
 // Если взяли прогретый — слот освобождается и будет догрет снова.
 func (lb *LoadBalancer) AcquireTCPWS(ctx context.Context, up *UpstreamState) (WSConn, error) {
@@ -50,25 +97,39 @@ func (lb *LoadBalancer) AcquireTCPWSForFlow(ctx context.Context, up *UpstreamSta
 
 // AcquireUDPWS returns a warm standby UDP websocket when available, otherwise dials fresh.
 func (lb *LoadBalancer) AcquireUDPWS(ctx context.Context, up *UpstreamState) (WSConn, error) {
+	if c := up.claimSpareMux(wsMuxDatagram); c != nil {
+		wsDebugf("acquire udp ws: sharing multiplexed ws upstream=%q", up.cfg.Name)
+		return c, nil
+	}
 	up.standbyMu.Lock()
 	c := up.standbyUDP
 	up.standbyUDP = nil
 	up.standbyMu.Unlock()
 	if c != nil {
 		wsDebugf("acquire udp ws: got standby upstream=%q", up.cfg.Name)
-		return c, nil
+		return up.tunnelConn(c, wsMuxDatagram), nil
 	}
 	wsDebugf("acquire udp ws: dialing fresh upstream=%q", up.cfg.Name)
-	return lb.DialWSStreamLimited(ctx, up.cfg.UDPWSS)
+	c, err := lb.DialWSStreamLimited(withUpstreamAuth(ctx, up.cfg), up.cfg.UDPWSS)
+	if err != nil {
+		return nil, err
+	}
+	return up.tunnelConn(c, wsMuxDatagram), nil
 }
 
 func (lb *LoadBalancer) acquireTCPWS(ctx context.Context, up *UpstreamState, flowID uint64) (WSConn, error) {
 	logf := func(format string, args ...any) {
 		if flowID > 0 {
-			wsDebugf("flow=%d "+format, append([]any{flowID}, args...)...)
+			wsTracef(ctx, "flow=%d "+format, append([]any{flowID}, args...)...)
 			return
 		}
-		wsDebugf(format, args...)
+		wsTracef(ctx, format, args...)
+	}
+
+	// 0) multiplexed upstream: a live WS whose stream channel is still free
+	if c := up.claimSpareMux(wsMuxStream); c != nil {
+		logf("acquire tcp ws: sharing multiplexed ws upstream=%q", up.cfg.Name)
+		return c, nil
 	}
 
 	// 1) попробуем взять прогретый
@@ -86,7 +147,7 @@ func (lb *LoadBalancer) acquireTCPWS(ctx context.Context, up *UpstreamState, flo
 		logf("acquire tcp ws: standby alive-check upstream=%q ok=%v elapsed=%s", up.cfg.Name, ok, time.Since(aliveStarted))
 
 		if ok {
-			return c, nil
+			return up.tunnelConn(c, wsMuxStream), nil
 		}
 		_ = c.Close(WSStatusNormalClosure, "stale-standby")
 		logf("acquire tcp ws: standby rejected upstream=%q reason=not-alive", up.cfg.Name)
@@ -95,7 +156,7 @@ func (lb *LoadBalancer) acquireTCPWS(ctx context.Context, up *UpstreamState, flo
 	// 2) иначе — обычный dial
 	dialStarted := time.Now()
 	logf("acquire tcp ws: dialing fresh upstream=%q", up.cfg.Name)
-	conn, err := lb.DialWSStreamLimited(ctx, up.cfg.TCPWSS)
+	conn, err := lb.dialTCPWS(ctx, up)
 	if err != nil {
 		logf("acquire tcp ws: fresh dial failed upstream=%q elapsed=%s err=%v", up.cfg.Name, time.Since(dialStarted), err)
 		return nil, err
@@ -104,8 +165,21 @@ func (lb *LoadBalancer) acquireTCPWS(ctx context.Context, up *UpstreamState, flo
 	return conn, nil
 }
 
+// dialTCPWS dials a new tunnel WebSocket to up, leaving its standby and
+// shared multiplexed streams alone.
+func (lb *LoadBalancer) dialTCPWS(ctx context.Context, up *UpstreamState) (WSConn, error) {
+	conn, err := lb.DialWSStreamLimited(withUpstreamAuth(ctx, up.cfg), up.cfg.TCPWSS)
+	if err != nil {
+		return nil, err
+	}
+	return up.tunnelConn(conn, wsMuxStream), nil
+}
+
 // EnsureStandbyTCP гарантирует, что у апстрима есть прогретый TCP WS (если он healthy и не в cooldown).
 func (lb *LoadBalancer) EnsureStandbyTCP(ctx context.Context, up *UpstreamState) {
+	if up.cfg.proxyPerClient() {
+		return
+	}
 	up.mu.Lock()
 	ok := up.tcp.healthy && time.Now().After(up.tcpCooldownUntil)
 	up.mu.Unlock()
@@ -120,36 +194,46 @@ func (lb *LoadBalancer) EnsureStandbyTCP(ctx context.Context, up *UpstreamState)
 		return
 	}
 
-	// уже есть прогретый?
+	// уже есть прогретый или ещё ждём после неудач?
 	up.standbyMu.Lock()
-	exists := up.standbyTCP != nil
+	skip := up.standbyTCP != nil || !up.standbyTCPBackoff.ready(time.Now())
 	up.standbyMu.Unlock()
-	if exists {
+	if skip {
 		return
 	}
 
 	// догреваем
-	cctx, cancel := context.WithTimeout(ctx, wsDialTimeoutForURL(lb.hc.Timeout, up.cfg.TCPWSS))
+	started := time.Now()
+	cctx, cancel := context.WithTimeout(withUpstreamAuth(ctx, up.cfg), wsDialTimeoutForURL(lb.hc.Timeout, up.cfg.TCPWSS))
 	defer cancel()
 
-	c, err := DialWSStream(cctx, up.cfg.TCPWSS, lb.fwmark)
+	c, err := lb.dialStandby(cctx, up.cfg.TCPWSS)
 	if err != nil {
-		// не делаем жёсткий failover только из-за standby — но можно чуть штрафовать
+		// не делаем жёсткий failover только из-за standby — только откладываем следующий прогрев
+		up.standbyMu.Lock()
+		d := up.standbyTCPBackoff.fail(started, lb.sel.WarmStandbyInterval)
+		up.standbyMu.Unlock()
+		wsDebugf("standby dial failed upstream=%q proto=tcp retry_in=%s err=%v", up.cfg.Name, d, err)
 		return
 	}
 
 	up.standbyMu.Lock()
-	// если пока мы dial'или другой уже прогрел — закроем лишний
-	if up.standbyTCP != nil {
+	up.standbyTCPBackoff.reset()
+	// если пока мы dial'или другой уже прогрел (или апстрим убран reload'ом) — закроем лишний
+	if up.standbyTCP != nil || up.retired.Load() {
 		_ = c.Close(WSStatusNormalClosure, "duplicate-standby")
 	} else {
 		up.standbyTCP = c
+		up.standbyTCPAt = time.Now()
 	}
 	up.standbyMu.Unlock()
 }
 
 // EnsureStandbyUDP keeps a warm UDP websocket for healthy upstream.
 func (lb *LoadBalancer) EnsureStandbyUDP(ctx context.Context, up *UpstreamState) {
+	if up.cfg.proxyPerClient() {
+		return
+	}
 	up.mu.Lock()
 	ok := up.udp.healthy && time.Now().After(up.udpCooldownUntil)
 	up.mu.Unlock()
@@ -164,28 +248,62 @@ func (lb *LoadBalancer) EnsureStandbyUDP(ctx context.Context, up *UpstreamState)
 	}
 
 	up.standbyMu.Lock()
-	exists := up.standbyUDP != nil
+	skip := up.standbyUDP != nil || !up.standbyUDPBackoff.ready(time.Now())
 	up.standbyMu.Unlock()
-	if exists {
+	if skip {
 		return
 	}
 
-	cctx, cancel := context.WithTimeout(ctx, wsDialTimeoutForURL(lb.hc.Timeout, up.cfg.UDPWSS))
+	started := time.Now()
+	cctx, cancel := context.WithTimeout(withUpstreamAuth(ctx, up.cfg), wsDialTimeoutForURL(lb.hc.Timeout, up.cfg.UDPWSS))
 	defer cancel()
-	c, err := DialWSStream(cctx, up.cfg.UDPWSS, lb.fwmark)
+	c, err := lb.dialStandby(cctx, up.cfg.UDPWSS)
 	if err != nil {
+		up.standbyMu.Lock()
+		d := up.standbyUDPBackoff.fail(started, lb.sel.WarmStandbyInterval)
+		up.standbyMu.Unlock()
+		wsDebugf("standby dial failed upstream=%q proto=udp retry_in=%s err=%v", up.cfg.Name, d, err)
 		return
 	}
 
 	up.standbyMu.Lock()
-	if up.standbyUDP != nil {
+	up.standbyUDPBackoff.reset()
+	if up.standbyUDP != nil || up.retired.Load() {
 		_ = c.Close(WSStatusNormalClosure, "duplicate-standby")
 	} else {
 		up.standbyUDP = c
+		up.standbyUDPAt = time.Now()
 	}
 	up.standbyMu.Unlock()
 }
 
+// recycleStaleStandbys closes standby conns that have been idle longer than
+// StandbyMaxIdle. Servers and middleboxes may drop long-idle streams without
+// a close frame; the next warm-standby tick dials a fresh replacement.
+func (lb *LoadBalancer) recycleStaleStandbys(now time.Time) {
+	maxIdle := lb.sel.StandbyMaxIdle
+	if maxIdle <= 0 {
+		return
+	}
+	lb.mu.Lock()
+	pool := append([]*UpstreamState(nil), lb.pool...)
+	lb.mu.Unlock()
+	for _, up := range pool {
+		up.standbyMu.Lock()
+		if up.standbyTCP != nil && !up.standbyTCPAt.IsZero() && now.Sub(up.standbyTCPAt) > maxIdle {
+			_ = up.standbyTCP.Close(WSStatusNormalClosure, "standby-max-idle")
+			up.standbyTCP = nil
+			wsDebugf("standby recycled upstream=%q proto=tcp age=%s", up.cfg.Name, now.Sub(up.standbyTCPAt))
+		}
+		if up.standbyUDP != nil && !up.standbyUDPAt.IsZero() && now.Sub(up.standbyUDPAt) > maxIdle {
+			_ = up.standbyUDP.Close(WSStatusNormalClosure, "standby-max-idle")
+			up.standbyUDP = nil
+			wsDebugf("standby recycled upstream=%q proto=udp age=%s", up.cfg.Name, now.Sub(up.standbyUDPAt))
+		}
+		up.standbyMu.Unlock()
+	}
+}
+
 func (lb *LoadBalancer) checkStandbyKeepalive(ctx context.Context) {
 	lb.mu.Lock()
 	pool := append([]*UpstreamState(nil), lb.pool...)
@@ -199,11 +317,12 @@ func (lb *LoadBalancer) checkStandbyKeepalive(ctx context.Context) {
 func (lb *LoadBalancer) keepaliveOneStandby(ctx context.Context, up *UpstreamState, proto string) {
 	up.standbyMu.Lock()
 	var c WSConn
+	var at time.Time
 	if proto == "tcp" {
-		c = up.standbyTCP
+		c, at = up.standbyTCP, up.standbyTCPAt
 		up.standbyTCP = nil
 	} else {
-		c = up.standbyUDP
+		c, at = up.standbyUDP, up.standbyUDPAt
 		up.standbyUDP = nil
 	}
 	up.standbyMu.Unlock()
@@ -222,14 +341,16 @@ func (lb *LoadBalancer) keepaliveOneStandby(ctx context.Context, up *UpstreamSta
 	}
 
 	up.standbyMu.Lock()
-	if proto == "tcp" {
+	if up.retired.Load() {
+		// dropped by Reload while the keepalive ran
+	} else if proto == "tcp" {
 		if up.standbyTCP == nil {
-			up.standbyTCP = c
+			up.standbyTCP, up.standbyTCPAt = c, at
 			c = nil
 		}
 	} else {
 		if up.standbyUDP == nil {
-			up.standbyUDP = c
+			up.standbyUDP, up.standbyUDPAt = c, at
 			c = nil
 		}
 	}
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"testing"
 	"time"
 )
@@ -93,3 +94,87 @@ func TestAcquireTCPWSForFlow_UsesStandbyWhenAlive(t *testing.T) {
 		t.Fatalf("expected standby conn for real flow")
 	}
 }
+
+func TestRecycleStaleStandbys_ClosesOverAgeConn(t *testing.T) {
+	lb := NewLoadBalancer([]UpstreamConfig{{TCPWSS: "wss://example", UDPWSS: "wss://example/udp"}}, HealthcheckConfig{Timeout: time.Second}, SelectionConfig{StandbyMaxIdle: time.Minute}, ProbeConfig{}, 0)
+	up := lb.pool[0]
+	now := time.Now()
+	stale := &mockWSConn{}
+	fresh := &mockWSConn{}
+
+	up.standbyMu.Lock()
+	up.standbyTCP, up.standbyTCPAt = stale, now.Add(-2*time.Minute)
+	up.standbyUDP, up.standbyUDPAt = fresh, now.Add(-10*time.Second)
+	up.standbyMu.Unlock()
+
+	lb.recycleStaleStandbys(now)
+
+	up.standbyMu.Lock()
+	defer up.standbyMu.Unlock()
+	if up.standbyTCP != nil {
+		t.Fatalf("expected over-age tcp standby to be dropped")
+	}
+	if !stale.closed {
+		t.Fatalf("expected over-age tcp standby to be closed")
+	}
+	if up.standbyUDP != fresh || fresh.closed {
+		t.Fatalf("expected young udp standby to be kept")
+	}
+}
+
+func TestEnsureStandbyTCP_BacksOffAfterFailures(t *testing.T) {
+	const base = time.Second
+	lb := NewLoadBalancer([]UpstreamConfig{{Name: "a", TCPWSS: "wss://example"}}, HealthcheckConfig{Timeout: time.Second}, SelectionConfig{WarmStandbyInterval: base}, ProbeConfig{}, 0)
+	up := lb.pool[0]
+	markHealthy(up, true, 10*time.Millisecond)
+
+	dials := 0
+	fail := true
+	lb.tunnelDial = func(ctx context.Context, rawurl string) (WSConn, error) {
+		dials++
+		if fail {
+			return nil, errors.New("refused")
+		}
+		return &mockWSConn{}, nil
+	}
+	ctx := context.Background()
+
+	var prev time.Duration
+	for i := 1; i <= 4; i++ {
+		started := time.Now()
+		lb.EnsureStandbyTCP(ctx, up)
+		if dials != i {
+			t.Fatalf("attempt %d: dials=%d", i, dials)
+		}
+		up.standbyMu.Lock()
+		wait := up.standbyTCPBackoff.retryAt.Sub(started)
+		up.standbyMu.Unlock()
+		if wait <= prev {
+			t.Fatalf("attempt %d: retry wait %s did not grow past %s", i, wait, prev)
+		}
+		prev = wait
+
+		// Until the deadline passes, ticks do not dial.
+		lb.EnsureStandbyTCP(ctx, up)
+		if dials != i {
+			t.Fatalf("attempt %d: dialed again during backoff", i)
+		}
+		up.standbyMu.Lock()
+		up.standbyTCPBackoff.retryAt = time.Time{}
+		up.standbyMu.Unlock()
+	}
+	if prev < 4*base {
+		t.Fatalf("retry wait after 4 failures = %s, want >= %s", prev, 4*base)
+	}
+
+	fail = false
+	lb.EnsureStandbyTCP(ctx, up)
+	up.standbyMu.Lock()
+	defer up.standbyMu.Unlock()
+	if up.standbyTCP == nil {
+		t.Fatalf("expected standby after successful dial")
+	}
+	if up.standbyTCPBackoff.fails != 0 {
+		t.Fatalf("backoff not reset on success: fails=%d", up.standbyTCPBackoff.fails)
+	}
+}
@@ -2,14 +2,20 @@ package internal
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha1"
 	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
-	"syscall"
+	"sync"
 	"time"
 )
 
@@ -34,6 +40,55 @@ import (
 // and forbids the HTTP/1 Connection/Upgrade headers.
 // See RFC 8441 Sections 4–5.
 func DialWSStream(ctx context.Context, rawurl string, fwmark uint32) (WSConn, error) {
+	c, err := dialWSStream(ctx, rawurl, fwmark)
+	if err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(rawurl) // parsed fine by dialWSStream
+	if rl, ok := c.(interface{ setReadLimit(int64) }); ok {
+		rl.setReadLimit(wsMaxMessageSize(u.Query()))
+	}
+	if tc, ok := c.(interface{ setOnClose(func()) }); ok {
+		upstream, _ := upstreamFromURL(u)
+		tc.setOnClose(trackWSConn(upstream, NegotiatedTransport(c)))
+	}
+	return c, nil
+}
+
+// wsTransportInfo records which handshake produced a conn and runs the
+// metrics untrack hook once, on the first Close. Embedded by the WSConn
+// implementations DialWSStream returns.
+type wsTransportInfo struct {
+	transport string
+	closeOnce sync.Once
+	onClose   func()
+}
+
+// NegotiatedTransport returns "h1", "h2" or "h3".
+func (i *wsTransportInfo) NegotiatedTransport() string { return i.transport }
+
+func (i *wsTransportInfo) setOnClose(f func()) { i.onClose = f }
+
+func (i *wsTransportInfo) closed() {
+	i.closeOnce.Do(func() {
+		if i.onClose != nil {
+			i.onClose()
+		}
+	})
+}
+
+// NegotiatedTransport reports the handshake a conn from DialWSStream actually
+// used ("h1", "h2" or "h3"), or "" for conns that do not know (mux channels,
+// test fakes).
+func NegotiatedTransport(c WSConn) string {
+	if t, ok := c.(interface{ NegotiatedTransport() string }); ok {
+		return t.NegotiatedTransport()
+	}
+	return ""
+}
+
+func dialWSStream(ctx context.Context, rawurl string, fwmark uint32) (WSConn, error) {
+	ctx = withTraceID(ctx) // probes and standby dials get their own ID
 	start := time.Now()
 	u, err := url.Parse(rawurl)
 	if err != nil {
@@ -41,50 +96,92 @@ func DialWSStream(ctx context.Context, rawurl string, fwmark uint32) (WSConn, er
 	}
 	upstream, proto := upstreamFromURL(u)
 	uDial := stripHealthcheckQueryParams(u)
+	shown := stripDialHints(u).Redacted()
+	if ctx, err = withHandshakeAuth(ctx); err != nil {
+		return nil, err
+	}
 
 	// Shared dialer with fwmark support.
-	d := &net.Dialer{
-		Timeout: 10 * time.Second,
-		Control: func(network, address string, c syscall.RawConn) error {
-			var ctrlErr error
-			if err := c.Control(func(fd uintptr) {
-				ctrlErr = setSocketMark(fd, fwmark)
-			}); err != nil {
-				return err
-			}
-			return ctrlErr
-		},
-	}
+	dialTimeout := wsDialTimeout(u.Query())
+	d := newMarkedDialer(dialTimeout, fwmark)
+	dial := familyDial(resolvingDial(d.DialContext), wsAddressFamily(u.Query()))
 
 	// Per-dial transport: disable HTTP keep-alive pools to avoid retaining
 	// idle connections and per-transport state across frequent probe dials.
 	tr := &http.Transport{
-		Proxy:             http.ProxyFromEnvironment,
-		DialContext:       d.DialContext,
-		ForceAttemptHTTP2: true,
-		DisableKeepAlives: true,
-		TLSClientConfig: &tls.Config{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dial,
+		ForceAttemptHTTP2:   true,
+		DisableKeepAlives:   true,
+		TLSHandshakeTimeout: dialTimeout,
+		TLSClientConfig: withUpstreamTLS(&tls.Config{
 			MinVersion: tls.VersionTLS12,
-		},
+		}),
 	}
 	defer tr.CloseIdleConnections()
+	if v := u.Query().Get(proxyProtocolHint); v != "" {
+		// The header must reach the upstream's load balancer, not an HTTP proxy.
+		tr.Proxy = nil
+		tr.DialContext = proxyProtocolDial(dial, v, u.Query().Get(proxySourceHint))
+	}
 
 	tryH2, h2Only, tryH3, h3Only, connectOnly := parseTransportHints(u.Query())
-	wsDebugf("dial start url=%q scheme=%q hints: tryH2=%v h2Only=%v tryH3=%v h3Only=%v connectOnly=%v", uDial.Redacted(), u.Scheme, tryH2, h2Only, tryH3, h3Only, connectOnly)
+	wsTracef(ctx, "dial start url=%q scheme=%q hints: tryH2=%v h2Only=%v tryH3=%v h3Only=%v connectOnly=%v", shown, u.Scheme, tryH2, h2Only, tryH3, h3Only, connectOnly)
+	subprotocol := uDial.Query().Get("subprotocol")
+
+	// Explicit mode hints (h2=..., h3=..., connect=only) override the
+	// configured transport ladder.
+	if order := u.Query().Get(transportOrderHint); order != "" && !tryH2 && !tryH3 && !connectOnly {
+		ladder, err := parseTransportOrder(order)
+		if err != nil {
+			return nil, err
+		}
+		first := ladder[0]
+		c, transport, err := dialTransportLadder(ctx, ladder, func(transport string) (WSConn, error) {
+			wsTracef(ctx, "attempt %s dial (transport ladder) url=%q", transport, shown)
+			switch transport {
+			case "h3":
+				return dialRFC9220(ctx, uDial)
+			case "h2":
+				if !isWebSocketLikeScheme(u.Scheme) {
+					return nil, fmt.Errorf("%w: h2 requires ws/wss URL, got scheme=%q", ErrH2NotSupported, u.Scheme)
+				}
+				return dialRFC8441(ctx, uDial, tr)
+			default:
+				return dialCoderWebSocket(ctx, stripDialHints(uDial).String(), tr, subprotocol)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		wsTracef(ctx, "%s dial succeeded (transport ladder) url=%q", transport, shown)
+		noteDialTransport(ctx, upstream, proto, first, transport, start)
+		return c, nil
+	}
+
+	// first is the transport tried first; a dial ending on another one is a
+	// fallback.
+	first := "h1"
+	switch {
+	case tryH3 && isWebSocketLikeScheme(u.Scheme):
+		first = "h3"
+	case h2Only || (tryH2 && isWebSocketLikeScheme(u.Scheme)):
+		first = "h2"
+	}
 
 	if tryH3 && isWebSocketLikeScheme(u.Scheme) {
-		wsDebugf("attempt h3/rfc9220 dial url=%q", uDial.Redacted())
+		wsTracef(ctx, "attempt h3/rfc9220 dial url=%q", shown)
 		h3c, h3err := dialRFC9220(ctx, uDial)
 		if h3err == nil {
-			wsDebugf("h3/rfc9220 dial succeeded url=%q", uDial.Redacted())
-			observeDial(upstream, proto, time.Since(start))
+			wsTracef(ctx, "h3/rfc9220 dial succeeded url=%q", shown)
+			noteDialTransport(ctx, upstream, proto, first, "h3", start)
 			return h3c, nil
 		}
-		wsDebugf("h3/rfc9220 dial failed url=%q err=%v", uDial.Redacted(), h3err)
+		wsTracef(ctx, "h3/rfc9220 dial failed url=%q err=%v", shown, h3err)
 		if h3Only {
 			return nil, fmt.Errorf("h3-only connect failed: %w", h3err)
 		}
-		wsDebugf("fallback to h2/http1 after h3 failure url=%q", uDial.Redacted())
+		wsTracef(ctx, "fallback to h2/http1 after h3 failure url=%q", shown)
 		if !tryH2 {
 			tryH2 = true
 		}
@@ -96,28 +193,28 @@ func DialWSStream(ctx context.Context, rawurl string, fwmark uint32) (WSConn, er
 		if !isWebSocketLikeScheme(u.Scheme) {
 			return nil, fmt.Errorf("h2-only mode requires ws/wss URL, got scheme=%q", u.Scheme)
 		}
-		wsDebugf("attempt h2/rfc8441 dial url=%q", uDial.Redacted())
+		wsTracef(ctx, "attempt h2/rfc8441 dial url=%q", shown)
 		h2c, h2err := dialRFC8441(ctx, uDial, tr)
 		if h2err == nil {
-			wsDebugf("h2/rfc8441 dial succeeded url=%q", uDial.Redacted())
-			observeDial(upstream, proto, time.Since(start))
+			wsTracef(ctx, "h2/rfc8441 dial succeeded url=%q", shown)
+			noteDialTransport(ctx, upstream, proto, first, "h2", start)
 			return h2c, nil
 		}
-		wsDebugf("h2-only dial failed url=%q err=%v", uDial.Redacted(), h2err)
+		wsTracef(ctx, "h2-only dial failed url=%q err=%v", shown, h2err)
 		return nil, fmt.Errorf("h2-only connect failed: %w", h2err)
 	}
 
 	if tryH2 && isWebSocketLikeScheme(u.Scheme) {
-		wsDebugf("attempt h2/rfc8441 dial url=%q", uDial.Redacted())
+		wsTracef(ctx, "attempt h2/rfc8441 dial url=%q", shown)
 		h2c, h2err := dialRFC8441(ctx, uDial, tr)
 		if h2err == nil {
-			wsDebugf("h2/rfc8441 dial succeeded url=%q", uDial.Redacted())
-			observeDial(upstream, proto, time.Since(start))
+			wsTracef(ctx, "h2/rfc8441 dial succeeded url=%q", shown)
+			noteDialTransport(ctx, upstream, proto, first, "h2", start)
 			return h2c, nil
 		}
-		wsDebugf("h2/rfc8441 dial failed url=%q err=%v", uDial.Redacted(), h2err)
+		wsTracef(ctx, "h2/rfc8441 dial failed url=%q err=%v", shown, h2err)
 		// Only fall back on "not supported" style errors; otherwise surface.
-		if !errors.Is(h2err, errRFC8441NotSupported) {
+		if !errors.Is(h2err, ErrH2NotSupported) {
 			return nil, h2err
 		}
 		// else: fall back to classic websocket.
@@ -128,17 +225,180 @@ func DialWSStream(ctx context.Context, rawurl string, fwmark uint32) (WSConn, er
 	}
 
 	// Classic websocket (HTTP/1.1 upgrade).
-	wsDebugf("attempt h1 websocket upgrade url=%q", uDial.Redacted())
-	c, err := dialCoderWebSocket(ctx, uDial.String(), tr)
+	wsTracef(ctx, "attempt h1 websocket upgrade url=%q", shown)
+	c, err := dialCoderWebSocket(ctx, stripDialHints(uDial).String(), tr, subprotocol)
 	if err != nil {
-		wsDebugf("h1 websocket upgrade failed url=%q err=%v", uDial.Redacted(), err)
+		wsTracef(ctx, "h1 websocket upgrade failed url=%q err=%v", shown, err)
 		return nil, err
 	}
-	wsDebugf("h1 websocket upgrade succeeded url=%q", uDial.Redacted())
-	observeDial(upstream, proto, time.Since(start))
+	wsTracef(ctx, "h1 websocket upgrade succeeded url=%q", shown)
+	noteDialTransport(ctx, upstream, proto, first, "h1", start)
 	return c, nil
 }
 
+// dialFallbacks holds the current fallback ("h2->h1") per dial label
+// ("host/proto") for the status snapshot. A dial that gets its first-choice
+// transport again clears it.
+var dialFallbacks sync.Map
+
+// noteDialTransport records a successful dial: its duration and, when it
+// ended on another transport than the first one tried, a fallback. The log
+// line is only written when an upstream's fallback state changes, not on
+// every dial.
+func noteDialTransport(ctx context.Context, upstream, proto, first, transport string, start time.Time) {
+	observeDial(upstream, proto, transport, time.Since(start))
+	key := upstream + "/" + proto
+	if first == transport {
+		if prev, ok := dialFallbacks.LoadAndDelete(key); ok {
+			log.Printf("%s[ws] upstream=%s proto=%s back on %s (was %s)", tracePrefix(ctx), upstream, proto, transport, prev)
+		}
+		return
+	}
+	observeTransportFallback(upstream, first, transport)
+	fb := first + "->" + transport
+	if prev, ok := dialFallbacks.Swap(key, fb); !ok || prev != fb {
+		log.Printf("%s[ws] upstream=%s proto=%s fell back from %s to %s", tracePrefix(ctx), upstream, proto, first, transport)
+	}
+}
+
+// dialFallbackFor returns the current fallback of the tunnel URL rawurl, or "".
+func dialFallbackFor(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || rawurl == "" {
+		return ""
+	}
+	upstream, proto := upstreamFromURL(u)
+	if fb, ok := dialFallbacks.Load(upstream + "/" + proto); ok {
+		return fb.(string)
+	}
+	return ""
+}
+
+// defaultWSDialTimeout bounds the TCP connect and TLS handshake of a tunnel
+// dial when the upstream sets no dial_timeout.
+const defaultWSDialTimeout = 10 * time.Second
+
+// defaultWSMaxMessageSize bounds server messages when the upstream sets no
+// max_message_size: far above a Shadowsocks chunk or datagram, far below
+// what a hostile server could make us buffer otherwise.
+const defaultWSMaxMessageSize = 1 << 20
+
+// maxMessageHint carries UpstreamConfig.MaxMessageSize to DialWSStream.
+var maxMessageHint = dialHint("max_message")
+
+// wsMaxMessageSize returns the max_message hint carried in q, or the default.
+func wsMaxMessageSize(q url.Values) int64 {
+	if n, err := strconv.ParseInt(q.Get(maxMessageHint), 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return defaultWSMaxMessageSize
+}
+
+// acceptStatusHint carries UpstreamConfig.AcceptStatus to DialWSStream.
+var acceptStatusHint = dialHint("accept_status")
+
+// wsStatusAccepted reports whether an Extended CONNECT response status is in
+// the accept_status hint (comma-separated codes), or is 200 without one.
+func wsStatusAccepted(q url.Values, status int) bool {
+	list := q.Get(acceptStatusHint)
+	if list == "" {
+		return status == http.StatusOK
+	}
+	for _, f := range strings.Split(list, ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(f)); err == nil && n == status {
+			return true
+		}
+	}
+	return false
+}
+
+// maxHandshakeHeaderDump caps the response headers quoted in a rejected
+// handshake error; an error page behind a CDN can carry a lot of them.
+const maxHandshakeHeaderDump = 2048
+
+// redactedHeaders are dumped with their value masked: a session cookie or
+// credential in a handshake error would end up in logs and /status.
+var redactedHeaders = map[string]bool{
+	"cookie":              true,
+	"set-cookie":          true,
+	"authorization":       true,
+	"proxy-authorization": true,
+}
+
+// headerDumpValue returns v for dumping header name, or "[redacted]".
+func headerDumpValue(name, v string) string {
+	if redactedHeaders[strings.ToLower(name)] {
+		return "[redacted]"
+	}
+	return v
+}
+
+// formatHandshakeHeaders renders h as sorted "name: value" pairs for a
+// handshake error, so a rejection (proxy, CDN, auth gateway) can be told
+// apart from the log line alone. Cookies and credentials are redacted.
+func formatHandshakeHeaders(h http.Header) string {
+	names := make([]string, 0, len(h))
+	for k := range h {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, k := range names {
+		for _, v := range h[k] {
+			if b.Len() > 0 {
+				b.WriteString("; ")
+			}
+			b.WriteString(strings.ToLower(k))
+			b.WriteString(": ")
+			b.WriteString(headerDumpValue(k, v))
+		}
+	}
+	if b.Len() > maxHandshakeHeaderDump {
+		return b.String()[:maxHandshakeHeaderDump] + "..."
+	}
+	return b.String()
+}
+
+// dialTimeoutHint carries UpstreamConfig.DialTimeout to DialWSStream.
+var dialTimeoutHint = dialHint("dial_timeout")
+
+// wsDialTimeout returns the dial_timeout hint carried in q, or the default.
+func wsDialTimeout(q url.Values) time.Duration {
+	if d, err := time.ParseDuration(q.Get(dialTimeoutHint)); err == nil && d > 0 {
+		return d
+	}
+	return defaultWSDialTimeout
+}
+
+// addressFamilyHint carries UpstreamConfig.AddressFamily to DialWSStream.
+var addressFamilyHint = dialHint("address_family")
+
+// wsAddressFamily returns the network suffix for the address_family hint:
+// "4" (ipv4), "6" (ipv6) or "" (auto, any family).
+func wsAddressFamily(q url.Values) string {
+	switch q.Get(addressFamilyHint) {
+	case "ipv4":
+		return "4"
+	case "ipv6":
+		return "6"
+	}
+	return ""
+}
+
+// familyDial pins dial to one address family: "tcp" becomes "tcp4" or
+// "tcp6", so a broken family is never attempted.
+func familyDial(dial dialContextFunc, family string) dialContextFunc {
+	if family == "" {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if network == "tcp" || network == "udp" {
+			network += family
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
 func parseTransportHints(q url.Values) (tryH2, h2Only, tryH3, h3Only, connectOnly bool) {
 	tryH2 = q.Get("h2") == "1" || q.Get("http2") == "1" || q.Get("h2c") == "1" || q.Get("rfc8441") == "1"
 	h2Only = q.Get("h2") == "only" || q.Get("http2") == "only" || q.Get("h2only") == "1" || q.Get("rfc8441") == "only"
@@ -157,6 +417,156 @@ func parseTransportHints(q url.Values) (tryH2, h2Only, tryH3, h3Only, connectOnl
 	return
 }
 
+// withDialHint sets a client-side dial hint (e.g. "subprotocol", "transport")
+// on rawurl unless the URL already carries one, so per-URL settings win over
+// per-upstream config.
+func withDialHint(rawurl, key, value string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || value == "" {
+		return rawurl
+	}
+	q := u.Query()
+	if q.Get(key) != "" {
+		return rawurl
+	}
+	q.Set(key, value)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// transportOrderHint carries UpstreamConfig.TransportOrder to DialWSStream.
+var transportOrderHint = dialHint("transport")
+
+// parseTransportOrder parses a comma-separated transport ladder such as
+// "h2,h1,h3". Duplicates are rejected.
+func parseTransportOrder(s string) ([]string, error) {
+	var out []string
+	seen := map[string]bool{}
+	for _, p := range strings.Split(s, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		switch p {
+		case "h1", "h2", "h3":
+		default:
+			return nil, fmt.Errorf("unknown transport %q (want h1, h2 or h3)", p)
+		}
+		if seen[p] {
+			return nil, fmt.Errorf("duplicate transport %q", p)
+		}
+		seen[p] = true
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// dialTransportLadder tries each transport in order and returns the first
+// successful connection. Only "not supported" failures (see
+// isTransportUnsupported) and an h3 handshake timeout fall through to the
+// next rung; the latter because UDP is often blocked where TCP is not, as
+// the legacy h3=1 path already assumes. Any other error (auth, TLS, a TCP
+// timeout, a refused handshake) is returned as is, since the next transport
+// would reach the same server with the same credentials. If every rung
+// falls through, the per-transport errors are joined.
+func dialTransportLadder(ctx context.Context, order []string, dial func(proto string) (WSConn, error)) (WSConn, string, error) {
+	var errs []error
+	for _, proto := range order {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		c, err := dial(proto)
+		if err == nil {
+			return c, proto, nil
+		}
+		wsTracef(ctx, "transport ladder: %s failed err=%v", proto, err)
+		if !isTransportUnsupported(err) && !(proto == "h3" && errors.Is(err, ErrH3HandshakeTimeout)) {
+			return nil, "", fmt.Errorf("%s (order=%s): %w", proto, strings.Join(order, ","), err)
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", proto, err))
+	}
+	return nil, "", fmt.Errorf("all transports failed (order=%s): %w", strings.Join(order, ","), errors.Join(errs...))
+}
+
+// checkSubprotocol fails a handshake whose response did not confirm the
+// requested subprotocol. An empty want means none was requested.
+func checkSubprotocol(want, got string) error {
+	if want == "" || got == want {
+		return nil
+	}
+	return fmt.Errorf("%w: websocket subprotocol %q not confirmed by server (got %q)", ErrHandshakeRejected, want, got)
+}
+
+// newWebSocketKey returns a random Sec-WebSocket-Key.
+func newWebSocketKey() (string, error) {
+	keyRaw := make([]byte, 16)
+	if _, err := rand.Read(keyRaw); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(keyRaw), nil
+}
+
+func computeAccept(key string) string {
+	// RFC6455 magic GUID
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// requireAcceptHint carries UpstreamConfig.RequireAccept to DialWSStream.
+var requireAcceptHint = dialHint("require_accept")
+
+// requireAccept reports the require_accept dial hint: the h2/h3 handshake
+// sends a Sec-WebSocket-Key and insists on the matching accept.
+func requireAccept(q url.Values) bool { return q.Get(requireAcceptHint) == "1" }
+
+var errMissingAccept = errors.New("server omitted sec-websocket-accept (require_accept is set)")
+
+// checkAccept verifies the Sec-WebSocket-Accept answering key. A missing
+// header passes unless require_accept is set; a wrong one always fails.
+func checkAccept(q url.Values, key, got string) error {
+	if got == "" {
+		if requireAccept(q) {
+			return errMissingAccept
+		}
+		wsDebugf("handshake response without sec-websocket-accept (accepted; set require_accept to refuse)")
+		return nil
+	}
+	if got != computeAccept(key) {
+		return errors.New("bad sec-websocket-accept")
+	}
+	return nil
+}
+
+// dialHintKeys are the query parameters only this client reads: transport
+// selection, handshake tuning and health-check paths, written by hand or
+// folded in by upstreamDialURL. stripDialHints keeps them out of every
+// request the server sees, whatever the transport. Hints owned by a single
+// feature are added with dialHint next to the code that reads them.
+var dialHintKeys = []string{
+	"h2", "http2", "h2only", "h2c", "rfc8441",
+	"h3", "http3", "h3only", "quic", "rfc9220",
+	"connect", "extended_connect", "extended-connect", "connect_protocol",
+	"test_path", "health_path", "hc_path",
+	"subprotocol",
+}
+
+// dialHint adds key to dialHintKeys and returns it, so a feature declares
+// its query parameter and keeps it from the server in one place.
+func dialHint(key string) string {
+	dialHintKeys = append(dialHintKeys, key)
+	return key
+}
+
+// stripDialHints returns a copy of u without dialHintKeys, as sent to the
+// server and shown in logs.
+func stripDialHints(u *url.URL) *url.URL {
+	clone := *u
+	q := clone.Query()
+	for _, k := range dialHintKeys {
+		q.Del(k)
+	}
+	clone.RawQuery = q.Encode()
+	return &clone
+}
+
 func stripHealthcheckQueryParams(u *url.URL) *url.URL {
 	if u == nil {
 		return nil
@@ -191,14 +601,27 @@ func upstreamFromURL(u *url.URL) (name, proto string) {
 
 // ProbeWSS verifies the websocket handshake succeeds.
 func ProbeWSS(ctx context.Context, rawurl string, fwmark uint32) (time.Duration, error) {
-	start := time.Now()
-	c, err := DialWSStream(ctx, rawurl, fwmark)
+	c, elapsed, err := ProbeWSSConn(ctx, rawurl, fwmark)
 	if err != nil {
 		return 0, err
 	}
-	elapsed := time.Since(start)
-	wsDebugf("probe: transport established url=%q elapsed=%s, closing intentionally", rawurl, elapsed)
+	wsDebugf("probe: closing intentionally url=%q", rawurl)
 	_ = c.Close(WSStatusNormalClosure, "probe")
 	wsDebugf("probe: close sent url=%q", rawurl)
 	return elapsed, nil
 }
+
+// ProbeWSSConn is ProbeWSS that hands the established connection to the
+// caller, which must close it: a quality probe or self-test can then run
+// over the same handshake instead of dialing again. The duration is the
+// handshake time; cancelling ctx aborts the dial.
+func ProbeWSSConn(ctx context.Context, rawurl string, fwmark uint32) (WSConn, time.Duration, error) {
+	start := time.Now()
+	c, err := DialWSStream(ctx, rawurl, fwmark)
+	if err != nil {
+		return nil, 0, err
+	}
+	elapsed := time.Since(start)
+	wsDebugf("probe: transport established url=%q elapsed=%s", rawurl, elapsed)
+	return c, elapsed, nil
+}
@@ -21,6 +21,8 @@ type WSStatusCode uint16
 
 const (
 	WSStatusNormalClosure WSStatusCode = 1000
+	WSStatusProtocolError WSStatusCode = 1002
+	WSStatusMessageTooBig WSStatusCode = 1009
 )
 
 // WSConn is the minimal subset this project needs from a WebSocket connection.
@@ -29,3 +31,19 @@ type WSConn interface {
 	Write(ctx context.Context, typ WSMessageType, data []byte) error
 	Close(code WSStatusCode, reason string) error
 }
+
+// pooledReader is implemented by connections whose Read can hand out a
+// borrowed buffer; release returns it once the caller is done with data.
+type pooledReader interface {
+	ReadPooled(ctx context.Context) (typ WSMessageType, data []byte, release func(), err error)
+}
+
+// readPooled reads through c's ReadPooled when it has one. Otherwise data is
+// owned by the caller and release is a no-op.
+func readPooled(ctx context.Context, c WSConn) (WSMessageType, []byte, func(), error) {
+	if pr, ok := c.(pooledReader); ok {
+		return pr.ReadPooled(ctx)
+	}
+	typ, data, err := c.Read(ctx)
+	return typ, data, func() {}, err
+}
@@ -4,16 +4,23 @@ package internal
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/coder/websocket"
 )
 
 type coderConn struct {
+	wsTransportInfo
 	c *websocket.Conn
 }
 
+func (c *coderConn) setReadLimit(n int64) {
+	c.c.SetReadLimit(n)
+}
+
 func (c *coderConn) Read(ctx context.Context) (WSMessageType, []byte, error) {
 	mt, data, err := c.c.Read(ctx)
 	if err != nil {
@@ -42,28 +49,68 @@ func (c *coderConn) Write(ctx context.Context, typ WSMessageType, data []byte) e
 }
 
 func (c *coderConn) Close(code WSStatusCode, reason string) error {
+	c.closed()
 	// coder/websocket Close expects a websocket.StatusCode.
-	return c.c.Close(websocket.StatusCode(int(code)), reason)
+	if err := c.c.Close(websocket.StatusCode(int(code)), reason); err != nil {
+		return err
+	}
+	// Pings and pongs are answered inside coder/websocket and never reach
+	// us; the close frame is the only control frame we can account for.
+	observeWSFrame("out", "control", 2+len(reason))
+	return nil
 }
 
-func dialCoderWebSocket(ctx context.Context, rawurl string, tr *http.Transport) (WSConn, error) {
+func dialCoderWebSocket(ctx context.Context, rawurl string, tr *http.Transport, subprotocol string) (WSConn, error) {
 	opts := &websocket.DialOptions{
 		HTTPClient: &http.Client{
-			Timeout:   10 * time.Second,
+			Timeout:   coderDialTimeout(tr),
 			Transport: tr,
 		},
 	}
-	conn, resp, err := websocket.Dial(ctx, rawurl, opts)
+	if subprotocol != "" {
+		opts.Subprotocols = []string{subprotocol}
+	}
+	dialURL := rawurl
+	cred, hasCred := handshakeCredFrom(ctx)
+	if hasCred {
+		opts.HTTPHeader = http.Header{}
+		cred.setHeader(opts.HTTPHeader)
+		dialURL = cred.withQuery(rawurl)
+	}
+	traced := ctx
+	if u, err := url.Parse(rawurl); err == nil {
+		traced = newDialPhaseTimer(ctx, u, "h1").trace(ctx)
+	}
+	conn, resp, err := websocket.Dial(traced, dialURL, opts)
 	if err != nil {
+		if hasCred {
+			err = cred.redact(err)
+		}
 		if resp != nil {
-			wsDebugf("h1: websocket dial failed url=%q status=%q err=%v", rawurl, resp.Status, err)
+			wsTracef(ctx, "h1: websocket dial failed url=%q status=%q err=%v", rawurl, resp.Status, err)
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				return nil, fmt.Errorf("%w: %w", ErrHandshakeRejected, err)
+			}
 		} else {
-			wsDebugf("h1: websocket dial failed url=%q err=%v", rawurl, err)
+			wsTracef(ctx, "h1: websocket dial failed url=%q err=%v", rawurl, err)
 		}
-		return nil, err
+		return nil, wrapTLSError(err)
 	}
 	if resp != nil {
-		wsDebugf("h1: websocket dial response status=%q", resp.Status)
+		wsTracef(ctx, "h1: websocket dial response status=%q", resp.Status)
+	}
+	if err := checkSubprotocol(subprotocol, conn.Subprotocol()); err != nil {
+		_ = conn.Close(websocket.StatusProtocolError, "subprotocol")
+		return nil, err
+	}
+	return &coderConn{wsTransportInfo: wsTransportInfo{transport: "h1"}, c: conn}, nil
+}
+
+// coderDialTimeout caps the whole HTTP/1.1 upgrade request at the dial
+// timeout DialWSStream put on the transport.
+func coderDialTimeout(tr *http.Transport) time.Duration {
+	if tr != nil && tr.TLSHandshakeTimeout > 0 {
+		return tr.TLSHandshakeTimeout
 	}
-	return &coderConn{c: conn}, nil
+	return defaultWSDialTimeout
 }
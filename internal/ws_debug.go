@@ -1,6 +1,9 @@
 package internal
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"log"
 	"sync/atomic"
 )
@@ -16,3 +19,41 @@ func wsDebugf(format string, args ...any) {
 		log.Printf("[debug] "+format, args...)
 	}
 }
+
+// Trace IDs correlate the log lines of one connection attempt across the
+// pick → dial → handshake → tunnel stages. They ride on the context.
+type traceIDKey struct{}
+
+func newTraceID() string {
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// withTraceID returns ctx carrying a trace ID, keeping one already present.
+func withTraceID(ctx context.Context) context.Context {
+	if traceIDFrom(ctx) != "" {
+		return ctx
+	}
+	return context.WithValue(ctx, traceIDKey{}, newTraceID())
+}
+
+func traceIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDKey{}).(string)
+	return id
+}
+
+// tracePrefix is "trace=<id> " for a traced ctx and "" otherwise.
+func tracePrefix(ctx context.Context) string {
+	if id := traceIDFrom(ctx); id != "" {
+		return "trace=" + id + " "
+	}
+	return ""
+}
+
+// wsTracef is wsDebugf with the ctx trace ID prepended.
+func wsTracef(ctx context.Context, format string, args ...any) {
+	if wsDebugEnabled.Load() {
+		log.Printf("[debug] "+tracePrefix(ctx)+format, args...)
+	}
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer guards a bytes.Buffer used as the log output.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.String()
+}
+
+func captureDebugLog(t *testing.T) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	prevOut, prevFlags := log.Writer(), log.Flags()
+	log.SetOutput(buf)
+	log.SetFlags(0)
+	SetWebSocketDebug(true)
+	t.Cleanup(func() {
+		SetWebSocketDebug(false)
+		log.SetOutput(prevOut)
+		log.SetFlags(prevFlags)
+	})
+	return buf
+}
+
+var traceRE = regexp.MustCompile(`trace=([0-9a-f]{8}) `)
+
+// traceIDs returns the trace IDs of the log lines containing substr, failing
+// on any matching line without one.
+func traceIDs(t *testing.T, logs, substr string) map[string]bool {
+	t.Helper()
+	ids := map[string]bool{}
+	for _, line := range strings.Split(logs, "\n") {
+		if !strings.Contains(line, substr) {
+			continue
+		}
+		m := traceRE.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("log line without trace id: %q", line)
+		}
+		ids[m[1]] = true
+	}
+	return ids
+}
+
+func TestTraceID_ConsistentAcrossOneConnection(t *testing.T) {
+	logs := captureDebugLog(t)
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		c, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(c, c)
+		c.Close()
+	}()
+
+	lb := NewLoadBalancer(nil, HealthcheckConfig{}, SelectionConfig{}, ProbeConfig{}, 0)
+	srv := &Socks5Server{LB: lb, Routing: RoutingConfig{Direct: []string{"127.0.0.1"}}}
+
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		srv.HandleConn(context.Background(), server)
+		close(done)
+	}()
+	port := echo.Addr().(*net.TCPAddr).Port
+	_, _ = client.Write([]byte{0x05, 0x01, 0x00})
+	_, _ = io.ReadFull(client, make([]byte, 2))
+	_, _ = client.Write([]byte{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, byte(port >> 8), byte(port)})
+	_, _ = io.ReadFull(client, make([]byte, 10))
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("HandleConn did not return")
+	}
+
+	// Filter on this connection's dst: other tests' handlers may still log.
+	ids := traceIDs(t, logs.String(), echo.Addr().String())
+	if len(ids) != 1 {
+		t.Fatalf("want one trace id across the connection, got %v\n%s", ids, logs.String())
+	}
+}
+
+func TestTraceID_DialKeepsCallerID(t *testing.T) {
+	logs := captureDebugLog(t)
+
+	ctx, cancel := context.WithTimeout(withTraceID(context.Background()), 2*time.Second)
+	defer cancel()
+	want := traceIDFrom(ctx)
+
+	// Nothing listens on port 1, so the dial fails after logging its attempts.
+	_, _ = DialWSStream(ctx, "ws://127.0.0.1:1/tcp", 0)
+
+	ids := traceIDs(t, logs.String(), "url=")
+	if len(ids) != 1 || !ids[want] {
+		t.Fatalf("dial logs carry %v, want only %s\n%s", ids, want, logs.String())
+	}
+}
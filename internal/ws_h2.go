@@ -13,21 +13,20 @@ import (
 	"net/url"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var errRFC8441NotSupported = errors.New("rfc8441 not supported by transport")
-
 // dialRFC8441 attempts WebSocket over HTTP/2 using RFC 8441 (Extended CONNECT).
 //
 // Important:
 //   - This relies on the Go HTTP stack supporting Extended CONNECT and passing
 //     the ":protocol" pseudo-header through to HTTP/2. In some Go versions this
 //     is behind a GODEBUG flag (commonly documented as GODEBUG=http2xconnect=1).
-//   - If unsupported, this returns errRFC8441NotSupported.
+//   - If unsupported, this returns ErrH2NotSupported.
 func dialRFC8441(ctx context.Context, u *url.URL, tr *http.Transport) (WSConn, error) {
 	// RFC 8441 uses "http"/"https" schemes, mapped from ws/wss.
-	target := *u
+	target := *stripDialHints(u)
 	switch u.Scheme {
 	case "wss":
 		target.Scheme = "https"
@@ -41,13 +40,15 @@ func dialRFC8441(ctx context.Context, u *url.URL, tr *http.Transport) (WSConn, e
 	tr2 := tr.Clone()
 	tr2.ForceAttemptHTTP2 = true
 	if tr2.TLSClientConfig == nil {
-		tr2.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		tr2.TLSClientConfig = withUpstreamTLS(&tls.Config{MinVersion: tls.VersionTLS12})
 	}
 
 	// We need full-duplex: request body is our write side; response body is read side.
 	pr, pw := io.Pipe()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodConnect, target.String(), pr)
+	cred, hasCred := handshakeCredFrom(ctx)
+	traced := newDialPhaseTimer(ctx, u, "h2").trace(ctx)
+	req, err := http.NewRequestWithContext(traced, http.MethodConnect, cred.withQuery(target.String()), pr)
 	if err != nil {
 		_ = pw.Close()
 		return nil, err
@@ -67,6 +68,20 @@ func dialRFC8441(ctx context.Context, u *url.URL, tr *http.Transport) (WSConn, e
 	if origin := u.Query().Get("origin"); origin != "" {
 		req.Header.Set("origin", origin)
 	}
+	subprotocol := u.Query().Get("subprotocol")
+	if subprotocol != "" {
+		req.Header.Set("sec-websocket-protocol", subprotocol)
+	}
+	cred.setHeader(req.Header)
+	// RFC 8441 drops the key exchange; it is only sent to enforce require_accept.
+	var key string
+	if requireAccept(u.Query()) {
+		if key, err = newWebSocketKey(); err != nil {
+			_ = pw.Close()
+			return nil, err
+		}
+		req.Header.Set("sec-websocket-key", key)
+	}
 
 	cli := &http.Client{
 		Timeout:   0, // stream
@@ -76,12 +91,27 @@ func dialRFC8441(ctx context.Context, u *url.URL, tr *http.Transport) (WSConn, e
 	resp, err := cli.Do(req)
 	if err != nil {
 		_ = pw.Close()
-		return nil, err
+		if hasCred {
+			err = cred.redact(err)
+		}
+		return nil, wrapTLSError(err)
 	}
-	if resp.StatusCode != http.StatusOK {
+	if !wsStatusAccepted(u.Query(), resp.StatusCode) {
 		_ = resp.Body.Close()
 		_ = pw.Close()
-		return nil, fmt.Errorf("rfc8441 connect failed: %s", resp.Status)
+		return nil, fmt.Errorf("%w: rfc8441 connect failed: %s (headers: %s)", ErrHandshakeRejected, resp.Status, formatHandshakeHeaders(resp.Header))
+	}
+	if err := checkSubprotocol(subprotocol, resp.Header.Get("sec-websocket-protocol")); err != nil {
+		_ = resp.Body.Close()
+		_ = pw.Close()
+		return nil, err
+	}
+	if key != "" {
+		if err := checkAccept(u.Query(), key, resp.Header.Get("sec-websocket-accept")); err != nil {
+			_ = resp.Body.Close()
+			_ = pw.Close()
+			return nil, fmt.Errorf("%w: rfc8441: %w", ErrHandshakeRejected, err)
+		}
 	}
 
 	stream := &h2Stream{
@@ -93,7 +123,9 @@ func dialRFC8441(ctx context.Context, u *url.URL, tr *http.Transport) (WSConn, e
 		},
 	}
 
-	return newFramedWSConn(stream), nil
+	c := newFramedWSConn(stream)
+	c.transport = "h2"
+	return c, nil
 }
 
 // setRequestProtocol tries to set req.Protocol = protocol.
@@ -121,27 +153,51 @@ func (s *h2Stream) Close() error                { return s.c() }
 
 // framedWSConn implements WSConn using RFC6455 framing over an io.ReadWriteCloser.
 type framedWSConn struct {
+	wsTransportInfo
 	br *bufio.Reader
 	s  io.ReadWriteCloser
 	mu sync.Mutex // serialize writes; multiple goroutines may write (data + auto pong/close)
 	// closeSent gates writes after we send a WS close frame.
 	closeSent bool
+	// maxMessage bounds a (reassembled) server message; see setReadLimit.
+	maxMessage uint64
+	pooled     bool
 }
 
 func newFramedWSConn(s io.ReadWriteCloser) *framedWSConn {
 	return &framedWSConn{
-		br: bufio.NewReaderSize(s, 32*1024),
-		s:  s,
+		br:         bufio.NewReaderSize(s, 32*1024),
+		s:          s,
+		maxMessage: defaultWSMaxMessageSize,
+		pooled:     pooledFrameReads.Load(),
 	}
 }
 
+// setReadLimit sets the largest server message Read accepts. Call before the
+// first Read.
+func (c *framedWSConn) setReadLimit(n int64) {
+	c.maxMessage = uint64(n)
+}
+
+// tooLarge closes the connection with 1009 after an over-limit message.
+func (c *framedWSConn) tooLarge(size uint64) error {
+	_ = c.sendClose([]byte{byte(WSStatusMessageTooBig >> 8), byte(WSStatusMessageTooBig & 0xff)})
+	_ = c.s.Close()
+	return fmt.Errorf("%w: %d bytes, limit %d", ErrMessageTooLarge, size, c.maxMessage)
+}
+
+// writeRaw sends an already-built (and already-masked) frame. Every client
+// frame goes through buildFrame exactly once, so nothing here masks again.
 func (c *framedWSConn) writeRaw(frame []byte) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.closeSent {
 		return io.EOF
 	}
+	return c.writeLocked(frame)
+}
 
+func (c *framedWSConn) writeLocked(frame []byte) error {
 	remaining := frame
 	for len(remaining) > 0 {
 		n, err := c.s.Write(remaining)
@@ -168,57 +224,108 @@ func (c *framedWSConn) sendClose(payload []byte) error {
 		return nil
 	}
 	c.closeSent = true
+	if err := c.writeLocked(frame); err != nil {
+		return err
+	}
+	observeWSFrame("out", "control", len(payload))
+	return nil
+}
 
-	remaining := frame
-	for len(remaining) > 0 {
-		n, err := c.s.Write(remaining)
-		if err != nil {
-			return err
-		}
-		if n <= 0 {
-			return io.ErrShortWrite
+// closeEchoPayload returns the payload to send back for a server close frame
+// (RFC 6455 5.5.1): the server's code and reason verbatim, or 1002 when the
+// received payload is malformed or carries a code that must not be sent.
+func closeEchoPayload(p []byte) []byte {
+	if len(p) == 0 {
+		return nil
+	}
+	if len(p) >= 2 {
+		code := binary.BigEndian.Uint16(p[:2])
+		if code >= 1000 && code != 1004 && code != 1005 && code != 1006 && code != 1015 && (code < 1016 || code >= 3000) && code < 5000 {
+			return p
 		}
-		remaining = remaining[n:]
 	}
-	return nil
+	out := make([]byte, 2)
+	binary.BigEndian.PutUint16(out, uint16(WSStatusProtocolError))
+	return out
 }
 
 func (c *framedWSConn) Read(ctx context.Context) (WSMessageType, []byte, error) {
+	typ, payload, _, err := c.readMessage(ctx, false)
+	return typ, payload, err
+}
+
+// ReadPooled is Read with the payload of unfragmented messages borrowed from
+// wsFramePool when pooled reads are enabled (websocket.pooled_reads). The
+// caller must call release once it no longer touches data.
+func (c *framedWSConn) ReadPooled(ctx context.Context) (typ WSMessageType, data []byte, release func(), err error) {
+	return c.readMessage(ctx, c.pooled)
+}
+
+func (c *framedWSConn) readMessage(ctx context.Context, pooled bool) (WSMessageType, []byte, func(), error) {
 	// Note: we cannot reliably cancel a blocked read on generic io.Reader without
 	// deadlines, so ctx is best-effort.
 	for {
 		if err := ctx.Err(); err != nil {
-			return 0, nil, err
+			return 0, nil, nil, err
 		}
 
-		typ, payload, fin, err := readFrame(c.br, false /* expect unmasked server frames */)
+		var (
+			typ     WSMessageType
+			payload []byte
+			fin     bool
+			err     error
+		)
+		release := func() {}
+		if pooled {
+			typ, payload, fin, release, err = readFramePooled(c.br, false /* expect unmasked server frames */, c.maxMessage)
+		} else {
+			typ, payload, fin, err = readFrameMax(c.br, false /* expect unmasked server frames */, c.maxMessage)
+		}
 		if err != nil {
-			return 0, nil, err
+			var big frameTooLargeError
+			if errors.As(err, &big) {
+				return 0, nil, nil, c.tooLarge(uint64(big))
+			}
+			return 0, nil, nil, err
+		}
+		if typ >= WSMessageClose {
+			observeWSFrame("in", "control", len(payload))
 		}
 
 		switch typ {
 		case WSMessagePing:
 			// auto-respond with pong
 			_ = c.Write(ctx, WSMessagePong, payload)
+			release()
 			continue
 		case WSMessagePong:
+			release()
 			continue
 		case WSMessageClose:
-			// Echo close (best-effort) and stop.
-			// If peer sent a close code/reason, preserve it.
-			// Send back the same payload.
-			_ = c.sendClose(payload)
+			// Echo close (best-effort) and stop, preserving the peer's
+			// code/reason.
+			_ = c.sendClose(closeEchoPayload(payload))
+			release()
 			_ = c.s.Close()
-			return 0, nil, io.EOF
+			return 0, nil, nil, io.EOF
 		case WSMessageContinuation:
-			return 0, nil, fmt.Errorf("websocket protocol error: unexpected continuation frame")
+			release()
+			return 0, nil, nil, fmt.Errorf("websocket protocol error: unexpected continuation frame")
 		case WSMessageText, WSMessageBinary:
 			if fin {
-				return typ, payload, nil
+				return typ, payload, release, nil
 			}
-			return c.readFragmentedMessage(ctx, typ, payload, fin)
+			// readFragmentedMessage copies the first fragment, so the pooled
+			// buffer can go back right away.
+			typ, payload, err = c.readFragmentedMessage(ctx, typ, payload, fin)
+			release()
+			if err != nil {
+				return 0, nil, nil, err
+			}
+			return typ, payload, func() {}, nil
 		default:
-			return 0, nil, fmt.Errorf("websocket protocol error: reserved opcode=%d", typ)
+			release()
+			return 0, nil, nil, fmt.Errorf("websocket protocol error: reserved opcode=%d", typ)
 		}
 	}
 }
@@ -234,10 +341,17 @@ func (c *framedWSConn) readFragmentedMessage(ctx context.Context, firstType WSMe
 		if err := ctx.Err(); err != nil {
 			return 0, nil, err
 		}
-		op2, p2, fin2, err := readFrame(c.br, false /* expect unmasked server frames */)
+		op2, p2, fin2, err := readFrameMax(c.br, false /* expect unmasked server frames */, c.maxMessage-uint64(len(buf)))
 		if err != nil {
+			var big frameTooLargeError
+			if errors.As(err, &big) {
+				return 0, nil, c.tooLarge(uint64(len(buf)) + uint64(big))
+			}
 			return 0, nil, err
 		}
+		if op2 >= WSMessageClose {
+			observeWSFrame("in", "control", len(p2))
+		}
 		switch op2 {
 		case WSMessagePing:
 			_ = c.Write(ctx, WSMessagePong, p2)
@@ -245,7 +359,7 @@ func (c *framedWSConn) readFragmentedMessage(ctx context.Context, firstType WSMe
 		case WSMessagePong:
 			continue
 		case WSMessageClose:
-			_ = c.sendClose(p2)
+			_ = c.sendClose(closeEchoPayload(p2))
 			_ = c.s.Close()
 			return 0, nil, io.EOF
 		case WSMessageContinuation:
@@ -268,18 +382,36 @@ func (c *framedWSConn) Write(ctx context.Context, typ WSMessageType, data []byte
 	if err != nil {
 		return err
 	}
-	return c.writeRaw(frame)
+	if err := c.writeRaw(frame); err != nil {
+		return err
+	}
+	// Data bytes are counted by the tunnel wrappers (WSStreamConn,
+	// WSPacketConn); only control frames are accounted here.
+	if typ >= WSMessageClose {
+		observeWSFrame("out", "control", len(data))
+	}
+	return nil
 }
 
 func (c *framedWSConn) Close(code WSStatusCode, reason string) error {
+	c.closed()
 	// Close frame: 2-byte code + reason.
 	var payload []byte
 	if code != 0 {
+		// Control frame payloads are capped at 125 bytes (RFC 6455 5.5).
+		if len(reason) > 123 {
+			reason = reason[:123]
+		}
 		payload = make([]byte, 2+len(reason))
 		binary.BigEndian.PutUint16(payload[:2], uint16(code))
 		copy(payload[2:], []byte(reason))
 	}
 	_ = c.sendClose(payload)
+	// Nothing follows a close frame: half-close the underlying stream when it
+	// supports it (raw h2 END_STREAM) so the peer can finish its side cleanly.
+	if cw, ok := c.s.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
 	// Give the peer a moment to read the close (best-effort).
 	_ = time.AfterFunc(150*time.Millisecond, func() { _ = c.s.Close() })
 	return nil
@@ -287,115 +419,202 @@ func (c *framedWSConn) Close(code WSStatusCode, reason string) error {
 
 // ---- framing helpers ----
 
+// wsFrameSafetyCap bounds any single frame regardless of configured limits.
+const wsFrameSafetyCap = 64 << 20
+
+// frameTooLargeError reports a frame whose payload length exceeds the limit
+// passed to readFrameMax; the payload has not been read.
+type frameTooLargeError uint64
+
+func (e frameTooLargeError) Error() string {
+	return fmt.Sprintf("ws frame too large: %d", uint64(e))
+}
+
 func readFrame(r *bufio.Reader, expectMasked bool) (typ WSMessageType, payload []byte, fin bool, err error) {
-	b0, err := r.ReadByte()
+	return readFrameMax(r, expectMasked, wsFrameSafetyCap)
+}
+
+// readFrameMax is readFrame rejecting payloads over max bytes before they
+// are allocated.
+func readFrameMax(r *bufio.Reader, expectMasked bool, max uint64) (typ WSMessageType, payload []byte, fin bool, err error) {
+	h, err := readFrameHeader(r, expectMasked, max)
 	if err != nil {
 		return 0, nil, false, err
 	}
+
+	payload = make([]byte, h.plen)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, false, err
+	}
+	if h.masked {
+		maskBytes(h.maskKey, payload)
+	}
+
+	return h.op, payload, h.fin, nil
+}
+
+const (
+	wsFramePoolDefaultCap   = 4 * 1024
+	wsFramePoolMaxRetainCap = 64 * 1024
+)
+
+var wsFramePool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, wsFramePoolDefaultCap)
+		return &b
+	},
+}
+
+var pooledFrameReads atomic.Bool
+
+// SetPooledFrameReads makes framed (h2/h3) connections opened afterwards
+// borrow data frame payloads from a shared pool instead of allocating one
+// buffer per frame (config websocket.pooled_reads).
+func SetPooledFrameReads(enabled bool) {
+	pooledFrameReads.Store(enabled)
+}
+
+// readFramePooled is readFrameMax with the payload taken from wsFramePool.
+// The caller must call release exactly once when done with payload and must
+// not touch payload afterwards. release is non-nil whenever err is nil.
+func readFramePooled(r *bufio.Reader, expectMasked bool, max uint64) (typ WSMessageType, payload []byte, fin bool, release func(), err error) {
+	h, err := readFrameHeader(r, expectMasked, max)
+	if err != nil {
+		return 0, nil, false, nil, err
+	}
+
+	bufPtr := wsFramePool.Get().(*[]byte)
+	buf := *bufPtr
+	if uint64(cap(buf)) < h.plen {
+		buf = make([]byte, h.plen)
+	}
+	buf = buf[:h.plen]
+	release = func() {
+		if cap(buf) > wsFramePoolMaxRetainCap {
+			*bufPtr = make([]byte, 0, wsFramePoolDefaultCap)
+		} else {
+			*bufPtr = buf[:0]
+		}
+		wsFramePool.Put(bufPtr)
+	}
+
+	if _, err := io.ReadFull(r, buf); err != nil {
+		release()
+		return 0, nil, false, nil, err
+	}
+	if h.masked {
+		maskBytes(h.maskKey, buf)
+	}
+
+	return h.op, buf, h.fin, release, nil
+}
+
+type wsFrameHeader struct {
+	op      WSMessageType
+	fin     bool
+	masked  bool
+	maskKey [4]byte
+	plen    uint64
+}
+
+func readFrameHeader(r *bufio.Reader, expectMasked bool, max uint64) (h wsFrameHeader, err error) {
+	b0, err := r.ReadByte()
+	if err != nil {
+		return h, err
+	}
 	b1, err := r.ReadByte()
 	if err != nil {
-		return 0, nil, false, err
+		return h, err
 	}
 
-	fin = (b0 & 0x80) != 0
-	op := WSMessageType(b0 & 0x0F)
+	h.fin = (b0 & 0x80) != 0
+	h.op = WSMessageType(b0 & 0x0F)
 
-	masked := (b1 & 0x80) != 0
-	if expectMasked && !masked {
-		return 0, nil, false, fmt.Errorf("websocket protocol error: expected masked frame")
+	h.masked = (b1 & 0x80) != 0
+	if expectMasked && !h.masked {
+		return h, fmt.Errorf("websocket protocol error: expected masked frame")
 	}
-	if !expectMasked && masked {
-		return 0, nil, false, fmt.Errorf("websocket protocol error: server frame must not be masked")
+	if !expectMasked && h.masked {
+		return h, fmt.Errorf("websocket protocol error: server frame must not be masked")
 	}
 	ln := int(b1 & 0x7F)
 
-	var plen uint64
 	switch ln {
 	case 126:
 		var b [2]byte
 		if _, err := io.ReadFull(r, b[:]); err != nil {
-			return 0, nil, false, err
+			return h, err
 		}
-		plen = uint64(binary.BigEndian.Uint16(b[:]))
+		h.plen = uint64(binary.BigEndian.Uint16(b[:]))
 	case 127:
 		var b [8]byte
 		if _, err := io.ReadFull(r, b[:]); err != nil {
-			return 0, nil, false, err
+			return h, err
 		}
-		plen = binary.BigEndian.Uint64(b[:])
+		h.plen = binary.BigEndian.Uint64(b[:])
 	default:
-		plen = uint64(ln)
+		h.plen = uint64(ln)
 	}
 
-	var maskKey [4]byte
-	if masked {
-		if _, err := io.ReadFull(r, maskKey[:]); err != nil {
-			return 0, nil, false, err
+	if h.masked {
+		if _, err := io.ReadFull(r, h.maskKey[:]); err != nil {
+			return h, err
 		}
 	}
 
-	if plen > (64 << 20) { // 64 MiB safety cap
-		return 0, nil, false, fmt.Errorf("ws frame too large: %d", plen)
-	}
-
-	payload = make([]byte, plen)
-	if _, err := io.ReadFull(r, payload); err != nil {
-		return 0, nil, false, err
-	}
-
-	if masked {
-		for i := range payload {
-			payload[i] ^= maskKey[i%4]
-		}
+	if h.plen > min(max, wsFrameSafetyCap) {
+		return h, frameTooLargeError(h.plen)
 	}
-
-	return op, payload, fin, nil
+	return h, nil
 }
 
 func buildFrame(typ WSMessageType, payload []byte, mask bool) ([]byte, error) {
 	// FIN + opcode
 	b0 := byte(0x80) | byte(typ&0x0F)
 
-	// length
+	// Header, mask key and payload share one allocation; the payload copy is
+	// masked in place, so the caller's slice is never modified.
 	plen := len(payload)
-	var hdr []byte
+	out := make([]byte, 0, 14+plen)
 
 	switch {
 	case plen < 126:
-		hdr = make([]byte, 2)
-		hdr[0] = b0
-		hdr[1] = byte(plen)
+		out = append(out, b0, byte(plen))
 	case plen <= 0xFFFF:
-		hdr = make([]byte, 4)
-		hdr[0] = b0
-		hdr[1] = 126
-		binary.BigEndian.PutUint16(hdr[2:], uint16(plen))
+		out = append(out, b0, 126)
+		out = binary.BigEndian.AppendUint16(out, uint16(plen))
 	default:
-		hdr = make([]byte, 10)
-		hdr[0] = b0
-		hdr[1] = 127
-		binary.BigEndian.PutUint64(hdr[2:], uint64(plen))
+		out = append(out, b0, 127)
+		out = binary.BigEndian.AppendUint64(out, uint64(plen))
 	}
 
-	var maskKey [4]byte
-	outPayload := payload
-	if mask {
-		hdr[1] |= 0x80
-		if _, err := rand.Read(maskKey[:]); err != nil {
-			return nil, err
-		}
-		outPayload = make([]byte, len(payload))
-		copy(outPayload, payload)
-		for i := range outPayload {
-			outPayload[i] ^= maskKey[i%4]
-		}
+	if !mask {
+		return append(out, payload...), nil
 	}
 
-	out := make([]byte, 0, len(hdr)+4+len(outPayload))
-	out = append(out, hdr...)
-	if mask {
-		out = append(out, maskKey[:]...)
+	out[1] |= 0x80
+	var maskKey [4]byte
+	if _, err := rand.Read(maskKey[:]); err != nil {
+		return nil, err
 	}
-	out = append(out, outPayload...)
+	out = append(out, maskKey[:]...)
+	start := len(out)
+	out = append(out, payload...)
+	maskBytes(maskKey, out[start:])
 	return out, nil
 }
+
+// maskBytes XORs b in place with the RFC 6455 masking key, starting at key
+// offset 0. The bulk runs eight bytes at a time.
+func maskBytes(key [4]byte, b []byte) {
+	k32 := uint64(binary.LittleEndian.Uint32(key[:]))
+	k64 := k32 | k32<<32
+	i := 0
+	for ; i+8 <= len(b); i += 8 {
+		v := binary.LittleEndian.Uint64(b[i:])
+		binary.LittleEndian.PutUint64(b[i:], v^k64)
+	}
+	for ; i < len(b); i++ {
+		b[i] ^= key[i&3]
+	}
+}
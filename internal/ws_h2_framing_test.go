@@ -89,3 +89,413 @@ type rwStub struct {
 func (s *rwStub) Read(p []byte) (int, error)  { return s.r.Read(p) }
 func (s *rwStub) Write(p []byte) (int, error) { return s.w.Write(p) }
 func (s *rwStub) Close() error                { return nil }
+
+// readClientFrame parses one client->server frame, requiring it to be masked.
+func readClientFrame(t *testing.T, wire []byte) (WSMessageType, []byte) {
+	t.Helper()
+	if len(wire) < 2 || wire[1]&0x80 == 0 {
+		t.Fatalf("client frame is not masked: % x", wire)
+	}
+	typ, payload, fin, err := readFrame(bufio.NewReader(bytes.NewReader(wire)), true)
+	if err != nil {
+		t.Fatalf("readFrame: %v", err)
+	}
+	if !fin {
+		t.Fatalf("expected FIN on client frame")
+	}
+	return typ, payload
+}
+
+func TestFramedWSConn_EchoesServerCloseMasked(t *testing.T) {
+	closePayload := append([]byte{0x0f, 0xa1}, []byte("going away for maintenance")...) // 4001
+	frame, err := buildFrame(WSMessageClose, closePayload, false)
+	if err != nil {
+		t.Fatalf("buildFrame: %v", err)
+	}
+	var out bytes.Buffer
+	conn := newFramedWSConn(&rwStub{r: bytes.NewReader(frame), w: &out})
+	if _, _, err := conn.Read(context.Background()); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected EOF after server close, got %v", err)
+	}
+
+	typ, payload := readClientFrame(t, out.Bytes())
+	if typ != WSMessageClose {
+		t.Fatalf("echoed opcode=%d, want close", typ)
+	}
+	// Unmasking once must restore the server payload; a double-masked frame
+	// would not round-trip.
+	if !bytes.Equal(payload, closePayload) {
+		t.Fatalf("echoed close payload=%q, want %q", payload, closePayload)
+	}
+}
+
+func TestFramedWSConn_PingAndCloseDuringFragmentAreMaskedOnce(t *testing.T) {
+	var wire []byte
+	for _, f := range []struct {
+		typ     WSMessageType
+		payload []byte
+		fin     bool
+	}{
+		{WSMessageBinary, []byte("part1"), false},
+		{WSMessagePing, []byte("hb"), true},
+		{WSMessageClose, []byte{0x03, 0xe8, 'o', 'k'}, true},
+	} {
+		b, err := buildFrame(f.typ, f.payload, false)
+		if err != nil {
+			t.Fatalf("buildFrame: %v", err)
+		}
+		if !f.fin {
+			b[0] &^= 0x80
+		}
+		wire = append(wire, b...)
+	}
+	var out bytes.Buffer
+	conn := newFramedWSConn(&rwStub{r: bytes.NewReader(wire), w: &out})
+	if _, _, err := conn.Read(context.Background()); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	br := bufio.NewReader(bytes.NewReader(out.Bytes()))
+	typ, payload, _, err := readFrame(br, true)
+	if err != nil || typ != WSMessagePong || string(payload) != "hb" {
+		t.Fatalf("pong: typ=%d payload=%q err=%v", typ, payload, err)
+	}
+	typ, payload, _, err = readFrame(br, true)
+	if err != nil || typ != WSMessageClose || !bytes.Equal(payload, []byte{0x03, 0xe8, 'o', 'k'}) {
+		t.Fatalf("close: typ=%d payload=%q err=%v", typ, payload, err)
+	}
+}
+
+func TestCloseEchoPayload(t *testing.T) {
+	protoErr := []byte{0x03, 0xea} // 1002
+	cases := []struct {
+		name string
+		in   []byte
+		want []byte
+	}{
+		{"empty", nil, nil},
+		{"code and reason", []byte{0x03, 0xe9, 'b', 'y', 'e'}, []byte{0x03, 0xe9, 'b', 'y', 'e'}},
+		{"private code", []byte{0x0f, 0xa0}, []byte{0x0f, 0xa0}},
+		{"one byte", []byte{0x03}, protoErr},
+		{"reserved 1005", []byte{0x03, 0xed}, protoErr},
+		{"below 1000", []byte{0x00, 0x10}, protoErr},
+	}
+	for _, tc := range cases {
+		if got := closeEchoPayload(tc.in); !bytes.Equal(got, tc.want) {
+			t.Fatalf("%s: got % x, want % x", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestFramedWSConn_CloseTruncatesLongReason(t *testing.T) {
+	var out bytes.Buffer
+	conn := newFramedWSConn(&rwStub{r: bytes.NewReader(nil), w: &out})
+	_ = conn.Close(WSStatusNormalClosure, strings.Repeat("x", 200))
+
+	typ, payload := readClientFrame(t, out.Bytes())
+	if typ != WSMessageClose || len(payload) != 125 {
+		t.Fatalf("close frame typ=%d len=%d, want close with 125-byte payload", typ, len(payload))
+	}
+}
+
+// buildFrameReference is the original byte-at-a-time framing, kept to check
+// buildFrame/maskBytes against.
+func buildFrameReference(typ WSMessageType, payload []byte, key [4]byte) []byte {
+	b0 := byte(0x80) | byte(typ&0x0F)
+	var hdr []byte
+	switch plen := len(payload); {
+	case plen < 126:
+		hdr = []byte{b0, byte(plen)}
+	case plen <= 0xFFFF:
+		hdr = []byte{b0, 126, byte(plen >> 8), byte(plen)}
+	default:
+		hdr = make([]byte, 10)
+		hdr[0], hdr[1] = b0, 127
+		for i := 0; i < 8; i++ {
+			hdr[2+i] = byte(uint64(plen) >> (56 - 8*i))
+		}
+	}
+	hdr[1] |= 0x80
+	out := make([]byte, 0, len(hdr)+4+len(payload))
+	out = append(append(out, hdr...), key[:]...)
+	for i, c := range payload {
+		out = append(out, c^key[i%4])
+	}
+	return out
+}
+
+func TestBuildFrame_MatchesReferenceMasking(t *testing.T) {
+	for _, n := range []int{0, 1, 3, 7, 8, 9, 125, 126, 127, 1000, 65535, 65536, 70001} {
+		payload := make([]byte, n)
+		for i := range payload {
+			payload[i] = byte(i*31 + 7)
+		}
+		orig := append([]byte(nil), payload...)
+
+		frame, err := buildFrame(WSMessageBinary, payload, true)
+		if err != nil {
+			t.Fatalf("n=%d: buildFrame: %v", n, err)
+		}
+		if !bytes.Equal(payload, orig) {
+			t.Fatalf("n=%d: buildFrame modified the caller's payload", n)
+		}
+		// Recover the random key from the frame, then compare byte-for-byte.
+		keyOff := len(frame) - n - 4
+		var key [4]byte
+		copy(key[:], frame[keyOff:keyOff+4])
+		if want := buildFrameReference(WSMessageBinary, payload, key); !bytes.Equal(frame, want) {
+			t.Fatalf("n=%d: frame differs from reference implementation", n)
+		}
+
+		unmasked := append([]byte(nil), frame[keyOff+4:]...)
+		maskBytes(key, unmasked)
+		if !bytes.Equal(unmasked, payload) {
+			t.Fatalf("n=%d: maskBytes is not its own inverse", n)
+		}
+	}
+}
+
+func BenchmarkBuildFrame(b *testing.B) {
+	payload := make([]byte, 64*1024)
+	b.Run("word", func(b *testing.B) {
+		b.SetBytes(int64(len(payload)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := buildFrame(WSMessageBinary, payload, true); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("reference", func(b *testing.B) {
+		key := [4]byte{1, 2, 3, 4}
+		b.SetBytes(int64(len(payload)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = buildFrameReference(WSMessageBinary, payload, key)
+		}
+	})
+}
+
+func TestReadFramePooled_MatchesReadFrame(t *testing.T) {
+	var wire bytes.Buffer
+	sizes := []int{0, 5, 125, 126, 4096, 70000}
+	for _, n := range sizes {
+		payload := make([]byte, n)
+		for i := range payload {
+			payload[i] = byte(i*13 + n)
+		}
+		frame, err := buildFrame(WSMessageBinary, payload, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wire.Write(frame)
+	}
+	raw := wire.Bytes()
+
+	plain := bufio.NewReader(bytes.NewReader(raw))
+	pooled := bufio.NewReader(bytes.NewReader(raw))
+	for _, n := range sizes {
+		wantTyp, want, wantFin, err := readFrame(plain, true)
+		if err != nil {
+			t.Fatalf("n=%d: readFrame: %v", n, err)
+		}
+		typ, got, fin, release, err := readFramePooled(pooled, true, wsFrameSafetyCap)
+		if err != nil {
+			t.Fatalf("n=%d: readFramePooled: %v", n, err)
+		}
+		if typ != wantTyp || fin != wantFin || !bytes.Equal(got, want) || len(got) != n {
+			t.Fatalf("n=%d: pooled frame differs: typ=%v fin=%v len=%d", n, typ, fin, len(got))
+		}
+		release()
+	}
+
+	if _, _, _, _, err := readFramePooled(pooled, true, wsFrameSafetyCap); err != io.EOF {
+		t.Fatalf("expected io.EOF after last frame, got %v", err)
+	}
+}
+
+// serverFrame builds an unmasked server->client frame, clearing FIN when
+// fin is false.
+func serverFrame(t testing.TB, typ WSMessageType, data []byte, fin bool) []byte {
+	t.Helper()
+	f, err := buildFrame(typ, data, false)
+	if err != nil {
+		t.Fatalf("buildFrame: %v", err)
+	}
+	if !fin {
+		f[0] &^= 0x80
+	}
+	return f
+}
+
+func TestWSStreamConn_PooledReadsMatchPlainReads(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789"), 7000)
+	var wire []byte
+	for _, f := range [][]byte{
+		serverFrame(t, WSMessagePing, []byte("ka"), true),
+		serverFrame(t, WSMessageBinary, []byte("hello world"), true),
+		serverFrame(t, WSMessageBinary, nil, true),
+		serverFrame(t, WSMessageText, []byte("heartbeat"), true),
+		serverFrame(t, WSMessageBinary, []byte("frag-"), false),
+		serverFrame(t, WSMessagePong, nil, true),
+		serverFrame(t, WSMessageContinuation, []byte("mented"), true),
+		serverFrame(t, WSMessageBinary, big, true),
+	} {
+		wire = append(wire, f...)
+	}
+	want := append([]byte("hello worldfrag-mented"), big...)
+
+	for _, pooled := range []bool{false, true} {
+		SetPooledFrameReads(pooled)
+		var out bytes.Buffer
+		fc := newFramedWSConn(&rwStub{r: bytes.NewReader(wire), w: &out})
+		SetPooledFrameReads(false)
+		if fc.pooled != pooled {
+			t.Fatalf("pooled=%v: framedWSConn.pooled=%v", pooled, fc.pooled)
+		}
+		// The heartbeat wrapper must pass ReadPooled through.
+		var c WSConn = &heartbeatWSConn{WSConn: fc, stop: func() {}}
+		if _, ok := c.(pooledReader); !ok {
+			t.Fatal("heartbeatWSConn does not forward ReadPooled")
+		}
+		sc := NewWSStreamConn(context.Background(), c, "edge-1", "tcp")
+
+		// Small reads leave part of a pooled frame in rb across calls.
+		var got []byte
+		buf := make([]byte, 7)
+		for {
+			n, err := sc.Read(buf)
+			got = append(got, buf[:n]...)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("pooled=%v: Read: %v", pooled, err)
+			}
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("pooled=%v: stream = %d bytes, want %d", pooled, len(got), len(want))
+		}
+		if typ, payload := readClientFrame(t, out.Bytes()); typ != WSMessagePong || string(payload) != "ka" {
+			t.Fatalf("pooled=%v: reply to ping = %d %q", pooled, typ, payload)
+		}
+	}
+}
+
+// loopReader replays b forever.
+type loopReader struct {
+	b   []byte
+	off int
+}
+
+func (r *loopReader) Read(p []byte) (int, error) {
+	n := copy(p, r.b[r.off:])
+	r.off = (r.off + n) % len(r.b)
+	return n, nil
+}
+
+// BenchmarkWSStreamConnRead drives the tunnel read path (WSStreamConn over
+// framedWSConn) with 16 KiB binary frames, with and without pooled reads.
+func BenchmarkWSStreamConnRead(b *testing.B) {
+	frame := serverFrame(b, WSMessageBinary, make([]byte, 16*1024), true)
+	SetWebSocketDebug(false) // TestMain turns it on; payload logging would dominate
+	b.Cleanup(func() { SetWebSocketDebug(true) })
+	for _, mode := range []struct {
+		name   string
+		pooled bool
+	}{{"alloc", false}, {"pooled", true}} {
+		b.Run(mode.name, func(b *testing.B) {
+			SetPooledFrameReads(mode.pooled)
+			fc := newFramedWSConn(&rwStub{r: &loopReader{b: frame}, w: io.Discard})
+			SetPooledFrameReads(false)
+			sc := NewWSStreamConn(context.Background(), fc, "bench", "tcp")
+			buf := make([]byte, 32*1024)
+
+			b.SetBytes(16 * 1024)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// One Read drains one frame: buf is larger than the payload.
+				if _, err := sc.Read(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestFramedWSConn_RejectsOverLimitMessage(t *testing.T) {
+	frame := func(typ WSMessageType, n int, fin bool) []byte {
+		f, err := buildFrame(typ, bytes.Repeat([]byte{0x42}, n), false)
+		if err != nil {
+			t.Fatalf("buildFrame: %v", err)
+		}
+		if !fin {
+			f[0] &^= 0x80
+		}
+		return f
+	}
+	cases := []struct {
+		name string
+		wire []byte
+	}{
+		{"single frame", frame(WSMessageBinary, 2048, true)},
+		{"fragments", append(frame(WSMessageBinary, 800, false), frame(WSMessageContinuation, 800, true)...)},
+	}
+	for _, tc := range cases {
+		var out bytes.Buffer
+		wire := append(frame(WSMessageBinary, 1024, true), tc.wire...)
+		conn := newFramedWSConn(&rwStub{r: bytes.NewReader(wire), w: &out})
+		conn.setReadLimit(1024)
+
+		if _, p, err := conn.Read(context.Background()); err != nil || len(p) != 1024 {
+			t.Fatalf("%s: message at the limit: len=%d err=%v", tc.name, len(p), err)
+		}
+		if _, _, err := conn.Read(context.Background()); !errors.Is(err, ErrMessageTooLarge) {
+			t.Fatalf("%s: over-limit message: err=%v want ErrMessageTooLarge", tc.name, err)
+		}
+		typ, payload := readClientFrame(t, out.Bytes())
+		if typ != WSMessageClose || len(payload) < 2 || WSStatusCode(payload[0])<<8|WSStatusCode(payload[1]) != WSStatusMessageTooBig {
+			t.Fatalf("%s: close sent type=%d payload=% x, want 1009", tc.name, typ, payload)
+		}
+	}
+}
+
+func TestFramedWSConn_PingCountsAsControlNotData(t *testing.T) {
+	metricsMu.Lock()
+	metrics = telemetry{}
+	metricsMu.Unlock()
+	EnablePrometheusMetrics()
+
+	var wire bytes.Buffer
+	for _, f := range []struct {
+		typ  WSMessageType
+		data string
+	}{{WSMessagePing, "keepalive"}, {WSMessageBinary, "hello"}} {
+		frame, err := buildFrame(f.typ, []byte(f.data), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wire.Write(frame)
+	}
+	var out bytes.Buffer
+	sc := NewWSStreamConn(context.Background(), newFramedWSConn(&rwStub{r: &wire, w: &out}), "edge-1", "tcp")
+
+	buf := make([]byte, 16)
+	if n, err := sc.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("Read = %q, %v", buf[:n], err)
+	}
+
+	metrics.mu.RLock()
+	defer metrics.mu.RUnlock()
+	for key, want := range map[string]uint64{
+		"dir=in,kind=data":     5,
+		"dir=in,kind=control":  9, // ping
+		"dir=out,kind=control": 9, // pong echoing it
+		"dir=out,kind=data":    0,
+	} {
+		if got := metrics.wsBytes[key]; got != want {
+			t.Fatalf("ws bytes{%s}=%d want %d", key, got, want)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	"net/netip"
 	"net/url"
 	"sort"
 	"strings"
@@ -225,7 +226,7 @@ func dialRFC9220(ctx context.Context, u *url.URL) (WSConn, error) {
 			break
 		}
 		if i+1 < len(profiles) {
-			wsDebugf("h3: retrying rfc9220 dial with alternate client stream profile=%d after peer frame-order error", profiles[i+1])
+			wsTracef(ctx, "h3: retrying rfc9220 dial with alternate client stream profile=%d after peer frame-order error", profiles[i+1])
 		}
 	}
 	return nil, lastErr
@@ -233,10 +234,14 @@ func dialRFC9220(ctx context.Context, u *url.URL) (WSConn, error) {
 
 func dialRFC9220Profile(ctx context.Context, u *url.URL, profile h3ClientStreamProfile) (WSConn, error) {
 	if u.Scheme != "wss" && u.Scheme != "https" {
-		return nil, fmt.Errorf("rfc9220 requires wss/https, got %q", u.Scheme)
+		return nil, fmt.Errorf("%w: rfc9220 requires wss/https, got %q", ErrH3NotSupported, u.Scheme)
 	}
 	h3BaseCtx := ctx
 	effectiveH3Timeout := h3HandshakeTimeout
+	if u.Query().Get(dialTimeoutHint) != "" {
+		// An explicit per-upstream dial_timeout replaces the QUIC default.
+		effectiveH3Timeout = wsDialTimeout(u.Query())
+	}
 	if ddl, ok := ctx.Deadline(); ok {
 		if rem := time.Until(ddl); rem > 0 && rem < effectiveH3Timeout {
 			// Some call sites use short per-attempt deadlines (~3s) that are too
@@ -247,6 +252,14 @@ func dialRFC9220Profile(ctx context.Context, u *url.URL, profile h3ClientStreamP
 	}
 	h3ctx, h3cancel := context.WithTimeout(h3BaseCtx, effectiveH3Timeout)
 	defer h3cancel()
+	// timedOut tags err with ErrH3HandshakeTimeout once the h3 deadline
+	// (not the caller) has ended the attempt.
+	timedOut := func(err error) error {
+		if errors.Is(h3ctx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+			return fmt.Errorf("%w: %w", ErrH3HandshakeTimeout, err)
+		}
+		return err
+	}
 	if h3BaseCtx != ctx {
 		go func(parent context.Context) {
 			<-parent.Done()
@@ -269,27 +282,39 @@ func dialRFC9220Profile(ctx context.Context, u *url.URL, profile h3ClientStreamP
 		authority = host
 	}
 	dialAddr := net.JoinHostPort(host, port)
-	wsDebugf("h3: prepare dial host=%q port=%q authority=%q dial_addr=%q timeout=%s url=%q", host, port, authority, dialAddr, effectiveH3Timeout, u.Redacted())
+	wsTracef(ctx, "h3: prepare dial host=%q port=%q authority=%q dial_addr=%q timeout=%s url=%q", host, port, authority, dialAddr, effectiveH3Timeout, u.Redacted())
 
-	tlsConf := &tls.Config{MinVersion: tls.VersionTLS13, ServerName: host, NextProtos: []string{"h3"}}
-	qcConf := &quic.Config{TLSConfig: tlsConf}
+	tlsConf := withUpstreamTLS(&tls.Config{MinVersion: tls.VersionTLS13, ServerName: host, NextProtos: []string{"h3"}})
+	qcConf := h3QUICConfig(u, tlsConf)
 	if wsDebugEnabled.Load() {
 		qcConf.QLogLogger = slog.New(&h3QlogDebugHandler{})
-		wsDebugf("h3: qlog packet tracing enabled (first %d sent/recv packets)", h3QlogFirstPackets)
+		wsTracef(ctx, "h3: qlog packet tracing enabled (first %d sent/recv packets)", h3QlogFirstPackets)
 	}
 	ep, err := quic.Listen("udp", ":0", qcConf)
 	if err != nil {
-		wsDebugf("h3: quic listen failed err=%v", err)
+		wsTracef(ctx, "h3: quic listen failed err=%v", err)
 		return nil, err
 	}
-	wsDebugf("h3: quic endpoint ready, dialing addr=%q sni=%q alpn=%v", dialAddr, tlsConf.ServerName, tlsConf.NextProtos)
-	qconn, err := ep.Dial(h3ctx, "udp", dialAddr, qcConf)
+	wsTracef(ctx, "h3: quic endpoint ready, dialing addr=%q sni=%q alpn=%v", dialAddr, tlsConf.ServerName, tlsConf.NextProtos)
+	network := "udp" + wsAddressFamily(u.Query())
+	var qconn *quic.Conn
+	if addrs := cachedDialAddrs(network, host); addrs != nil {
+		// Same addresses and Happy Eyeballs racing as the TCP transports.
+		wsTracef(ctx, "h3: dialing cached addrs=%v", addrs)
+		qconn, err = raceDials(h3ctx, addrs, happyEyeballsDelay, func(dctx context.Context, a netip.Addr) (*quic.Conn, error) {
+			return ep.Dial(dctx, network, net.JoinHostPort(a.String(), port), qcConf)
+		})
+	} else {
+		qconn, err = ep.Dial(h3ctx, network, dialAddr, qcConf)
+	}
 	if err != nil {
-		wsDebugf("h3: quic dial failed addr=%q err=%s", dialAddr, h3DescribeErr(err))
-		_ = ep.Close(context.Background())
-		return nil, err
+		wsTracef(ctx, "h3: quic dial failed addr=%q err=%s", dialAddr, h3DescribeErr(err))
+		// Closing waits out the dead connection's drain period; do not hold
+		// up the next transport rung for it.
+		go func() { _ = ep.Close(context.Background()) }()
+		return nil, timedOut(wrapTLSError(err))
 	}
-	wsDebugf("h3: quic dial established addr=%q", dialAddr)
+	wsTracef(ctx, "h3: quic dial established addr=%q", dialAddr)
 	obs := newH3PeerObservations()
 	peerDrainCancel := startH3PeerStreamDrainer(qconn, obs)
 	h3Established := false
@@ -301,32 +326,43 @@ func dialRFC9220Profile(ctx context.Context, u *url.URL, profile h3ClientStreamP
 	}()
 
 	if err := h3OpenClientUniStreams(h3ctx, qconn, profile); err != nil {
-		wsDebugf("h3: open client uni streams failed err=%v", err)
-		return nil, err
+		wsTracef(ctx, "h3: open client uni streams failed err=%v", err)
+		return nil, timedOut(err)
 	}
-	wsDebugf("h3: client streams initialized profile=%d (%s)", profile, h3ProfileName(profile))
+	wsTracef(ctx, "h3: client streams initialized profile=%d (%s)", profile, h3ProfileName(profile))
 
 	st, err := qconn.NewStream(h3ctx)
 	if err != nil {
-		wsDebugf("h3: open request stream failed err=%v", err)
-		return nil, err
+		wsTracef(ctx, "h3: open request stream failed err=%v", err)
+		return nil, timedOut(err)
 	}
-	wsDebugf("h3: request stream opened")
+	wsTracef(ctx, "h3: request stream opened")
 
-	headers := h3ConnectHeaders(u, authority)
+	fields := h3ConnectHeaderFields(u, authority)
+	if cred, ok := handshakeCredFrom(ctx); ok {
+		fields = cred.fields(fields) // the trace below logs the fields without it
+	}
+	var key string
+	if requireAccept(u.Query()) {
+		if key, err = newWebSocketKey(); err != nil {
+			return nil, err
+		}
+		fields = append(fields, [2]string{"sec-websocket-key", key})
+	}
+	headers := h3EncodeHeaders(fields)
 	requestFrame := appendVarint(nil, h3FrameHeaders)
 	requestFrame = appendVarint(requestFrame, uint64(len(headers)))
 	requestFrame = append(requestFrame, headers...)
-	wsDebugf("h3: request CONNECT headers=%s", h3FormatHeaders(h3ConnectHeaderMap(u, authority)))
-	wsDebugf("h3: writing HEADERS frame total_len=%d (field_section_len=%d)", len(requestFrame), len(headers))
+	wsTracef(ctx, "h3: request CONNECT headers=%s", h3FormatHeaders(h3ConnectHeaderMap(u, authority)))
+	wsTracef(ctx, "h3: writing HEADERS frame total_len=%d (field_section_len=%d)", len(requestFrame), len(headers))
 	if err := h3WriteWithContext(h3ctx, st, requestFrame); err != nil {
-		wsDebugf("h3: write HEADERS frame failed err=%v", err)
-		return nil, err
+		wsTracef(ctx, "h3: write HEADERS frame failed err=%v", err)
+		return nil, timedOut(err)
 	}
 	// x/net/quic may buffer stream data until scheduler tick; force flushing the
 	// CONNECT request headers so the server can respond promptly.
 	_ = st.Flush()
-	wsDebugf("h3: request headers sent, flushed, waiting response")
+	wsTracef(ctx, "h3: request headers sent, flushed, waiting response")
 	// IMPORTANT: do NOT close the client request stream here.
 	//
 	// RFC 9220 upgrades this very stream into a bidirectional WebSocket data
@@ -350,33 +386,58 @@ func dialRFC9220Profile(ctx context.Context, u *url.URL, profile h3ClientStreamP
 	select {
 	case <-h3ctx.Done():
 		elapsed := time.Since(handshakeStarted)
-		wsDebugf("h3: timeout/cancel while waiting response after %s (authority=%q path=%q err=%v)", elapsed, authority, cleanedRequestURI(u), h3ctx.Err())
+		wsTracef(ctx, "h3: timeout/cancel while waiting response after %s (authority=%q path=%q err=%v)", elapsed, authority, cleanedRequestURI(u), h3ctx.Err())
 		_ = qconn.Close()
 		_ = ep.Close(context.Background())
 		if errors.Is(h3ctx.Err(), context.DeadlineExceeded) {
-			return nil, fmt.Errorf("rfc9220 handshake timeout waiting response headers after %s", elapsed)
+			return nil, timedOut(fmt.Errorf("waiting response headers after %s: %w", elapsed, context.DeadlineExceeded))
 		}
 		return nil, h3ctx.Err()
 	case err := <-errCh:
 		if hint := h3PeerSupportHint(err, obs); hint != "" {
-			wsDebugf("h3: read response headers failed hint=%s", hint)
-			wsDebugf("h3: read response headers failed err=%s", h3DescribeErr(err))
-			return nil, fmt.Errorf("rfc9220 unsupported by peer: %s", hint)
+			wsTracef(ctx, "h3: read response headers failed hint=%s", hint)
+			wsTracef(ctx, "h3: read response headers failed err=%s", h3DescribeErr(err))
+			return nil, fmt.Errorf("%w: rfc9220 unsupported by peer: %s", ErrH3NotSupported, hint)
 		}
-		wsDebugf("h3: read response headers failed err=%s", h3DescribeErr(err))
+		wsTracef(ctx, "h3: read response headers failed err=%s", h3DescribeErr(err))
 		return nil, err
 	case resp = <-respCh:
 	}
-	wsDebugf("h3: response status=%q headers=%s", resp[":status"], h3FormatHeaders(resp))
+	wsTracef(ctx, "h3: response status=%q headers=%s", resp[":status"], h3FormatHeaders(resp))
 	if resp[":status"] != "200" {
-		return nil, fmt.Errorf("rfc9220 connect failed: status=%s headers=%s", resp[":status"], h3FormatHeaders(resp))
+		return nil, fmt.Errorf("%w: rfc9220 connect failed: status=%s headers=%s", ErrHandshakeRejected, resp[":status"], h3FormatHeaders(resp))
 	}
-	if got := resp["sec-websocket-accept"]; got != "" {
-		wsDebugf("h3: server returned optional sec-websocket-accept=%q", got)
+	if err := checkSubprotocol(u.Query().Get("subprotocol"), resp["sec-websocket-protocol"]); err != nil {
+		return nil, err
 	}
-	wsDebugf("h3: websocket CONNECT established")
+	if key != "" {
+		if err := checkAccept(u.Query(), key, resp["sec-websocket-accept"]); err != nil {
+			return nil, fmt.Errorf("%w: rfc9220: %w", ErrHandshakeRejected, err)
+		}
+	} else if got := resp["sec-websocket-accept"]; got != "" {
+		wsTracef(ctx, "h3: server returned optional sec-websocket-accept=%q", got)
+	}
+	wsTracef(ctx, "h3: websocket CONNECT established")
 	h3Established = true
-	return newFramedWSConn(&h3wsStream{s: st, qconn: qconn, ep: ep, stopPeerDrainer: peerDrainCancel}), nil
+	c := newFramedWSConn(&h3wsStream{s: st, qconn: qconn, ep: ep, stopPeerDrainer: peerDrainCancel})
+	c.transport = "h3"
+	return c, nil
+}
+
+// h3QUICConfig builds the quic.Config of an h3 dial from the upstream's
+// quic_params hint.
+func h3QUICConfig(u *url.URL, tlsConf *tls.Config) *quic.Config {
+	p := parseQUICHint(u.Query().Get(quicParamsHint))
+	return &quic.Config{
+		TLSConfig:                tlsConf,
+		MaxIdleTimeout:           p.MaxIdleTimeout,
+		KeepAlivePeriod:          p.KeepAlivePeriod,
+		MaxBidiRemoteStreams:     p.MaxBidiStreams,
+		MaxUniRemoteStreams:      p.MaxUniStreams,
+		MaxStreamReadBufferSize:  p.StreamReadBuffer,
+		MaxStreamWriteBufferSize: p.StreamWriteBuffer,
+		MaxConnReadBufferSize:    p.ConnReadBuffer,
+	}
 }
 
 func startH3PeerStreamDrainer(c *quic.Conn, obs *h3PeerObservations) context.CancelFunc {
@@ -501,6 +562,9 @@ func h3ConnectHeaderFields(u *url.URL, authority string) [][2]string {
 	if origin := u.Query().Get("origin"); origin != "" {
 		fields = append(fields, [2]string{"origin", origin})
 	}
+	if subprotocol := u.Query().Get("subprotocol"); subprotocol != "" {
+		fields = append(fields, [2]string{"sec-websocket-protocol", subprotocol})
+	}
 	return fields
 }
 
@@ -694,7 +758,7 @@ func h3FormatHeaders(h map[string]string) string {
 	sort.Strings(keys)
 	parts := make([]string, 0, len(keys))
 	for _, k := range keys {
-		v := h[k]
+		v := headerDumpValue(k, h[k])
 		if len(v) > 128 {
 			v = v[:128] + "..."
 		}
@@ -6,6 +6,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/url"
@@ -180,3 +181,80 @@ func TestH3PeerSupportHint_WaitsForLateSettingsObservation(t *testing.T) {
 		t.Fatalf("expected remediation in delayed hint, got %q", hint)
 	}
 }
+
+func TestH3ConnectHeaders_Subprotocol(t *testing.T) {
+	u, err := url.Parse(withDialHint("wss://example.com/tcp?h3=only", "subprotocol", "outline.v1"))
+	if err != nil {
+		t.Fatalf("parse url: %v", err)
+	}
+
+	headers, err := h3DecodeHeaders(h3ConnectHeaders(u, u.Host))
+	if err != nil {
+		t.Fatalf("decode headers: %v", err)
+	}
+	if got := headers["sec-websocket-protocol"]; got != "outline.v1" {
+		t.Fatalf("sec-websocket-protocol=%q want outline.v1", got)
+	}
+	if got := headers[":path"]; got != "/tcp" {
+		t.Fatalf(":path=%q, subprotocol hint must not reach the server", got)
+	}
+}
+
+func TestH3QUICConfig_UpstreamSettingsReachQUICConfig(t *testing.T) {
+	up := UpstreamConfig{QUIC: QUICConfig{MaxIdleTimeout: 90 * time.Second, KeepAlivePeriod: 15 * time.Second, MaxBidiStreams: 8, ConnReadBuffer: 4 << 20}}
+	u, err := url.Parse(upstreamDialURL("wss://example.com/tcp?h3=only", up))
+	if err != nil {
+		t.Fatal(err)
+	}
+	qc := h3QUICConfig(u, nil)
+	if qc.MaxIdleTimeout != 90*time.Second || qc.KeepAlivePeriod != 15*time.Second {
+		t.Fatalf("idle=%s keepalive=%s, want 1m30s and 15s", qc.MaxIdleTimeout, qc.KeepAlivePeriod)
+	}
+	if qc.MaxBidiRemoteStreams != 8 || qc.MaxConnReadBufferSize != 4<<20 {
+		t.Fatalf("bidi=%d conn_rbuf=%d", qc.MaxBidiRemoteStreams, qc.MaxConnReadBufferSize)
+	}
+	if qc.MaxUniRemoteStreams != 0 || qc.MaxStreamReadBufferSize != 0 {
+		t.Fatal("unset fields must keep the library defaults (0)")
+	}
+	if strings.Contains(cleanedRequestURI(u), "quic_params") {
+		t.Fatalf(":path leaks the quic_params hint: %s", cleanedRequestURI(u))
+	}
+
+	if qc := h3QUICConfig(&url.URL{Path: "/tcp"}, nil); qc.MaxIdleTimeout != 0 || qc.KeepAlivePeriod != 0 {
+		t.Fatal("no quic settings must leave the defaults")
+	}
+}
+
+func TestDialRFC9220_UsesCachedUpstreamAddrs(t *testing.T) {
+	// The host does not resolve; only the refresh cache knows it. A silent
+	// UDP socket stands in for the server, so the handshake times out once
+	// the first Initial packet has reached the cached address.
+	r := useFakeResolver(t)
+	const host = "h3.dns-refresh.test"
+	r.set(host, "127.0.0.1")
+	if _, _, err := upstreamDNS.refresh(context.Background(), host, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+
+	got := make(chan int, 1)
+	go func() {
+		buf := make([]byte, 2048)
+		_ = pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, _ := pc.ReadFrom(buf)
+		got <- n
+	}()
+
+	u, _ := url.Parse(fmt.Sprintf("wss://%s:%d/tcp?dial_timeout=300ms", host, port))
+	if _, err := dialRFC9220(context.Background(), u); !errors.Is(err, ErrH3HandshakeTimeout) {
+		t.Fatalf("dialRFC9220 err=%v, want a handshake timeout against the cached address", err)
+	}
+	if n := <-got; n == 0 {
+		t.Fatal("no QUIC packet reached the cached address")
+	}
+}
@@ -0,0 +1,749 @@
+//go:build !unit
+
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// testTLSCert borrows httptest's certificate (valid for 127.0.0.1) and
+// returns it with a client transport that trusts it.
+func testTLSCert(t *testing.T) (tls.Certificate, *http.Transport) {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	cert := srv.TLS.Certificates[0]
+	tr := srv.Client().Transport.(*http.Transport).Clone()
+	srv.Close()
+	return cert, tr
+}
+
+// rfc8441TestServer is an in-process HTTP/2 server speaking just enough of
+// RFC 8441 for one Extended CONNECT stream: it answers with status and, on
+// 200, echoes every WebSocket message back unmasked.
+type rfc8441TestServer struct {
+	ln       net.Listener
+	status   string
+	noEnable bool              // omit SETTINGS_ENABLE_CONNECT_PROTOCOL
+	extra    map[string]string // response headers sent besides :status
+	accept   bool              // answer sec-websocket-key with its accept
+	delay    time.Duration     // wait before answering the CONNECT
+
+	mu      sync.Mutex
+	request map[string]string // pseudo and regular headers of the CONNECT
+}
+
+func newRFC8441TestServer(t *testing.T, cert tls.Certificate, status string, noEnable bool) *rfc8441TestServer {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &rfc8441TestServer{ln: ln, status: status, noEnable: noEnable}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *rfc8441TestServer) url(path string) *url.URL {
+	return &url.URL{Scheme: "wss", Host: s.ln.Addr().String(), Path: path}
+}
+
+func (s *rfc8441TestServer) headers() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.request
+}
+
+func (s *rfc8441TestServer) serve(c net.Conn) {
+	defer c.Close()
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(c, preface); err != nil || string(preface) != http2.ClientPreface {
+		return
+	}
+	fr := http2.NewFramer(c, c)
+	fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	var wmu sync.Mutex
+	write := func(fn func() error) error {
+		wmu.Lock()
+		defer wmu.Unlock()
+		return fn()
+	}
+
+	var settings []http2.Setting
+	if !s.noEnable {
+		settings = append(settings, http2.Setting{ID: 0x8, Val: 1}) // SETTINGS_ENABLE_CONNECT_PROTOCOL
+	}
+	if err := write(func() error { return fr.WriteSettings(settings...) }); err != nil {
+		return
+	}
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			return
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				_ = write(fr.WriteSettingsAck)
+			}
+		case *http2.MetaHeadersFrame:
+			req := map[string]string{}
+			for _, hf := range f.Fields {
+				req[hf.Name] = hf.Value
+			}
+			s.mu.Lock()
+			s.request = req
+			s.mu.Unlock()
+			time.Sleep(s.delay)
+
+			var hb bytes.Buffer
+			enc := hpack.NewEncoder(&hb)
+			_ = enc.WriteField(hpack.HeaderField{Name: ":status", Value: s.status})
+			for k, v := range s.extra {
+				_ = enc.WriteField(hpack.HeaderField{Name: k, Value: v})
+			}
+			if key := req["sec-websocket-key"]; s.accept && key != "" {
+				_ = enc.WriteField(hpack.HeaderField{Name: "sec-websocket-accept", Value: computeAccept(key)})
+			}
+			ok := strings.HasPrefix(s.status, "2")
+			if err := write(func() error {
+				return fr.WriteHeaders(http2.HeadersFrameParam{StreamID: f.StreamID, BlockFragment: hb.Bytes(), EndHeaders: true, EndStream: !ok})
+			}); err != nil || !ok {
+				continue
+			}
+			go echoWSFrames(pr, func(frame []byte) error {
+				return write(func() error { return fr.WriteData(f.StreamID, false, frame) })
+			})
+		case *http2.DataFrame:
+			if len(f.Data()) > 0 {
+				if _, err := pw.Write(f.Data()); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// echoWSFrames reads masked client frames from r and sends each back
+// unmasked through send.
+func echoWSFrames(r io.Reader, send func([]byte) error) {
+	br := bufio.NewReader(r)
+	for {
+		typ, payload, _, err := readFrame(br, true)
+		if err != nil {
+			return
+		}
+		frame, err := buildFrame(typ, payload, false)
+		if err != nil || send(frame) != nil {
+			return
+		}
+	}
+}
+
+func TestDialRFC8441_HandshakeAndEchoInProcess(t *testing.T) {
+	cert, tr := testTLSCert(t)
+	srv := newRFC8441TestServer(t, cert, "200", false)
+	u := srv.url("/tcp")
+	u.RawQuery = "subprotocol=&h2=only"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := dialRFC8441(ctx, u, tr)
+	if err != nil {
+		t.Fatalf("dialRFC8441: %v", err)
+	}
+	defer c.Close(WSStatusNormalClosure, "")
+
+	req := srv.headers()
+	if req[":method"] != "CONNECT" || req[":protocol"] != "websocket" || req[":path"] != "/tcp" {
+		t.Fatalf("unexpected CONNECT headers: %v", req)
+	}
+
+	msg := bytes.Repeat([]byte{0xAB}, 300) // > 125 bytes: extended length
+	if err := c.Write(ctx, WSMessageBinary, msg); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	typ, got, err := c.Read(ctx)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if typ != WSMessageBinary || !bytes.Equal(got, msg) {
+		t.Fatalf("echo mismatch: type=%v len=%d", typ, len(got))
+	}
+}
+
+func TestDialRFC8441_RejectedHandshakeInProcess(t *testing.T) {
+	cert, tr := testTLSCert(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := newRFC8441TestServer(t, cert, "403", false)
+	if _, err := dialRFC8441(ctx, srv.url("/tcp"), tr); !errors.Is(err, errRFC8441HandshakeFailed) || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("403 response: err=%v want errRFC8441HandshakeFailed", err)
+	}
+
+	srv = newRFC8441TestServer(t, cert, "200", true)
+	if _, err := dialRFC8441(ctx, srv.url("/tcp"), tr); !errors.Is(err, ErrH2NotSupported) {
+		t.Fatalf("server without extended CONNECT: err=%v want ErrH2NotSupported", err)
+	}
+}
+
+func TestDialRFC8441_AcceptStatusAndRejectionHeaders(t *testing.T) {
+	cert, tr := testTLSCert(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := newRFC8441TestServer(t, cert, "403", false)
+	srv.extra = map[string]string{"server": "edge-proxy", "cf-ray": "8a1b2c", "set-cookie": "session=s3cr3t"}
+	_, err := dialRFC8441(ctx, srv.url("/tcp"), tr)
+	if !errors.Is(err, ErrHandshakeRejected) {
+		t.Fatalf("403 response: err=%v want ErrHandshakeRejected", err)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "403") || !strings.Contains(msg, "cf-ray: 8a1b2c; server: edge-proxy; set-cookie: [redacted]") {
+		t.Fatalf("rejection error lacks status or response headers: %q", msg)
+	}
+	if strings.Contains(err.Error(), "s3cr3t") {
+		t.Fatalf("rejection error leaks the cookie: %q", err)
+	}
+
+	srv = newRFC8441TestServer(t, cert, "204", false)
+	if _, err := dialRFC8441(ctx, srv.url("/tcp"), tr); !errors.Is(err, ErrHandshakeRejected) || !strings.Contains(err.Error(), "204") {
+		t.Fatalf("204 without accept_status: err=%v want rejection", err)
+	}
+	u := srv.url("/tcp")
+	u.RawQuery = "accept_status=200,204"
+	c, err := dialRFC8441(ctx, u, tr)
+	if err != nil {
+		t.Fatalf("204 with accept_status=200,204: %v", err)
+	}
+	_ = c.Close(WSStatusNormalClosure, "")
+	if p := srv.headers()[":path"]; p != "/tcp" {
+		t.Fatalf("accept_status hint leaked into :path: %q", p)
+	}
+}
+
+func TestDialRFC8441_RequireAccept(t *testing.T) {
+	cert, tr := testTLSCert(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for name, dial := range map[string]func(context.Context, *url.URL, *http.Transport) (WSConn, error){
+		"stdlib": dialRFC8441,
+		"raw":    dialRFC8441RawH2,
+	} {
+		srv := newRFC8441TestServer(t, cert, "200", false)
+		lenient, strict := srv.url("/tcp"), srv.url("/tcp")
+		strict.RawQuery = "require_accept=1"
+
+		// Lenient (default): a server that omits the header is accepted.
+		c, err := dial(ctx, lenient, tr)
+		if err != nil {
+			t.Fatalf("%s lenient without accept: %v", name, err)
+		}
+		_ = c.Close(WSStatusNormalClosure, "")
+
+		_, err = dial(ctx, strict, tr)
+		if !errors.Is(err, errMissingAccept) || !errors.Is(err, ErrHandshakeRejected) {
+			t.Fatalf("%s strict without accept: err=%v, want errMissingAccept", name, err)
+		}
+		if srv.headers()["sec-websocket-key"] == "" {
+			t.Fatalf("%s strict handshake sent no sec-websocket-key", name)
+		}
+
+		srv.accept = true
+		c, err = dial(ctx, strict, tr)
+		if err != nil {
+			t.Fatalf("%s strict with matching accept: %v", name, err)
+		}
+		_ = c.Close(WSStatusNormalClosure, "")
+		if p := srv.headers()[":path"]; p != "/tcp" {
+			t.Fatalf("%s: require_accept hint leaked into :path: %q", name, p)
+		}
+
+		// A wrong accept fails whenever a key was sent: always on the raw
+		// path, only with require_accept on the stdlib one.
+		srv.accept = false
+		srv.extra = map[string]string{"sec-websocket-accept": "bm90IHRoZSBhY2NlcHQ="}
+		if _, err := dial(ctx, strict, tr); !errors.Is(err, ErrHandshakeRejected) {
+			t.Fatalf("%s strict with wrong accept: err=%v, want rejection", name, err)
+		}
+		c, err = dial(ctx, lenient, tr)
+		if name == "raw" && !errors.Is(err, ErrHandshakeRejected) {
+			t.Fatalf("raw lenient with wrong accept: err=%v, want rejection", err)
+		}
+		if err == nil {
+			_ = c.Close(WSStatusNormalClosure, "")
+		}
+	}
+}
+
+func TestDialRFC8441_RecordsPhaseTimings(t *testing.T) {
+	metricsMu.Lock()
+	metrics = telemetry{}
+	metricsMu.Unlock()
+	EnablePrometheusMetrics()
+
+	cert, tr := testTLSCert(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	const delay = 150 * time.Millisecond
+
+	for name, dial := range map[string]func(context.Context, *url.URL, *http.Transport) (WSConn, error){
+		"stdlib": dialRFC8441,
+		"raw":    dialRFC8441RawH2,
+	} {
+		srv := newRFC8441TestServer(t, cert, "200", false)
+		srv.delay = delay
+		u := srv.url("/tcp")
+		c, err := dial(ctx, u, tr)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		_ = c.Close(WSStatusNormalClosure, "")
+
+		metrics.mu.RLock()
+		phase := func(p string) (uint64, time.Duration) {
+			k := fmt.Sprintf("upstream=%s,transport=h2,phase=%s", u.Host, p)
+			return metrics.dialPhaseCnt[k], time.Duration(metrics.dialPhaseSum[k] * float64(time.Second))
+		}
+		for _, p := range []string{dialPhaseConnect, dialPhaseTLS, dialPhaseHandshake} {
+			n, d := phase(p)
+			if n != 1 {
+				t.Errorf("%s: phase %s recorded %d times, want 1", name, p, n)
+			}
+			// Only the handshake waits on the server's delay.
+			if slow := d >= delay; slow != (p == dialPhaseHandshake) {
+				t.Errorf("%s: phase %s took %s with the CONNECT answer delayed %s", name, p, d, delay)
+			}
+		}
+		metrics.mu.RUnlock()
+	}
+}
+
+func newH1EchoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/tcp" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.CloseNow()
+		for {
+			typ, data, err := c.Read(r.Context())
+			if err != nil {
+				return
+			}
+			if err := c.Write(r.Context(), typ, data); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDialWSStream_KeepsDialHintsFromServer(t *testing.T) {
+	const hints = "x=1&subprotocol=&dial_timeout=3s&max_message=4096&accept_status=200&transport=h1&address_family=ipv4"
+
+	var mu sync.Mutex
+	var gotQuery string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		gotQuery = r.URL.RawQuery
+		mu.Unlock()
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		_ = c.CloseNow()
+	}))
+	t.Cleanup(srv.Close)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writeCertPEM(t, caFile, srv.Certificate().Raw)
+	if err := LoadTLSMaterial(TLSConfig{CAFile: caFile}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = LoadTLSMaterial(TLSConfig{}) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := DialWSStream(ctx, "wss"+strings.TrimPrefix(srv.URL, "https")+"/tcp?"+hints, 0)
+	if err != nil {
+		t.Fatalf("h1: %v", err)
+	}
+	_ = c.Close(WSStatusNormalClosure, "")
+	mu.Lock()
+	if gotQuery != "x=1" {
+		t.Errorf("h1 server saw query %q, want x=1", gotQuery)
+	}
+	mu.Unlock()
+
+	cert, tr := testTLSCert(t)
+	h2 := newRFC8441TestServer(t, cert, "200", false)
+	u := h2.url("/tcp")
+	u.RawQuery = hints
+	c, err = dialRFC8441(ctx, u, tr)
+	if err != nil {
+		t.Fatalf("h2: %v", err)
+	}
+	_ = c.Close(WSStatusNormalClosure, "")
+	if p := h2.headers()[":path"]; p != "/tcp?x=1" {
+		t.Errorf("h2 server saw :path %q, want /tcp?x=1", p)
+	}
+}
+
+func TestDialCoderWebSocket_HandshakeAndEchoInProcess(t *testing.T) {
+	srv := newH1EchoServer(t)
+	tr := srv.Client().Transport.(*http.Transport).Clone()
+	base := "wss://" + strings.TrimPrefix(srv.URL, "https://")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := dialCoderWebSocket(ctx, base+"/tcp", tr, "")
+	if err != nil {
+		t.Fatalf("dialCoderWebSocket: %v", err)
+	}
+	defer c.Close(WSStatusNormalClosure, "")
+	msg := []byte("hello over h1")
+	if err := c.Write(ctx, WSMessageBinary, msg); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if typ, got, err := c.Read(ctx); err != nil || typ != WSMessageBinary || !bytes.Equal(got, msg) {
+		t.Fatalf("echo: type=%v got=%q err=%v", typ, got, err)
+	}
+
+	if _, err := dialCoderWebSocket(ctx, base+"/nope", tr, ""); !errors.Is(err, ErrHandshakeRejected) {
+		t.Fatalf("rejected upgrade: err=%v want ErrHandshakeRejected", err)
+	}
+}
+
+func TestDialWSStream_MaxMessageHintLimitsCoderReads(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.CloseNow()
+		for _, n := range []int{1024, 2048} {
+			if err := c.Write(r.Context(), websocket.MessageBinary, make([]byte, n)); err != nil {
+				return
+			}
+		}
+		_, _, _ = c.Read(r.Context())
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := DialWSStream(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+"/tcp?max_message=1024", 0)
+	if err != nil {
+		t.Fatalf("DialWSStream: %v", err)
+	}
+	defer c.Close(WSStatusNormalClosure, "")
+	if _, p, err := c.Read(ctx); err != nil || len(p) != 1024 {
+		t.Fatalf("message at the limit: len=%d err=%v", len(p), err)
+	}
+	if _, _, err := c.Read(ctx); err == nil {
+		t.Fatal("over-limit message was accepted")
+	}
+}
+
+func TestDialWSStream_ReportsNegotiatedTransport(t *testing.T) {
+	metricsMu.Lock()
+	metrics = telemetry{}
+	metricsMu.Unlock()
+	EnablePrometheusMetrics()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.CloseNow()
+		_, _, _ = c.Read(r.Context())
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// h2 is tried first, but the server only speaks HTTP/1.1: the ladder falls back.
+	c, err := DialWSStream(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+"/tcp?transport=h2,h1", 0)
+	if err != nil {
+		t.Fatalf("DialWSStream: %v", err)
+	}
+	if got := NegotiatedTransport(c); got != "h1" {
+		t.Fatalf("NegotiatedTransport=%q want h1 after h2 fallback", got)
+	}
+
+	metrics.mu.RLock()
+	var dials, active []string
+	for k := range metrics.wsDialCount {
+		dials = append(dials, k)
+	}
+	for k, v := range metrics.wsConnsActive {
+		if v != 0 {
+			active = append(active, k)
+		}
+	}
+	metrics.mu.RUnlock()
+	if len(dials) != 1 || !strings.HasSuffix(dials[0], ",transport=h1") {
+		t.Fatalf("dial series %v, want one with transport=h1", dials)
+	}
+	if len(active) != 1 || !strings.HasSuffix(active[0], ",transport=h1") {
+		t.Fatalf("active series %v, want one with transport=h1", active)
+	}
+
+	_ = c.Close(WSStatusNormalClosure, "")
+	_ = c.Close(WSStatusNormalClosure, "") // a second Close must not count twice
+	metrics.mu.RLock()
+	left := metrics.wsConnsActive[active[0]]
+	metrics.mu.RUnlock()
+	if left != 0 {
+		t.Fatalf("active %s=%v after Close, want 0", active[0], left)
+	}
+
+	cert, tr := testTLSCert(t)
+	h2 := newRFC8441TestServer(t, cert, "200", false)
+	h2c, err := dialRFC8441(ctx, h2.url("/tcp"), tr)
+	if err != nil {
+		t.Fatalf("dialRFC8441: %v", err)
+	}
+	defer h2c.Close(WSStatusNormalClosure, "")
+	if got := NegotiatedTransport(h2c); got != "h2" {
+		t.Fatalf("NegotiatedTransport=%q want h2", got)
+	}
+}
+
+func TestDialWSStream_H2NotSupportedFallbackIsCountedAndReported(t *testing.T) {
+	metricsMu.Lock()
+	metrics = telemetry{}
+	metricsMu.Unlock()
+	EnablePrometheusMetrics()
+
+	// An HTTP/1.1-only TLS server: ALPN never offers h2, so the RFC 8441
+	// attempt fails as not supported and the dial falls back to h1.
+	srv := newH1EchoServer(t)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writeCertPEM(t, caFile, srv.Certificate().Raw)
+	if err := LoadTLSMaterial(TLSConfig{CAFile: caFile}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = LoadTLSMaterial(TLSConfig{}) })
+
+	rawurl := "wss" + strings.TrimPrefix(srv.URL, "https") + "/tcp?h2=1"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := DialWSStream(ctx, rawurl, 0)
+	if err != nil {
+		t.Fatalf("DialWSStream: %v", err)
+	}
+	_ = c.Close(WSStatusNormalClosure, "")
+	if got := NegotiatedTransport(c); got != "h1" {
+		t.Fatalf("NegotiatedTransport=%q, want h1", got)
+	}
+
+	host := strings.TrimPrefix(srv.URL, "https://")
+	metrics.mu.RLock()
+	n := metrics.fallbacks["upstream="+host+",from=h2,to=h1"]
+	metrics.mu.RUnlock()
+	if n != 1 {
+		t.Fatalf("fallback counter = %d, want 1", n)
+	}
+
+	lb := NewLoadBalancer([]UpstreamConfig{{Name: "edge", TCPWSS: rawurl}}, HealthcheckConfig{}, SelectionConfig{}, ProbeConfig{}, 0)
+	if got := lb.Snapshot()[0].TCP.TransportFallback; got != "h2->h1" {
+		t.Fatalf("status transport_fallback=%q, want h2->h1", got)
+	}
+}
+
+func TestDialWSStream_H3HandshakeTimeoutFallsThroughLadder(t *testing.T) {
+	metricsMu.Lock()
+	metrics = telemetry{}
+	metricsMu.Unlock()
+	EnablePrometheusMetrics()
+
+	srv := newH1EchoServer(t)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writeCertPEM(t, caFile, srv.Certificate().Raw)
+	if err := LoadTLSMaterial(TLSConfig{CAFile: caFile}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = LoadTLSMaterial(TLSConfig{}) })
+
+	// A UDP socket on the server's port that never answers: the QUIC
+	// handshake times out the way it does behind a UDP-dropping firewall.
+	host := strings.TrimPrefix(srv.URL, "https://")
+	blackhole, err := net.ListenPacket("udp", host)
+	if err != nil {
+		t.Skipf("cannot bind udp %s: %v", host, err)
+	}
+	defer blackhole.Close()
+
+	rawurl := "wss://" + host + "/tcp?transport=h3,h1&dial_timeout=300ms"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := DialWSStream(ctx, rawurl, 0)
+	if err != nil {
+		t.Fatalf("DialWSStream: %v", err)
+	}
+	_ = c.Close(WSStatusNormalClosure, "")
+	if got := NegotiatedTransport(c); got != "h1" {
+		t.Fatalf("NegotiatedTransport=%q, want h1", got)
+	}
+
+	metrics.mu.RLock()
+	n := metrics.fallbacks["upstream="+host+",from=h3,to=h1"]
+	metrics.mu.RUnlock()
+	if n != 1 {
+		t.Fatalf("fallback counter = %d, want 1", n)
+	}
+}
+
+func TestDialWSStream_HandshakeTokenSentAndRedacted(t *testing.T) {
+	const headerToken, queryToken = "Bearer hdr-s3cret", "qry-s3cret"
+	var mu sync.Mutex
+	var gotHeader, gotQuery string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		gotHeader, gotQuery = r.Header.Get("X-Edge-Auth"), r.URL.Query().Get("token")
+		mu.Unlock()
+		if gotHeader != headerToken && gotQuery != queryToken {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		_ = c.CloseNow()
+	}))
+	t.Cleanup(srv.Close)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writeCertPEM(t, caFile, srv.Certificate().Raw)
+	if err := LoadTLSMaterial(TLSConfig{CAFile: caFile}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = LoadTLSMaterial(TLSConfig{}) })
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	SetWebSocketDebug(true)
+	t.Cleanup(func() {
+		SetWebSocketDebug(false)
+		log.SetOutput(os.Stderr)
+	})
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte(queryToken+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	base := "wss" + strings.TrimPrefix(srv.URL, "https") + "/tcp"
+	lb := NewLoadBalancer([]UpstreamConfig{
+		{Name: "gated-header", TCPWSS: base, AuthHeader: "X-Edge-Auth", AuthToken: headerToken},
+		{Name: "gated-query", TCPWSS: base, AuthQuery: "token", AuthTokenFile: tokenFile},
+	}, HealthcheckConfig{}, SelectionConfig{}, ProbeConfig{}, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i, want := range []struct{ header, query string }{{headerToken, ""}, {"", queryToken}} {
+		rawurl := lb.pool[i].cfg.TCPWSS
+		if strings.Contains(rawurl, "s3cret") {
+			t.Fatalf("token leaked into the dial URL %q", rawurl)
+		}
+		c, err := DialWSStream(withUpstreamAuth(ctx, lb.pool[i].cfg), rawurl, 0)
+		if err != nil {
+			t.Fatalf("%s: DialWSStream: %v", lb.pool[i].cfg.Name, err)
+		}
+		_ = c.Close(WSStatusNormalClosure, "")
+		mu.Lock()
+		h, q := gotHeader, gotQuery
+		mu.Unlock()
+		if h != want.header || q != want.query {
+			t.Fatalf("%s: server saw header=%q query=%q, want %q %q", lb.pool[i].cfg.Name, h, q, want.header, want.query)
+		}
+	}
+
+	// A failing dial reports the URL it was given, without the token.
+	srv.Close()
+	_, err := DialWSStream(withUpstreamAuth(ctx, lb.pool[1].cfg), lb.pool[1].cfg.TCPWSS, 0)
+	if err == nil {
+		t.Fatal("dial to a closed server succeeded")
+	}
+	if strings.Contains(err.Error(), "s3cret") {
+		t.Fatalf("token in dial error: %v", err)
+	}
+	log.Printf("dial failed: %v", err)
+	if strings.Contains(logs.String(), "s3cret") {
+		t.Fatalf("token in logs:\n%s", logs.String())
+	}
+}
+
+func TestProbeWSSConn_ReturnsUsableConn(t *testing.T) {
+	srv := newH1EchoServer(t)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writeCertPEM(t, caFile, srv.Certificate().Raw)
+	if err := LoadTLSMaterial(TLSConfig{CAFile: caFile}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = LoadTLSMaterial(TLSConfig{}) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, rtt, err := ProbeWSSConn(ctx, "wss"+strings.TrimPrefix(srv.URL, "https")+"/tcp", 0)
+	if err != nil {
+		t.Fatalf("ProbeWSSConn: %v", err)
+	}
+	defer c.Close(WSStatusNormalClosure, "")
+	if rtt <= 0 {
+		t.Fatalf("handshake duration = %s", rtt)
+	}
+	if err := c.Write(ctx, WSMessageBinary, []byte("after-probe")); err != nil {
+		t.Fatalf("write on the probe conn: %v", err)
+	}
+	if _, data, err := c.Read(ctx); err != nil || string(data) != "after-probe" {
+		t.Fatalf("echo = %q, %v", data, err)
+	}
+
+	// A cancelled context aborts the dial.
+	cctx, ccancel := context.WithCancel(context.Background())
+	ccancel()
+	if _, _, err := ProbeWSSConn(cctx, "wss"+strings.TrimPrefix(srv.URL, "https")+"/tcp", 0); err == nil {
+		t.Fatal("ProbeWSSConn succeeded with a cancelled context")
+	}
+}
@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const defaultHeartbeatInterval = 30 * time.Second
+
+// heartbeatWSConn sends UpstreamConfig.HeartbeatText as a text message every
+// HeartbeatInterval until closed. Some WebSocket front-ends only reset their
+// idle timers on data frames, not on control pings. The Outline server drops
+// non-binary messages, so the heartbeat never reaches the Shadowsocks layer.
+type heartbeatWSConn struct {
+	WSConn
+	stop     context.CancelFunc
+	stopOnce sync.Once
+}
+
+// withHeartbeat wraps c when up has a heartbeat configured.
+func withHeartbeat(c WSConn, up UpstreamConfig) WSConn {
+	if c == nil || up.HeartbeatText == "" {
+		return c
+	}
+	every := up.HeartbeatInterval
+	if every <= 0 {
+		every = defaultHeartbeatInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	hc := &heartbeatWSConn{WSConn: c, stop: cancel}
+	go hc.run(ctx, []byte(up.HeartbeatText), every, up.Name)
+	return hc
+}
+
+func (c *heartbeatWSConn) run(ctx context.Context, msg []byte, every time.Duration, name string) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			wctx, cancel := context.WithTimeout(ctx, every)
+			err := c.WSConn.Write(wctx, WSMessageText, msg)
+			cancel()
+			if err != nil {
+				wsDebugf("heartbeat stopped upstream=%q err=%v", name, err)
+				return
+			}
+		}
+	}
+}
+
+func (c *heartbeatWSConn) Close(code WSStatusCode, reason string) error {
+	c.stopOnce.Do(c.stop)
+	return c.WSConn.Close(code, reason)
+}
+
+// ReadPooled forwards to the wrapped connection so pooled reads survive the
+// heartbeat wrapper.
+func (c *heartbeatWSConn) ReadPooled(ctx context.Context) (WSMessageType, []byte, func(), error) {
+	return readPooled(ctx, c.WSConn)
+}
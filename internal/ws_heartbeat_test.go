@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func heartbeatWrites(m *mockWSConn, text string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, w := range m.writes {
+		if w.typ == WSMessageText && string(w.data) == text {
+			n++
+		}
+	}
+	return n
+}
+
+func TestWithHeartbeat_EmitsTextAtInterval(t *testing.T) {
+	m := &mockWSConn{}
+	c := withHeartbeat(m, UpstreamConfig{Name: "cdn", HeartbeatText: `{"type":"hb"}`, HeartbeatInterval: 20 * time.Millisecond})
+	if c == WSConn(m) {
+		t.Fatalf("expected a heartbeat wrapper")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for heartbeatWrites(m, `{"type":"hb"}`) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected >=3 heartbeats, got %d", heartbeatWrites(m, `{"type":"hb"}`))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := c.Close(WSStatusNormalClosure, "done"); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	m.mu.Lock()
+	closed := m.closed
+	m.mu.Unlock()
+	if !closed {
+		t.Fatalf("Close must reach the underlying conn")
+	}
+
+	// Allow an in-flight tick to land, then make sure the ticker is gone.
+	time.Sleep(30 * time.Millisecond)
+	n := heartbeatWrites(m, `{"type":"hb"}`)
+	time.Sleep(80 * time.Millisecond)
+	if got := heartbeatWrites(m, `{"type":"hb"}`); got != n {
+		t.Fatalf("heartbeat kept running after Close: %d -> %d", n, got)
+	}
+}
+
+func TestWithHeartbeat_DisabledByDefault(t *testing.T) {
+	m := &mockWSConn{}
+	if c := withHeartbeat(m, UpstreamConfig{}); c != WSConn(m) {
+		t.Fatalf("expected the conn unchanged without heartbeat_text")
+	}
+}
@@ -0,0 +1,271 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Multiplexed upstreams (upstream.multiplex) carry a Shadowsocks TCP stream
+// and Shadowsocks UDP datagrams over one WebSocket. Every binary message in
+// either direction starts with a channel byte:
+//
+//	0x00  TCP stream bytes, exactly what tcp_wss would carry
+//	0x00  with no payload: end of stream (the sender closed its side)
+//	0x01  one UDP datagram, exactly what udp_wss would carry
+//
+// Text and control messages are not tagged. The server must open the TCP
+// target on the first stream message, keep datagrams flowing after a stream
+// end, and close the WebSocket only when the client does.
+const (
+	wsMuxStream   byte = 0x00
+	wsMuxDatagram byte = 0x01
+)
+
+// wsMuxDatagramQueue bounds datagrams buffered for a slow reader; excess
+// datagrams are dropped, as on any UDP path.
+const wsMuxDatagramQueue = 256
+
+// wsMuxFinTimeout bounds the end-of-stream write on stream close.
+const wsMuxFinTimeout = 2 * time.Second
+
+// wsMux splits one WebSocket into a stream channel and a datagram channel.
+// Each channel is claimed at most once; the WebSocket closes when every
+// claimed channel has closed.
+type wsMux struct {
+	c    WSConn
+	done chan struct{} // closed when the read loop stops
+	err  error         // why the read loop stopped; valid after done
+
+	mu     sync.Mutex
+	chans  [2]*wsMuxChannel // nil = not claimed yet
+	closed bool
+}
+
+func newWSMux(c WSConn) *wsMux {
+	m := &wsMux{c: c, done: make(chan struct{})}
+	go m.readLoop()
+	return m
+}
+
+func (m *wsMux) readLoop() {
+	defer close(m.done)
+	for {
+		typ, data, err := m.c.Read(context.Background())
+		if err != nil {
+			m.err = err
+			return
+		}
+		if typ != WSMessageBinary || len(data) == 0 || data[0] > wsMuxDatagram {
+			continue
+		}
+		m.mu.Lock()
+		ch := m.chans[data[0]]
+		m.mu.Unlock()
+		if ch == nil {
+			continue // nobody claimed the channel; the server should not send yet
+		}
+		payload := data[1:]
+		if ch.tag == wsMuxDatagram {
+			select {
+			case ch.in <- payload:
+			case <-ch.done:
+			default: // reader is behind: drop
+			}
+			continue
+		}
+		// The stream applies backpressure to the whole WebSocket.
+		select {
+		case ch.in <- payload:
+		case <-ch.done:
+		}
+	}
+}
+
+// claim returns channel tag unless it is taken or the WebSocket closed.
+func (m *wsMux) claim(tag byte) (*wsMuxChannel, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed || m.chans[tag] != nil {
+		return nil, false
+	}
+	queue := 0
+	if tag == wsMuxDatagram {
+		queue = wsMuxDatagramQueue
+	}
+	ch := &wsMuxChannel{m: m, tag: tag, in: make(chan []byte, queue), done: make(chan struct{})}
+	m.chans[tag] = ch
+	return ch, true
+}
+
+// spareLocked reports whether a channel can still be claimed on a live
+// WebSocket. Callers hold m.mu.
+func (m *wsMux) spareLocked() bool {
+	return !m.closed && !m.dead() && (m.chans[wsMuxStream] == nil || m.chans[wsMuxDatagram] == nil)
+}
+
+func (m *wsMux) dead() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// release closes the WebSocket once no claimed channel is open.
+func (m *wsMux) release(code WSStatusCode, reason string) error {
+	m.mu.Lock()
+	for _, ch := range m.chans {
+		if ch != nil && !ch.isClosed() {
+			m.mu.Unlock()
+			return nil
+		}
+	}
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	m.mu.Unlock()
+	return m.c.Close(code, reason)
+}
+
+// wsMuxChannel is one side of a wsMux, usable wherever a dedicated
+// WebSocket is (WSStreamConn for the stream, WSPacketConn for datagrams).
+type wsMuxChannel struct {
+	m    *wsMux
+	tag  byte
+	in   chan []byte
+	done chan struct{}
+	once sync.Once
+}
+
+func (ch *wsMuxChannel) isClosed() bool {
+	select {
+	case <-ch.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (ch *wsMuxChannel) deliver(p []byte) (WSMessageType, []byte, error) {
+	if ch.tag == wsMuxStream && len(p) == 0 {
+		return 0, nil, io.EOF
+	}
+	return WSMessageBinary, p, nil
+}
+
+func (ch *wsMuxChannel) Read(ctx context.Context) (WSMessageType, []byte, error) {
+	select {
+	case p := <-ch.in:
+		return ch.deliver(p)
+	default:
+	}
+	select {
+	case p := <-ch.in:
+		return ch.deliver(p)
+	case <-ch.done:
+		return 0, nil, net.ErrClosed
+	case <-ch.m.done:
+		select {
+		case p := <-ch.in:
+			return ch.deliver(p)
+		default:
+		}
+		return 0, nil, ch.m.err
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+}
+
+func (ch *wsMuxChannel) Write(ctx context.Context, typ WSMessageType, data []byte) error {
+	if ch.isClosed() {
+		return net.ErrClosed
+	}
+	if typ != WSMessageBinary {
+		return ch.m.c.Write(ctx, typ, data)
+	}
+	if ch.tag == wsMuxStream && len(data) == 0 {
+		return nil // an empty stream message would read as end of stream
+	}
+	msg := make([]byte, 1+len(data))
+	msg[0] = ch.tag
+	copy(msg[1:], data)
+	return ch.m.c.Write(ctx, WSMessageBinary, msg)
+}
+
+func (ch *wsMuxChannel) Close(code WSStatusCode, reason string) error {
+	var err error
+	ch.once.Do(func() {
+		if ch.tag == wsMuxStream && !ch.m.dead() {
+			ctx, cancel := context.WithTimeout(context.Background(), wsMuxFinTimeout)
+			_ = ch.m.c.Write(ctx, WSMessageBinary, []byte{wsMuxStream})
+			cancel()
+		}
+		close(ch.done)
+		err = ch.m.release(code, reason)
+	})
+	return err
+}
+
+// tunnelConn finishes a tunnel WebSocket dialed (or taken from standby) for
+// up: heartbeats are attached to the WebSocket itself, and on a multiplexed
+// upstream the requested channel is returned while the other one is parked
+// for the next tunnel of the other protocol.
+func (up *UpstreamState) tunnelConn(c WSConn, tag byte) WSConn {
+	c = withHeartbeat(c, up.cfg)
+	if !up.cfg.Multiplex {
+		return c
+	}
+	m := newWSMux(c)
+	ch, _ := m.claim(tag)
+	up.muxMu.Lock()
+	up.muxSpare = append(pruneMuxSpares(up.muxSpare), m)
+	up.muxMu.Unlock()
+	return ch
+}
+
+// claimSpareMux returns channel tag of an open multiplexed WebSocket to up
+// whose channel is still free, or nil.
+func (up *UpstreamState) claimSpareMux(tag byte) WSConn {
+	up.muxMu.Lock()
+	defer up.muxMu.Unlock()
+	for _, m := range up.muxSpare {
+		if m.dead() {
+			continue
+		}
+		if ch, ok := m.claim(tag); ok {
+			up.muxSpare = pruneMuxSpares(up.muxSpare)
+			return ch
+		}
+	}
+	up.muxSpare = pruneMuxSpares(up.muxSpare)
+	return nil
+}
+
+func pruneMuxSpares(ms []*wsMux) []*wsMux {
+	out := ms[:0]
+	for _, m := range ms {
+		m.mu.Lock()
+		ok := m.spareLocked()
+		m.mu.Unlock()
+		if ok {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// dedicatedMuxChannel adapts a WebSocket dialed for a single purpose (probes,
+// pinned UDP associations) to up's framing: unchanged unless up.Multiplex.
+func dedicatedMuxChannel(up UpstreamConfig, c WSConn, tag byte) WSConn {
+	if !up.Multiplex {
+		return c
+	}
+	ch, _ := newWSMux(c).claim(tag)
+	return ch
+}
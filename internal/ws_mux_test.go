@@ -0,0 +1,251 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type pipeWSMsg struct {
+	typ  WSMessageType
+	data []byte
+}
+
+// pipeWSConn is one end of an in-memory WebSocket; closing either end
+// closes both.
+type pipeWSConn struct {
+	in     <-chan pipeWSMsg
+	out    chan<- pipeWSMsg
+	closed chan struct{}
+	once   *sync.Once
+}
+
+func newWSPipe() (*pipeWSConn, *pipeWSConn) {
+	ab, ba := make(chan pipeWSMsg, 64), make(chan pipeWSMsg, 64)
+	closed, once := make(chan struct{}), &sync.Once{}
+	return &pipeWSConn{in: ba, out: ab, closed: closed, once: once},
+		&pipeWSConn{in: ab, out: ba, closed: closed, once: once}
+}
+
+func (p *pipeWSConn) Read(ctx context.Context) (WSMessageType, []byte, error) {
+	select {
+	case m := <-p.in:
+		return m.typ, m.data, nil
+	case <-p.closed:
+		return 0, nil, io.EOF
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+}
+
+func (p *pipeWSConn) Write(ctx context.Context, typ WSMessageType, data []byte) error {
+	select {
+	case <-p.closed:
+		return net.ErrClosed
+	default:
+	}
+	select {
+	case p.out <- pipeWSMsg{typ: typ, data: append([]byte(nil), data...)}:
+		return nil
+	case <-p.closed:
+		return net.ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *pipeWSConn) Close(WSStatusCode, string) error {
+	p.once.Do(func() { close(p.closed) })
+	return nil
+}
+
+func (p *pipeWSConn) isClosed() bool {
+	select {
+	case <-p.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestWSMux_InterleavedTCPAndUDPRoundTrip(t *testing.T) {
+	client, server := newWSPipe()
+	defer client.Close(WSStatusNormalClosure, "")
+
+	// Server: echo every message on the channel it arrived on.
+	go func() {
+		for {
+			typ, data, err := server.Read(context.Background())
+			if err != nil {
+				return
+			}
+			if len(data) > 1 && data[0] > wsMuxDatagram {
+				t.Errorf("untagged message from client: %q", data)
+			}
+			_ = server.Write(context.Background(), typ, data)
+		}
+	}()
+
+	m := newWSMux(client)
+	streamCh, ok := m.claim(wsMuxStream)
+	if !ok {
+		t.Fatal("claim stream")
+	}
+	dgramCh, ok := m.claim(wsMuxDatagram)
+	if !ok {
+		t.Fatal("claim datagram")
+	}
+	if _, ok := m.claim(wsMuxStream); ok {
+		t.Fatal("stream channel claimed twice")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream := NewWSStreamConn(ctx, streamCh, "mux", "tcp")
+	packets := NewWSPacketConn(ctx, dgramCh, "mux", "udp")
+
+	const rounds = 50
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		var want bytes.Buffer
+		for i := 0; i < rounds; i++ {
+			chunk := bytes.Repeat([]byte{byte(i)}, 100+i)
+			want.Write(chunk)
+			if _, err := stream.Write(chunk); err != nil {
+				t.Errorf("stream write: %v", err)
+				return
+			}
+		}
+		got := make([]byte, want.Len())
+		if _, err := io.ReadFull(stream, got); err != nil {
+			t.Errorf("stream read: %v", err)
+			return
+		}
+		if !bytes.Equal(got, want.Bytes()) {
+			t.Errorf("stream bytes corrupted by interleaving")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 64)
+		for i := 0; i < rounds; i++ {
+			dgram := []byte{0xd0, byte(i)}
+			if _, err := packets.WriteTo(dgram, nil); err != nil {
+				t.Errorf("datagram write: %v", err)
+				return
+			}
+			n, _, err := packets.ReadFrom(buf)
+			if err != nil {
+				t.Errorf("datagram read: %v", err)
+				return
+			}
+			if !bytes.Equal(buf[:n], dgram) {
+				t.Errorf("datagram %d: got %x want %x", i, buf[:n], dgram)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestWSMux_StreamEndKeepsDatagramsFlowing(t *testing.T) {
+	client, server := newWSPipe()
+	m := newWSMux(client)
+	streamCh, _ := m.claim(wsMuxStream)
+	dgramCh, _ := m.claim(wsMuxDatagram)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	_ = streamCh.Close(WSStatusNormalClosure, "done")
+	if _, data, err := server.Read(ctx); err != nil || !bytes.Equal(data, []byte{wsMuxStream}) {
+		t.Fatalf("expected end-of-stream marker, got %x err=%v", data, err)
+	}
+	if client.isClosed() {
+		t.Fatal("websocket closed while the datagram channel is open")
+	}
+	if err := streamCh.Write(ctx, WSMessageBinary, []byte("late")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("write on closed stream: err=%v", err)
+	}
+
+	_ = server.Write(ctx, WSMessageBinary, []byte{wsMuxDatagram, 'o', 'k'})
+	if _, data, err := dgramCh.Read(ctx); err != nil || string(data) != "ok" {
+		t.Fatalf("datagram after stream end: %q err=%v", data, err)
+	}
+
+	_ = dgramCh.Close(WSStatusNormalClosure, "done")
+	if !client.isClosed() {
+		t.Fatal("websocket left open after both channels closed")
+	}
+	if _, ok := m.claim(wsMuxStream); ok {
+		t.Fatal("claimed a channel on a closed websocket")
+	}
+}
+
+func TestWSMux_PeerEndOfStreamIsEOF(t *testing.T) {
+	client, server := newWSPipe()
+	defer client.Close(WSStatusNormalClosure, "")
+	streamCh, _ := newWSMux(client).claim(wsMuxStream)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	_ = server.Write(ctx, WSMessageBinary, []byte{wsMuxStream, 'x'})
+	_ = server.Write(ctx, WSMessageBinary, []byte{wsMuxStream})
+	if _, data, err := streamCh.Read(ctx); err != nil || string(data) != "x" {
+		t.Fatalf("first read: %q err=%v", data, err)
+	}
+	if _, _, err := streamCh.Read(ctx); err != io.EOF {
+		t.Fatalf("end of stream: err=%v want io.EOF", err)
+	}
+}
+
+func TestAcquire_MultiplexSharesOneWebSocket(t *testing.T) {
+	up := UpstreamConfig{Name: "m", TCPWSS: "wss://m.example/mux", UDPWSS: "wss://m.example/mux", Multiplex: true}
+	lb := NewLoadBalancer([]UpstreamConfig{up}, HealthcheckConfig{Timeout: time.Second}, SelectionConfig{}, ProbeConfig{}, 0)
+	st := lb.pool[0]
+
+	var dials []*pipeWSConn
+	lb.tunnelDial = func(ctx context.Context, rawurl string) (WSConn, error) {
+		c, _ := newWSPipe()
+		dials = append(dials, c)
+		return c, nil
+	}
+	ctx := context.Background()
+
+	tcp1, err := lb.AcquireTCPWS(ctx, st)
+	if err != nil {
+		t.Fatalf("tcp: %v", err)
+	}
+	udp1, err := lb.AcquireUDPWS(ctx, st)
+	if err != nil {
+		t.Fatalf("udp: %v", err)
+	}
+	if len(dials) != 1 {
+		t.Fatalf("tcp+udp took %d dials, want 1 shared websocket", len(dials))
+	}
+
+	// The shared WebSocket's stream is taken: the next TCP tunnel dials.
+	tcp2, err := lb.AcquireTCPWS(ctx, st)
+	if err != nil {
+		t.Fatalf("tcp2: %v", err)
+	}
+	if len(dials) != 2 {
+		t.Fatalf("second tcp tunnel: dials=%d want 2", len(dials))
+	}
+
+	_ = tcp1.Close(WSStatusNormalClosure, "")
+	if dials[0].isClosed() {
+		t.Fatal("shared websocket closed under a live udp channel")
+	}
+	_ = udp1.Close(WSStatusNormalClosure, "")
+	if !dials[0].isClosed() {
+		t.Fatal("shared websocket left open")
+	}
+	_ = tcp2.Close(WSStatusNormalClosure, "")
+}
@@ -34,7 +34,7 @@ func (w *WSPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
 			continue
 		}
 		n := copy(p, data)
-		observeWSFrame("in", n)
+		observeWSFrame("in", "data", n)
 		observeUpstreamTraffic(w.upstream, w.proto, "in", n)
 		wsDebugPayload("in", w.upstream, w.proto, data[:n])
 		return n, dummyAddr{}, nil
@@ -45,7 +45,7 @@ func (w *WSPacketConn) WriteTo(p []byte, _ net.Addr) (int, error) {
 	if err := w.c.Write(w.ctx, WSMessageBinary, p); err != nil {
 		return 0, err
 	}
-	observeWSFrame("out", len(p))
+	observeWSFrame("out", "data", len(p))
 	observeUpstreamTraffic(w.upstream, w.proto, "out", len(p))
 	wsDebugPayload("out", w.upstream, w.proto, p)
 	return len(p), nil
@@ -156,10 +156,10 @@ func TestWSStreamConn_ObservesTrafficMetrics(t *testing.T) {
 	metrics.mu.RLock()
 	defer metrics.mu.RUnlock()
 
-	if got := metrics.wsBytes["dir=in"]; got != 5 {
+	if got := metrics.wsBytes["dir=in,kind=data"]; got != 5 {
 		t.Fatalf("ws in bytes=%d want 5", got)
 	}
-	if got := metrics.wsBytes["dir=out"]; got != 6 {
+	if got := metrics.wsBytes["dir=out,kind=data"]; got != 6 {
 		t.Fatalf("ws out bytes=%d want 6", got)
 	}
 	if got := metrics.upstreamBytes["upstream=edge-1,proto=tcp,dir=in"]; got != 5 {
@@ -176,3 +176,40 @@ func TestWSStreamConn_ObservesTrafficMetrics(t *testing.T) {
 		t.Fatalf("unexpected writes: %+v", writes)
 	}
 }
+
+func TestWSStreamConn_StatsCountBytes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	m := &mockWSConn{}
+	m.enqueueRead(WSMessageBinary, []byte("0123456789"), nil)
+	m.enqueueRead(WSMessageText, []byte("ignored"), nil)
+	m.enqueueRead(WSMessageBinary, []byte("abc"), nil)
+
+	sc := NewWSStreamConn(ctx, m, "edge-1", "tcp")
+
+	// Short reads must count only what was handed to the caller.
+	buf := make([]byte, 4)
+	total := 0
+	for total < 13 {
+		n, err := sc.Read(buf)
+		if err != nil {
+			t.Fatalf("Read after %d bytes: %v", total, err)
+		}
+		total += n
+		if got := sc.Stats().BytesIn; got != int64(total) {
+			t.Fatalf("BytesIn=%d want %d", got, total)
+		}
+	}
+
+	for _, p := range [][]byte{[]byte("hello"), make([]byte, 1000)} {
+		if _, err := sc.Write(p); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	_ = sc.Close()
+
+	if st := sc.Stats(); st.BytesIn != 13 || st.BytesOut != 1005 {
+		t.Fatalf("Stats=%+v want in=13 out=1005", st)
+	}
+}
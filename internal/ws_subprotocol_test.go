@@ -0,0 +1,92 @@
+//go:build !unit
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func newSubprotocolTestServer(t *testing.T, accept []string) (*httptest.Server, <-chan string) {
+	t.Helper()
+	requested := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- r.Header.Get("Sec-WebSocket-Protocol")
+		c, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: accept})
+		if err != nil {
+			return
+		}
+		_ = c.Close(websocket.StatusNormalClosure, "")
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requested
+}
+
+func TestDialWSStream_SubprotocolConfirmed(t *testing.T) {
+	srv, requested := newSubprotocolTestServer(t, []string{"outline.v1"})
+	rawurl := withDialHint("ws"+strings.TrimPrefix(srv.URL, "http")+"/tcp", "subprotocol", "outline.v1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := DialWSStream(ctx, rawurl, 0)
+	if err != nil {
+		t.Fatalf("DialWSStream: %v", err)
+	}
+	_ = c.Close(WSStatusNormalClosure, "")
+
+	if got := <-requested; got != "outline.v1" {
+		t.Fatalf("Sec-WebSocket-Protocol sent=%q want outline.v1", got)
+	}
+}
+
+func TestDialWSStream_SubprotocolNotConfirmed(t *testing.T) {
+	srv, requested := newSubprotocolTestServer(t, nil)
+	rawurl := withDialHint("ws"+strings.TrimPrefix(srv.URL, "http")+"/tcp", "subprotocol", "outline.v1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := DialWSStream(ctx, rawurl, 0)
+	if err == nil {
+		_ = c.Close(WSStatusNormalClosure, "")
+		t.Fatalf("expected handshake failure when server does not echo subprotocol")
+	}
+	if !errors.Is(err, ErrHandshakeRejected) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := <-requested; got != "outline.v1" {
+		t.Fatalf("Sec-WebSocket-Protocol sent=%q want outline.v1", got)
+	}
+}
+
+func TestCheckSubprotocol(t *testing.T) {
+	if err := checkSubprotocol("", ""); err != nil {
+		t.Fatalf("no subprotocol requested: %v", err)
+	}
+	if err := checkSubprotocol("outline.v1", "outline.v1"); err != nil {
+		t.Fatalf("confirmed subprotocol: %v", err)
+	}
+	if err := checkSubprotocol("outline.v1", ""); err == nil {
+		t.Fatalf("expected error for missing echo")
+	}
+}
+
+func TestDialWSStream_RejectedHandshakeIsTyped(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := DialWSStream(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+"/tcp", 0)
+	if !errors.Is(err, ErrHandshakeRejected) {
+		t.Fatalf("expected ErrHandshakeRejected, got %v", err)
+	}
+}
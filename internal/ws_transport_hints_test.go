@@ -1,8 +1,14 @@
 package internal
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseTransportHints(t *testing.T) {
@@ -103,3 +109,156 @@ func TestStripHealthcheckQueryParams(t *testing.T) {
 		t.Fatalf("origin must be preserved")
 	}
 }
+
+func TestParseTransportOrder(t *testing.T) {
+	got, err := parseTransportOrder(" H2, h1 ,h3")
+	if err != nil {
+		t.Fatalf("parseTransportOrder: %v", err)
+	}
+	if len(got) != 3 || got[0] != "h2" || got[1] != "h1" || got[2] != "h3" {
+		t.Fatalf("unexpected order: %v", got)
+	}
+	if _, err := parseTransportOrder("h2,h4"); err == nil {
+		t.Fatalf("expected error for unknown transport")
+	}
+	if _, err := parseTransportOrder("h1,h1"); err == nil {
+		t.Fatalf("expected error for duplicate transport")
+	}
+}
+
+func TestDialTransportLadder_Orderings(t *testing.T) {
+	cases := []struct {
+		name    string
+		order   []string
+		failing map[string]bool
+		want    string
+		tried   string
+		fatal   bool // fail with a handshake rejection, not "not supported"
+		timeout bool // fail with an h3 handshake timeout
+	}{
+		{name: "first succeeds", order: []string{"h2", "h1", "h3"}, want: "h2", tried: "h2"},
+		{name: "h2 falls through to h1", order: []string{"h2", "h1", "h3"}, failing: map[string]bool{"h2": true}, want: "h1", tried: "h2,h1"},
+		{name: "h3 last resort", order: []string{"h2", "h1", "h3"}, failing: map[string]bool{"h2": true, "h1": true}, want: "h3", tried: "h2,h1,h3"},
+		{name: "h3 first", order: []string{"h3", "h2"}, failing: map[string]bool{"h3": true}, want: "h2", tried: "h3,h2"},
+		{name: "all fail", order: []string{"h1", "h2"}, failing: map[string]bool{"h1": true, "h2": true}, tried: "h1,h2"},
+		{name: "other errors stop the ladder", order: []string{"h2", "h1"}, failing: map[string]bool{"h2": true}, tried: "h2", fatal: true},
+		{name: "h3 handshake timeout falls through", order: []string{"h3", "h2"}, failing: map[string]bool{"h3": true}, want: "h2", tried: "h3,h2", timeout: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var tried []string
+			c, proto, err := dialTransportLadder(context.Background(), tc.order, func(proto string) (WSConn, error) {
+				tried = append(tried, proto)
+				switch {
+				case tc.failing[proto] && tc.fatal:
+					return nil, ErrHandshakeRejected
+				case tc.failing[proto] && tc.timeout:
+					return nil, fmt.Errorf("%w: %w", ErrH3HandshakeTimeout, context.DeadlineExceeded)
+				case tc.failing[proto]:
+					return nil, ErrH2NotSupported
+				}
+				return &mockWSConn{}, nil
+			})
+			if got := strings.Join(tried, ","); got != tc.tried {
+				t.Fatalf("tried=%q want %q", got, tc.tried)
+			}
+			if tc.want == "" {
+				if err == nil || c != nil {
+					t.Fatalf("expected failure, got proto=%q err=%v", proto, err)
+				}
+				if want := ErrH2NotSupported; tc.fatal && !errors.Is(err, ErrHandshakeRejected) || !tc.fatal && !errors.Is(err, want) {
+					t.Fatalf("unexpected ladder error %v", err)
+				}
+				return
+			}
+			if err != nil || proto != tc.want {
+				t.Fatalf("proto=%q err=%v want %q", proto, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamDialURL_QueryHintsWin(t *testing.T) {
+	up := UpstreamConfig{TransportOrder: []string{"h2", "h1"}, Subprotocol: "outline.v1"}
+	got := upstreamDialURL("wss://example.com/tcp?subprotocol=custom", up)
+	u, err := url.Parse(got)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if v := u.Query().Get("transport"); v != "h2,h1" {
+		t.Fatalf("transport=%q", v)
+	}
+	if v := u.Query().Get("subprotocol"); v != "custom" {
+		t.Fatalf("subprotocol=%q, URL value must win", v)
+	}
+}
+
+func TestHandshakeAuth_LeavesServerQueryAlone(t *testing.T) {
+	// "auth" belongs to the server here; the gate token travels in the context.
+	up := UpstreamConfig{Name: "edge", AuthHeader: "X-Edge-Auth", AuthToken: "s3cret"}
+	u, err := url.Parse(upstreamDialURL("wss://example.com/tcp?auth=server-side", up))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if v := u.Query().Get("auth"); v != "server-side" {
+		t.Fatalf("auth=%q, want the server's own value", v)
+	}
+
+	ctx, err := withHandshakeAuth(context.Background())
+	if err != nil {
+		t.Fatalf("dial without a gate: %v", err)
+	}
+	if _, ok := handshakeCredFrom(ctx); ok {
+		t.Fatal("credential without withUpstreamAuth")
+	}
+	ctx, err = withHandshakeAuth(withUpstreamAuth(context.Background(), up))
+	if err != nil {
+		t.Fatalf("gated dial: %v", err)
+	}
+	if c, ok := handshakeCredFrom(ctx); !ok || c.header != "X-Edge-Auth" || c.value != "s3cret" {
+		t.Fatalf("credential = %+v, %v", c, ok)
+	}
+}
+
+func TestWSDialTimeout_FromUpstreamConfig(t *testing.T) {
+	u, err := url.Parse(upstreamDialURL("wss://example.com/tcp", UpstreamConfig{DialTimeout: 1500 * time.Millisecond}))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if got := wsDialTimeout(u.Query()); got != 1500*time.Millisecond {
+		t.Fatalf("dial timeout=%s, want 1.5s", got)
+	}
+	if got := wsDialTimeout(url.Values{}); got != defaultWSDialTimeout {
+		t.Fatalf("default dial timeout=%s", got)
+	}
+}
+
+func TestDialWSStream_DialTimeoutAbortsStalledHandshake(t *testing.T) {
+	// The listener accepts but never answers, so the dial hangs in the TLS
+	// handshake until the per-upstream timeout fires.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	for _, hint := range []string{"", "&h2=only"} {
+		start := time.Now()
+		_, err := DialWSStream(context.Background(), "wss://"+ln.Addr().String()+"/tcp?dial_timeout=200ms"+hint, 0)
+		if err == nil {
+			t.Fatalf("hint %q: dial unexpectedly succeeded", hint)
+		}
+		if took := time.Since(start); took > 3*time.Second {
+			t.Fatalf("hint %q: dial took %s, want it bounded by dial_timeout", hint, took)
+		}
+	}
+}
@@ -5,6 +5,8 @@ package outlinews
 
 import (
 	"context"
+	"net"
+	"time"
 
 	"outline-cli-ws/internal"
 )
@@ -25,10 +27,31 @@ type TunConfig = internal.TunConfig
 
 type WebSocketConfig = internal.WebSocketConfig
 
+type HooksConfig = internal.HooksConfig
+
+type MetricsConfig = internal.MetricsConfig
+
+type RoutingConfig = internal.RoutingConfig
+
+type TLSConfig = internal.TLSConfig
+
+type LogConfig = internal.LogConfig
+
 // LoadConfig loads YAML configuration file.
 // Note: internal.LoadConfig returns a pointer.
 func LoadConfig(path string) (*Config, error) { return internal.LoadConfig(path) }
 
+// --- Errors ---
+
+// Errors returned (wrapped) by dialing and upstream selection; test with errors.Is.
+var (
+	ErrNoHealthyUpstreams = internal.ErrNoHealthyUpstreams
+	ErrHandshakeRejected  = internal.ErrHandshakeRejected
+	ErrTLSFailure         = internal.ErrTLSFailure
+	ErrH2NotSupported     = internal.ErrH2NotSupported
+	ErrH3NotSupported     = internal.ErrH3NotSupported
+)
+
 // --- Core runtime ---
 
 type LoadBalancer = internal.LoadBalancer
@@ -49,17 +72,119 @@ func RunTunNative(ctx context.Context, cfg TunConfig, lb *LoadBalancer) error {
 	return internal.RunTunNative(ctx, cfg, lb)
 }
 
+// --- Lifecycle hooks ---
+
+// RunLifecycleHook runs the on_connect ("connect") or on_disconnect ("disconnect")
+// command from hooks with env added to the process environment.
+func RunLifecycleHook(ctx context.Context, hooks HooksConfig, event string, env map[string]string) error {
+	return internal.RunLifecycleHook(ctx, hooks, event, env)
+}
+
+// --- Event stream ---
+
+type Event = internal.Event
+
+type EventSubscription = internal.EventSubscription
+
+// SubscribeEvents returns a subscription to daemon state-change events
+// (upstream up/down, selection, failover, connection open/close). Slow
+// subscribers lose events rather than blocking the data plane.
+func SubscribeEvents(buffer int) *EventSubscription { return internal.SubscribeEvents(buffer) }
+
+// ServeEvents streams events as newline-delimited JSON on the Unix socket
+// addr ("unix:/path.sock", mode 0600) until ctx is cancelled.
+func ServeEvents(ctx context.Context, addr string) error { return internal.ServeEvents(ctx, addr) }
+
 // EnablePrometheusMetrics registers and enables default Prometheus metrics.
 func EnablePrometheusMetrics() {
 	internal.EnablePrometheusMetrics()
 }
 
+// SetMetricsToken requires "Authorization: Bearer <token>" on /metrics.
+// An empty token leaves the endpoint unauthenticated.
+func SetMetricsToken(token string) { internal.SetMetricsToken(token) }
+
+// RunOTLPExporter pushes the enabled metrics to an OTLP/HTTP collector at
+// endpoint every interval (0 = 15s) until ctx is cancelled.
+func RunOTLPExporter(ctx context.Context, endpoint string, interval time.Duration) {
+	internal.RunOTLPExporter(ctx, endpoint, interval)
+}
+
+// UpstreamStatus is a point-in-time view of one upstream (see LoadBalancer.Snapshot).
+type UpstreamStatus = internal.UpstreamStatus
+
+// ProtoStatus is the per-protocol part of UpstreamStatus.
+type ProtoStatus = internal.ProtoStatus
+
+// StartAdminServer serves /metrics, /status, /healthz, /readyz and /debug/pprof on addr
+// until context cancellation.
+func StartAdminServer(ctx context.Context, addr string, lb *LoadBalancer) error {
+	return internal.StartAdminServer(ctx, addr, lb)
+}
+
 // StartMetricsServer serves /metrics on the provided address until context cancellation.
 func StartMetricsServer(ctx context.Context, addr string) error {
 	return internal.StartMetricsServer(ctx, addr)
 }
 
+// ResetMetrics zeroes the cumulative Prometheus counters in this process.
+func ResetMetrics() {
+	internal.ResetMetrics()
+}
+
+// ResetStats asks a running daemon's admin server (POST /reset) to zero its
+// metric counters.
+func ResetStats(ctx context.Context, addr, token string) error {
+	return internal.ResetStats(ctx, addr, token)
+}
+
+// LogRecord is one daemon log line as served by the admin /logs endpoint.
+type LogRecord = internal.LogRecord
+
+// FetchLogs reads the recent log lines of a running daemon's admin server
+// (the last tail, or all kept ones when tail <= 0) and, with follow, streams
+// new ones to fn until ctx is cancelled.
+func FetchLogs(ctx context.Context, addr, token string, tail int, follow bool, fn func(LogRecord)) error {
+	return internal.FetchLogs(ctx, addr, token, tail, follow, fn)
+}
+
+// SetAllowPlainCipher permits cipher "none"/"plain" (no Shadowsocks layer,
+// unencrypted). Call before LoadConfig; debugging only.
+func SetAllowPlainCipher(enabled bool) {
+	internal.SetAllowPlainCipher(enabled)
+}
+
+// SetRelayBufferSize sets the per-direction copy buffer of SOCKS5 and TUN
+// relays in bytes (config copy_buffer_size); 0 keeps the 32 KiB default.
+func SetRelayBufferSize(n int) {
+	internal.SetRelayBufferSize(n)
+}
+
+// LoadTLSMaterial (re)reads the CA bundle and client certificate used by
+// upstream TLS handshakes; on error the previous material stays in use.
+func LoadTLSMaterial(cfg TLSConfig) error {
+	return internal.LoadTLSMaterial(cfg)
+}
+
+// ListenSocks5 opens the SOCKS5 listener, wrapped in TLS when certFile and
+// keyFile are set (listen.tls_cert/tls_key).
+func ListenSocks5(addr, certFile, keyFile string) (net.Listener, error) {
+	return internal.ListenSocks5(addr, certFile, keyFile)
+}
+
+// SetLogFormat switches the standard logger to "text" (default) or "json"
+// lines (config log.format).
+func SetLogFormat(format string) error {
+	return internal.SetLogFormat(format)
+}
+
 // SetWebSocketDebug enables verbose websocket transport diagnostics (h1/h2/h3).
 func SetWebSocketDebug(enabled bool) {
 	internal.SetWebSocketDebug(enabled)
 }
+
+// SetPooledFrameReads makes h2/h3 tunnels read data frames into pooled
+// buffers (config websocket.pooled_reads).
+func SetPooledFrameReads(enabled bool) {
+	internal.SetPooledFrameReads(enabled)
+}